@@ -15,10 +15,13 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // AccessContextID is the type unique access context identifiers.
@@ -80,16 +83,23 @@ var AccessContexts _AccessContexts
 
 // New creates a new access context with the globally-unique name
 // given.
-func (_AccessContexts) New(otx *sql.Tx, name string) (AccessContextID, error) {
+func (_AccessContexts) New(otx *sql.Tx, name string) (_ AccessContextID, err error) {
+	defer observeQuery("AccessContexts.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("access context name should be non-empty")
+		return 0, invalidArg("access context", "AccessContexts.New", "access context name should be non-empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("access context", "AccessContexts.New", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("access context", "AccessContexts.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -98,12 +108,12 @@ func (_AccessContexts) New(otx *sql.Tx, name string) (AccessContextID, error) {
 		tx = otx
 	}
 
-	q := `INSERT INTO wf_access_contexts(name, active) VALUES(?, 1)`
-	res, err := tx.Exec(q, name)
-	if err != nil {
-		return 0, err
+	if err = checkNameFree(context.Background(), tx, "wf_access_contexts", name); err != nil {
+		return 0, classify("access context", "AccessContexts.New", err)
 	}
-	acID, err := res.LastInsertId()
+
+	q := `INSERT INTO wf_access_contexts(name, active) VALUES(?, 1)`
+	acID, err := dbDialect().InsertID(context.Background(), tx, q, name)
 	if err != nil {
 		return 0, err
 	}
@@ -123,9 +133,11 @@ func (_AccessContexts) New(otx *sql.Tx, name string) (AccessContextID, error) {
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_AccessContexts) List(prefix string, offset, limit int64) ([]*AccessContext, error) {
+func (_AccessContexts) List(prefix string, offset, limit int64) (_ []*AccessContext, err error) {
+	defer observeQuery("AccessContexts.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit should be non-negative integers")
+		return nil, invalidArg("access context", "AccessContexts.List", "offset and limit should be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -133,7 +145,6 @@ func (_AccessContexts) List(prefix string, offset, limit int64) ([]*AccessContex
 
 	var q string
 	var rows *sql.Rows
-	var err error
 
 	prefix = strings.TrimSpace(prefix)
 	if prefix == "" {
@@ -143,16 +154,16 @@ func (_AccessContexts) List(prefix string, offset, limit int64) ([]*AccessContex
 		ORDER BY id
 		LIMIT ? OFFSET ?
 		`
-		rows, err = db.Query(q, limit, offset)
+		rows, err = db().Query(dbDialect().Rebind(q), limit, offset)
 	} else {
 		q = `
 		SELECT id, name, active
 		FROM wf_access_contexts
-		WHERE name LIKE ?
+		WHERE name LIKE ?` + likeEscapeClause + `
 		ORDER BY id
 		LIMIT ? OFFSET ?
 		`
-		rows, err = db.Query(q, prefix+"%", limit, offset)
+		rows, err = db().Query(dbDialect().Rebind(q), likePrefix(prefix), limit, offset)
 	}
 
 	if err != nil {
@@ -182,9 +193,11 @@ func (_AccessContexts) List(prefix string, offset, limit int64) ([]*AccessContex
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_AccessContexts) ListByGroup(gid GroupID, offset, limit int64) ([]*AccessContext, error) {
+func (_AccessContexts) ListByGroup(gid GroupID, offset, limit int64) (_ []*AccessContext, err error) {
+	defer observeQuery("AccessContexts.ListByGroup", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit should be non-negative integers")
+		return nil, invalidArg("access context", "AccessContexts.ListByGroup", "offset and limit should be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -198,7 +211,7 @@ func (_AccessContexts) ListByGroup(gid GroupID, offset, limit int64) ([]*AccessC
 	ORDER BY agh.ac_id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, gid, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), gid, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -226,9 +239,11 @@ func (_AccessContexts) ListByGroup(gid GroupID, offset, limit int64) ([]*AccessC
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_AccessContexts) ListByUser(uid UserID, offset, limit int64) ([]*AccessContext, error) {
+func (_AccessContexts) ListByUser(uid UserID, offset, limit int64) (_ []*AccessContext, err error) {
+	defer observeQuery("AccessContexts.ListByUser", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit should be non-negative integers")
+		return nil, invalidArg("access context", "AccessContexts.ListByUser", "offset and limit should be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -248,7 +263,7 @@ func (_AccessContexts) ListByUser(uid UserID, offset, limit int64) ([]*AccessCon
 	ORDER BY agh.ac_id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, uid, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), uid, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -272,17 +287,19 @@ func (_AccessContexts) ListByUser(uid UserID, offset, limit int64) ([]*AccessCon
 
 // Get fetches the requested access context that determines how the
 // workflows that operate in its context run.
-func (_AccessContexts) Get(id AccessContextID) (*AccessContext, error) {
+func (_AccessContexts) Get(id AccessContextID) (_ *AccessContext, err error) {
+	defer observeQuery("AccessContexts.Get", time.Now(), &err)
+
 	q := `
 	SELECT id, name, active
 	FROM wf_access_contexts
 	WHERE id = ?
 	`
-	res := db.QueryRow(q, id)
+	res := db().QueryRow(dbDialect().Rebind(q), id)
 	var elem AccessContext
-	err := res.Scan(&elem.ID, &elem.Name, &elem.Active)
+	err = res.Scan(&elem.ID, &elem.Name, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "access context", "AccessContexts.Get")
 	}
 
 	return &elem, nil
@@ -290,16 +307,23 @@ func (_AccessContexts) Get(id AccessContextID) (*AccessContext, error) {
 
 // Rename changes the name of the given access context to the
 // specified new name.
-func (_AccessContexts) Rename(otx *sql.Tx, id AccessContextID, name string) error {
+func (_AccessContexts) Rename(otx *sql.Tx, id AccessContextID, name string) (err error) {
+	defer observeQuery("AccessContexts.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("access context name should be non-empty")
+		return invalidArg("access context", "AccessContexts.Rename", "access context name should be non-empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("access context", "AccessContexts.Rename", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.Rename")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -308,12 +332,20 @@ func (_AccessContexts) Rename(otx *sql.Tx, id AccessContextID, name string) erro
 		tx = otx
 	}
 
+	if err = checkNameFreeExcept(context.Background(), tx, "wf_access_contexts", name, "id", id); err != nil {
+		return classify("access context", "AccessContexts.Rename", err)
+	}
+
 	q := `
 	UPDATE wf_access_contexts
 	SET name = ?
 	WHERE id = ?
 	`
-	_, err = tx.Exec(q, name, id)
+	res, err := tx.Exec(dbDialect().Rebind(q), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_access_contexts", "id", id, "access context", "AccessContexts.Rename")
 	if err != nil {
 		return err
 	}
@@ -330,16 +362,20 @@ func (_AccessContexts) Rename(otx *sql.Tx, id AccessContextID, name string) erro
 
 // SetActive updates the given access context with the new active
 // status.
-func (_AccessContexts) SetActive(otx *sql.Tx, id AccessContextID, active bool) error {
+func (_AccessContexts) SetActive(otx *sql.Tx, id AccessContextID, active bool) (err error) {
+	defer observeQuery("AccessContexts.SetActive", time.Now(), &err)
+
 	act := 0
 	if active {
 		act = 1
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.SetActive")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -353,7 +389,7 @@ func (_AccessContexts) SetActive(otx *sql.Tx, id AccessContextID, active bool) e
 	SET active = ?
 	WHERE id = ?
 	`
-	_, err = tx.Exec(q, act, id)
+	_, err = tx.Exec(dbDialect().Rebind(q), act, id)
 	if err != nil {
 		return err
 	}
@@ -370,15 +406,17 @@ func (_AccessContexts) SetActive(otx *sql.Tx, id AccessContextID, active bool) e
 
 // GroupRoles retrieves the groups --> roles mapping for this access
 // context.
-func (_AccessContexts) GroupRoles(id AccessContextID, gids []GroupID, offset, limit int64) (map[GroupID]*AcGroupRoles, error) {
+func (_AccessContexts) GroupRoles(id AccessContextID, gids []GroupID, offset, limit int64) (_ map[GroupID]*AcGroupRoles, err error) {
+	defer observeQuery("AccessContexts.GroupRoles", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("access context ID should be a positive integer")
+		return nil, invalidArg("access context", "AccessContexts.GroupRoles", "access context ID should be a positive integer")
 	}
 	if len(gids) == 0 {
-		return nil, errors.New("list of group IDs should be non-empty")
+		return nil, invalidArg("access context", "AccessContexts.GroupRoles", "list of group IDs should be non-empty")
 	}
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit should be non-negative integers")
+		return nil, invalidArg("access context", "AccessContexts.GroupRoles", "offset and limit should be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -402,7 +440,7 @@ func (_AccessContexts) GroupRoles(id AccessContextID, gids []GroupID, offset, li
 	ORDER BY agrs.group_id
 	LIMIT ? OFFSET ?
 	`
-	stmt, err := db.Prepare(q)
+	stmt, err := db().Prepare(dbDialect().Rebind(q))
 	if err != nil {
 		return nil, err
 	}
@@ -448,9 +486,11 @@ type GroupRolesstruct struct {
 }
 
 //自定义 直接查出数据库
-func (_AccessContexts) GroupRolesList(offset, limit int64) ([]*GroupRolesstruct, error) {
+func (_AccessContexts) GroupRolesList(offset, limit int64) (_ []*GroupRolesstruct, err error) {
+	defer observeQuery("AccessContexts.GroupRolesList", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("access context", "AccessContexts.GroupRolesList", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -462,7 +502,7 @@ func (_AccessContexts) GroupRolesList(offset, limit int64) ([]*GroupRolesstruct,
 	ORDER BY id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -486,15 +526,19 @@ func (_AccessContexts) GroupRolesList(offset, limit int64) ([]*GroupRolesstruct,
 
 // AddGroupRole assigns the specified role to the given group, if it
 // is not already assigned.
-func (_AccessContexts) AddGroupRole(otx *sql.Tx, id AccessContextID, gid GroupID, rid RoleID) error {
+func (_AccessContexts) AddGroupRole(otx *sql.Tx, id AccessContextID, gid GroupID, rid RoleID) (err error) {
+	defer observeQuery("AccessContexts.AddGroupRole", time.Now(), &err)
+
 	if gid <= 0 || rid <= 0 {
-		return errors.New("group ID and role ID should be positive integers")
+		return invalidArg("access context", "AccessContexts.AddGroupRole", "group ID and role ID should be positive integers")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.AddGroupRole")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -503,7 +547,7 @@ func (_AccessContexts) AddGroupRole(otx *sql.Tx, id AccessContextID, gid GroupID
 		tx = otx
 	}
 
-	_, err = tx.Exec(`INSERT INTO wf_ac_group_roles(ac_id, group_id, role_id) VALUES(?, ?, ?)`, id, gid, rid)
+	_, err = tx.Exec(dbDialect().Rebind(`INSERT INTO wf_ac_group_roles(ac_id, group_id, role_id) VALUES(?, ?, ?)`), id, gid, rid)
 	if err != nil {
 		return err
 	}
@@ -519,15 +563,19 @@ func (_AccessContexts) AddGroupRole(otx *sql.Tx, id AccessContextID, gid GroupID
 }
 
 // RemoveGroupRole unassigns the specified role from the given group.
-func (_AccessContexts) RemoveGroupRole(otx *sql.Tx, id AccessContextID, gid GroupID, rid RoleID) error {
+func (_AccessContexts) RemoveGroupRole(otx *sql.Tx, id AccessContextID, gid GroupID, rid RoleID) (err error) {
+	defer observeQuery("AccessContexts.RemoveGroupRole", time.Now(), &err)
+
 	if gid <= 0 || rid <= 0 {
-		return errors.New("group ID and role ID should be positive integers")
+		return invalidArg("access context", "AccessContexts.RemoveGroupRole", "group ID and role ID should be positive integers")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.RemoveGroupRole")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -536,7 +584,7 @@ func (_AccessContexts) RemoveGroupRole(otx *sql.Tx, id AccessContextID, gid Grou
 		tx = otx
 	}
 
-	_, err = tx.Exec(`DELETE FROM wf_ac_group_roles WHERE ac_id = ? AND group_id = ? AND role_id = ?`, id, gid, rid)
+	_, err = tx.Exec(dbDialect().Rebind(`DELETE FROM wf_ac_group_roles WHERE ac_id = ? AND group_id = ? AND role_id = ?`), id, gid, rid)
 	if err != nil {
 		return err
 	}
@@ -552,9 +600,11 @@ func (_AccessContexts) RemoveGroupRole(otx *sql.Tx, id AccessContextID, gid Grou
 }
 
 // Groups retrieves the users included in this access context.
-func (_AccessContexts) Groups(id AccessContextID, offset, limit int64) (map[GroupID]*AcGroup, error) {
+func (_AccessContexts) Groups(id AccessContextID, offset, limit int64) (_ map[GroupID]*AcGroup, err error) {
+	defer observeQuery("AccessContexts.Groups", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit should be non-negative integers")
+		return nil, invalidArg("access context", "AccessContexts.Groups", "offset and limit should be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -569,7 +619,7 @@ func (_AccessContexts) Groups(id AccessContextID, offset, limit int64) (map[Grou
 	ORDER BY auh.group_id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, id, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), id, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -594,16 +644,22 @@ func (_AccessContexts) Groups(id AccessContextID, offset, limit int64) (map[Grou
 
 // AddGroup adds the given group to this access context, with the
 // specified reporting authority within the hierarchy of this access
-// context.
-func (_AccessContexts) AddGroup(otx *sql.Tx, id AccessContextID, gid, reportsTo GroupID) error {
+// context.  A conflict error is answered if the given group is the
+// reporting authority itself, or one of its ancestors, since that
+// would create a cycle in the hierarchy.
+func (_AccessContexts) AddGroup(otx *sql.Tx, id AccessContextID, gid, reportsTo GroupID) (err error) {
+	defer observeQuery("AccessContexts.AddGroup", time.Now(), &err)
+
 	if gid <= 0 || reportsTo < 0 {
-		return errors.New("group ID should be a positive integer; reporting authority ID should be a non-negative integer")
+		return invalidArg("access context", "AccessContexts.AddGroup", "group ID should be a positive integer; reporting authority ID should be a non-negative integer")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.AddGroup")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -612,8 +668,13 @@ func (_AccessContexts) AddGroup(otx *sql.Tx, id AccessContextID, gid, reportsTo
 		tx = otx
 	}
 
+	err = checkHierarchyCycle(tx, id, gid, reportsTo, "AccessContexts.AddGroup")
+	if err != nil {
+		return err
+	}
+
 	q := `INSERT INTO wf_ac_group_hierarchy(ac_id, group_id, reports_to) VALUES (?, ?, ?)`
-	_, err = tx.Exec(q, id, gid, reportsTo)
+	_, err = tx.Exec(dbDialect().Rebind(q), id, gid, reportsTo)
 	if err != nil {
 		return err
 	}
@@ -628,16 +689,55 @@ func (_AccessContexts) AddGroup(otx *sql.Tx, id AccessContextID, gid, reportsTo
 	return nil
 }
 
+// AddChildGroup adds the given child group to this access context,
+// reporting to the given parent group.  It is a convenience wrapper
+// over `AddGroup`, for building group hierarchies top-down.
+func (_AccessContexts) AddChildGroup(otx *sql.Tx, id AccessContextID, parent, child GroupID) error {
+	if parent <= 0 {
+		return invalidArg("access context", "AccessContexts.AddChildGroup", "parent group ID should be a positive integer")
+	}
+
+	return AccessContexts.AddGroup(otx, id, child, parent)
+}
+
+// checkHierarchyCycle answers a conflict error if making the given
+// group report to the given authority, within the given access
+// context, would create a cycle in its hierarchy.
+func checkHierarchyCycle(tx *sql.Tx, id AccessContextID, gid, reportsTo GroupID, op string) error {
+	if reportsTo <= 0 {
+		return nil
+	}
+	if reportsTo == gid {
+		return conflict("access context", op, errors.New("a group cannot report to itself"))
+	}
+
+	ancs, err := groupHierarchyWalk(tx, id, true, reportsTo)
+	if err != nil {
+		return err
+	}
+	for _, anc := range ancs {
+		if anc == gid {
+			return conflict("access context", op, fmt.Errorf("group %d is an ancestor of group %d; reporting would create a cycle", gid, reportsTo))
+		}
+	}
+
+	return nil
+}
+
 // DeleteGroup removes the given group from this access context.
-func (_AccessContexts) DeleteGroup(otx *sql.Tx, id AccessContextID, gid GroupID) error {
+func (_AccessContexts) DeleteGroup(otx *sql.Tx, id AccessContextID, gid GroupID) (err error) {
+	defer observeQuery("AccessContexts.DeleteGroup", time.Now(), &err)
+
 	if gid <= 0 {
-		return errors.New("user ID should be positive integer")
+		return invalidArg("access context", "AccessContexts.DeleteGroup", "user ID should be positive integer")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.DeleteGroup")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -647,7 +747,7 @@ func (_AccessContexts) DeleteGroup(otx *sql.Tx, id AccessContextID, gid GroupID)
 	}
 
 	q := `DELETE FROM wf_ac_group_hierarchy WHERE ac_id = ? AND group_id = ?`
-	_, err = tx.Exec(q, id, gid)
+	_, err = tx.Exec(dbDialect().Rebind(q), id, gid)
 	if err != nil {
 		return err
 	}
@@ -664,16 +764,18 @@ func (_AccessContexts) DeleteGroup(otx *sql.Tx, id AccessContextID, gid GroupID)
 
 // GroupReportsTo answers the group to whom the given group reports to,
 // within this access context.
-func (_AccessContexts) GroupReportsTo(id AccessContextID, uid GroupID) (GroupID, error) {
+func (_AccessContexts) GroupReportsTo(id AccessContextID, uid GroupID) (_ GroupID, err error) {
+	defer observeQuery("AccessContexts.GroupReportsTo", time.Now(), &err)
+
 	q := `
 	SELECT reports_to
 	FROM wf_ac_group_hierarchy
 	WHERE ac_id = ?
 	AND group_id = ?
 	`
-	row := db.QueryRow(q, id, uid)
+	row := db().QueryRow(dbDialect().Rebind(q), id, uid)
 	var repID int64
-	err := row.Scan(&repID)
+	err = row.Scan(&repID)
 	if err != nil {
 		return 0, err
 	}
@@ -683,14 +785,16 @@ func (_AccessContexts) GroupReportsTo(id AccessContextID, uid GroupID) (GroupID,
 
 // GroupReportees answers a list of the groups who report to the given
 // group, within this access context.
-func (_AccessContexts) GroupReportees(id AccessContextID, uid GroupID) ([]GroupID, error) {
+func (_AccessContexts) GroupReportees(id AccessContextID, uid GroupID) (_ []GroupID, err error) {
+	defer observeQuery("AccessContexts.GroupReportees", time.Now(), &err)
+
 	q := `
 	SELECT group_id
 	FROM wf_ac_group_hierarchy
 	WHERE ac_id = ?
 	AND reports_to = ?
 	`
-	rows, err := db.Query(q, id, uid)
+	rows, err := db().Query(dbDialect().Rebind(q), id, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -713,16 +817,21 @@ func (_AccessContexts) GroupReportees(id AccessContextID, uid GroupID) ([]GroupI
 }
 
 // ChangeReporting reassigns the group to a different reporting
-// authority.
-func (_AccessContexts) ChangeReporting(otx *sql.Tx, id AccessContextID, gid, reportsTo GroupID) error {
+// authority.  As with `AddGroup`, changes that would create a cycle in
+// the hierarchy are rejected.
+func (_AccessContexts) ChangeReporting(otx *sql.Tx, id AccessContextID, gid, reportsTo GroupID) (err error) {
+	defer observeQuery("AccessContexts.ChangeReporting", time.Now(), &err)
+
 	if gid <= 0 || reportsTo < 0 {
-		return errors.New("group ID should be positive integer; reporting authority ID should be a non-negative integer")
+		return invalidArg("access context", "AccessContexts.ChangeReporting", "group ID should be positive integer; reporting authority ID should be a non-negative integer")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("access context", "AccessContexts.ChangeReporting")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -731,13 +840,18 @@ func (_AccessContexts) ChangeReporting(otx *sql.Tx, id AccessContextID, gid, rep
 		tx = otx
 	}
 
+	err = checkHierarchyCycle(tx, id, gid, reportsTo, "AccessContexts.ChangeReporting")
+	if err != nil {
+		return err
+	}
+
 	q := `
 	UPDATE wf_ac_group_hierarchy
 	SET reports_to = ?
 	WHERE ac_id = ?
 	AND group_id = ?
 	`
-	_, err = tx.Exec(q, reportsTo, id, gid)
+	_, err = tx.Exec(dbDialect().Rebind(q), reportsTo, id, gid)
 	if err != nil {
 		return err
 	}
@@ -754,9 +868,11 @@ func (_AccessContexts) ChangeReporting(otx *sql.Tx, id AccessContextID, gid, rep
 
 // IncludesGroup answers `true` if the given group is included in this
 // access context.
-func (_AccessContexts) IncludesGroup(id AccessContextID, gid GroupID) (bool, error) {
+func (_AccessContexts) IncludesGroup(id AccessContextID, gid GroupID) (_ bool, err error) {
+	defer observeQuery("AccessContexts.IncludesGroup", time.Now(), &err)
+
 	if gid <= 0 {
-		return false, errors.New("group ID should be a positive integer")
+		return false, invalidArg("access context", "AccessContexts.IncludesGroup", "group ID should be a positive integer")
 	}
 
 	q := `
@@ -766,8 +882,8 @@ func (_AccessContexts) IncludesGroup(id AccessContextID, gid GroupID) (bool, err
 	AND group_id = ?
 	`
 	var repTo int64
-	row := db.QueryRow(q, id, gid)
-	err := row.Scan(&repTo)
+	row := db().QueryRow(dbDialect().Rebind(q), id, gid)
+	err = row.Scan(&repTo)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -780,9 +896,11 @@ func (_AccessContexts) IncludesGroup(id AccessContextID, gid GroupID) (bool, err
 
 // IncludesUser answers `true` if the given user is included in this
 // access context.
-func (_AccessContexts) IncludesUser(id AccessContextID, uid UserID) (bool, error) {
+func (_AccessContexts) IncludesUser(id AccessContextID, uid UserID) (_ bool, err error) {
+	defer observeQuery("AccessContexts.IncludesUser", time.Now(), &err)
+
 	if uid <= 0 {
-		return false, errors.New("user ID should be a positive integer")
+		return false, invalidArg("access context", "AccessContexts.IncludesUser", "user ID should be a positive integer")
 	}
 
 	q := `
@@ -797,8 +915,8 @@ func (_AccessContexts) IncludesUser(id AccessContextID, uid UserID) (bool, error
 	)
 	`
 	var count int64
-	row := db.QueryRow(q, id, uid)
-	err := row.Scan(&count)
+	row := db().QueryRow(dbDialect().Rebind(q), id, uid)
+	err = row.Scan(&count)
 	if err != nil {
 		return false, err
 	}
@@ -810,11 +928,59 @@ func (_AccessContexts) IncludesUser(id AccessContextID, uid UserID) (bool, error
 	return true, nil
 }
 
+// AllUsers answers the users who have any role in this access
+// context, through any of their groups.  Members of the groups placed
+// in the reporting hierarchy of this access context are included as
+// well.  Each user appears only once, however many of their groups
+// qualify.
+func (_AccessContexts) AllUsers(id AccessContextID) (_ []UserID, err error) {
+	defer observeQuery("AccessContexts.AllUsers", time.Now(), &err)
+
+	if id <= 0 {
+		return nil, invalidArg("access context", "AccessContexts.AllUsers", "access context ID should be a positive integer")
+	}
+
+	q := `
+	SELECT gu.user_id
+	FROM wf_group_users gu
+	JOIN wf_ac_group_roles agrs ON agrs.group_id = gu.group_id
+	WHERE agrs.ac_id = ?
+	UNION
+	SELECT gu.user_id
+	FROM wf_group_users gu
+	JOIN wf_ac_group_hierarchy agh ON agh.group_id = gu.group_id
+	WHERE agh.ac_id = ?
+	ORDER BY user_id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]UserID, 0, 10)
+	for rows.Next() {
+		var uid UserID
+		err = rows.Scan(&uid)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, uid)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
 // UserPermissions answers a list of the permissions available to the
 // given user in this access context.
-func (_AccessContexts) UserPermissions(id AccessContextID, uid UserID) (map[DocTypeID][]DocAction, error) {
+func (_AccessContexts) UserPermissions(id AccessContextID, uid UserID) (_ map[DocTypeID][]DocAction, err error) {
+	defer observeQuery("AccessContexts.UserPermissions", time.Now(), &err)
+
 	if uid <= 0 {
-		return nil, errors.New("user ID should be a positive integer")
+		return nil, invalidArg("access context", "AccessContexts.UserPermissions", "user ID should be a positive integer")
 	}
 
 	q := `
@@ -824,7 +990,7 @@ func (_AccessContexts) UserPermissions(id AccessContextID, uid UserID) (map[DocT
 	WHERE acpv.ac_id = ?
 	AND acpv.user_id = ?
 	`
-	rows, err := db.Query(q, id, uid)
+	rows, err := db().Query(dbDialect().Rebind(q), id, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -856,9 +1022,11 @@ func (_AccessContexts) UserPermissions(id AccessContextID, uid UserID) (map[DocT
 // UserPermissionsByDocType answers a list of the permissions
 // available on the given document type, to the given user, in this
 // access context.
-func (_AccessContexts) UserPermissionsByDocType(id AccessContextID, dtype DocTypeID, uid UserID) ([]DocAction, error) {
+func (_AccessContexts) UserPermissionsByDocType(id AccessContextID, dtype DocTypeID, uid UserID) (_ []DocAction, err error) {
+	defer observeQuery("AccessContexts.UserPermissionsByDocType", time.Now(), &err)
+
 	if id <= 0 || dtype <= 0 || uid <= 0 {
-		return nil, errors.New("all identifiers should be positive integers")
+		return nil, invalidArg("access context", "AccessContexts.UserPermissionsByDocType", "all identifiers should be positive integers")
 	}
 
 	q := `
@@ -869,7 +1037,7 @@ func (_AccessContexts) UserPermissionsByDocType(id AccessContextID, dtype DocTyp
 	AND acpv.doctype_id = ?
 	AND acpv.user_id = ?
 	`
-	rows, err := db.Query(q, id, dtype, uid)
+	rows, err := db().Query(dbDialect().Rebind(q), id, dtype, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -894,9 +1062,11 @@ func (_AccessContexts) UserPermissionsByDocType(id AccessContextID, dtype DocTyp
 
 // GroupPermissions answers a list of the permissions available to the
 // given user in this access context.
-func (_AccessContexts) GroupPermissions(id AccessContextID, gid GroupID) (map[DocTypeID][]DocAction, error) {
+func (_AccessContexts) GroupPermissions(id AccessContextID, gid GroupID) (_ map[DocTypeID][]DocAction, err error) {
+	defer observeQuery("AccessContexts.GroupPermissions", time.Now(), &err)
+
 	if gid <= 0 {
-		return nil, errors.New("group ID should be a positive integer")
+		return nil, invalidArg("access context", "AccessContexts.GroupPermissions", "group ID should be a positive integer")
 	}
 
 	q := `
@@ -906,7 +1076,7 @@ func (_AccessContexts) GroupPermissions(id AccessContextID, gid GroupID) (map[Do
 	WHERE acpv.ac_id = ?
 	AND acpv.group_id = ?
 	`
-	rows, err := db.Query(q, id, gid)
+	rows, err := db().Query(dbDialect().Rebind(q), id, gid)
 	if err != nil {
 		return nil, err
 	}
@@ -938,9 +1108,11 @@ func (_AccessContexts) GroupPermissions(id AccessContextID, gid GroupID) (map[Do
 // GroupPermissionsByDocType answers a list of the permissions
 // available on the given document type, to the given user, in this
 // access context.
-func (_AccessContexts) GroupPermissionsByDocType(id AccessContextID, dtype DocTypeID, gid GroupID) ([]DocAction, error) {
+func (_AccessContexts) GroupPermissionsByDocType(id AccessContextID, dtype DocTypeID, gid GroupID) (_ []DocAction, err error) {
+	defer observeQuery("AccessContexts.GroupPermissionsByDocType", time.Now(), &err)
+
 	if id <= 0 || dtype <= 0 || gid <= 0 {
-		return nil, errors.New("all identifiers should be positive integers")
+		return nil, invalidArg("access context", "AccessContexts.GroupPermissionsByDocType", "all identifiers should be positive integers")
 	}
 
 	q := `
@@ -951,7 +1123,7 @@ func (_AccessContexts) GroupPermissionsByDocType(id AccessContextID, dtype DocTy
 	AND acpv.doctype_id = ?
 	AND acpv.group_id = ?
 	`
-	rows, err := db.Query(q, id, dtype, gid)
+	rows, err := db().Query(dbDialect().Rebind(q), id, dtype, gid)
 	if err != nil {
 		return nil, err
 	}
@@ -974,12 +1146,80 @@ func (_AccessContexts) GroupPermissionsByDocType(id AccessContextID, dtype DocTy
 	return res, nil
 }
 
+// HasRole answers `true` if the given user holds the given role in
+// this access context; `false` otherwise.
+//
+// A user holds a role when any of the user's groups -- including the
+// user's singleton group -- is assigned that role in this access
+// context.  Roles are inherited down the group hierarchy of this
+// access context: a group is considered to hold the roles of all the
+// groups that it reports to, directly or transitively.
+func (_AccessContexts) HasRole(id AccessContextID, uid UserID, rid RoleID) (_ bool, err error) {
+	defer observeQuery("AccessContexts.HasRole", time.Now(), &err)
+
+	if id <= 0 || uid <= 0 || rid <= 0 {
+		return false, invalidArg("access context", "AccessContexts.HasRole", "all identifiers should be positive integers")
+	}
+
+	rows, err := db().Query(dbDialect().Rebind("SELECT group_id FROM wf_group_users WHERE user_id = ?"), uid)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	gids := make([]GroupID, 0, 4)
+	for rows.Next() {
+		var gid GroupID
+		err = rows.Scan(&gid)
+		if err != nil {
+			return false, err
+		}
+		gids = append(gids, gid)
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+	if len(gids) == 0 {
+		return false, nil
+	}
+
+	// Roles are inherited from the groups reported to.
+	ancs, err := groupHierarchyWalk(nil, id, true, gids...)
+	if err != nil {
+		return false, err
+	}
+	gids = append(gids, ancs...)
+
+	args := make([]interface{}, 0, len(gids)+2)
+	args = append(args, id, rid)
+	for _, gid := range gids {
+		args = append(args, gid)
+	}
+	q := `
+	SELECT COUNT(*)
+	FROM wf_ac_group_roles
+	WHERE ac_id = ?
+	AND role_id = ?
+	AND group_id IN (?` + strings.Repeat(", ?", len(gids)-1) + `)
+	`
+	var n int64
+	err = db().QueryRow(dbDialect().Rebind(q), args...).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
 // UserHasPermission answers `true` if the given user has the
 // requested action enabled on the specified document type; `false`
 // otherwise.
-func (_AccessContexts) UserHasPermission(id AccessContextID, uid UserID, dtype DocTypeID, action DocActionID) (bool, error) {
+func (_AccessContexts) UserHasPermission(id AccessContextID, uid UserID, dtype DocTypeID, action DocActionID) (_ bool, err error) {
+	defer observeQuery("AccessContexts.UserHasPermission", time.Now(), &err)
+
 	if uid <= 0 || dtype <= 0 || action <= 0 {
-		return false, errors.New("invalid user ID or document type or document action")
+		return false, invalidArg("access context", "AccessContexts.UserHasPermission", "invalid user ID or document type or document action")
 	}
 
 	q := `
@@ -990,9 +1230,9 @@ func (_AccessContexts) UserHasPermission(id AccessContextID, uid UserID, dtype D
 	AND docaction_id = ?
 	LIMIT 1
 	`
-	row := db.QueryRow(q, id, uid, dtype, action)
+	row := db().QueryRow(dbDialect().Rebind(q), id, uid, dtype, action)
 	var roleID int64
-	err := row.Scan(&roleID)
+	err = row.Scan(&roleID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -1002,12 +1242,71 @@ func (_AccessContexts) UserHasPermission(id AccessContextID, uid UserID, dtype D
 	return true, nil
 }
 
+// CanPerformMany answers, for each of the given actions, whether the
+// given user may perform it on a document of the specified type that
+// is in the specified state, in this access context.
+//
+// An action is performable when the user has the permission for it,
+// and the document type defines a transition out of the given state
+// upon that action.  All the actions are resolved in a single query.
+func (_AccessContexts) CanPerformMany(id AccessContextID, uid UserID, dtype DocTypeID, state DocStateID, actions []DocActionID) (_ map[DocActionID]bool, err error) {
+	defer observeQuery("AccessContexts.CanPerformMany", time.Now(), &err)
+
+	if id <= 0 || uid <= 0 || dtype <= 0 || state <= 0 {
+		return nil, invalidArg("access context", "AccessContexts.CanPerformMany", "all identifiers should be positive integers")
+	}
+
+	res := make(map[DocActionID]bool, len(actions))
+	if len(actions) == 0 {
+		return res, nil
+	}
+
+	args := make([]interface{}, 0, len(actions)+4)
+	args = append(args, id, uid, dtype, state)
+	for _, action := range actions {
+		res[action] = false
+		args = append(args, action)
+	}
+
+	q := `
+	SELECT DISTINCT acpv.docaction_id
+	FROM wf_ac_perms_v acpv
+	JOIN wf_docstate_transitions dst ON dst.doctype_id = acpv.doctype_id AND dst.docaction_id = acpv.docaction_id
+	WHERE acpv.ac_id = ?
+	AND acpv.user_id = ?
+	AND acpv.doctype_id = ?
+	AND dst.from_state_id = ?
+	AND acpv.docaction_id IN (?` + strings.Repeat(",?", len(actions)-1) + `)
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var action DocActionID
+		err = rows.Scan(&action)
+		if err != nil {
+			return nil, err
+		}
+		res[action] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // GroupHasPermission answers `true` if the given group has the
 // requested action enabled on the specified document type; `false`
 // otherwise.
-func (ac *AccessContext) GroupHasPermission(id AccessContextID, gid GroupID, dtype DocTypeID, action DocActionID) (bool, error) {
+func (ac *AccessContext) GroupHasPermission(id AccessContextID, gid GroupID, dtype DocTypeID, action DocActionID) (_ bool, err error) {
+	defer observeQuery("AccessContext.GroupHasPermission", time.Now(), &err)
+
 	if gid <= 0 || dtype <= 0 || action <= 0 {
-		return false, errors.New("invalid group ID or document type or document action")
+		return false, invalidArg("access context", "AccessContext.GroupHasPermission", "invalid group ID or document type or document action")
 	}
 
 	q := `
@@ -1018,9 +1317,9 @@ func (ac *AccessContext) GroupHasPermission(id AccessContextID, gid GroupID, dty
 	AND docaction_id = ?
 	LIMIT 1
 	`
-	row := db.QueryRow(q, id, gid, dtype, action)
+	row := db().QueryRow(dbDialect().Rebind(q), id, gid, dtype, action)
 	var roleID int64
-	err := row.Scan(&roleID)
+	err = row.Scan(&roleID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -0,0 +1,183 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// daCache holds all the document actions in memory, once enabled
+// using `EnableDocActionCache`.  It is loaded lazily, on first use,
+// and is discarded whenever document actions are changed through
+// `flow`.
+var daCache = struct {
+	sync.Mutex
+	enabled bool
+	byID    map[DocActionID]*DocAction
+	byName  map[string]*DocAction
+	pending int // Number of uncommitted changes to document actions
+}{}
+
+// EnableDocActionCache turns on an in-memory cache of document
+// actions, which serves `DocActions.Get`, `GetByName` and `Exists`.
+//
+// Document actions form a small vocabulary that rarely changes.  The
+// cache is discarded whenever they are changed through `flow`; it is
+// not aware, though, of changes made directly in the database, or by
+// other processes.  Hence, caching is off by default.  Reads made
+// within a transaction always go to the database.
+//
+// While a change made in a transaction is not yet committed, the cache
+// is bypassed; it is used again once the transaction ends.  Hence,
+// while the cache is enabled, changes to document actions in a
+// transaction of the caller need that transaction to be begun through
+// `WithTx`, since `flow` cannot otherwise know when -- or whether --
+// it commits.  Changes in any other transaction of the caller answer
+// an error wrapping `ErrTxUntracked`, and are not made.
+func EnableDocActionCache() {
+	daCache.Lock()
+	defer daCache.Unlock()
+
+	daCache.enabled = true
+	daCache.byID, daCache.byName = nil, nil
+}
+
+// DisableDocActionCache turns off the cache of document actions, and
+// discards its contents.
+func DisableDocActionCache() {
+	daCache.Lock()
+	defer daCache.Unlock()
+
+	daCache.enabled = false
+	daCache.byID, daCache.byName = nil, nil
+}
+
+// invalidateDocActionCache discards the cached document actions, if
+// any, so that they are loaded afresh on next use.
+func invalidateDocActionCache() {
+	daCache.Lock()
+	defer daCache.Unlock()
+
+	daCache.byID, daCache.byName = nil, nil
+}
+
+// checkDocActionTx answers an error if the cache is enabled, and the
+// given transaction of the caller was not begun through `WithTx`.
+// Document actions should not be changed in such a transaction, since
+// the cache could not be refreshed once it commits.
+func checkDocActionTx(otx *sql.Tx, op string) error {
+	if otx == nil || txTracked(otx) {
+		return nil
+	}
+
+	daCache.Lock()
+	defer daCache.Unlock()
+
+	if daCache.enabled {
+		return txUntrackedErr("document action", op)
+	}
+	return nil
+}
+
+// docActionsChanged is called after document actions are changed,
+// in the given transaction of the caller, if any.  Without one, the
+// change is already committed, and the cache is simply discarded.
+// Otherwise, the cache is bypassed until the transaction ends.
+//
+// Changes are made in a transaction that was not begun through
+// `WithTx` only while the cache is disabled; see `checkDocActionTx`.
+// Such a change is merely discarded from the cache, which is loaded
+// afresh when it is enabled again.
+func docActionsChanged(otx *sql.Tx) {
+	if otx == nil {
+		invalidateDocActionCache()
+		return
+	}
+
+	daCache.Lock()
+	defer daCache.Unlock()
+
+	daCache.byID, daCache.byName = nil, nil
+	ok := onTxDone(otx, func(bool) {
+		daCache.Lock()
+		defer daCache.Unlock()
+
+		daCache.pending--
+		daCache.byID, daCache.byName = nil, nil
+	})
+	if ok {
+		daCache.pending++
+	}
+}
+
+// cachedDocAction answers a copy of the cached document action with
+// the given ID or, if `id` is `0`, the given name.  The boolean result
+// is `false` if the cache is disabled, or has no such action.
+func cachedDocAction(ctx context.Context, id DocActionID, name string) (*DocAction, bool, error) {
+	daCache.Lock()
+	defer daCache.Unlock()
+
+	if !daCache.enabled || daCache.pending > 0 {
+		return nil, false, nil
+	}
+	if daCache.byID == nil {
+		err := loadDocActionCache(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var da *DocAction
+	if id > 0 {
+		da = daCache.byID[id]
+	} else {
+		da = daCache.byName[name]
+	}
+	if da == nil {
+		return nil, false, nil
+	}
+	elem := *da
+	return &elem, true, nil
+}
+
+// loadDocActionCache reads all the document actions, including
+// archived ones, into the cache.  The caller should hold the lock.
+func loadDocActionCache(ctx context.Context) error {
+	rows, err := db().QueryContext(ctx, dbDialect().Rebind("SELECT id, name, reconfirm, active = 0, ctime, mtime FROM wf_docactions_master"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byID := make(map[DocActionID]*DocAction)
+	byName := make(map[string]*DocAction)
+	for rows.Next() {
+		var elem DocAction
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived, &elem.ctime, &elem.mtime)
+		if err != nil {
+			return err
+		}
+		byID[elem.ID] = &elem
+		byName[elem.Name] = &elem
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	daCache.byID, daCache.byName = byID, byName
+	return nil
+}
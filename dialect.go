@@ -0,0 +1,248 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Dialect abstracts the differences between the SQL dialects of the
+// databases that `flow` can work with.  Queries in `flow` are written
+// using `?` placeholders; a dialect renders them appropriately, and
+// knows how to obtain the identifier of a newly-inserted row.  The few
+// other constructs that differ between the databases are obtained from
+// the dialect as well; the rest of the SQL is common to them.
+//
+// N.B. The DDL under `sql/`, which `CreateSchema`, `MigrateSchema` and
+// `DropSchema` run, is MySQL's.  On other databases, the equivalent
+// tables should be created by the application.  The tables that hold
+// the documents of each type are created by `flow`, using the dialect.
+type Dialect interface {
+	// Rebind rewrites the `?` placeholders in the given query into
+	// those of this dialect.
+	Rebind(q string) string
+
+	// InsertID runs the given `INSERT` statement in the given
+	// transaction, and answers the identifier of the inserted row.
+	// The table is expected to have an auto-generated `id` column.
+	InsertID(ctx context.Context, tx *sql.Tx, q string, args ...interface{}) (int64, error)
+
+	// IgnoreDuplicates answers a clause that, appended to an
+	// `INSERT` statement, makes it skip the rows that would violate
+	// a unique constraint.  The given column of the table is used
+	// where the dialect needs one to express this.
+	IgnoreDuplicates(col string) string
+
+	// CreateDocTable answers the statements that create the given
+	// table, which holds the documents of a document type.
+	CreateDocTable(tbl string) []string
+
+	// Now answers an expression for the current time.
+	Now() string
+
+	// SecondsSince answers an integral expression for the number of
+	// seconds elapsed since the time given by the expression.
+	SecondsSince(expr string) string
+
+	// CurrentSchema answers an expression for the name of the schema
+	// in which unqualified tables are looked up.
+	CurrentSchema() string
+}
+
+// MySQL is the default dialect of `flow`.
+var MySQL Dialect = mysqlDialect{}
+
+// Postgres is the dialect of PostgreSQL.
+var Postgres Dialect = postgresDialect{}
+
+// dbDialect answers the dialect of the registered database.
+func dbDialect() Dialect {
+	c, _ := curConn.Load().(*dbConn)
+	if c == nil {
+		return MySQL
+	}
+	return c.dialect
+}
+
+// RegisterDBDialect is a variant of `RegisterDB` that also specifies
+// the SQL dialect of the given database.  Every query that `flow` runs
+// against the registered handle goes through this dialect.
+func RegisterDBDialect(sdb *sql.DB, d Dialect) error {
+	if d == nil {
+		return errors.New("given dialect is `nil`")
+	}
+	if sdb == nil {
+		log.Fatal("given database handle is `nil`")
+	}
+	registerDB(sdb, d)
+
+	return nil
+}
+
+// Unexported type, implementing MySQL's dialect.
+type mysqlDialect struct{}
+
+// Rebind answers the given query as is.
+func (mysqlDialect) Rebind(q string) string {
+	return q
+}
+
+// InsertID uses the driver's `LastInsertId`.
+func (mysqlDialect) InsertID(ctx context.Context, tx *sql.Tx, q string, args ...interface{}) (int64, error) {
+	res, err := tx.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// IgnoreDuplicates updates the given column to itself.
+func (mysqlDialect) IgnoreDuplicates(col string) string {
+	return "ON DUPLICATE KEY UPDATE " + col + " = " + col
+}
+
+// CreateDocTable uses an auto-incremented identifier, and an inline
+// index.
+func (mysqlDialect) CreateDocTable(tbl string) []string {
+	q := `
+	CREATE TABLE ` + tbl + ` (
+		id INT NOT NULL AUTO_INCREMENT,
+		path VARCHAR(1000) NOT NULL,
+		ac_id INT NOT NULL,
+		docstate_id INT NOT NULL,
+		group_id INT NOT NULL,
+		ctime TIMESTAMP NOT NULL,
+		title VARCHAR(250) NULL,
+		data TEXT NOT NULL,
+		correlation_id VARCHAR(100) NULL,
+		version INT NOT NULL DEFAULT 1,
+		PRIMARY KEY (id),
+		INDEX (correlation_id),
+		FOREIGN KEY (ac_id) REFERENCES wf_access_contexts(id),
+		FOREIGN KEY (docstate_id) REFERENCES wf_docstates_master(id),
+		FOREIGN KEY (group_id) REFERENCES wf_groups_master(id)
+	)
+	`
+	return []string{q}
+}
+
+// Now uses `NOW()`.
+func (mysqlDialect) Now() string {
+	return "NOW()"
+}
+
+// SecondsSince uses `TIMESTAMPDIFF`.
+func (mysqlDialect) SecondsSince(expr string) string {
+	return "TIMESTAMPDIFF(SECOND, " + expr + ", NOW())"
+}
+
+// CurrentSchema uses `DATABASE()`.
+func (mysqlDialect) CurrentSchema() string {
+	return "DATABASE()"
+}
+
+// Unexported type, implementing PostgreSQL's dialect.
+type postgresDialect struct{}
+
+// Rebind rewrites the `?` placeholders as `$1`, `$2`, etc.  Question
+// marks inside quoted literals are left untouched.
+func (postgresDialect) Rebind(q string) string {
+	var sb strings.Builder
+	sb.Grow(len(q) + 10)
+
+	n := 0
+	var quote rune
+	for _, r := range q {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+
+		case r == '\'' || r == '"':
+			quote = r
+
+		case r == '?':
+			n++
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// InsertID appends a `RETURNING id` clause to the given statement,
+// since PostgreSQL's drivers do not support `LastInsertId`.
+func (d postgresDialect) InsertID(ctx context.Context, tx *sql.Tx, q string, args ...interface{}) (int64, error) {
+	var id int64
+	row := tx.QueryRowContext(ctx, d.Rebind(q)+" RETURNING id", args...)
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// IgnoreDuplicates does nothing upon any conflict.
+func (postgresDialect) IgnoreDuplicates(col string) string {
+	return "ON CONFLICT DO NOTHING"
+}
+
+// CreateDocTable uses a serial identifier, and creates the index
+// separately.
+func (postgresDialect) CreateDocTable(tbl string) []string {
+	q := `
+	CREATE TABLE ` + tbl + ` (
+		id SERIAL,
+		path VARCHAR(1000) NOT NULL,
+		ac_id INT NOT NULL,
+		docstate_id INT NOT NULL,
+		group_id INT NOT NULL,
+		ctime TIMESTAMP NOT NULL,
+		title VARCHAR(250) NULL,
+		data TEXT NOT NULL,
+		correlation_id VARCHAR(100) NULL,
+		version INT NOT NULL DEFAULT 1,
+		PRIMARY KEY (id),
+		FOREIGN KEY (ac_id) REFERENCES wf_access_contexts(id),
+		FOREIGN KEY (docstate_id) REFERENCES wf_docstates_master(id),
+		FOREIGN KEY (group_id) REFERENCES wf_groups_master(id)
+	)
+	`
+	return []string{q, `CREATE INDEX ON ` + tbl + ` (correlation_id)`}
+}
+
+// Now uses `NOW()`.
+func (postgresDialect) Now() string {
+	return "NOW()"
+}
+
+// SecondsSince truncates the epoch of the interval to an integer.
+func (postgresDialect) SecondsSince(expr string) string {
+	return "CAST(EXTRACT(EPOCH FROM (NOW() - " + expr + ")) AS BIGINT)"
+}
+
+// CurrentSchema uses `current_schema()`.
+func (postgresDialect) CurrentSchema() string {
+	return "current_schema()"
+}
@@ -13,11 +13,26 @@
 // limitations under the License.
 
 // Package flow is a tiny workflow engine written in Go (golang).
+//
+// Lookups of individual items, such as `Get` and `GetByName`, answer
+// an error wrapping `ErrNotFound` when no such item exists.  So do
+// `Rename` and `Delete`, rather than silently doing nothing.  Callers
+// can test for that with `errors.Is(err, ErrNotFound)`, without
+// depending on `database/sql`.
+//
+// Rejected arguments, missing items and conflicts with existing data
+// are answered as a `*FlowError`, which names the entity and the
+// operation, and carries a `Code` that `errors.As` can extract.  The
+// sentinel errors, such as `ErrDocumentClosed` and `ErrTxRequired`,
+// are answered wrapped in one; test for them with `errors.Is`.
 package flow
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -26,8 +41,23 @@ const (
 	DefACRoleCount = 1
 )
 
-var db *sql.DB
+// dbConn is a registered database handle, together with its dialect.
+type dbConn struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// curConn holds the current `*dbConn`.  It is replaced as a whole
+// upon registration, so that registering a database handle is safe
+// even while queries are in flight.
+var curConn atomic.Value
+
+// regMu serialises registrations of database handles.
+var regMu sync.Mutex
+
 var blobsDir string
+var nullNamesAsEmpty bool
+var txRequired bool
 
 //
 
@@ -35,22 +65,51 @@ func init() {
 	f := log.Flags()
 	log.SetFlags(f | log.Lmicroseconds | log.Lshortfile)
 	driver, connStr := "mysql", "travis@/flow?charset=utf8&parseTime=true"
-	tdb := fatal1(sql.Open(driver, connStr)).(*sql.DB)
+	tdb, err := sql.Open(driver, connStr)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	RegisterDB(tdb)
 }
 
 // RegisterDB provides an already initialised database handle to `flow`.
 //
 // N.B. This method **MUST** be called before anything else in `flow`.
+// The database is assumed to be MySQL; use `RegisterDBDialect` for
+// others.
 func RegisterDB(sdb *sql.DB) error {
 	if sdb == nil {
 		log.Fatal("given database handle is `nil`")
 	}
-	db = sdb
+	registerDB(sdb, MySQL)
 
 	return nil
 }
 
+// registerDB makes the given handle and dialect current.  Cached
+// statements and document actions are discarded if either of them
+// changes.
+func registerDB(sdb *sql.DB, d Dialect) {
+	regMu.Lock()
+	defer regMu.Unlock()
+
+	old, _ := curConn.Load().(*dbConn)
+	curConn.Store(&dbConn{db: sdb, dialect: d})
+	if old == nil || old.db != sdb || old.dialect != d {
+		resetStmtCache()
+		invalidateDocActionCache()
+	}
+}
+
+// db answers the registered database handle.
+func db() *sql.DB {
+	c, _ := curConn.Load().(*dbConn)
+	if c == nil {
+		return nil
+	}
+	return c.db
+}
+
 // SetBlobsDir specifies the base directory inside which blob files
 // should be stored.
 //
@@ -70,10 +129,46 @@ func SetBlobsDir(base string) error {
 	return nil
 }
 
-// fatal1 expects a value and an error value as its arguments.
-func fatal1(val1 interface{}, err error) interface{} {
+// SetNullNamesAsEmpty specifies how `NULL` names in master tables
+// should be treated when loading document types, states, actions,
+// roles and groups.
+//
+// By default, `flow` is strict: a `NULL` name results in an error.
+// When `lenient` is `true`, such names are answered as empty strings
+// instead, so that listings do not fail on dirty legacy data.
+func SetNullNamesAsEmpty(lenient bool) {
+	nullNamesAsEmpty = lenient
+}
+
+// RequireExplicitTx specifies whether mutating methods may manage
+// their own transactions.
+//
+// By default, a mutating method that is given a `nil` transaction
+// begins and commits one of its own.  When `required` is `true`, such
+// a call fails with `ErrTxRequired` instead, so that every change is
+// made as part of an explicit unit of work.
+func RequireExplicitTx(required bool) {
+	txRequired = required
+}
+
+// nullName is a scan destination for names in master tables.  It
+// honours the treatment of `NULL` names specified through
+// `SetNullNamesAsEmpty`.
+type nullName struct {
+	name *string
+}
+
+// Scan implements the `sql.Scanner` interface.
+func (n nullName) Scan(src interface{}) error {
+	var ns sql.NullString
+	err := ns.Scan(src)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return err
 	}
-	return val1
+	if !ns.Valid && !nullNamesAsEmpty {
+		return errors.New("name is NULL")
+	}
+
+	*n.name = ns.String
+	return nil
 }
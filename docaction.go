@@ -15,10 +15,13 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"fmt"
 	"math"
+	"sort"
 	"strings"
+	"time"
 )
 
 // DocActionID is the type of unique identifiers of document actions.
@@ -42,9 +45,28 @@ type DocActionID int64
 //
 // N.B. All document actions must be defined as constant strings.
 type DocAction struct {
-	ID        DocActionID `json:"ID"`        // Unique identifier of this action
-	Name      string      `json:"Name"`      // Globally-unique name of this action
-	Reconfirm bool        `json:"Reconfirm"` // Should the user be prompted for a reconfirmation of this action?
+	ID        DocActionID `json:"ID"`                 // Unique identifier of this action
+	Name      string      `json:"Name"`               // Globally-unique name of this action
+	Reconfirm bool        `json:"Reconfirm"`          // Should the user be prompted for a reconfirmation of this action?
+	Archived  bool        `json:"Archived,omitempty"` // Is this action retired from further use?
+
+	ctime time.Time // Time of creation
+	mtime time.Time // Time of last modification
+}
+
+// CreatedAt answers the time at which this document action was
+// created.  It is available only on actions read using `Get`,
+// `GetByName` or `Ensure`.
+func (da *DocAction) CreatedAt() time.Time {
+	return da.ctime
+}
+
+// UpdatedAt answers the time at which this document action was last
+// renamed, archived or unarchived; it is the time of creation
+// otherwise.  It is available only on actions read using `Get`,
+// `GetByName` or `Ensure`.
+func (da *DocAction) UpdatedAt() time.Time {
+	return da.mtime
 }
 
 // Unexported type, only for convenience methods.
@@ -56,69 +78,302 @@ var DocActions _DocActions
 
 // New creates and registers a new document action in the system.
 func (_DocActions) New(otx *sql.Tx, name string, reconfirm bool) (DocActionID, error) {
+	return DocActions.NewContext(context.Background(), otx, name, reconfirm)
+}
+
+// NewContext is the context-aware variant of `New`.  A transaction
+// begun by this method, if any, is tied to the given context too.
+func (_DocActions) NewContext(ctx context.Context, otx *sql.Tx, name string, reconfirm bool) (_ DocActionID, err error) {
+	defer observeQuery("DocActions.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("document action cannot be empty")
+		return 0, invalidArg("document action", "DocActions.New", "document action cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("document action", "DocActions.New", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("document action", "DocActions.New")
+		}
+		tx, err = db().BeginTx(ctx, nil)
 		if err != nil {
 			return 0, err
 		}
 		defer tx.Rollback()
 	} else {
+		if err = checkDocActionTx(otx, "DocActions.New"); err != nil {
+			return 0, err
+		}
 		tx = otx
 	}
 
-	var res sql.Result
+	aid, err := DocActions.create(ctx, tx, name, reconfirm)
+	if err != nil {
+		return 0, classify("document action", "DocActions.New", err)
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	docActionsChanged(otx)
+	return aid, nil
+}
+
+// create inserts a new document action in the given transaction.  It
+// leaves the cache alone; the caller should call `docActionsChanged`
+// as appropriate.
+func (_DocActions) create(ctx context.Context, tx *sql.Tx, name string, reconfirm bool) (DocActionID, error) {
+	if err := checkNameFree(ctx, tx, "wf_docactions_master", name); err != nil {
+		return 0, err
+	}
+
+	flag := 0
 	if reconfirm {
-		res, err = tx.Exec("INSERT INTO wf_docactions_master(name, reconfirm) VALUES(?, ?)", name, 1)
-	} else {
-		res, err = tx.Exec("INSERT INTO wf_docactions_master(name, reconfirm) VALUES(?, ?)", name, 0)
+		flag = 1
 	}
+	aid, err := dbDialect().InsertID(ctx, tx, "INSERT INTO wf_docactions_master(name, reconfirm) VALUES(?, ?)", name, flag)
 	if err != nil {
 		return 0, err
 	}
-	var aid int64
-	aid, err = res.LastInsertId()
+	return DocActionID(aid), nil
+}
+
+// NewBatch creates and registers several document actions in a single
+// statement, none of which requires reconfirmation.  It answers the
+// identifiers of the new actions, in the order of the given names.
+func (_DocActions) NewBatch(otx *sql.Tx, names []string) ([]DocActionID, error) {
+	return DocActions.NewBatchContext(context.Background(), otx, names)
+}
+
+// NewBatchContext is the context-aware variant of `NewBatch`.  A
+// transaction begun by this method, if any, is tied to the given
+// context too.
+func (_DocActions) NewBatchContext(ctx context.Context, otx *sql.Tx, names []string) (_ []DocActionID, err error) {
+	defer observeQuery("DocActions.NewBatch", time.Now(), &err)
+
+	if len(names) == 0 {
+		return nil, invalidArg("document action", "DocActions.NewBatch", "list of document actions cannot be empty")
+	}
+	// Names are compared case-insensitively; `keys` holds the
+	// normalised form of each name in `ns`.
+	ns := make([]string, 0, len(names))
+	keys := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, invalidArg("document action", "DocActions.NewBatch", "document action cannot be empty")
+		}
+		if err := checkName(name); err != nil {
+			return nil, classify("document action", "DocActions.NewBatch", err)
+		}
+		key := strings.ToLower(name)
+		if seen[key] {
+			return nil, flowError("document action", "DocActions.NewBatch", CodeInvalidArg, fmt.Errorf("duplicate document action : %s", name))
+		}
+		seen[key] = true
+		ns = append(ns, name)
+		keys = append(keys, key)
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, txRequiredErr("document action", "DocActions.NewBatch")
+		}
+		tx, err = db().BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, "DocActions.NewBatch"); err != nil {
+			return nil, err
+		}
+		tx = otx
+	}
+
+	args := make([]interface{}, 0, len(ns))
+	for _, name := range ns {
+		if err = checkNameFree(ctx, tx, "wf_docactions_master", name); err != nil {
+			return nil, classify("document action", "DocActions.NewBatch", err)
+		}
+		args = append(args, name)
+	}
+	ph := strings.TrimSuffix(strings.Repeat("?, ", len(ns)), ", ")
+
+	q := "INSERT INTO wf_docactions_master(name, reconfirm) VALUES" +
+		strings.TrimSuffix(strings.Repeat("(?, 0), ", len(ns)), ", ")
+	_, err = tx.ExecContext(ctx, dbDialect().Rebind(q), args...)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	// `LastInsertId` answers only the first identifier of a multi-row
+	// insert, so we read all of them back by name.
+	q = `
+	SELECT id, name
+	FROM wf_docactions_master
+	WHERE name IN (` + ph + `)
+	`
+	rows, err := tx.QueryContext(ctx, dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]DocActionID, len(ns))
+	for rows.Next() {
+		var id DocActionID
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+		ids[strings.ToLower(name)] = id
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ary := make([]DocActionID, 0, len(ns))
+	for i, name := range ns {
+		id, ok := ids[keys[i]]
+		if !ok {
+			return nil, conflict("document action", "DocActions.NewBatch", fmt.Errorf("document action not found after insertion : %s", name))
+		}
+		ary = append(ary, id)
 	}
 
 	if otx == nil {
 		err = tx.Commit()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
 
-	return DocActionID(aid), nil
+	docActionsChanged(otx)
+	return ary, nil
 }
 
-// List answers a subset of the document actions, based on the input
-// specification.
+// List answers a subset of the active document actions, based on the
+// input specification.  Archived actions are excluded; use `ListAll`
+// to include them.
 //
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
 func (_DocActions) List(offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListContext(context.Background(), offset, limit)
+}
+
+// ListContext is the context-aware variant of `List`.
+func (_DocActions) ListContext(ctx context.Context, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.listOrdered(ctx, nil, OrderByID, offset, limit)
+}
+
+// ListTx is a variant of `List` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocActions) ListTx(otx *sql.Tx, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListTxContext(context.Background(), otx, offset, limit)
+}
+
+// ListTxContext is the context-aware variant of `ListTx`.
+func (_DocActions) ListTxContext(ctx context.Context, otx *sql.Tx, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.listOrdered(ctx, otx, OrderByID, offset, limit)
+}
+
+// ListOrdered is a variant of `List` that answers the results in the
+// given order.
+func (_DocActions) ListOrdered(order OrderBy, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListOrderedContext(context.Background(), order, offset, limit)
+}
+
+// ListOrderedContext is the context-aware variant of `ListOrdered`.
+func (_DocActions) ListOrderedContext(ctx context.Context, order OrderBy, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.listOrdered(ctx, nil, order, offset, limit)
+}
+
+// listOrdered implements the listings of active document actions,
+// using the given transaction, if any.
+func (_DocActions) listOrdered(ctx context.Context, otx *sql.Tx, order OrderBy, offset, limit int64) (_ []*DocAction, err error) {
+	defer observeQuery("DocActions.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document action", "DocActions.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
 	}
+	ob, err := orderClause(order)
+	if err != nil {
+		return nil, flowError("document action", "DocActions.List", CodeInvalidArg, err)
+	}
 
 	q := `
 	SELECT id, name, reconfirm
 	FROM wf_docactions_master
+	WHERE active = 1
+	ORDER BY ` + ob + `
+	LIMIT ? OFFSET ?
+	`
+	rows, err := dbOrTx(otx).QueryContext(ctx, dbDialect().Rebind(q), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocAction, 0, 10)
+	for rows.Next() {
+		var elem DocAction
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ListAll answers a subset of all the document actions, including
+// archived ones, based on the input specification.  Pagination is as
+// in `List`.
+func (_DocActions) ListAll(offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListAllContext(context.Background(), offset, limit)
+}
+
+// ListAllContext is the context-aware variant of `ListAll`.
+func (_DocActions) ListAllContext(ctx context.Context, offset, limit int64) (_ []*DocAction, err error) {
+	defer observeQuery("DocActions.ListAll", time.Now(), &err)
+
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("document action", "DocActions.ListAll", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT id, name, reconfirm, active = 0
+	FROM wf_docactions_master
 	ORDER BY id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().QueryContext(ctx, dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +382,7 @@ func (_DocActions) List(offset, limit int64) ([]*DocAction, error) {
 	ary := make([]*DocAction, 0, 10)
 	for rows.Next() {
 		var elem DocAction
-		err = rows.Scan(&elem.ID, &elem.Name, &elem.Reconfirm)
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived)
 		if err != nil {
 			return nil, err
 		}
@@ -140,60 +395,441 @@ func (_DocActions) List(offset, limit int64) ([]*DocAction, error) {
 	return ary, nil
 }
 
+// ListByPrefix answers a subset of the active document actions whose
+// names begin with the given prefix.  Wildcard characters in the prefix are
+// matched literally.  An empty prefix matches all document actions.
+//
+// Result set is ordered by ID, and is paginated using `offset` and
+// `limit`, as in `List`.
+func (_DocActions) ListByPrefix(prefix string, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListByPrefixContext(context.Background(), prefix, offset, limit)
+}
+
+// ListByPrefixContext is the context-aware variant of `ListByPrefix`.
+func (_DocActions) ListByPrefixContext(ctx context.Context, prefix string, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListByPrefixTxContext(ctx, nil, prefix, offset, limit)
+}
+
+// ListByPrefixTx is a variant of `ListByPrefix` that reads using the
+// given transaction, if any, so that changes made but not yet
+// committed in it are visible.
+func (_DocActions) ListByPrefixTx(otx *sql.Tx, prefix string, offset, limit int64) ([]*DocAction, error) {
+	return DocActions.ListByPrefixTxContext(context.Background(), otx, prefix, offset, limit)
+}
+
+// ListByPrefixTxContext is the context-aware variant of
+// `ListByPrefixTx`.
+func (_DocActions) ListByPrefixTxContext(ctx context.Context, otx *sql.Tx, prefix string, offset, limit int64) (_ []*DocAction, err error) {
+	defer observeQuery("DocActions.ListByPrefix", time.Now(), &err)
+
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("document action", "DocActions.ListByPrefix", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT id, name, reconfirm
+	FROM wf_docactions_master
+	WHERE name LIKE ?` + likeEscapeClause + `
+	AND active = 1
+	ORDER BY id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := dbOrTx(otx).QueryContext(ctx, dbDialect().Rebind(q), likePrefix(prefix), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocAction, 0, 10)
+	for rows.Next() {
+		var elem DocAction
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// Count answers the number of active document actions in the system,
+// which agrees with `List`.  Use `CountAll` to include archived ones.
+func (_DocActions) Count() (int64, error) {
+	return DocActions.CountContext(context.Background())
+}
+
+// CountContext is the context-aware variant of `Count`.
+func (_DocActions) CountContext(ctx context.Context) (_ int64, err error) {
+	defer observeQuery("DocActions.Count", time.Now(), &err)
+
+	var n int64
+	row := db().QueryRowContext(ctx, dbDialect().Rebind("SELECT COUNT(*) FROM wf_docactions_master WHERE active = 1"))
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// CountAll answers the total number of document actions in the system,
+// including archived ones, which agrees with `ListAll`.
+func (_DocActions) CountAll() (int64, error) {
+	return DocActions.CountAllContext(context.Background())
+}
+
+// CountAllContext is the context-aware variant of `CountAll`.
+func (_DocActions) CountAllContext(ctx context.Context) (_ int64, err error) {
+	defer observeQuery("DocActions.CountAll", time.Now(), &err)
+
+	var n int64
+	row := db().QueryRowContext(ctx, dbDialect().Rebind("SELECT COUNT(*) FROM wf_docactions_master"))
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 // Get retrieves the document action for the given ID.
 func (_DocActions) Get(id DocActionID) (*DocAction, error) {
+	return DocActions.GetContext(context.Background(), id)
+}
+
+// GetContext is the context-aware variant of `Get`.
+func (_DocActions) GetContext(ctx context.Context, id DocActionID) (*DocAction, error) {
+	return DocActions.GetTxContext(ctx, nil, id)
+}
+
+// GetTx is a variant of `Get` that reads using the given transaction,
+// if any, so that changes made but not yet committed in it are
+// visible.
+func (_DocActions) GetTx(otx *sql.Tx, id DocActionID) (*DocAction, error) {
+	return DocActions.GetTxContext(context.Background(), otx, id)
+}
+
+// GetTxContext is the context-aware variant of `GetTx`.
+func (_DocActions) GetTxContext(ctx context.Context, otx *sql.Tx, id DocActionID) (_ *DocAction, err error) {
+	defer observeQuery("DocActions.Get", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("ID should be a positive integer")
+		return nil, invalidArg("document action", "DocActions.Get", "ID should be a positive integer")
+	}
+	if otx == nil {
+		if da, ok, err := cachedDocAction(ctx, id, ""); ok || err != nil {
+			return da, err
+		}
 	}
 
-	var elem DocAction
-	row := db.QueryRow("SELECT id, name, reconfirm FROM wf_docactions_master WHERE id = ?", id)
-	err := row.Scan(&elem.ID, &elem.Name, &elem.Reconfirm)
+	stmt, release, err := cachedStmt(ctx, "SELECT id, name, reconfirm, active = 0, ctime, mtime FROM wf_docactions_master WHERE id = ?")
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	if otx != nil {
+		stmt = otx.StmtContext(ctx, stmt)
+	}
+
+	var elem DocAction
+	row := stmt.QueryRowContext(ctx, id)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived, &elem.ctime, &elem.mtime)
+	if err != nil {
+		return nil, notFound(err, "document action", "DocActions.Get")
+	}
 
 	return &elem, nil
 }
 
+// GetMany answers the document actions with the given IDs, in a
+// single query, keyed by their IDs.  IDs that do not exist are absent
+// from the answer.  An empty list of IDs answers an empty map.
+func (_DocActions) GetMany(ids []DocActionID) (map[DocActionID]*DocAction, error) {
+	return DocActions.GetManyContext(context.Background(), ids)
+}
+
+// GetManyContext is the context-aware variant of `GetMany`.
+func (_DocActions) GetManyContext(ctx context.Context, ids []DocActionID) (_ map[DocActionID]*DocAction, err error) {
+	defer observeQuery("DocActions.GetMany", time.Now(), &err)
+
+	res := make(map[DocActionID]*DocAction, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, invalidArg("document action", "DocActions.GetMany", "all identifiers should be positive integers")
+		}
+		args = append(args, id)
+	}
+
+	q := `
+	SELECT id, name, reconfirm, active = 0, ctime, mtime
+	FROM wf_docactions_master
+	WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+	`
+	rows, err := db().QueryContext(ctx, dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var elem DocAction
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived, &elem.ctime, &elem.mtime)
+		if err != nil {
+			return nil, err
+		}
+		res[elem.ID] = &elem
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // GetByName answers the document action, if one such with the given
 // name is registered; `nil` and the error, otherwise.
 func (_DocActions) GetByName(name string) (*DocAction, error) {
+	return DocActions.GetByNameContext(context.Background(), name)
+}
+
+// GetByNameContext is the context-aware variant of `GetByName`.
+func (_DocActions) GetByNameContext(ctx context.Context, name string) (*DocAction, error) {
+	return DocActions.GetByNameTxContext(ctx, nil, name)
+}
+
+// GetByNameTx is a variant of `GetByName` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocActions) GetByNameTx(otx *sql.Tx, name string) (*DocAction, error) {
+	return DocActions.GetByNameTxContext(context.Background(), otx, name)
+}
+
+// GetByNameTxContext is the context-aware variant of `GetByNameTx`.
+func (_DocActions) GetByNameTxContext(ctx context.Context, otx *sql.Tx, name string) (_ *DocAction, err error) {
+	defer observeQuery("DocActions.GetByName", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return nil, errors.New("document action cannot be empty")
+		return nil, invalidArg("document action", "DocActions.GetByName", "document action cannot be empty")
+	}
+	if otx == nil {
+		if da, ok, err := cachedDocAction(ctx, 0, name); ok || err != nil {
+			return da, err
+		}
 	}
 
 	var elem DocAction
-	row := db.QueryRow("SELECT id, name, reconfirm FROM wf_docactions_master WHERE name = ?", name)
-	err := row.Scan(&elem.ID, &elem.Name, &elem.Reconfirm)
+	row := dbOrTx(otx).QueryRowContext(ctx, dbDialect().Rebind("SELECT id, name, reconfirm, active = 0, ctime, mtime FROM wf_docactions_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived, &elem.ctime, &elem.mtime)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "document action", "DocActions.GetByName")
 	}
 
 	return &elem, nil
 }
 
+// Exists answers the ID of the document action with the given name,
+// and `true`, if one such is registered.  It answers `false` and a
+// `nil` error if there is no such action; any other error is answered
+// as is.
+func (_DocActions) Exists(name string) (DocActionID, bool, error) {
+	return DocActions.ExistsContext(context.Background(), name)
+}
+
+// ExistsContext is the context-aware variant of `Exists`.
+func (_DocActions) ExistsContext(ctx context.Context, name string) (DocActionID, bool, error) {
+	return DocActions.ExistsTxContext(ctx, nil, name)
+}
+
+// ExistsTx is a variant of `Exists` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocActions) ExistsTx(otx *sql.Tx, name string) (DocActionID, bool, error) {
+	return DocActions.ExistsTxContext(context.Background(), otx, name)
+}
+
+// ExistsTxContext is the context-aware variant of `ExistsTx`.
+func (_DocActions) ExistsTxContext(ctx context.Context, otx *sql.Tx, name string) (_ DocActionID, _ bool, err error) {
+	defer observeQuery("DocActions.Exists", time.Now(), &err)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, false, invalidArg("document action", "DocActions.Exists", "document action cannot be empty")
+	}
+	if otx == nil {
+		if da, ok, err := cachedDocAction(ctx, 0, name); ok || err != nil {
+			if err != nil {
+				return 0, false, err
+			}
+			return da.ID, true, nil
+		}
+	}
+
+	stmt, release, err := cachedStmt(ctx, "SELECT id FROM wf_docactions_master WHERE name = ?")
+	if err != nil {
+		return 0, false, err
+	}
+	defer release()
+
+	if otx != nil {
+		stmt = otx.StmtContext(ctx, stmt)
+	}
+
+	var id DocActionID
+	row := stmt.QueryRowContext(ctx, name)
+	err = row.Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+
+	case err != nil:
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+// Ensure answers the document action with the given name, creating it if it is
+// not registered yet.  The boolean result is `true` only when the
+// document action was created by this call.
+//
+// N.B. `reconfirm` is used only when creating the document action;
+// an existing action is answered as is.
+func (_DocActions) Ensure(otx *sql.Tx, name string, reconfirm bool) (*DocAction, bool, error) {
+	return DocActions.EnsureContext(context.Background(), otx, name, reconfirm)
+}
+
+// EnsureContext is the context-aware variant of `Ensure`.  A transaction
+// begun by this method, if any, is tied to the given context too.
+func (_DocActions) EnsureContext(ctx context.Context, otx *sql.Tx, name string, reconfirm bool) (_ *DocAction, _ bool, err error) {
+	defer observeQuery("DocActions.Ensure", time.Now(), &err)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, false, invalidArg("document action", "DocActions.Ensure", "document action cannot be empty")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, false, txRequiredErr("document action", "DocActions.Ensure")
+		}
+		tx, err = db().BeginTx(ctx, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, "DocActions.Ensure"); err != nil {
+			return nil, false, err
+		}
+		tx = otx
+	}
+
+	elem, created, err := DocActions.ensure(ctx, tx, name, reconfirm)
+	if err != nil || !created {
+		return elem, false, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	docActionsChanged(otx)
+	return elem, true, nil
+}
+
+// ensure answers the document action with the given name, creating it
+// in the given transaction if it is not registered yet.  Like `create`,
+// it leaves the cache alone.
+func (_DocActions) ensure(ctx context.Context, tx *sql.Tx, name string, reconfirm bool) (*DocAction, bool, error) {
+	var elem DocAction
+	row := tx.QueryRowContext(ctx, dbDialect().Rebind("SELECT id, name, reconfirm, active = 0, ctime, mtime FROM wf_docactions_master WHERE name = ?"), name)
+	err := row.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived, &elem.ctime, &elem.mtime)
+	switch {
+	case err == nil:
+		return &elem, false, nil
+
+	case err != sql.ErrNoRows:
+		return nil, false, err
+	}
+
+	if err = checkName(name); err != nil {
+		return nil, false, classify("document action", "DocActions.Ensure", err)
+	}
+	id, err := DocActions.create(ctx, tx, name, reconfirm)
+	if err != nil {
+		return nil, false, classify("document action", "DocActions.Ensure", err)
+	}
+
+	// Read the new row back, for its database-assigned times.
+	row = tx.QueryRowContext(ctx, dbDialect().Rebind("SELECT id, name, reconfirm, active = 0, ctime, mtime FROM wf_docactions_master WHERE id = ?"), id)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm, &elem.Archived, &elem.ctime, &elem.mtime)
+	if err != nil {
+		return nil, false, err
+	}
+	return &elem, true, nil
+}
+
 // Rename renames the given document action.
 func (_DocActions) Rename(otx *sql.Tx, id DocActionID, name string) error {
+	return DocActions.RenameContext(context.Background(), otx, id, name)
+}
+
+// RenameContext is the context-aware variant of `Rename`.  A transaction
+// begun by this method, if any, is tied to the given context too.
+func (_DocActions) RenameContext(ctx context.Context, otx *sql.Tx, id DocActionID, name string) (err error) {
+	defer observeQuery("DocActions.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name cannot be empty")
+		return invalidArg("document action", "DocActions.Rename", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("document action", "DocActions.Rename", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document action", "DocActions.Rename")
+		}
+		tx, err = db().BeginTx(ctx, nil)
 		if err != nil {
 			return err
 		}
 		defer tx.Rollback()
 	} else {
+		if err = checkDocActionTx(otx, "DocActions.Rename"); err != nil {
+			return err
+		}
 		tx = otx
 	}
 
-	_, err = tx.Exec("UPDATE wf_docactions_master SET name = ? WHERE id = ?", name, id)
+	if err = checkNameFreeExcept(ctx, tx, "wf_docactions_master", name, "id", id); err != nil {
+		return classify("document action", "DocActions.Rename", err)
+	}
+
+	res, err := tx.ExecContext(ctx, dbDialect().Rebind("UPDATE wf_docactions_master SET name = ?, mtime = CURRENT_TIMESTAMP WHERE id = ?"), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(ctx, tx, res, "wf_docactions_master", "id", id, "document action", "DocActions.Rename")
 	if err != nil {
 		return err
 	}
@@ -205,5 +841,320 @@ func (_DocActions) Rename(otx *sql.Tx, id DocActionID, name string) error {
 		}
 	}
 
+	docActionsChanged(otx)
+	return nil
+}
+
+// RenameMany renames several document actions together, as given by
+// the map from their IDs to their new names.  All new names are
+// validated -- including for uniqueness within the batch, ignoring
+// case -- before any of them is applied.  All the updates happen in
+// the given or a self-managed transaction; hence, a single failure
+// leaves all the actions unchanged.
+//
+// N.B. Swapping names between actions in one batch is not supported,
+// since each update is subject to the uniqueness of names.
+func (_DocActions) RenameMany(otx *sql.Tx, changes map[DocActionID]string) error {
+	return DocActions.RenameManyContext(context.Background(), otx, changes)
+}
+
+// RenameManyContext is the context-aware variant of `RenameMany`.  A
+// transaction begun by this method, if any, is tied to the given
+// context too.
+func (_DocActions) RenameManyContext(ctx context.Context, otx *sql.Tx, changes map[DocActionID]string) (err error) {
+	defer observeQuery("DocActions.RenameMany", time.Now(), &err)
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	ids := make([]DocActionID, 0, len(changes))
+	names := make(map[DocActionID]string, len(changes))
+	seen := make(map[string]bool, len(changes))
+	for id, name := range changes {
+		if id <= 0 {
+			return invalidArg("document action", "DocActions.RenameMany", "all identifiers should be positive integers")
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return invalidArg("document action", "DocActions.RenameMany", "names cannot be empty")
+		}
+		if err := checkName(name); err != nil {
+			return classify("document action", "DocActions.RenameMany", err)
+		}
+		lname := strings.ToLower(name)
+		if seen[lname] {
+			return invalidArg("document action", "DocActions.RenameMany", "duplicate name in batch : "+name)
+		}
+		seen[lname] = true
+		ids = append(ids, id)
+		names[id] = name
+	}
+	// A fixed order keeps concurrent batches from deadlocking.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document action", "DocActions.RenameMany")
+		}
+		tx, err = db().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, "DocActions.RenameMany"); err != nil {
+			return err
+		}
+		tx = otx
+	}
+
+	q := dbDialect().Rebind("UPDATE wf_docactions_master SET name = ?, mtime = CURRENT_TIMESTAMP WHERE id = ?")
+	for _, id := range ids {
+		if err = checkNameFreeExcept(ctx, tx, "wf_docactions_master", names[id], "id", id); err != nil {
+			return classify("document action", "DocActions.RenameMany", err)
+		}
+		res, err := tx.ExecContext(ctx, q, names[id], id)
+		if err != nil {
+			return err
+		}
+		err = checkAffected(ctx, tx, res, "wf_docactions_master", "id", id, "document action", "DocActions.RenameMany")
+		if err != nil {
+			return err
+		}
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	docActionsChanged(otx)
+	return nil
+}
+
+// RenameByName renames the document action with the given old name,
+// without the need to look it up first.  An error wrapping
+// `ErrNotFound` is answered if no action has the old name.
+func (_DocActions) RenameByName(otx *sql.Tx, oldName, newName string) error {
+	return DocActions.RenameByNameContext(context.Background(), otx, oldName, newName)
+}
+
+// RenameByNameContext is the context-aware variant of `RenameByName`.
+// A transaction begun by this method, if any, is tied to the given
+// context too.
+func (_DocActions) RenameByNameContext(ctx context.Context, otx *sql.Tx, oldName, newName string) (err error) {
+	defer observeQuery("DocActions.RenameByName", time.Now(), &err)
+
+	oldName = strings.TrimSpace(oldName)
+	newName = strings.TrimSpace(newName)
+	if oldName == "" || newName == "" {
+		return invalidArg("document action", "DocActions.RenameByName", "names cannot be empty")
+	}
+	if err := checkName(newName); err != nil {
+		return classify("document action", "DocActions.RenameByName", err)
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document action", "DocActions.RenameByName")
+		}
+		tx, err = db().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, "DocActions.RenameByName"); err != nil {
+			return err
+		}
+		tx = otx
+	}
+
+	if err = checkNameFreeExcept(ctx, tx, "wf_docactions_master", newName, "name", oldName); err != nil {
+		return classify("document action", "DocActions.RenameByName", err)
+	}
+
+	res, err := tx.ExecContext(ctx, dbDialect().Rebind("UPDATE wf_docactions_master SET name = ?, mtime = CURRENT_TIMESTAMP WHERE name = ?"), newName, oldName)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(ctx, tx, res, "wf_docactions_master", "name", oldName, "document action", "DocActions.RenameByName")
+	if err != nil {
+		return err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	docActionsChanged(otx)
+	return nil
+}
+
+// Archive retires the given document action.  An archived action is
+// excluded from `List` and `ListByPrefix`, but continues to be
+// available through `Get`, so that historical documents and events
+// that refer to it remain intact.
+func (_DocActions) Archive(otx *sql.Tx, id DocActionID) error {
+	return DocActions.setActive(context.Background(), otx, id, false)
+}
+
+// ArchiveContext is the context-aware variant of `Archive`.  A
+// transaction begun by this method, if any, is tied to the given
+// context too.
+func (_DocActions) ArchiveContext(ctx context.Context, otx *sql.Tx, id DocActionID) error {
+	return DocActions.setActive(ctx, otx, id, false)
+}
+
+// Unarchive restores the given archived document action for use.
+func (_DocActions) Unarchive(otx *sql.Tx, id DocActionID) error {
+	return DocActions.setActive(context.Background(), otx, id, true)
+}
+
+// UnarchiveContext is the context-aware variant of `Unarchive`.  A
+// transaction begun by this method, if any, is tied to the given
+// context too.
+func (_DocActions) UnarchiveContext(ctx context.Context, otx *sql.Tx, id DocActionID) error {
+	return DocActions.setActive(ctx, otx, id, true)
+}
+
+// setActive updates the active flag of the given document action.
+func (_DocActions) setActive(ctx context.Context, otx *sql.Tx, id DocActionID, active bool) (err error) {
+	op := "DocActions.Archive"
+	if active {
+		op = "DocActions.Unarchive"
+	}
+	defer observeQuery(op, time.Now(), &err)
+
+	if id <= 0 {
+		return invalidArg("document action", op, "ID should be a positive integer")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document action", op)
+		}
+		tx, err = db().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, op); err != nil {
+			return err
+		}
+		tx = otx
+	}
+
+	flag := 0
+	if active {
+		flag = 1
+	}
+	res, err := tx.ExecContext(ctx, dbDialect().Rebind("UPDATE wf_docactions_master SET active = ?, mtime = CURRENT_TIMESTAMP WHERE id = ?"), flag, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(ctx, tx, res, "wf_docactions_master", "id", id, "document action", op)
+	if err != nil {
+		return err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	docActionsChanged(otx)
+	return nil
+}
+
+// Delete removes the given document action from the system.
+//
+// A document action that is referenced by transitions, role
+// permissions or document events cannot be deleted; a descriptive
+// error is answered in such a case.
+func (_DocActions) Delete(otx *sql.Tx, id DocActionID) error {
+	return DocActions.DeleteContext(context.Background(), otx, id)
+}
+
+// DeleteContext is the context-aware variant of `Delete`.  A
+// transaction begun by this method, if any, is tied to the given
+// context too.
+func (_DocActions) DeleteContext(ctx context.Context, otx *sql.Tx, id DocActionID) (err error) {
+	defer observeQuery("DocActions.Delete", time.Now(), &err)
+
+	if id <= 0 {
+		return invalidArg("document action", "DocActions.Delete", "ID should be a positive integer")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document action", "DocActions.Delete")
+		}
+		tx, err = db().BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, "DocActions.Delete"); err != nil {
+			return err
+		}
+		tx = otx
+	}
+
+	for _, ref := range []struct {
+		table, what string
+	}{
+		{"wf_docstate_transitions", "transitions"},
+		{"wf_role_docactions", "role permissions"},
+		{"wf_docevents", "document events"},
+	} {
+		var n int64
+		row := tx.QueryRowContext(ctx, dbDialect().Rebind(`SELECT COUNT(*) FROM `+ref.table+` WHERE docaction_id = ?`), id)
+		err = row.Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return conflict("document action", "DocActions.Delete", fmt.Errorf("document action is in use by %d %s", n, ref.what))
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, dbDialect().Rebind("DELETE FROM wf_docactions_master WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound("document action", "DocActions.Delete")
+	}
+	if n != 1 {
+		return fmt.Errorf("expected number of affected rows : 1; actual affected : %d", n)
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	docActionsChanged(otx)
 	return nil
 }
@@ -15,8 +15,8 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"math"
 	"strings"
@@ -56,15 +56,23 @@ type DocEvent struct {
 	Text    string      `json:"Text"`      // Comment or other content
 	Ctime   time.Time   `json:"Ctime"`     // Time at which the event occurred
 	Status  EventStatus `json:"Status"`    // Status of this event
+
+	ActionName string `json:"DocActionName,omitempty"` // Name of the action; populated only by display-oriented listings
+	StateName  string `json:"DocStateName,omitempty"`  // Name of the state; populated only by display-oriented listings
+	GroupName  string `json:"GroupName,omitempty"`     // Name of the group; populated only by display-oriented listings
+
+	ToState DocStateID `json:"ToState,omitempty"` // State into which the document moved; populated only by `ListByDocument`, for applied events
 }
 
 // StatusInDB answers the status of this event.
-func (e *DocEvent) StatusInDB() (EventStatus, error) {
+func (e *DocEvent) StatusInDB() (_ EventStatus, err error) {
+	defer observeQuery("DocEvent.StatusInDB", time.Now(), &err)
+
 	var dstatus string
-	row := db.QueryRow("SELECT status FROM wf_docevents WHERE id = ?", e.ID)
-	err := row.Scan(&dstatus)
+	row := db().QueryRow(dbDialect().Rebind("SELECT status FROM wf_docevents WHERE id = ?"), e.ID)
+	err = row.Scan(&dstatus)
 	if err != nil {
-		return 0, err
+		return 0, notFound(err, "document event", "DocEvent.StatusInDB")
 	}
 	switch dstatus {
 	case "A":
@@ -99,18 +107,22 @@ type DocEventsNewInput struct {
 
 // New creates and initialises an event that transforms the document
 // that it refers to.
-func (_DocEvents) New(otx *sql.Tx, input *DocEventsNewInput) (DocEventID, error) {
+func (_DocEvents) New(otx *sql.Tx, input *DocEventsNewInput) (_ DocEventID, err error) {
+	defer observeQuery("DocEvents.New", time.Now(), &err)
+
 	if input.DocTypeID <= 0 || input.DocumentID <= 0 || input.DocStateID <= 0 || input.DocActionID <= 0 || input.GroupID <= 0 {
-		return 0, errors.New("all identifiers should be positive integers")
+		return 0, invalidArg("document event", "DocEvents.New", "all identifiers should be positive integers")
 	}
 	if input.Text == "" {
-		return 0, errors.New("please add comments or notes")
+		return 0, invalidArg("document event", "DocEvents.New", "please add comments or notes")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("document event", "DocEvents.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -138,14 +150,9 @@ func (_DocEvents) New(otx *sql.Tx, input *DocEventsNewInput) (DocEventID, error)
 
 	q := `
 	INSERT INTO wf_docevents(doctype_id, doc_id, docstate_id, docaction_id, group_id, data, ctime, status)
-	VALUES(?, ?, ?, ?, ?, ?, NOW(), 'P')
+	VALUES(?, ?, ?, ?, ?, ?, ` + dbDialect().Now() + `, 'P')
 	`
-	res, err := tx.Exec(q, input.DocTypeID, input.DocumentID, input.DocStateID, input.DocActionID, input.GroupID, input.Text)
-	if err != nil {
-		return 0, err
-	}
-	var id int64
-	id, err = res.LastInsertId()
+	id, err := dbDialect().InsertID(context.Background(), tx, q, input.DocTypeID, input.DocumentID, input.DocStateID, input.DocActionID, input.GroupID, input.Text)
 	if err != nil {
 		return 0, err
 	}
@@ -180,9 +187,11 @@ type DocEventsListInput struct {
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_DocEvents) List(input *DocEventsListInput, offset, limit int64) ([]*DocEvent, error) {
+func (_DocEvents) List(input *DocEventsListInput, offset, limit int64) (_ []*DocEvent, err error) {
+	defer observeQuery("DocEvents.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document event", "DocEvents.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -256,7 +265,7 @@ func (_DocEvents) List(input *DocEventsListInput, offset, limit int64) ([]*DocEv
 	LIMIT ? OFFSET ?
 	`
 	args = append(args, limit, offset)
-	rows, err := db.Query(q, args...)
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -303,7 +312,9 @@ type DocEventsHistory struct {
 }
 
 // DocEventsHistory answers the possible document wf_docevent_application.
-func (_DocEvents) DocEventsHistory(dtype DocTypeID, id DocumentID) ([]*DocEventsHistory, error) {
+func (_DocEvents) DocEventsHistory(dtype DocTypeID, id DocumentID) (_ []*DocEventsHistory, err error) {
+	defer observeQuery("DocEvents.DocEventsHistory", time.Now(), &err)
+
 	q := `
 	SELECT dsm1.name, dam.name, dsm2.name, gm.name, de.data, de.ctime
 	FROM wf_docevent_application dea
@@ -314,7 +325,7 @@ func (_DocEvents) DocEventsHistory(dtype DocTypeID, id DocumentID) ([]*DocEvents
 	JOIN wf_groups_master gm ON gm.id = de.group_id
 	WHERE dea.doctype_id = ? AND dea.doc_id = ? ORDER BY de.ctime DESC
 	`
-	rows, err := db.Query(q, dtype, id)
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, id)
 	if err != nil {
 		return nil, err
 	}
@@ -336,11 +347,77 @@ func (_DocEvents) DocEventsHistory(dtype DocTypeID, id DocumentID) ([]*DocEvents
 	return ary, nil
 }
 
+// ListByDocument answers all the events raised on the given document,
+// in chronological order.  Each event carries the names of its
+// action, source state and group; applied events carry their target
+// state as well.
+func (_DocEvents) ListByDocument(dtype DocTypeID, id DocumentID) (_ []*DocEvent, err error) {
+	defer observeQuery("DocEvents.ListByDocument", time.Now(), &err)
+
+	if dtype <= 0 || id <= 0 {
+		return nil, invalidArg("document event", "DocEvents.ListByDocument", "all identifiers should be positive integers")
+	}
+
+	q := `
+	SELECT de.id, de.doctype_id, de.doc_id, de.docstate_id, dsm.name, de.docaction_id, dam.name, de.group_id, gm.name, de.data, de.ctime, de.status, dea.to_state_id
+	FROM wf_docevents de
+	JOIN wf_docstates_master dsm ON dsm.id = de.docstate_id
+	JOIN wf_docactions_master dam ON dam.id = de.docaction_id
+	JOIN wf_groups_master gm ON gm.id = de.group_id
+	LEFT JOIN wf_docevent_application dea ON dea.docevent_id = de.id
+	WHERE de.doctype_id = ?
+	AND de.doc_id = ?
+	ORDER BY de.ctime, de.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocEvent, 0, 10)
+	for rows.Next() {
+		var elem DocEvent
+		var text sql.NullString
+		var dstatus string
+		var to sql.NullInt64
+		err = rows.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.StateName, &elem.Action, &elem.ActionName,
+			&elem.Group, &elem.GroupName, &text, &elem.Ctime, &dstatus, &to)
+		if err != nil {
+			return nil, err
+		}
+		if text.Valid {
+			elem.Text = text.String
+		}
+		if to.Valid {
+			elem.ToState = DocStateID(to.Int64)
+		}
+		switch dstatus {
+		case "A":
+			elem.Status = EventStatusApplied
+
+		case "P":
+			elem.Status = EventStatusPending
+
+		default:
+			return nil, fmt.Errorf("unknown event status : %s", dstatus)
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
 // Get retrieves a document event from the database, using the given
 // event ID.
-func (_DocEvents) Get(eid DocEventID) (*DocEvent, error) {
+func (_DocEvents) Get(eid DocEventID) (_ *DocEvent, err error) {
+	defer observeQuery("DocEvents.Get", time.Now(), &err)
+
 	if eid <= 0 {
-		return nil, errors.New("event ID should be a positive integer")
+		return nil, invalidArg("document event", "DocEvents.Get", "event ID should be a positive integer")
 	}
 
 	var text sql.NullString
@@ -351,9 +428,57 @@ func (_DocEvents) Get(eid DocEventID) (*DocEvent, error) {
 	FROM wf_docevents
 	WHERE id = ?
 	`
-	row := db.QueryRow(q, eid)
-	err := row.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.Action, &elem.Group, &text, &elem.Ctime, &dstatus)
+	row := db().QueryRow(dbDialect().Rebind(q), eid)
+	err = row.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.Action, &elem.Group, &text, &elem.Ctime, &dstatus)
+	if err != nil {
+		return nil, notFound(err, "document event", "DocEvents.Get")
+	}
+	if text.Valid {
+		elem.Text = text.String
+	}
+	switch dstatus {
+	case "A":
+		elem.Status = EventStatusApplied
+
+	case "P":
+		elem.Status = EventStatusPending
+
+	default:
+		return nil, fmt.Errorf("unknown event status : %s", dstatus)
+	}
+
+	return &elem, nil
+}
+
+// Last answers the most recent event of the given document, with the
+// names of its state and action filled in.  It answers an error
+// wrapping `ErrNotFound` if the document has no events.
+func (_DocEvents) Last(dtype DocTypeID, id DocumentID) (_ *DocEvent, err error) {
+	defer observeQuery("DocEvents.Last", time.Now(), &err)
+
+	if dtype <= 0 || id <= 0 {
+		return nil, invalidArg("document event", "DocEvents.Last", "all identifiers should be positive integers")
+	}
+
+	var text sql.NullString
+	var dstatus string
+	var elem DocEvent
+	q := `
+	SELECT de.id, de.doctype_id, de.doc_id, de.docstate_id, dsm.name, de.docaction_id, dam.name, de.group_id, de.data, de.ctime, de.status
+	FROM wf_docevents de
+	JOIN wf_docstates_master dsm ON dsm.id = de.docstate_id
+	JOIN wf_docactions_master dam ON dam.id = de.docaction_id
+	WHERE de.doctype_id = ?
+	AND de.doc_id = ?
+	ORDER BY de.ctime DESC, de.id DESC
+	LIMIT 1
+	`
+	row := db().QueryRow(dbDialect().Rebind(q), dtype, id)
+	err = row.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.StateName, &elem.Action, &elem.ActionName, &elem.Group, &text, &elem.Ctime, &dstatus)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errNotFound("document event", "DocEvents.Last")
+		}
 		return nil, err
 	}
 	if text.Valid {
@@ -372,3 +497,246 @@ func (_DocEvents) Get(eid DocEventID) (*DocEvent, error) {
 
 	return &elem, nil
 }
+
+// RecentByActor answers the most recent events raised by the given
+// user, across all documents, newest first.  The name of each event's
+// action is filled in, for display in activity feeds.
+//
+// Events are attributed to the singleton group of the user.  A value
+// of `0` for `limit` fetches all such events.
+func (_DocEvents) RecentByActor(uid UserID, limit int64) (_ []*DocEvent, err error) {
+	defer observeQuery("DocEvents.RecentByActor", time.Now(), &err)
+
+	if uid <= 0 {
+		return nil, invalidArg("document event", "DocEvents.RecentByActor", "user ID should be a positive integer")
+	}
+	if limit < 0 {
+		return nil, invalidArg("document event", "DocEvents.RecentByActor", "limit must be a non-negative integer")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT de.id, de.doctype_id, de.doc_id, de.docstate_id, de.docaction_id, dam.name, de.group_id, de.data, de.ctime, de.status
+	FROM wf_docevents de
+	JOIN wf_docactions_master dam ON dam.id = de.docaction_id
+	JOIN wf_groups_master gm ON gm.id = de.group_id
+	JOIN wf_group_users gu ON gu.group_id = gm.id
+	WHERE gu.user_id = ?
+	AND gm.group_type = 'S'
+	ORDER BY de.ctime DESC, de.id DESC
+	LIMIT ?
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), uid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var text sql.NullString
+	var dstatus string
+	ary := make([]*DocEvent, 0, 10)
+	for rows.Next() {
+		var elem DocEvent
+		err = rows.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.Action, &elem.ActionName, &elem.Group, &text, &elem.Ctime, &dstatus)
+		if err != nil {
+			return nil, err
+		}
+		if text.Valid {
+			elem.Text = text.String
+		}
+		switch dstatus {
+		case "A":
+			elem.Status = EventStatusApplied
+
+		case "P":
+			elem.Status = EventStatusPending
+
+		default:
+			return nil, fmt.Errorf("unknown event status : %s", dstatus)
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ByActorPaged answers a page of the events caused by the given user,
+// within the given time window, most recent first.  The total number
+// of such events is answered as well.
+//
+// A zero value for `from` or `to` leaves that end of the window open.
+// Result set is paginated using `offset` and `limit` as usual.  The
+// page and the total are read in the same transaction, so that they
+// are consistent with each other.
+func (_DocEvents) ByActorPaged(uid UserID, from, to time.Time, offset, limit int64) (_ []*DocEvent, _ int64, err error) {
+	defer observeQuery("DocEvents.ByActorPaged", time.Now(), &err)
+
+	if uid <= 0 {
+		return nil, 0, invalidArg("document event", "DocEvents.ByActorPaged", "user ID should be a positive integer")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, 0, invalidArg("document event", "DocEvents.ByActorPaged", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	where := `
+	WHERE gu.user_id = ?
+	AND gm.group_type = 'S'
+	`
+	args := []interface{}{uid}
+	if !from.IsZero() {
+		where += "AND de.ctime >= ?\n"
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where += "AND de.ctime < ?\n"
+		args = append(args, to)
+	}
+
+	tx, err := db().Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	q := `
+	SELECT COUNT(*)
+	FROM wf_docevents de
+	JOIN wf_groups_master gm ON gm.id = de.group_id
+	JOIN wf_group_users gu ON gu.group_id = gm.id
+	` + where
+	row := tx.QueryRow(dbDialect().Rebind(q), args...)
+	err = row.Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	q = `
+	SELECT de.id, de.doctype_id, de.doc_id, de.docstate_id, dsm.name, de.docaction_id, dam.name, de.group_id, de.data, de.ctime, de.status
+	FROM wf_docevents de
+	JOIN wf_docstates_master dsm ON dsm.id = de.docstate_id
+	JOIN wf_docactions_master dam ON dam.id = de.docaction_id
+	JOIN wf_groups_master gm ON gm.id = de.group_id
+	JOIN wf_group_users gu ON gu.group_id = gm.id
+	` + where + `
+	ORDER BY de.ctime DESC, de.id DESC
+	LIMIT ? OFFSET ?
+	`
+	args = append(args, limit, offset)
+	rows, err := tx.Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var text sql.NullString
+	var dstatus string
+	ary := make([]*DocEvent, 0, 10)
+	for rows.Next() {
+		var elem DocEvent
+		err = rows.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.StateName, &elem.Action, &elem.ActionName, &elem.Group, &text, &elem.Ctime, &dstatus)
+		if err != nil {
+			return nil, 0, err
+		}
+		if text.Valid {
+			elem.Text = text.String
+		}
+		switch dstatus {
+		case "A":
+			elem.Status = EventStatusApplied
+
+		case "P":
+			elem.Status = EventStatusPending
+
+		default:
+			return nil, 0, fmt.Errorf("unknown event status : %s", dstatus)
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return ary, total, nil
+}
+
+// ByCorrelation answers the events of all the documents that share the
+// given correlation identifier, across document types, in the order
+// in which they occurred.  This helps in presenting a combined
+// timeline of related documents.
+func (_DocEvents) ByCorrelation(cid string) (_ []*DocEvent, err error) {
+	defer observeQuery("DocEvents.ByCorrelation", time.Now(), &err)
+
+	cid = strings.TrimSpace(cid)
+	if cid == "" {
+		return nil, invalidArg("document event", "DocEvents.ByCorrelation", "correlation ID should be non-empty")
+	}
+
+	dts, err := DocTypes.List(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(dts) == 0 {
+		return []*DocEvent{}, nil
+	}
+
+	// Documents are stored in type-specific tables.
+	parts := make([]string, 0, len(dts))
+	args := make([]interface{}, 0, len(dts))
+	for _, dt := range dts {
+		parts = append(parts, fmt.Sprintf(`SELECT %d AS doctype_id, id FROM %s WHERE correlation_id = ?`, dt.ID, DocTypes.docStorName(dt.ID)))
+		args = append(args, cid)
+	}
+
+	q := `
+	SELECT de.id, de.doctype_id, de.doc_id, de.docstate_id, de.docaction_id, de.group_id, de.data, de.ctime, de.status
+	FROM wf_docevents de
+	JOIN (` + strings.Join(parts, `
+	UNION ALL
+	`) + `) docs ON docs.doctype_id = de.doctype_id AND docs.id = de.doc_id
+	ORDER BY de.ctime, de.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var text sql.NullString
+	var dstatus string
+	ary := make([]*DocEvent, 0, 10)
+	for rows.Next() {
+		var elem DocEvent
+		err = rows.Scan(&elem.ID, &elem.DocType, &elem.DocID, &elem.State, &elem.Action, &elem.Group, &text, &elem.Ctime, &dstatus)
+		if err != nil {
+			return nil, err
+		}
+		if text.Valid {
+			elem.Text = text.String
+		}
+		switch dstatus {
+		case "A":
+			elem.Status = EventStatusApplied
+
+		case "P":
+			elem.Status = EventStatusPending
+
+		default:
+			return nil, fmt.Errorf("unknown event status : %s", dstatus)
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
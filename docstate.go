@@ -15,10 +15,12 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // DocStateID is the type of unique identifiers of document states.
@@ -39,6 +41,23 @@ type DocStateID int64
 type DocState struct {
 	ID   DocStateID `json:"ID"`             // Unique identifier of this document state
 	Name string     `json:"Name,omitempty"` // Unique identifier of this state in its workflow
+
+	ctime time.Time // Time of creation
+	mtime time.Time // Time of last modification
+}
+
+// CreatedAt answers the time at which this document state was
+// created.  It is available only on states read using `Get`,
+// `GetByName` or `Ensure`.
+func (ds *DocState) CreatedAt() time.Time {
+	return ds.ctime
+}
+
+// UpdatedAt answers the time at which this document state was last
+// renamed; it is the time of creation otherwise.  It is available only
+// on states read using `Get`, `GetByName` or `Ensure`.
+func (ds *DocState) UpdatedAt() time.Time {
+	return ds.mtime
 }
 
 // Unexported type, only for convenience methods.
@@ -50,16 +69,23 @@ var DocStates _DocStates
 
 // New creates an enumerated state as defined by the consuming
 // application.
-func (_DocStates) New(otx *sql.Tx, name string) (DocStateID, error) {
+func (_DocStates) New(otx *sql.Tx, name string) (_ DocStateID, err error) {
+	defer observeQuery("DocStates.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("name cannot be empty")
+		return 0, invalidArg("document state", "DocStates.New", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("document state", "DocStates.New", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("document state", "DocStates.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -68,12 +94,11 @@ func (_DocStates) New(otx *sql.Tx, name string) (DocStateID, error) {
 		tx = otx
 	}
 
-	res, err := tx.Exec("INSERT INTO wf_docstates_master(name) VALUES(?)", name)
-	if err != nil {
-		return 0, err
+	if err = checkNameFree(context.Background(), tx, "wf_docstates_master", name); err != nil {
+		return 0, classify("document state", "DocStates.New", err)
 	}
-	var id int64
-	id, err = res.LastInsertId()
+
+	id, err := dbDialect().InsertID(context.Background(), tx, "INSERT INTO wf_docstates_master(name) VALUES(?)", name)
 	if err != nil {
 		return 0, err
 	}
@@ -95,20 +120,101 @@ func (_DocStates) New(otx *sql.Tx, name string) (DocStateID, error) {
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
 func (_DocStates) List(offset, limit int64) ([]*DocState, error) {
+	return DocStates.listOrdered(nil, OrderByID, offset, limit)
+}
+
+// ListOrdered is a variant of `List` that answers the results in the
+// given order.
+func (_DocStates) ListOrdered(order OrderBy, offset, limit int64) ([]*DocState, error) {
+	return DocStates.listOrdered(nil, order, offset, limit)
+}
+
+// ListTx is a variant of `List` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocStates) ListTx(otx *sql.Tx, offset, limit int64) ([]*DocState, error) {
+	return DocStates.listOrdered(otx, OrderByID, offset, limit)
+}
+
+// listOrdered implements the listings of document states, using the given
+// transaction, if any.
+func (_DocStates) listOrdered(otx *sql.Tx, order OrderBy, offset, limit int64) (_ []*DocState, err error) {
+	defer observeQuery("DocStates.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document state", "DocStates.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
 	}
+	ob, err := orderClause(order)
+	if err != nil {
+		return nil, flowError("document state", "DocStates.List", CodeInvalidArg, err)
+	}
 
 	q := `
 	SELECT id, name
 	FROM wf_docstates_master
-	ORDER BY id
+	ORDER BY ` + ob + `
+	LIMIT ? OFFSET ?
+	`
+	rows, err := dbOrTx(otx).Query(dbDialect().Rebind(q), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocState, 0, 10)
+	for rows.Next() {
+		var elem DocState
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ListByDocType answers a subset of the document states used by the
+// given document type.
+//
+// Document states are global in `flow`.  A state is used by a
+// document type when it is the source or the target of one of the
+// type's transitions, or when it is mapped to a node of the type's
+// workflow.  Result set is ordered by ID, and is paginated using
+// `offset` and `limit`, as in `List`.
+func (_DocStates) ListByDocType(dtid DocTypeID, offset, limit int64) (_ []*DocState, err error) {
+	defer observeQuery("DocStates.ListByDocType", time.Now(), &err)
+
+	if dtid <= 0 {
+		return nil, invalidArg("document state", "DocStates.ListByDocType", "document type ID should be a positive integer")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("document state", "DocStates.ListByDocType", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT dsm.id, dsm.name
+	FROM wf_docstates_master dsm
+	WHERE dsm.id IN (
+		SELECT from_state_id FROM wf_docstate_transitions WHERE doctype_id = ?
+		UNION
+		SELECT to_state_id FROM wf_docstate_transitions WHERE doctype_id = ?
+		UNION
+		SELECT docstate_id FROM wf_workflow_nodes WHERE doctype_id = ?
+	)
+	ORDER BY dsm.id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), dtid, dtid, dtid, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +223,7 @@ func (_DocStates) List(offset, limit int64) ([]*DocState, error) {
 	ary := make([]*DocState, 0, 10)
 	for rows.Next() {
 		var elem DocState
-		err = rows.Scan(&elem.ID, &elem.Name)
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
 		if err != nil {
 			return nil, err
 		}
@@ -130,57 +236,480 @@ func (_DocStates) List(offset, limit int64) ([]*DocState, error) {
 	return ary, nil
 }
 
+// Count answers the total number of document states in the system.
+func (_DocStates) Count() (_ int64, err error) {
+	defer observeQuery("DocStates.Count", time.Now(), &err)
+
+	var n int64
+	row := db().QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_docstates_master"))
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 // Get retrieves the document state for the given ID.
 func (_DocStates) Get(id DocStateID) (*DocState, error) {
+	return DocStates.GetTx(nil, id)
+}
+
+// GetTx is a variant of `Get` that reads using the given transaction,
+// if any, so that changes made but not yet committed in it are
+// visible.
+func (_DocStates) GetTx(otx *sql.Tx, id DocStateID) (_ *DocState, err error) {
+	defer observeQuery("DocStates.Get", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("ID should be a positive integer")
+		return nil, invalidArg("document state", "DocStates.Get", "ID should be a positive integer")
 	}
 
 	var elem DocState
 	q := `
-	SELECT name
+	SELECT name, ctime, mtime
 	FROM wf_docstates_master
 	WHERE id = ?
 	`
-	row := db.QueryRow(q, id)
-	err := row.Scan(&elem.Name)
+	var row *sql.Row
+	if otx == nil {
+		row = db().QueryRow(dbDialect().Rebind(q), id)
+	} else {
+		row = otx.QueryRow(dbDialect().Rebind(q), id)
+	}
+	err = row.Scan(nullName{&elem.Name}, &elem.ctime, &elem.mtime)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "document state", "DocStates.Get")
 	}
 
 	elem.ID = id
 	return &elem, nil
 }
 
+// GetMany answers the document states with the given IDs, in a single
+// query, keyed by their IDs.  IDs that do not exist are absent from
+// the answer.  An empty list of IDs answers an empty map.
+func (_DocStates) GetMany(ids []DocStateID) (_ map[DocStateID]*DocState, err error) {
+	defer observeQuery("DocStates.GetMany", time.Now(), &err)
+
+	res := make(map[DocStateID]*DocState, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, invalidArg("document state", "DocStates.GetMany", "all identifiers should be positive integers")
+		}
+		args = append(args, id)
+	}
+
+	q := `
+	SELECT id, name, ctime, mtime
+	FROM wf_docstates_master
+	WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var elem DocState
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.ctime, &elem.mtime)
+		if err != nil {
+			return nil, err
+		}
+		res[elem.ID] = &elem
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // GetByName answers the document state, if one with the given name is
 // registered; `nil` and the error, otherwise.
 func (_DocStates) GetByName(name string) (*DocState, error) {
+	return DocStates.GetByNameTx(nil, name)
+}
+
+// GetByNameTx is a variant of `GetByName` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocStates) GetByNameTx(otx *sql.Tx, name string) (_ *DocState, err error) {
+	defer observeQuery("DocStates.GetByName", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return nil, errors.New("document state name should be non-empty")
+		return nil, invalidArg("document state", "DocStates.GetByName", "document state name should be non-empty")
 	}
 
 	var elem DocState
-	row := db.QueryRow("SELECT id, name FROM wf_docstates_master WHERE name = ?", name)
-	err := row.Scan(&elem.ID, &elem.Name)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind("SELECT id, name, ctime, mtime FROM wf_docstates_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.ctime, &elem.mtime)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "document state", "DocStates.GetByName")
 	}
 
 	return &elem, nil
 }
 
+// Ensure answers the document state with the given name, creating it if it is
+// not registered yet.  The boolean result is `true` only when the
+// document state was created by this call.
+func (_DocStates) Ensure(otx *sql.Tx, name string) (_ *DocState, _ bool, err error) {
+	defer observeQuery("DocStates.Ensure", time.Now(), &err)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, false, invalidArg("document state", "DocStates.Ensure", "document state name should be non-empty")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, false, txRequiredErr("document state", "DocStates.Ensure")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return nil, false, err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var elem DocState
+	row := tx.QueryRow(dbDialect().Rebind("SELECT id, name, ctime, mtime FROM wf_docstates_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.ctime, &elem.mtime)
+	switch {
+	case err == nil:
+		return &elem, false, nil
+
+	case err != sql.ErrNoRows:
+		return nil, false, err
+	}
+
+	id, err := DocStates.New(tx, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Read the new row back, for its database-assigned times.
+	row = tx.QueryRow(dbDialect().Rebind("SELECT id, name, ctime, mtime FROM wf_docstates_master WHERE id = ?"), id)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.ctime, &elem.mtime)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &elem, true, nil
+}
+
+// Initial answers the initial state of the given document type.
+//
+// A state is initial when it is mapped to a node of type
+// `NodeTypeBegin` in the workflow of the document type.  Should the
+// document type have no such state -- or, erroneously, more than one
+// -- `ErrNoInitialState` is answered.
+func (_DocStates) Initial(dtid DocTypeID) (_ *DocState, err error) {
+	defer observeQuery("DocStates.Initial", time.Now(), &err)
+
+	if dtid <= 0 {
+		return nil, invalidArg("document state", "DocStates.Initial", "document type should be a positive integer")
+	}
+
+	q := `
+	SELECT dsm.id, dsm.name
+	FROM wf_workflow_nodes wn
+	JOIN wf_docstates_master dsm ON dsm.id = wn.docstate_id
+	WHERE wn.doctype_id = ?
+	AND wn.type = 'begin'
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocState, 0, 1)
+	for rows.Next() {
+		var elem DocState
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ary) != 1 {
+		return nil, flowError("document state", "DocStates.Initial", CodeNotFound, ErrNoInitialState)
+	}
+	return ary[0], nil
+}
+
+// InitialState answers the initial state of the given document type,
+// in which its new documents begin.  It is the same as `Initial`.
+func (_DocStates) InitialState(dtid DocTypeID) (*DocState, error) {
+	return DocStates.Initial(dtid)
+}
+
+// SetInitial makes the given state the initial state of the given
+// document type, in which its new documents begin.
+//
+// The initial state of a document type is the state of the `begin`
+// node of its workflow; see `Initial`.  Hence, the state should
+// already be mapped to a `linear` node of that workflow -- or to its
+// `begin` node, in which case nothing changes.  Nodes of other types
+// are rejected, since their type carries meaning of its own.
+//
+// N.B. This changes the topology of the workflow: the given state's
+// node becomes its `begin` node, while the node that was so earlier
+// becomes a `linear` one.  The workflow's `BeginState` is updated to
+// match.
+func (_DocStates) SetInitial(otx *sql.Tx, dtid DocTypeID, id DocStateID) (err error) {
+	defer observeQuery("DocStates.SetInitial", time.Now(), &err)
+
+	if dtid <= 0 || id <= 0 {
+		return invalidArg("document state", "DocStates.SetInitial", "document type and state IDs should be positive integers")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document state", "DocStates.SetInitial")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	q := `
+	SELECT wn.type
+	FROM wf_workflow_nodes wn
+	JOIN wf_workflows wf ON wf.id = wn.workflow_id
+	WHERE wf.doctype_id = ?
+	AND wn.docstate_id = ?
+	`
+	var ntype NodeType
+	err = tx.QueryRow(dbDialect().Rebind(q), dtid, id).Scan(&ntype)
+	switch {
+	case err == sql.ErrNoRows:
+		return flowError("document state", "DocStates.SetInitial", CodeInvalidArg, fmt.Errorf("document state %d has no node in the workflow of document type : %d", id, dtid))
+
+	case err != nil:
+		return err
+	}
+	switch ntype {
+	case NodeTypeBegin, NodeTypeLinear:
+	default:
+		return flowError("document state", "DocStates.SetInitial", CodeInvalidArg, fmt.Errorf("only a linear node can begin a workflow, not one of type %s : document state %d", ntype, id))
+	}
+
+	q = `
+	UPDATE wf_workflow_nodes
+	SET type = 'linear'
+	WHERE doctype_id = ?
+	AND type = 'begin'
+	AND docstate_id <> ?
+	`
+	if _, err = tx.Exec(dbDialect().Rebind(q), dtid, id); err != nil {
+		return err
+	}
+	q = `UPDATE wf_workflow_nodes SET type = 'begin' WHERE doctype_id = ? AND docstate_id = ?`
+	if _, err = tx.Exec(dbDialect().Rebind(q), dtid, id); err != nil {
+		return err
+	}
+	q = `UPDATE wf_workflows SET docstate_id = ? WHERE doctype_id = ?`
+	if _, err = tx.Exec(dbDialect().Rebind(q), id, dtid); err != nil {
+		return err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StateConsistency reports the initial and final states defined for
+// a document type, as found in its workflow nodes.
+type StateConsistency struct {
+	DocType      DocTypeID // Document type that was checked
+	InitialCount int64     // Number of initial (`begin`) states
+	FinalCount   int64     // Number of final (`end`) states
+	Violations   []string  // Human-readable descriptions of the problems found
+}
+
+// OK answers `true` if no violations were found.
+func (sc *StateConsistency) OK() bool {
+	return len(sc.Violations) == 0
+}
+
+// ConsistencyCheck counts the initial and final states of the given
+// document type, and reports any violations.  A document type must
+// have exactly one initial state, in which its workflow begins.  Use
+// this as a preflight check before enabling a workflow.
+func (_DocStates) ConsistencyCheck(dtid DocTypeID) (_ *StateConsistency, err error) {
+	defer observeQuery("DocStates.ConsistencyCheck", time.Now(), &err)
+
+	if dtid <= 0 {
+		return nil, invalidArg("document state", "DocStates.ConsistencyCheck", "document type should be a positive integer")
+	}
+
+	q := `
+	SELECT COALESCE(SUM(CASE WHEN type = 'begin' THEN 1 ELSE 0 END), 0), COALESCE(SUM(CASE WHEN type = 'end' THEN 1 ELSE 0 END), 0)
+	FROM wf_workflow_nodes
+	WHERE doctype_id = ?
+	`
+	sc := &StateConsistency{DocType: dtid}
+	row := db().QueryRow(dbDialect().Rebind(q), dtid)
+	err = row.Scan(&sc.InitialCount, &sc.FinalCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.InitialCount != 1 {
+		sc.Violations = append(sc.Violations, fmt.Sprintf("expected exactly one initial state; found %d", sc.InitialCount))
+		return sc, nil
+	}
+
+	// The workflow should begin where its `begin` node is.
+	q = `
+	SELECT wf.docstate_id, wn.docstate_id
+	FROM wf_workflows wf
+	JOIN wf_workflow_nodes wn ON wn.workflow_id = wf.id
+	WHERE wf.doctype_id = ?
+	AND wn.type = 'begin'
+	`
+	var begin, node DocStateID
+	err = db().QueryRow(dbDialect().Rebind(q), dtid).Scan(&begin, &node)
+	switch {
+	case err == sql.ErrNoRows:
+		sc.Violations = append(sc.Violations, "the initial state does not belong to the workflow of the document type")
+
+	case err != nil:
+		return nil, err
+
+	case begin != node:
+		sc.Violations = append(sc.Violations, fmt.Sprintf("workflow begins in state %d, but its begin node is for state %d", begin, node))
+	}
+
+	return sc, nil
+}
+
+// SetTerminal marks the given state as terminal, or not, in the given
+// document type.  Documents of that type that reach a terminal state
+// are closed: no further actions can be applied to them.  The same
+// state may well be terminal in one document type, but not in another.
+// Hence, the state should be used by the document type, either in a
+// transition or in a workflow node.  See `Documents.IsClosed`.
+func (_DocStates) SetTerminal(otx *sql.Tx, dtid DocTypeID, id DocStateID, terminal bool) (err error) {
+	defer observeQuery("DocStates.SetTerminal", time.Now(), &err)
+
+	if dtid <= 0 || id <= 0 {
+		return invalidArg("document state", "DocStates.SetTerminal", "document type and state IDs should be positive integers")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document state", "DocStates.SetTerminal")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var n int64
+	err = tx.QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_docstates_master WHERE id = ?"), id).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound("document state", "DocStates.SetTerminal")
+	}
+	q := `
+	SELECT COUNT(*)
+	FROM (
+		SELECT from_state_id AS docstate_id FROM wf_docstate_transitions WHERE doctype_id = ?
+		UNION
+		SELECT to_state_id FROM wf_docstate_transitions WHERE doctype_id = ?
+		UNION
+		SELECT docstate_id FROM wf_workflow_nodes WHERE doctype_id = ?
+	) AS used
+	WHERE used.docstate_id = ?
+	`
+	err = tx.QueryRow(dbDialect().Rebind(q), dtid, dtid, dtid, id).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return flowError("document state", "DocStates.SetTerminal", CodeInvalidArg, fmt.Errorf("document state %d is not used by document type : %d", id, dtid))
+	}
+
+	_, err = tx.Exec(dbDialect().Rebind("DELETE FROM wf_doctype_terminal_states WHERE doctype_id = ? AND docstate_id = ?"), dtid, id)
+	if err != nil {
+		return err
+	}
+	if terminal {
+		_, err = tx.Exec(dbDialect().Rebind("INSERT INTO wf_doctype_terminal_states(doctype_id, docstate_id) VALUES(?, ?)"), dtid, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Rename renames the given document state.
-func (_DocStates) Rename(otx *sql.Tx, id DocStateID, name string) error {
+func (_DocStates) Rename(otx *sql.Tx, id DocStateID, name string) (err error) {
+	defer observeQuery("DocStates.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name cannot be empty")
+		return invalidArg("document state", "DocStates.Rename", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("document state", "DocStates.Rename", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document state", "DocStates.Rename")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -189,7 +718,15 @@ func (_DocStates) Rename(otx *sql.Tx, id DocStateID, name string) error {
 		tx = otx
 	}
 
-	_, err = tx.Exec("UPDATE wf_docstates_master SET name = ? WHERE id = ?", name, id)
+	if err = checkNameFreeExcept(context.Background(), tx, "wf_docstates_master", name, "id", id); err != nil {
+		return classify("document state", "DocStates.Rename", err)
+	}
+
+	res, err := tx.Exec(dbDialect().Rebind("UPDATE wf_docstates_master SET name = ?, mtime = CURRENT_TIMESTAMP WHERE id = ?"), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_docstates_master", "id", id, "document state", "DocStates.Rename")
 	if err != nil {
 		return err
 	}
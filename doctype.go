@@ -15,16 +15,19 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // DocTypeID is the type of unique identifiers of document types.
 type DocTypeID int64
 
+// DocTransitionID is the type of unique identifiers of document state
+// transitions.
 type DocTransitionID int64
 
 // DocType enumerates the types of documents in the system, as defined
@@ -66,16 +69,23 @@ func (_DocTypes) docStorName(dtid DocTypeID) string {
 }
 
 // New creates and registers a new document type in the system.
-func (_DocTypes) New(otx *sql.Tx, name string) (DocTypeID, error) {
+func (_DocTypes) New(otx *sql.Tx, name string) (_ DocTypeID, err error) {
+	defer observeQuery("DocTypes.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("name cannot be empty")
+		return 0, invalidArg("document type", "DocTypes.New", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("document type", "DocTypes.New", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("document type", "DocTypes.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -84,41 +94,26 @@ func (_DocTypes) New(otx *sql.Tx, name string) (DocTypeID, error) {
 		tx = otx
 	}
 
-	res, err := tx.Exec("INSERT INTO wf_doctypes_master(name) VALUES(?)", name)
-	if err != nil {
-		return 0, err
+	if err = checkNameFree(context.Background(), tx, "wf_doctypes_master", name); err != nil {
+		return 0, classify("document type", "DocTypes.New", err)
 	}
-	var id int64
-	id, err = res.LastInsertId()
+
+	id, err := dbDialect().InsertID(context.Background(), tx, "INSERT INTO wf_doctypes_master(name) VALUES(?)", name)
 	if err != nil {
 		return 0, err
 	}
 
 	tbl := DocTypes.docStorName(DocTypeID(id))
 	q := `DROP TABLE IF EXISTS ` + tbl
-	res, err = tx.Exec(q)
+	_, err = tx.Exec(dbDialect().Rebind(q))
 	if err != nil {
 		return 0, err
 	}
-	q = `
-	CREATE TABLE ` + tbl + ` (
-		id INT NOT NULL AUTO_INCREMENT,
-		path VARCHAR(1000) NOT NULL,
-		ac_id INT NOT NULL,
-		docstate_id INT NOT NULL,
-		group_id INT NOT NULL,
-		ctime TIMESTAMP NOT NULL,
-		title VARCHAR(250) NULL,
-		data TEXT NOT NULL,
-		PRIMARY KEY (id),
-		FOREIGN KEY (ac_id) REFERENCES wf_access_contexts(id),
-		FOREIGN KEY (docstate_id) REFERENCES wf_docstates_master(id),
-		FOREIGN KEY (group_id) REFERENCES wf_groups_master(id)
-	)
-	`
-	res, err = tx.Exec(q)
-	if err != nil {
-		return 0, err
+	for _, q = range dbDialect().CreateDocTable(tbl) {
+		_, err = tx.Exec(q)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	if otx == nil {
@@ -130,6 +125,14 @@ func (_DocTypes) New(otx *sql.Tx, name string) (DocTypeID, error) {
 	return DocTypeID(id), nil
 }
 
+// drop removes the given document type and its storage table.  It is
+// used to undo a document type whose definition could not be
+// completed; errors are ignored, since there is nothing more to undo.
+func (_DocTypes) drop(id DocTypeID) {
+	db().Exec(dbDialect().Rebind(`DROP TABLE IF EXISTS ` + DocTypes.docStorName(id)))
+	db().Exec(dbDialect().Rebind("DELETE FROM wf_doctypes_master WHERE id = ?"), id)
+}
+
 // List answers a subset of the document types, based on the input
 // specification.
 //
@@ -137,20 +140,45 @@ func (_DocTypes) New(otx *sql.Tx, name string) (DocTypeID, error) {
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
 func (_DocTypes) List(offset, limit int64) ([]*DocType, error) {
+	return DocTypes.listOrdered(nil, OrderByID, offset, limit)
+}
+
+// ListOrdered is a variant of `List` that answers the results in the
+// given order.
+func (_DocTypes) ListOrdered(order OrderBy, offset, limit int64) ([]*DocType, error) {
+	return DocTypes.listOrdered(nil, order, offset, limit)
+}
+
+// ListTx is a variant of `List` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocTypes) ListTx(otx *sql.Tx, offset, limit int64) ([]*DocType, error) {
+	return DocTypes.listOrdered(otx, OrderByID, offset, limit)
+}
+
+// listOrdered implements the listings of document types, using the given
+// transaction, if any.
+func (_DocTypes) listOrdered(otx *sql.Tx, order OrderBy, offset, limit int64) (_ []*DocType, err error) {
+	defer observeQuery("DocTypes.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document type", "DocTypes.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
 	}
+	ob, err := orderClause(order)
+	if err != nil {
+		return nil, flowError("document type", "DocTypes.List", CodeInvalidArg, err)
+	}
 
 	q := `
 	SELECT id, name
 	FROM wf_doctypes_master
-	ORDER BY id
+	ORDER BY ` + ob + `
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := dbOrTx(otx).Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +187,7 @@ func (_DocTypes) List(offset, limit int64) ([]*DocType, error) {
 	ary := make([]*DocType, 0, 10)
 	for rows.Next() {
 		var elem DocType
-		err = rows.Scan(&elem.ID, &elem.Name)
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
 		if err != nil {
 			return nil, err
 		}
@@ -172,51 +200,317 @@ func (_DocTypes) List(offset, limit int64) ([]*DocType, error) {
 	return ary, nil
 }
 
+// Count answers the total number of document types in the system.
+func (_DocTypes) Count() (_ int64, err error) {
+	defer observeQuery("DocTypes.Count", time.Now(), &err)
+
+	var n int64
+	row := db().QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_doctypes_master"))
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// ForUser answers the document types on which the given user can
+// perform at least one action, through any of the user's groups and
+// roles, in any access context.  They are ordered by name.
+func (_DocTypes) ForUser(uid UserID) (_ []*DocType, err error) {
+	defer observeQuery("DocTypes.ForUser", time.Now(), &err)
+
+	if uid <= 0 {
+		return nil, invalidArg("document type", "DocTypes.ForUser", "user ID should be a positive integer")
+	}
+
+	q := `
+	SELECT DISTINCT dtm.id, dtm.name
+	FROM wf_doctypes_master dtm
+	JOIN wf_ac_perms_v acpv ON acpv.doctype_id = dtm.id
+	WHERE acpv.user_id = ?
+	ORDER BY dtm.name
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocType, 0, 10)
+	for rows.Next() {
+		var elem DocType
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// DocTypeStateCount pairs a document type with the number of states
+// that it uses.
+type DocTypeStateCount struct {
+	DocType    DocType `json:"DocType"`    // The document type
+	StateCount int64   `json:"StateCount"` // Number of distinct states it uses
+}
+
+// ListWithStateCounts answers all document types, ordered by ID, each
+// with the number of distinct states that it uses.  As in
+// `DocStates.ListByDocType`, a state is used by a document type when
+// it occurs in one of the type's transitions, or is mapped to a node
+// of the type's workflow.  Document types that use no states are
+// included, with a count of zero.
+func (_DocTypes) ListWithStateCounts() (_ []DocTypeStateCount, err error) {
+	defer observeQuery("DocTypes.ListWithStateCounts", time.Now(), &err)
+
+	q := `
+	SELECT dtm.id, dtm.name, COUNT(dts.docstate_id)
+	FROM wf_doctypes_master dtm
+	LEFT JOIN (
+		SELECT doctype_id, from_state_id AS docstate_id FROM wf_docstate_transitions
+		UNION
+		SELECT doctype_id, to_state_id FROM wf_docstate_transitions
+		UNION
+		SELECT doctype_id, docstate_id FROM wf_workflow_nodes
+	) dts ON dts.doctype_id = dtm.id
+	GROUP BY dtm.id, dtm.name
+	ORDER BY dtm.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]DocTypeStateCount, 0, 10)
+	for rows.Next() {
+		var elem DocTypeStateCount
+		err = rows.Scan(&elem.DocType.ID, nullName{&elem.DocType.Name}, &elem.StateCount)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
 // Get retrieves the document type for the given ID.
 func (_DocTypes) Get(id DocTypeID) (*DocType, error) {
+	return DocTypes.GetTx(nil, id)
+}
+
+// GetTx is a variant of `Get` that reads using the given transaction,
+// if any, so that changes made but not yet committed in it are
+// visible.
+func (_DocTypes) GetTx(otx *sql.Tx, id DocTypeID) (_ *DocType, err error) {
+	defer observeQuery("DocTypes.Get", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("ID should be a positive integer")
+		return nil, invalidArg("document type", "DocTypes.Get", "ID should be a positive integer")
 	}
 
 	var elem DocType
-	row := db.QueryRow("SELECT id, name FROM wf_doctypes_master WHERE id = ?", id)
-	err := row.Scan(&elem.ID, &elem.Name)
+	q := "SELECT id, name FROM wf_doctypes_master WHERE id = ?"
+	var row *sql.Row
+	if otx == nil {
+		row = db().QueryRow(dbDialect().Rebind(q), id)
+	} else {
+		row = otx.QueryRow(dbDialect().Rebind(q), id)
+	}
+	err = row.Scan(&elem.ID, nullName{&elem.Name})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "document type", "DocTypes.Get")
 	}
 
 	return &elem, nil
 }
 
+// GetMany answers the document types with the given IDs, in a single
+// query, keyed by their IDs.  IDs that do not exist are absent from
+// the answer.  An empty list of IDs answers an empty map.
+func (_DocTypes) GetMany(ids []DocTypeID) (_ map[DocTypeID]*DocType, err error) {
+	defer observeQuery("DocTypes.GetMany", time.Now(), &err)
+
+	res := make(map[DocTypeID]*DocType, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, invalidArg("document type", "DocTypes.GetMany", "all identifiers should be positive integers")
+		}
+		args = append(args, id)
+	}
+
+	q := `
+	SELECT id, name
+	FROM wf_doctypes_master
+	WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var elem DocType
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
+		if err != nil {
+			return nil, err
+		}
+		res[elem.ID] = &elem
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // GetByName answers the document type, if one with the given name is
 // registered; `nil` and the error, otherwise.
 func (_DocTypes) GetByName(name string) (*DocType, error) {
+	return DocTypes.GetByNameTx(nil, name)
+}
+
+// GetByNameTx is a variant of `GetByName` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocTypes) GetByNameTx(otx *sql.Tx, name string) (_ *DocType, err error) {
+	defer observeQuery("DocTypes.GetByName", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return nil, errors.New("document type cannot be empty")
+		return nil, invalidArg("document type", "DocTypes.GetByName", "document type cannot be empty")
 	}
 
 	var elem DocType
-	row := db.QueryRow("SELECT id, name FROM wf_doctypes_master WHERE name = ?", name)
-	err := row.Scan(&elem.ID, &elem.Name)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind("SELECT id, name FROM wf_doctypes_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "document type", "DocTypes.GetByName")
 	}
 
 	return &elem, nil
 }
 
+// Exists answers the ID of the document type with the given name, and
+// `true`, if one such is registered.  It answers `false` and a `nil`
+// error if there is no such type; any other error is answered as is.
+func (_DocTypes) Exists(name string) (DocTypeID, bool, error) {
+	return DocTypes.ExistsTx(nil, name)
+}
+
+// ExistsTx is a variant of `Exists` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocTypes) ExistsTx(otx *sql.Tx, name string) (_ DocTypeID, _ bool, err error) {
+	defer observeQuery("DocTypes.Exists", time.Now(), &err)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, false, invalidArg("document type", "DocTypes.Exists", "document type cannot be empty")
+	}
+
+	var id DocTypeID
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind("SELECT id FROM wf_doctypes_master WHERE name = ?"), name)
+	err = row.Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+
+	case err != nil:
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+// Ensure answers the document type with the given name, creating it if it is
+// not registered yet.  The boolean result is `true` only when the
+// document type was created by this call.
+//
+// N.B. Creating a document type creates its storage table as well.
+// Since that is a DDL statement, it implicitly commits any enclosing
+// transaction.
+func (_DocTypes) Ensure(otx *sql.Tx, name string) (_ *DocType, _ bool, err error) {
+	defer observeQuery("DocTypes.Ensure", time.Now(), &err)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, false, invalidArg("document type", "DocTypes.Ensure", "document type cannot be empty")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, false, txRequiredErr("document type", "DocTypes.Ensure")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return nil, false, err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var elem DocType
+	row := tx.QueryRow(dbDialect().Rebind("SELECT id, name FROM wf_doctypes_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name})
+	switch {
+	case err == nil:
+		return &elem, false, nil
+
+	case err != sql.ErrNoRows:
+		return nil, false, err
+	}
+
+	id, err := DocTypes.New(tx, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &DocType{ID: id, Name: name}, true, nil
+}
+
 // Rename renames the given document type.
-func (_DocTypes) Rename(otx *sql.Tx, id DocTypeID, name string) error {
+func (_DocTypes) Rename(otx *sql.Tx, id DocTypeID, name string) (err error) {
+	defer observeQuery("DocTypes.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name cannot be empty")
+		return invalidArg("document type", "DocTypes.Rename", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("document type", "DocTypes.Rename", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document type", "DocTypes.Rename")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -225,7 +519,15 @@ func (_DocTypes) Rename(otx *sql.Tx, id DocTypeID, name string) error {
 		tx = otx
 	}
 
-	_, err = tx.Exec("UPDATE wf_doctypes_master SET name = ? WHERE id = ?", name, id)
+	if err = checkNameFreeExcept(context.Background(), tx, "wf_doctypes_master", name, "id", id); err != nil {
+		return classify("document type", "DocTypes.Rename", err)
+	}
+
+	res, err := tx.Exec(dbDialect().Rebind("UPDATE wf_doctypes_master SET name = ? WHERE id = ?"), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_doctypes_master", "id", id, "document type", "DocTypes.Rename")
 	if err != nil {
 		return err
 	}
@@ -257,7 +559,9 @@ type TransitionMap struct {
 
 // Transitions answers the possible document states into which a
 // document currently in the given state can transition.
-func (_DocTypes) Transitions(dtype DocTypeID, from DocStateID) (map[DocStateID]*TransitionMap, error) {
+func (_DocTypes) Transitions(dtype DocTypeID, from DocStateID) (_ map[DocStateID]*TransitionMap, err error) {
+	defer observeQuery("DocTypes.Transitions", time.Now(), &err)
+
 	q := `
 	SELECT dst.from_state_id, dsm1.name, dst.docaction_id, dam.name, dam.reconfirm, dst.to_state_id, dsm2.name
 	FROM wf_docstate_transitions dst
@@ -267,13 +571,12 @@ func (_DocTypes) Transitions(dtype DocTypeID, from DocStateID) (map[DocStateID]*
 	WHERE dst.doctype_id = ?
 	`
 	var rows *sql.Rows
-	var err error
 	if from > 0 {
 		q += `AND dst.from_state_id = ?
 		`
-		rows, err = db.Query(q, dtype, from)
+		rows, err = db().Query(dbDialect().Rebind(q), dtype, from)
 	} else {
-		rows, err = db.Query(q, dtype)
+		rows, err = db().Query(dbDialect().Rebind(q), dtype)
 	}
 
 	if err != nil {
@@ -316,9 +619,11 @@ type Transitionstruct struct {
 	ToStateId   int64
 }
 
-func (_DocTypes) TransitionsList(offset, limit int64) ([]*Transitionstruct, error) {
+func (_DocTypes) TransitionsList(offset, limit int64) (_ []*Transitionstruct, err error) {
+	defer observeQuery("DocTypes.TransitionsList", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document type", "DocTypes.TransitionsList", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -330,7 +635,51 @@ func (_DocTypes) TransitionsList(offset, limit int64) ([]*Transitionstruct, erro
 	ORDER BY id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Transitionstruct, 0, 10)
+	for rows.Next() {
+		var elem Transitionstruct
+		err = rows.Scan(&elem.Id, &elem.DoctypeId, &elem.FromStateId, &elem.DocactionId, &elem.ToStateId)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// TransitionsByRole answers the transitions, across all document
+// types, that the given role can effect.
+//
+// `flow` does not record a required role per transition.  Instead,
+// a role is required for a transition when it holds the permission
+// to perform the transition's action on the transition's document
+// type.  Transitions whose actions are not granted to the role are
+// excluded.
+func (_DocTypes) TransitionsByRole(rid RoleID) (_ []*Transitionstruct, err error) {
+	defer observeQuery("DocTypes.TransitionsByRole", time.Now(), &err)
+
+	if rid <= 0 {
+		return nil, invalidArg("document type", "DocTypes.TransitionsByRole", "role ID should be a positive integer")
+	}
+
+	q := `
+	SELECT dst.id, dst.doctype_id, dst.from_state_id, dst.docaction_id, dst.to_state_id
+	FROM wf_docstate_transitions dst
+	JOIN wf_role_docactions rdas ON rdas.doctype_id = dst.doctype_id AND rdas.docaction_id = dst.docaction_id
+	WHERE rdas.role_id = ?
+	ORDER BY dst.doctype_id, dst.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), rid)
 	if err != nil {
 		return nil, err
 	}
@@ -356,13 +705,19 @@ func (_DocTypes) TransitionsList(offset, limit int64) ([]*Transitionstruct, erro
 // document currently in the given state can transition.  Only
 // identifiers are answered in the map.
 func (_DocTypes) _Transitions(dtype DocTypeID, state DocStateID) (map[DocActionID]DocStateID, error) {
+	return DocTypes.transitionsTx(nil, dtype, state)
+}
+
+// transitionsTx is a variant of `_Transitions` that reads using the
+// given transaction, if any.
+func (_DocTypes) transitionsTx(otx *sql.Tx, dtype DocTypeID, state DocStateID) (map[DocActionID]DocStateID, error) {
 	q := `
 	SELECT docaction_id, to_state_id
 	FROM wf_docstate_transitions
 	WHERE doctype_id = ?
 	AND from_state_id = ?
 	`
-	rows, err := db.Query(q, dtype, state)
+	rows, err := dbOrTx(otx).Query(dbDialect().Rebind(q), dtype, state)
 	if err != nil {
 		return nil, err
 	}
@@ -387,12 +742,19 @@ func (_DocTypes) _Transitions(dtype DocTypeID, state DocStateID) (map[DocActionI
 
 // AddTransition associates a target document state with a document
 // action performed on documents in the given current state.
+//
+// Several target states may be associated with the same state and
+// action.  See `DocStateTransitions.New`, which allows only one.
 func (_DocTypes) AddTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID,
-	action DocActionID, toState DocStateID) error {
+	action DocActionID, toState DocStateID) (err error) {
+	defer observeQuery("DocTypes.AddTransition", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document type", "DocTypes.AddTransition")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -405,7 +767,7 @@ func (_DocTypes) AddTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID,
 	INSERT INTO wf_docstate_transitions(doctype_id, from_state_id, docaction_id, to_state_id)
 	VALUES(?, ?, ?, ?)
 	`
-	_, err = tx.Exec(q, dtype, state, action, toState)
+	_, err = tx.Exec(dbDialect().Rebind(q), dtype, state, action, toState)
 	if err != nil {
 		return err
 	}
@@ -422,11 +784,15 @@ func (_DocTypes) AddTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID,
 
 // RemoveTransition disassociates a target document state with a
 // document action performed on documents in the given current state.
-func (_DocTypes) RemoveTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID, action DocActionID) error {
+func (_DocTypes) RemoveTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID, action DocActionID) (err error) {
+	defer observeQuery("DocTypes.RemoveTransition", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document type", "DocTypes.RemoveTransition")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -441,7 +807,57 @@ func (_DocTypes) RemoveTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID
 	AND from_state_id =?
 	AND docaction_id = ?
 	`
-	_, err = tx.Exec(q, dtype, state, action)
+	_, err = tx.Exec(dbDialect().Rebind(q), dtype, state, action)
+	if err != nil {
+		return err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetTransitionSLA specifies the maximum time for which a document may
+// wait in the source state of the given transition, before the
+// transition's action is performed.  A zero value for `sla` removes
+// the SLA of the transition.
+//
+// Use `Documents.SLABreaches` to find documents that have waited
+// longer.
+func (_DocTypes) SetTransitionSLA(otx *sql.Tx, id DocTransitionID, sla time.Duration) (err error) {
+	defer observeQuery("DocTypes.SetTransitionSLA", time.Now(), &err)
+
+	if id <= 0 {
+		return invalidArg("document type", "DocTypes.SetTransitionSLA", "transition ID should be a positive integer")
+	}
+	if sla < 0 {
+		return invalidArg("document type", "DocTypes.SetTransitionSLA", "SLA should be a non-negative duration")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("document type", "DocTypes.SetTransitionSLA")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var secs sql.NullInt64
+	if sla > 0 {
+		secs = sql.NullInt64{Int64: int64(sla / time.Second), Valid: true}
+	}
+	_, err = tx.Exec(dbDialect().Rebind("UPDATE wf_docstate_transitions SET sla_seconds = ? WHERE id = ?"), secs, id)
 	if err != nil {
 		return err
 	}
@@ -457,16 +873,20 @@ func (_DocTypes) RemoveTransition(otx *sql.Tx, dtype DocTypeID, state DocStateID
 }
 
 // Rename renames the given document transition.
-func (_DocTypes) RenameTransition(otx *sql.Tx, id DocTransitionID, name string) error {
+func (_DocTypes) RenameTransition(otx *sql.Tx, id DocTransitionID, name string) (err error) {
+	defer observeQuery("DocTypes.RenameTransition", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name cannot be empty")
+		return invalidArg("document type", "DocTypes.RenameTransition", "name cannot be empty")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document type", "DocTypes.RenameTransition")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -475,7 +895,11 @@ func (_DocTypes) RenameTransition(otx *sql.Tx, id DocTransitionID, name string)
 		tx = otx
 	}
 
-	_, err = tx.Exec("UPDATE wf_docstate_transitions SET name = ? WHERE id = ?", name, id)
+	res, err := tx.Exec(dbDialect().Rebind("UPDATE wf_docstate_transitions SET name = ? WHERE id = ?"), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_docstate_transitions", "id", id, "transition", "DocTypes.RenameTransition")
 	if err != nil {
 		return err
 	}
@@ -15,6 +15,7 @@
 package flow
 
 import (
+	"context"
 	"crypto/sha1"
 	"database/sql"
 	"errors"
@@ -97,7 +98,7 @@ func (p *DocPath) Components() ([]struct {
 // updating it as a result.
 func (p *DocPath) Append(dtid DocTypeID, did DocumentID) error {
 	if dtid <= 0 || did <= 0 {
-		return errors.New("document type ID and document ID should be positive integers")
+		return invalidArg("document", "DocPath.Append", "document type ID and document ID should be positive integers")
 	}
 
 	*p = *p + DocPath(fmt.Sprintf("%d:%d/", dtid, did))
@@ -146,6 +147,9 @@ type Document struct {
 
 	Title string `json:"Title"`          // Human-readable title; applicable only for root documents
 	Data  string `json:"Data,omitempty"` // Primary content of the document
+
+	CorrelationID string `json:"CorrelationID,omitempty"` // Identifier shared by related documents, if any
+	Version       int64  `json:"Version"`                 // Incremented by every action applied through `Documents`
 }
 
 // Unexported type, only for convenience methods.
@@ -165,6 +169,7 @@ type DocumentsNewInput struct {
 	ParentID        DocumentID // Unique identifier of the parent document, if any
 	Title           string     // Title of the new document; applicable to only root (top-level) documents
 	Data            string     // Body of the new document; required
+	CorrelationID   string     // Identifier shared by related documents, if any
 }
 
 // New creates and initialises a document.
@@ -177,17 +182,18 @@ type DocumentsNewInput struct {
 //
 // N.B. Blobs, tags and children documents have to be associated with
 // this document, if needed, through appropriate separate calls.
-func (_Documents) New(otx *sql.Tx, input *DocumentsNewInput) (DocumentID, error) {
+func (_Documents) New(otx *sql.Tx, input *DocumentsNewInput) (_ DocumentID, err error) {
+	defer observeQuery("Documents.New", time.Now(), &err)
+
 	if input.DocTypeID <= 0 || input.AccessContextID <= 0 || input.GroupID <= 0 {
-		return 0, errors.New("all identifiers should be positive integers")
+		return 0, invalidArg("document", "Documents.New", "all identifiers should be positive integers")
 	}
 	if len(input.Data) == 0 {
-		return 0, errors.New("document's body should be non-empty")
+		return 0, invalidArg("document", "Documents.New", "document's body should be non-empty")
 	}
 
 	var dsid int64
 	var path DocPath
-	var err error
 	if input.ParentID > 0 {
 		pdoc, err := Documents.Get(nil, input.ParentType, input.ParentID)
 		if err != nil {
@@ -200,27 +206,34 @@ func (_Documents) New(otx *sql.Tx, input *DocumentsNewInput) (DocumentID, error)
 		dsid = 1 // `__RESERVED_CHILD_STATE__`
 	} else {
 		q := `
-		SELECT docstate_id
+		SELECT COUNT(*)
 		FROM wf_workflows
 		WHERE doctype_id = ?
 		AND active = 1
 		`
-		row := db.QueryRow(q, input.DocTypeID)
-		err = row.Scan(&dsid)
+		var n int64
+		row := db().QueryRow(dbDialect().Rebind(q), input.DocTypeID)
+		err = row.Scan(&n)
 		if err != nil {
-			switch {
-			case err == sql.ErrNoRows:
-				return 0, errors.New("no active workflow is defined for the given document type")
+			return 0, err
+		}
+		if n == 0 {
+			return 0, flowError("document", "Documents.New", CodeNotFound, errors.New("no active workflow is defined for the given document type"))
+		}
 
-			default:
-				return 0, err
-			}
+		ds, err := DocStates.Initial(input.DocTypeID)
+		if err != nil {
+			return 0, err
 		}
+		dsid = int64(ds.ID)
 	}
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("document", "Documents.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -230,14 +243,14 @@ func (_Documents) New(otx *sql.Tx, input *DocumentsNewInput) (DocumentID, error)
 	}
 
 	tbl := DocTypes.docStorName(input.DocTypeID)
-	q2 := `INSERT INTO ` + tbl + `(path, ac_id, docstate_id, group_id, ctime, title, data)
-	VALUES (?, ?, ?, ?, NOW(), ?, ?)
-	`
-	res, err := tx.Exec(q2, string(path), input.AccessContextID, dsid, input.GroupID, input.Title, input.Data)
-	if err != nil {
-		return 0, err
+	var cid sql.NullString
+	if c := strings.TrimSpace(input.CorrelationID); c != "" {
+		cid = sql.NullString{String: c, Valid: true}
 	}
-	id, err := res.LastInsertId()
+	q2 := `INSERT INTO ` + tbl + `(path, ac_id, docstate_id, group_id, ctime, title, data, correlation_id)
+	VALUES (?, ?, ?, ?, ` + dbDialect().Now() + `, ?, ?, ?)
+	`
+	id, err := dbDialect().InsertID(context.Background(), tx, q2, string(path), input.AccessContextID, dsid, input.GroupID, input.Title, input.Data, cid)
 	if err != nil {
 		return 0, err
 	}
@@ -247,7 +260,7 @@ func (_Documents) New(otx *sql.Tx, input *DocumentsNewInput) (DocumentID, error)
 		INSERT INTO wf_document_children(parent_doctype_id, parent_id, child_doctype_id, child_id)
 		VALUES (?, ?, ?, ?)
 		`
-		res, err = tx.Exec(q2, input.ParentType, input.ParentID, input.DocTypeID, id)
+		_, err = tx.Exec(dbDialect().Rebind(q2), input.ParentType, input.ParentID, input.DocTypeID, id)
 		if err != nil {
 			return 0, err
 		}
@@ -282,9 +295,11 @@ type DocumentsListInput struct {
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_Documents) List(input *DocumentsListInput, offset, limit int64) ([]*Document, error) {
+func (_Documents) List(input *DocumentsListInput, offset, limit int64) (_ []*Document, err error) {
+	defer observeQuery("Documents.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document", "Documents.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -328,8 +343,8 @@ func (_Documents) List(input *DocumentsListInput, offset, limit int64) ([]*Docum
 	}
 
 	if input.TitleContains != "" {
-		where = append(where, `docs.title LIKE ?`)
-		args = append(args, "%"+input.TitleContains+"%")
+		where = append(where, `docs.title LIKE ?`+likeEscapeClause)
+		args = append(args, likeContains(input.TitleContains))
 	}
 
 	if input.RootOnly {
@@ -348,7 +363,7 @@ func (_Documents) List(input *DocumentsListInput, offset, limit int64) ([]*Docum
 
 	// Fetch document data.
 
-	rows, err := db.Query(q, args...)
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -365,7 +380,7 @@ func (_Documents) List(input *DocumentsListInput, offset, limit int64) ([]*Docum
 
 		elem.DocType.ID = input.DocTypeID
 		q2 := `SELECT name FROM wf_doctypes_master WHERE id = ?`
-		row2 := db.QueryRow(q2, input.DocTypeID)
+		row2 := db().QueryRow(dbDialect().Rebind(q2), input.DocTypeID)
 		err = row2.Scan(&elem.DocType.Name)
 		if err != nil {
 			return nil, err
@@ -382,6 +397,322 @@ func (_Documents) List(input *DocumentsListInput, offset, limit int64) ([]*Docum
 	return ary, nil
 }
 
+// CreatedBetween answers a page of the documents of the given type
+// that were created in the given time window, oldest first.  The
+// total number of such documents is answered as well.
+//
+// The window includes `from`, but excludes `to`.  A zero value for
+// either leaves that end of the window open.  Result set is paginated
+// using `offset` and `limit` as usual.
+func (_Documents) CreatedBetween(dtype DocTypeID, from, to time.Time, offset, limit int64) (_ []*Document, _ int64, err error) {
+	defer observeQuery("Documents.CreatedBetween", time.Now(), &err)
+
+	if dtype <= 0 {
+		return nil, 0, invalidArg("document", "Documents.CreatedBetween", "document type should be a positive integer")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, 0, invalidArg("document", "Documents.CreatedBetween", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	tbl := DocTypes.docStorName(dtype)
+	where := `
+	WHERE 1 = 1
+	`
+	args := []interface{}{}
+	if !from.IsZero() {
+		where += "AND docs.ctime >= ?\n"
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where += "AND docs.ctime < ?\n"
+		args = append(args, to)
+	}
+
+	tx, err := db().Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	q := `
+	SELECT COUNT(*)
+	FROM ` + tbl + ` docs
+	` + where
+	row := tx.QueryRow(dbDialect().Rebind(q), args...)
+	err = row.Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	q = `
+	SELECT docs.id, docs.path, docs.ac_id, docs.group_id, gm.name, docs.docstate_id, dsm.name, docs.ctime, docs.title, dtm.name
+	FROM ` + tbl + ` docs
+	JOIN wf_groups_master gm ON gm.id = docs.group_id
+	JOIN wf_docstates_master dsm ON dsm.id = docs.docstate_id
+	JOIN wf_doctypes_master dtm ON dtm.id = ?
+	` + where + `
+	ORDER BY docs.ctime, docs.id
+	LIMIT ? OFFSET ?
+	`
+	args = append([]interface{}{dtype}, args...)
+	args = append(args, limit, offset)
+	rows, err := tx.Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Document, 0, 10)
+	for rows.Next() {
+		var elem Document
+		var title sql.NullString
+		err = rows.Scan(&elem.ID, &elem.Path, &elem.AccCtx.ID, &elem.Group.ID, &elem.Group.Name, &elem.State.ID, &elem.State.Name, &elem.Ctime, &title, nullName{&elem.DocType.Name})
+		if err != nil {
+			return nil, 0, err
+		}
+		elem.DocType.ID = dtype
+		if title.Valid {
+			elem.Title = title.String
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return ary, total, nil
+}
+
+// ListByState answers a page of the documents of the given type that
+// are currently in the given state, ordered by ID.  This serves work
+// queues, such as all the requests pending approval.  Result set is
+// paginated using `offset` and `limit` as usual.
+func (_Documents) ListByState(dtype DocTypeID, state DocStateID, offset, limit int64) (_ []*Document, err error) {
+	defer observeQuery("Documents.ListByState", time.Now(), &err)
+
+	if dtype <= 0 || state <= 0 {
+		return nil, invalidArg("document", "Documents.ListByState", "document type ID and state ID should be positive integers")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("document", "Documents.ListByState", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	tbl := DocTypes.docStorName(dtype)
+	q := `
+	SELECT docs.id, docs.path, docs.ac_id, docs.group_id, gm.name, docs.docstate_id, dsm.name, docs.ctime, docs.title, dtm.name
+	FROM ` + tbl + ` docs
+	JOIN wf_groups_master gm ON gm.id = docs.group_id
+	JOIN wf_docstates_master dsm ON dsm.id = docs.docstate_id
+	JOIN wf_doctypes_master dtm ON dtm.id = ?
+	WHERE docs.docstate_id = ?
+	ORDER BY docs.id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, state, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Document, 0, 10)
+	for rows.Next() {
+		var elem Document
+		var title sql.NullString
+		err = rows.Scan(&elem.ID, &elem.Path, &elem.AccCtx.ID, &elem.Group.ID, &elem.Group.Name, &elem.State.ID, &elem.State.Name, &elem.Ctime, &title, nullName{&elem.DocType.Name})
+		if err != nil {
+			return nil, err
+		}
+		elem.DocType.ID = dtype
+		if title.Valid {
+			elem.Title = title.String
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ActionableBy answers a page of the root documents, of all types, on
+// which the given user can currently perform at least one action,
+// most recent first.  The total number of such documents is answered
+// as well.
+//
+// A user can act on a document when, in the document's access
+// context, the user has the permission for an action that has a
+// transition out of the document's current state, and that state is
+// not terminal in the document's type; see `IsClosed`.  Result set is
+// paginated using `offset` and `limit` as usual.
+//
+// N.B. This query spans the storage tables of all document types.
+func (_Documents) ActionableBy(uid UserID, offset, limit int64) (_ []*Document, _ int64, err error) {
+	defer observeQuery("Documents.ActionableBy", time.Now(), &err)
+
+	if uid <= 0 {
+		return nil, 0, invalidArg("document", "Documents.ActionableBy", "user ID should be a positive integer")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, 0, invalidArg("document", "Documents.ActionableBy", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	dts, err := DocTypes.List(0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(dts) == 0 {
+		return []*Document{}, 0, nil
+	}
+
+	// Documents are stored in type-specific tables.
+	parts := make([]string, 0, len(dts))
+	for _, dt := range dts {
+		parts = append(parts, fmt.Sprintf(`SELECT %d AS doctype_id, id, path, ac_id, docstate_id, group_id, ctime, title FROM %s WHERE path = ''`, dt.ID, DocTypes.docStorName(dt.ID)))
+	}
+	from := `
+	FROM (` + strings.Join(parts, `
+	UNION ALL
+	`) + `) docs
+	JOIN (
+		SELECT DISTINCT acpv.ac_id, acpv.doctype_id, dst.from_state_id
+		FROM wf_ac_perms_v acpv
+		JOIN wf_docstate_transitions dst ON dst.doctype_id = acpv.doctype_id AND dst.docaction_id = acpv.docaction_id
+		WHERE acpv.user_id = ?
+	) perms ON perms.ac_id = docs.ac_id AND perms.doctype_id = docs.doctype_id AND perms.from_state_id = docs.docstate_id
+	AND NOT EXISTS (
+		SELECT 1
+		FROM wf_doctype_terminal_states ts
+		WHERE ts.doctype_id = docs.doctype_id
+		AND ts.docstate_id = docs.docstate_id
+	)
+	`
+
+	tx, err := db().Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	row := tx.QueryRow(dbDialect().Rebind(`SELECT COUNT(*)`+from), uid)
+	err = row.Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	q := `
+	SELECT docs.doctype_id, dtm.name, docs.id, docs.path, docs.ac_id, docs.group_id, gm.name, docs.docstate_id, dsm.name, docs.ctime, docs.title
+	` + from + `
+	JOIN wf_doctypes_master dtm ON dtm.id = docs.doctype_id
+	JOIN wf_groups_master gm ON gm.id = docs.group_id
+	JOIN wf_docstates_master dsm ON dsm.id = docs.docstate_id
+	ORDER BY docs.ctime DESC, docs.doctype_id, docs.id DESC
+	LIMIT ? OFFSET ?
+	`
+	rows, err := tx.Query(dbDialect().Rebind(q), uid, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Document, 0, 10)
+	for rows.Next() {
+		var elem Document
+		var title sql.NullString
+		err = rows.Scan(&elem.DocType.ID, nullName{&elem.DocType.Name}, &elem.ID, &elem.Path, &elem.AccCtx.ID, &elem.Group.ID, &elem.Group.Name, &elem.State.ID, &elem.State.Name, &elem.Ctime, &title)
+		if err != nil {
+			return nil, 0, err
+		}
+		if title.Valid {
+			elem.Title = title.String
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return ary, total, nil
+}
+
+// SLABreach describes a document that has been waiting in its current
+// state for longer than the SLA of an outgoing transition.
+type SLABreach struct {
+	DocID   DocumentID    `json:"DocID"`   // Document in breach
+	State   DocStateID    `json:"State"`   // Current state of the document
+	Since   time.Time     `json:"Since"`   // Time at which the document entered its current state
+	SLA     time.Duration `json:"SLA"`     // Shortest SLA of the transitions out of the current state
+	Elapsed time.Duration `json:"Elapsed"` // Time spent in the current state so far
+}
+
+// SLABreaches answers the root documents of the given type that have
+// been in their current states for longer than the SLA of any of the
+// transitions out of those states.
+//
+// A document enters its current state when its latest applied event
+// occurs, or, in the absence of any, when it is created.
+func (_Documents) SLABreaches(dtype DocTypeID) (_ []SLABreach, err error) {
+	defer observeQuery("Documents.SLABreaches", time.Now(), &err)
+
+	if dtype <= 0 {
+		return nil, invalidArg("document", "Documents.SLABreaches", "document type should be a positive integer")
+	}
+
+	tbl := DocTypes.docStorName(dtype)
+	elapsed := dbDialect().SecondsSince("COALESCE(MAX(de.ctime), docs.ctime)")
+	q := `
+	SELECT docs.id, docs.docstate_id, COALESCE(MAX(de.ctime), docs.ctime) AS since, sla.sla_seconds,
+		` + elapsed + ` AS elapsed
+	FROM ` + tbl + ` docs
+	JOIN (
+		SELECT from_state_id, MIN(sla_seconds) AS sla_seconds
+		FROM wf_docstate_transitions
+		WHERE doctype_id = ?
+		AND sla_seconds IS NOT NULL
+		GROUP BY from_state_id
+	) sla ON sla.from_state_id = docs.docstate_id
+	LEFT JOIN wf_docevents de ON de.doctype_id = ? AND de.doc_id = docs.id AND de.status = 'A'
+	WHERE docs.path = ''
+	GROUP BY docs.id, docs.docstate_id, docs.ctime, sla.sla_seconds
+	HAVING ` + elapsed + ` > sla.sla_seconds
+	ORDER BY docs.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, dtype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]SLABreach, 0, 10)
+	for rows.Next() {
+		var elem SLABreach
+		var sla, elapsed int64
+		err = rows.Scan(&elem.DocID, &elem.State, &elem.Since, &sla, &elapsed)
+		if err != nil {
+			return nil, err
+		}
+		elem.SLA = time.Duration(sla) * time.Second
+		elem.Elapsed = time.Duration(elapsed) * time.Second
+		ary = append(ary, elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
 type Documentstruct struct {
 	Id         int64
 	Path       string
@@ -394,9 +725,11 @@ type Documentstruct struct {
 }
 
 //自定义直接查出数据库
-func (_Documents) DocumentList(id DocTypeID, offset, limit int64) ([]*Documentstruct, error) {
+func (_Documents) DocumentList(id DocTypeID, offset, limit int64) (_ []*Documentstruct, err error) {
+	defer observeQuery("Documents.DocumentList", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("document", "Documents.DocumentList", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -411,7 +744,7 @@ func (_Documents) DocumentList(id DocTypeID, offset, limit int64) ([]*Documentst
 	ORDER BY id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -433,37 +766,39 @@ func (_Documents) DocumentList(id DocTypeID, offset, limit int64) ([]*Documentst
 	return ary, nil
 }
 
-// Get initialises a document by reading from the database.
+// Get initialises a document by reading from the database.  The name
+// of its document type is resolved in the same query.
 //
 // N.B. This retrieves the primary data of the document.  Other
 // information viz. blobs, tags and children documents have to be
 // fetched separately.
-func (_Documents) Get(otx *sql.Tx, dtype DocTypeID, id DocumentID) (*Document, error) {
+func (_Documents) Get(otx *sql.Tx, dtype DocTypeID, id DocumentID) (_ *Document, err error) {
+	defer observeQuery("Documents.Get", time.Now(), &err)
+
 	tbl := DocTypes.docStorName(dtype)
 	var elem Document
 	q := `
-	SELECT docs.path, docs.ac_id, docs.group_id, gm.name, docs.ctime, docs.title, docs.data, docs.docstate_id, dsm.name
+	SELECT docs.path, docs.ac_id, docs.group_id, gm.name, docs.ctime, docs.title, docs.data, docs.docstate_id, dsm.name, docs.correlation_id, docs.version, dtm.name
 	FROM ` + tbl + ` AS docs
 	JOIN wf_groups_master gm ON gm.id = docs.group_id
 	JOIN wf_docstates_master dsm ON docs.docstate_id = dsm.id
+	JOIN wf_doctypes_master dtm ON dtm.id = ?
 	WHERE docs.id = ?
 	`
 
 	var row *sql.Row
 	if otx == nil {
-		row = db.QueryRow(q, id)
+		row = db().QueryRow(dbDialect().Rebind(q), dtype, id)
 	} else {
-		row = otx.QueryRow(q, id)
+		row = otx.QueryRow(dbDialect().Rebind(q), dtype, id)
 	}
-	err := row.Scan(&elem.Path, &elem.AccCtx.ID, &elem.Group.ID, &elem.Group.Name, &elem.Ctime, &elem.Title, &elem.Data, &elem.State.ID, &elem.State.Name)
+	var cid sql.NullString
+	err = row.Scan(&elem.Path, &elem.AccCtx.ID, &elem.Group.ID, &elem.Group.Name, &elem.Ctime, &elem.Title, &elem.Data, &elem.State.ID, &elem.State.Name, &cid, &elem.Version, nullName{&elem.DocType.Name})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "document", "Documents.Get")
 	}
-	q = `SELECT name FROM wf_doctypes_master WHERE id = ?`
-	row = db.QueryRow(q, dtype)
-	err = row.Scan(&elem.DocType.Name)
-	if err != nil {
-		return nil, err
+	if cid.Valid {
+		elem.CorrelationID = cid.String
 	}
 
 	elem.ID = id
@@ -471,8 +806,72 @@ func (_Documents) Get(otx *sql.Tx, dtype DocTypeID, id DocumentID) (*Document, e
 	return &elem, nil
 }
 
+// CurrentState answers the current state of the given document.
+func (_Documents) CurrentState(dtype DocTypeID, id DocumentID) (_ *DocState, err error) {
+	defer observeQuery("Documents.CurrentState", time.Now(), &err)
+
+	if dtype <= 0 || id <= 0 {
+		return nil, invalidArg("document", "Documents.CurrentState", "all identifiers should be positive integers")
+	}
+
+	tbl := DocTypes.docStorName(dtype)
+	q := `
+	SELECT dsm.id, dsm.name, dsm.ctime, dsm.mtime
+	FROM ` + tbl + ` AS docs
+	JOIN wf_docstates_master dsm ON dsm.id = docs.docstate_id
+	WHERE docs.id = ?
+	`
+	var elem DocState
+	row := db().QueryRow(dbDialect().Rebind(q), id)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.ctime, &elem.mtime)
+	if err != nil {
+		return nil, notFound(err, "document", "Documents.CurrentState")
+	}
+
+	return &elem, nil
+}
+
+// IsClosed answers `true` if the given document is in a state that is
+// terminal in its document type.  See `DocStates.SetTerminal`.
+func (_Documents) IsClosed(dtype DocTypeID, id DocumentID) (_ bool, err error) {
+	defer observeQuery("Documents.IsClosed", time.Now(), &err)
+
+	return Documents.isClosed(nil, dtype, id)
+}
+
+// isClosed is the transaction-aware implementation of `IsClosed`.
+func (_Documents) isClosed(otx *sql.Tx, dtype DocTypeID, id DocumentID) (bool, error) {
+	if dtype <= 0 || id <= 0 {
+		return false, invalidArg("document", "Documents.isClosed", "all identifiers should be positive integers")
+	}
+
+	tbl := DocTypes.docStorName(dtype)
+	q := `
+	SELECT COUNT(ts.docstate_id)
+	FROM ` + tbl + ` AS docs
+	LEFT JOIN wf_doctype_terminal_states ts ON ts.doctype_id = ? AND ts.docstate_id = docs.docstate_id
+	WHERE docs.id = ?
+	GROUP BY docs.id
+	`
+	var row *sql.Row
+	if otx == nil {
+		row = db().QueryRow(dbDialect().Rebind(q), dtype, id)
+	} else {
+		row = otx.QueryRow(dbDialect().Rebind(q), dtype, id)
+	}
+	var closed bool
+	err := row.Scan(&closed)
+	if err != nil {
+		return false, notFound(err, "document", "Documents.isClosed")
+	}
+
+	return closed, nil
+}
+
 // GetParent answers the parent document of the specified document.
-func (_Documents) GetParent(otx *sql.Tx, dtype DocTypeID, id DocumentID) (*Document, error) {
+func (_Documents) GetParent(otx *sql.Tx, dtype DocTypeID, id DocumentID) (_ *Document, err error) {
+	defer observeQuery("Documents.GetParent", time.Now(), &err)
+
 	q := `
 	SELECT parent_doctype_id, parent_id
 	FROM wf_document_children
@@ -482,15 +881,15 @@ func (_Documents) GetParent(otx *sql.Tx, dtype DocTypeID, id DocumentID) (*Docum
 	`
 	var row *sql.Row
 	if otx == nil {
-		row = db.QueryRow(q, dtype, id)
+		row = db().QueryRow(dbDialect().Rebind(q), dtype, id)
 	} else {
-		row = otx.QueryRow(q, dtype, id)
+		row = otx.QueryRow(dbDialect().Rebind(q), dtype, id)
 	}
 	var ptid, pid int64
-	err := row.Scan(&ptid, &pid)
+	err = row.Scan(&ptid, &pid)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, ErrDocumentNoParent
+			return nil, flowError("document", "Documents.GetParent", CodeInvalidArg, ErrDocumentNoParent)
 		}
 		return nil, err
 	}
@@ -509,19 +908,391 @@ func (_Documents) setState(otx *sql.Tx, dtype DocTypeID, id DocumentID, state Do
 	var err error
 	if ac > 0 {
 		q = `UPDATE ` + tbl + ` SET docstate_id = ?, ac_id = ? WHERE id = ?`
-		_, err = otx.Exec(q, state, ac, id)
+		_, err = otx.Exec(dbDialect().Rebind(q), state, ac, id)
 	} else {
 		q = `UPDATE ` + tbl + ` SET docstate_id = ? WHERE id = ?`
-		_, err = otx.Exec(q, state, id)
+		_, err = otx.Exec(dbDialect().Rebind(q), state, id)
 	}
 	return err
 }
 
+// applyAction raises an event for the given action on the given
+// document in its current state, and applies that event through the
+// given workflow.  Both happen within the given transaction.  The
+// applied event is answered, with its target state filled in.
+//
+// The version of the document is incremented first.  Should the
+// given version be positive, and the document be at another version,
+// `ErrConcurrentModification` is answered instead.
+func (_Documents) applyAction(tx *sql.Tx, wf *Workflow, dtype DocTypeID, id DocumentID,
+	action DocActionID, gid GroupID, text string, version int64) (*DocEvent, error) {
+	tbl := DocTypes.docStorName(dtype)
+	q := `UPDATE ` + tbl + ` SET version = version + 1 WHERE id = ?`
+	args := []interface{}{id}
+	if version > 0 {
+		q += ` AND version = ?`
+		args = append(args, version)
+	}
+	res, err := tx.Exec(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if version > 0 {
+			return nil, conflict("document", "Documents.ApplyAction", ErrConcurrentModification)
+		}
+		return nil, errNotFound("document", "Documents.ApplyAction")
+	}
+
+	doc, err := Documents.Get(tx, dtype, id)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &DocEventsNewInput{
+		DocTypeID:   dtype,
+		DocumentID:  id,
+		DocStateID:  doc.State.ID,
+		DocActionID: action,
+		GroupID:     gid,
+		Text:        text,
+	}
+	eid, err := DocEvents.New(tx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &DocEvent{
+		ID:      eid,
+		DocType: input.DocTypeID,
+		DocID:   input.DocumentID,
+		State:   input.DocStateID,
+		Action:  action,
+		Group:   gid,
+		Text:    text,
+		Status:  EventStatusPending,
+	}
+	state, err := wf.ApplyEvent(tx, event, nil)
+	if err != nil {
+		return nil, err
+	}
+	if hasAfterTransitions() {
+		row := tx.QueryRow(dbDialect().Rebind("SELECT ctime FROM wf_docevents WHERE id = ?"), eid)
+		if err = row.Scan(&event.Ctime); err != nil {
+			return nil, err
+		}
+	}
+
+	event.Status = EventStatusApplied
+	event.ToState = state
+	return event, nil
+}
+
+// ApplyAction applies the given action to the given document, on
+// behalf of the given user, moving the document to the next state of
+// its workflow.  An event is recorded for the action, with the given
+// text as its comment, and is attributed to the user's singleton
+// group.
+//
+// `ErrWorkflowInvalidAction` is answered if no transition is defined
+// for the action from the document's current state, and
+// `ErrDocumentClosed` if that state is terminal; no event is recorded
+// in either case.  Nor is the transition made when a registered
+// `TransitionGuard` vetoes it; its error is answered, and a
+// transaction supplied by the caller should then be rolled back.
+//
+// Registered `AfterTransition` listeners are invoked once the
+// transition is committed.  N.B. When the transaction is supplied by
+// the caller, that is known only if it was begun by `WithTx`; while a
+// listener is registered, any other transaction of the caller is
+// refused.  See `RegisterAfterTransition`.
+func (_Documents) ApplyAction(otx *sql.Tx, dtype DocTypeID, id DocumentID,
+	action DocActionID, uid UserID, text string) (DocStateID, error) {
+	return Documents.ApplyActionVersion(otx, dtype, id, action, uid, text, 0)
+}
+
+// ApplyActionVersion is a variant of `ApplyAction` that applies the
+// action only if the document is still at the given version, as last
+// read through `Get`.  Otherwise, an error wrapping
+// `ErrConcurrentModification` is answered, and nothing is recorded.
+// A version of `0` matches any.  The document is locked before its
+// version and state are checked, so that concurrent applications are
+// serialised.
+func (_Documents) ApplyActionVersion(otx *sql.Tx, dtype DocTypeID, id DocumentID,
+	action DocActionID, uid UserID, text string, version int64) (_ DocStateID, err error) {
+	defer observeQuery("Documents.ApplyAction", time.Now(), &err)
+
+	if dtype <= 0 || id <= 0 || action <= 0 || uid <= 0 {
+		return 0, invalidArg("document", "Documents.ApplyAction", "all identifiers should be positive integers")
+	}
+	if text == "" {
+		return 0, invalidArg("document", "Documents.ApplyAction", "please add comments or notes")
+	}
+	if version < 0 {
+		return 0, invalidArg("document", "Documents.ApplyAction", "version should be a non-negative integer")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return 0, txRequiredErr("document", "Documents.ApplyAction")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkAfterTransitionTx(otx, "Documents.ApplyAction"); err != nil {
+			return 0, err
+		}
+		tx = otx
+	}
+
+	// Read through the transaction, so that the user, the workflow
+	// and its transitions can be defined earlier in it.
+	g, err := Users.SingletonGroupOfTx(tx, uid)
+	if err != nil {
+		return 0, err
+	}
+	wf, err := Workflows.GetByDocTypeTx(tx, dtype)
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock the document, so that its state cannot change between
+	// the checks below and the application of the action.
+	var state DocStateID
+	var cur int64
+	tbl := DocTypes.docStorName(dtype)
+	row := tx.QueryRow(dbDialect().Rebind(`SELECT docstate_id, version FROM `+tbl+` WHERE id = ? FOR UPDATE`), id)
+	err = row.Scan(&state, &cur)
+	if err != nil {
+		return 0, notFound(err, "document", "Documents.ApplyAction")
+	}
+	if version > 0 && cur != version {
+		return 0, conflict("document", "Documents.ApplyAction", ErrConcurrentModification)
+	}
+
+	closed, err := Documents.isClosed(tx, dtype, id)
+	if err != nil {
+		return 0, err
+	}
+	if closed {
+		return 0, flowError("document", "Documents.ApplyAction", CodeConflict, ErrDocumentClosed)
+	}
+	_, ok, err := DocStateTransitions.NextStateTx(tx, dtype, state, action)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, flowError("document", "Documents.ApplyAction", CodeConflict, ErrWorkflowInvalidAction)
+	}
+
+	ev, err := Documents.applyAction(tx, wf, dtype, id, action, g.ID, text, version)
+	if err != nil {
+		return 0, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err = notifyAfterCommit(otx, "Documents.ApplyAction", ev); err != nil {
+		return 0, err
+	}
+
+	return ev.ToState, nil
+}
+
+// ApplyActionToMany applies the given action to each of the given
+// documents, on behalf of the given (singleton) group.  An event is
+// recorded for every document, with the given text as its comment.
+//
+// This operation is atomic: should the action not be applicable to
+// even one of the documents in its current state, none of the
+// documents is transitioned.  When the transaction is supplied by the
+// caller, it is the caller's responsibility to roll it back upon an
+// error.  The new states are answered in the order of the input
+// documents.
+func (_Documents) ApplyActionToMany(otx *sql.Tx, dtype DocTypeID, ids []DocumentID,
+	action DocActionID, gid GroupID, text string) (_ []DocStateID, err error) {
+	defer observeQuery("Documents.ApplyActionToMany", time.Now(), &err)
+
+	if dtype <= 0 || action <= 0 || gid <= 0 {
+		return nil, invalidArg("document", "Documents.ApplyActionToMany", "all identifiers should be positive integers")
+	}
+	if len(ids) == 0 {
+		return nil, invalidArg("document", "Documents.ApplyActionToMany", "list of documents should be non-empty")
+	}
+	if text == "" {
+		return nil, invalidArg("document", "Documents.ApplyActionToMany", "please add comments or notes")
+	}
+
+	wf, err := Workflows.GetByDocType(dtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, txRequiredErr("document", "Documents.ApplyActionToMany")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkAfterTransitionTx(otx, "Documents.ApplyActionToMany"); err != nil {
+			return nil, err
+		}
+		tx = otx
+	}
+
+	ary := make([]DocStateID, 0, len(ids))
+	evs := make([]*DocEvent, 0, len(ids))
+	for _, id := range ids {
+		ev, err := Documents.applyAction(tx, wf, dtype, id, action, gid, text, 0)
+		if err != nil {
+			return nil, fmt.Errorf("document %d : %w", id, err)
+		}
+		ary = append(ary, ev.ToState)
+		evs = append(evs, ev)
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = notifyAfterCommit(otx, "Documents.ApplyActionToMany", evs...); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ApplyActionCAS applies the given action to the given document, on
+// behalf of the given (singleton) group, provided that the document
+// is still in the state in which it was last read.
+//
+// Should another transition intervene between reading the state and
+// applying the action, the document is read again.  If the action is
+// valid from the new state as well, it is attempted again; otherwise,
+// `ErrWorkflowInvalidAction` is answered.  After `maxAttempts` failed
+// attempts, `ErrDocEventStateMismatch` is answered.
+//
+// Each attempt runs in a transaction of its own.  Hence, this
+// operation answers `ErrTxRequired` when explicit transactions are
+// required.
+func (_Documents) ApplyActionCAS(dtype DocTypeID, id DocumentID, action DocActionID,
+	gid GroupID, text string, maxAttempts int) (DocStateID, error) {
+	return Documents.applyActionCAS(dtype, id, action, gid, text, maxAttempts, nil)
+}
+
+// applyActionCAS implements `ApplyActionCAS`.  When `onRead` is not
+// `nil`, it is invoked after reading the current state of the
+// document, but before attempting the action.
+func (_Documents) applyActionCAS(dtype DocTypeID, id DocumentID, action DocActionID,
+	gid GroupID, text string, maxAttempts int, onRead func()) (_ DocStateID, err error) {
+	defer observeQuery("Documents.ApplyActionCAS", time.Now(), &err)
+
+	if txRequired {
+		return 0, txRequiredErr("document", "Documents.ApplyActionCAS")
+	}
+	if dtype <= 0 || id <= 0 || action <= 0 || gid <= 0 {
+		return 0, invalidArg("document", "Documents.ApplyActionCAS", "all identifiers should be positive integers")
+	}
+	if maxAttempts <= 0 {
+		return 0, invalidArg("document", "Documents.ApplyActionCAS", "maximum number of attempts should be a positive integer")
+	}
+
+	wf, err := Workflows.GetByDocType(dtype)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < maxAttempts; i++ {
+		state, err := Documents.CurrentState(dtype, id)
+		if err != nil {
+			return 0, err
+		}
+		ts, err := DocTypes._Transitions(dtype, state.ID)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := ts[action]; !ok {
+			return 0, flowError("document", "Documents.ApplyActionCAS", CodeConflict, ErrWorkflowInvalidAction)
+		}
+
+		if onRead != nil {
+			onRead()
+		}
+
+		nstate, err := Documents.applyActionIf(wf, dtype, id, state.ID, action, gid, text)
+		if !errors.Is(err, ErrDocEventStateMismatch) {
+			return nstate, err
+		}
+	}
+
+	return 0, flowError("document", "Documents.ApplyActionCAS", CodeConflict, ErrDocEventStateMismatch)
+}
+
+// applyActionIf applies the given action to the given document in a
+// new transaction, only if the document is in the expected state.
+// Otherwise, it answers `ErrDocEventStateMismatch`.
+func (_Documents) applyActionIf(wf *Workflow, dtype DocTypeID, id DocumentID, expected DocStateID,
+	action DocActionID, gid GroupID, text string) (DocStateID, error) {
+	tx, err := db().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the document until the action is applied.
+	var state DocStateID
+	tbl := DocTypes.docStorName(dtype)
+	row := tx.QueryRow(dbDialect().Rebind(`SELECT docstate_id FROM `+tbl+` WHERE id = ? FOR UPDATE`), id)
+	err = row.Scan(&state)
+	if err != nil {
+		return 0, notFound(err, "document", "Documents.ApplyActionCAS")
+	}
+	if state != expected {
+		return 0, flowError("document", "Documents.ApplyActionCAS", CodeConflict, ErrDocEventStateMismatch)
+	}
+
+	ev, err := Documents.applyAction(tx, wf, dtype, id, action, gid, text, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	if err = notifyAfterCommit(nil, "Documents.ApplyActionCAS", ev); err != nil {
+		return 0, err
+	}
+
+	return ev.ToState, nil
+}
+
 // SetTitle sets the title of the document.
-func (_Documents) SetTitle(otx *sql.Tx, dtype DocTypeID, id DocumentID, title string) error {
+func (_Documents) SetTitle(otx *sql.Tx, dtype DocTypeID, id DocumentID, title string) (err error) {
+	defer observeQuery("Documents.SetTitle", time.Now(), &err)
+
 	title = strings.TrimSpace(title)
 	if title == "" {
-		return errors.New("document title should not be empty")
+		return invalidArg("document", "Documents.SetTitle", "document title should not be empty")
 	}
 
 	// A child document does not have its own title.
@@ -529,18 +1300,21 @@ func (_Documents) SetTitle(otx *sql.Tx, dtype DocTypeID, id DocumentID, title st
 	var path DocPath
 	var dgroup GroupID
 	q := `SELECT path, group_id FROM ` + tbl + ` WHERE id = ?`
-	row := db.QueryRow(q, id)
-	err := row.Scan(&path, &dgroup)
+	row := db().QueryRow(dbDialect().Rebind(q), id)
+	err = row.Scan(&path, &dgroup)
 	if err != nil {
-		return err
+		return notFound(err, "document", "Documents.SetTitle")
 	}
 	if path != "" {
-		return errors.New("a child document cannot have its own title")
+		return invalidArg("document", "Documents.SetTitle", "a child document cannot have its own title")
 	}
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document", "Documents.SetTitle")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -549,8 +1323,8 @@ func (_Documents) SetTitle(otx *sql.Tx, dtype DocTypeID, id DocumentID, title st
 		tx = otx
 	}
 
-	q = `UPDATE ` + tbl + ` SET title = ?, ctime = NOW() WHERE id = ?`
-	_, err = tx.Exec(q, title, id)
+	q = `UPDATE ` + tbl + ` SET title = ?, ctime = ` + dbDialect().Now() + ` WHERE id = ?`
+	_, err = tx.Exec(dbDialect().Rebind(q), title, id)
 	if err != nil {
 		return err
 	}
@@ -565,17 +1339,21 @@ func (_Documents) SetTitle(otx *sql.Tx, dtype DocTypeID, id DocumentID, title st
 }
 
 // SetData sets the data of the document.
-func (_Documents) SetData(otx *sql.Tx, dtype DocTypeID, id DocumentID, data string) error {
+func (_Documents) SetData(otx *sql.Tx, dtype DocTypeID, id DocumentID, data string) (err error) {
+	defer observeQuery("Documents.SetData", time.Now(), &err)
+
 	if data == "" {
-		return errors.New("document data should not be empty")
+		return invalidArg("document", "Documents.SetData", "document data should not be empty")
 	}
 
 	tbl := DocTypes.docStorName(dtype)
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document", "Documents.SetData")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -584,8 +1362,8 @@ func (_Documents) SetData(otx *sql.Tx, dtype DocTypeID, id DocumentID, data stri
 		tx = otx
 	}
 
-	q := `UPDATE ` + tbl + ` SET data = ?, ctime = NOW() WHERE id = ?`
-	_, err = tx.Exec(q, data, id)
+	q := `UPDATE ` + tbl + ` SET data = ?, ctime = ` + dbDialect().Now() + ` WHERE id = ?`
+	_, err = tx.Exec(dbDialect().Rebind(q), data, id)
 	if err != nil {
 		return err
 	}
@@ -601,7 +1379,9 @@ func (_Documents) SetData(otx *sql.Tx, dtype DocTypeID, id DocumentID, data stri
 
 // Blobs answers a list of this document's enclosures (as names, not
 // the actual blobs).
-func (_Documents) Blobs(dtype DocTypeID, id DocumentID) ([]*Blob, error) {
+func (_Documents) Blobs(dtype DocTypeID, id DocumentID) (_ []*Blob, err error) {
+	defer observeQuery("Documents.Blobs", time.Now(), &err)
+
 	bs := make([]*Blob, 0, 1)
 	q := `
 	SELECT name, sha1sum
@@ -609,7 +1389,7 @@ func (_Documents) Blobs(dtype DocTypeID, id DocumentID) ([]*Blob, error) {
 	WHERE doctype_id = ?
 	AND doc_id = ?
 	`
-	rows, err := db.Query(q, dtype, id)
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, id)
 	if err != nil {
 		return nil, err
 	}
@@ -634,9 +1414,11 @@ func (_Documents) Blobs(dtype DocTypeID, id DocumentID) ([]*Blob, error) {
 // GetBlob retrieves the requested blob from the specified document,
 // if one such exists.  Lookup happens based on the given blob name.
 // The retrieved blob is copied into the specified path.
-func (_Documents) GetBlob(dtype DocTypeID, id DocumentID, blob *Blob) error {
+func (_Documents) GetBlob(dtype DocTypeID, id DocumentID, blob *Blob) (err error) {
+	defer observeQuery("Documents.GetBlob", time.Now(), &err)
+
 	if blob == nil {
-		return errors.New("blob should be non-nil")
+		return invalidArg("document", "Documents.GetBlob", "blob should be non-nil")
 	}
 
 	q := `
@@ -646,11 +1428,11 @@ func (_Documents) GetBlob(dtype DocTypeID, id DocumentID, blob *Blob) error {
 	AND doc_id = ?
 	AND sha1sum = ?
 	`
-	row := db.QueryRow(q, dtype, id, blob.SHA1Sum)
+	row := db().QueryRow(dbDialect().Rebind(q), dtype, id, blob.SHA1Sum)
 	var b Blob
-	err := row.Scan(&b.Name, &b.Path)
+	err = row.Scan(&b.Name, &b.Path)
 	if err != nil {
-		return err
+		return notFound(err, "blob", "Documents.GetBlob")
 	}
 	b.SHA1Sum = blob.SHA1Sum
 
@@ -675,9 +1457,11 @@ func (_Documents) GetBlob(dtype DocTypeID, id DocumentID, blob *Blob) error {
 }
 
 // AddBlob adds the path to an enclosure to this document.
-func (_Documents) AddBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, blob *Blob) error {
+func (_Documents) AddBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, blob *Blob) (err error) {
+	defer observeQuery("Documents.AddBlob", time.Now(), &err)
+
 	if blob == nil {
-		return errors.New("blob should be non-nil")
+		return invalidArg("document", "Documents.AddBlob", "blob should be non-nil")
 	}
 
 	// Verify the given checksum.
@@ -693,7 +1477,7 @@ func (_Documents) AddBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, blob *Blo
 	}
 	csum := fmt.Sprintf("%x", h.Sum(nil))
 	if blob.SHA1Sum != csum {
-		return fmt.Errorf("checksum mismatch -- given SHA1 sum : %s, computed SHA1 sum : %s", blob.SHA1Sum, csum)
+		return flowError("document", "Documents.AddBlob", CodeInvalidArg, fmt.Errorf("checksum mismatch -- given SHA1 sum : %s, computed SHA1 sum : %s", blob.SHA1Sum, csum))
 	}
 
 	// Store the blob in the appropriate path.
@@ -718,7 +1502,10 @@ func (_Documents) AddBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, blob *Blo
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document", "Documents.AddBlob")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -733,7 +1520,7 @@ func (_Documents) AddBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, blob *Blo
 	INSERT INTO wf_document_blobs(doctype_id, doc_id, name, path, sha1sum)
 	VALUES(?, ?, ?, ?, ?)
 	`
-	_, err = tx.Exec(q, dtype, id, blob.Name, bpath, csum)
+	_, err = tx.Exec(dbDialect().Rebind(q), dtype, id, blob.Name, bpath, csum)
 	if err != nil {
 		return err
 	}
@@ -750,15 +1537,19 @@ func (_Documents) AddBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, blob *Blo
 }
 
 // DeleteBlob deletes the given blob from the specified document.
-func (_Documents) DeleteBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, sha1 string) error {
+func (_Documents) DeleteBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, sha1 string) (err error) {
+	defer observeQuery("Documents.DeleteBlob", time.Now(), &err)
+
 	if sha1 == "" {
-		return errors.New("SHA1 sum should be non-empty")
+		return invalidArg("document", "Documents.DeleteBlob", "SHA1 sum should be non-empty")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document", "Documents.DeleteBlob")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -773,7 +1564,7 @@ func (_Documents) DeleteBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, sha1 s
 	WHERE sha1sum = ?
 	`
 	var count int64
-	row := tx.QueryRow(q, sha1)
+	row := tx.QueryRow(dbDialect().Rebind(q), sha1)
 	err = row.Scan(&count)
 	if err != nil {
 		return err
@@ -787,7 +1578,7 @@ func (_Documents) DeleteBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, sha1 s
 		AND sha1sum = ?
 		`
 		var path string
-		row = tx.QueryRow(q, dtype, id, sha1)
+		row = tx.QueryRow(dbDialect().Rebind(q), dtype, id, sha1)
 		err = row.Scan(&path)
 		if err != nil {
 			return err
@@ -805,7 +1596,7 @@ func (_Documents) DeleteBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, sha1 s
 	AND doc_id = ?
 	AND sha1sum = ?
 	`
-	_, err = tx.Exec(q, dtype, id, sha1)
+	_, err = tx.Exec(dbDialect().Rebind(q), dtype, id, sha1)
 	if err != nil {
 		return err
 	}
@@ -821,15 +1612,18 @@ func (_Documents) DeleteBlob(otx *sql.Tx, dtype DocTypeID, id DocumentID, sha1 s
 }
 
 // Tags answers a list of the tags associated with this document.
-func (_Documents) Tags(dtype DocTypeID, id DocumentID) ([]string, error) {
+func (_Documents) Tags(dtype DocTypeID, id DocumentID) (_ []string, err error) {
+	defer observeQuery("Documents.Tags", time.Now(), &err)
+
 	ts := make([]string, 0, 1)
 	q := `
 	SELECT tag
 	FROM wf_document_tags
 	WHERE doctype_id = ?
 	AND doc_id = ?
+	ORDER BY tag
 	`
-	rows, err := db.Query(q, dtype, id)
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, id)
 	if err != nil {
 		return nil, err
 	}
@@ -853,10 +1647,13 @@ func (_Documents) Tags(dtype DocTypeID, id DocumentID) ([]string, error) {
 
 // AddTags associates the given tag with this document.
 //
-// Tags are converted to lower case (as per normal Unicode casing)
-// before getting associated with documents.  Also, embedded spaces,
-// if any, are retained.
-func (_Documents) AddTags(otx *sql.Tx, dtype DocTypeID, id DocumentID, tags ...string) error {
+// Tags are trimmed, and converted to lower case (as per normal Unicode
+// casing) before getting associated with documents.  Also, embedded
+// spaces, if any, are retained.  Empty tags are ignored, and tags
+// already associated with the document are not duplicated.
+func (_Documents) AddTags(otx *sql.Tx, dtype DocTypeID, id DocumentID, tags ...string) (err error) {
+	defer observeQuery("Documents.AddTags", time.Now(), &err)
+
 	// A child document does not have its own tags.
 	q := `
 	SELECT parent_id
@@ -867,10 +1664,10 @@ func (_Documents) AddTags(otx *sql.Tx, dtype DocTypeID, id DocumentID, tags ...s
 	LIMIT 1
 	`
 	var tid int64
-	row := db.QueryRow(q, dtype, id)
-	err := row.Scan(&tid)
+	row := db().QueryRow(dbDialect().Rebind(q), dtype, id)
+	err = row.Scan(&tid)
 	if err == nil {
-		return ErrDocumentIsChild
+		return flowError("document", "Documents.AddTags", CodeInvalidArg, ErrDocumentIsChild)
 	}
 	if err != sql.ErrNoRows {
 		return err
@@ -878,7 +1675,10 @@ func (_Documents) AddTags(otx *sql.Tx, dtype DocTypeID, id DocumentID, tags ...s
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document", "Documents.AddTags")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -892,11 +1692,14 @@ func (_Documents) AddTags(otx *sql.Tx, dtype DocTypeID, id DocumentID, tags ...s
 	q = `
 	INSERT INTO wf_document_tags(doctype_id, doc_id, tag)
 	VALUES(?, ?, ?)
-	`
+	` + dbDialect().IgnoreDuplicates("tag")
 	for _, tag := range tags {
 		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
 		tag = strings.ToLower(tag)
-		_, err = tx.Exec(q, dtype, id, tag)
+		_, err = tx.Exec(dbDialect().Rebind(q), dtype, id, tag)
 		if err != nil {
 			return err
 		}
@@ -913,17 +1716,21 @@ func (_Documents) AddTags(otx *sql.Tx, dtype DocTypeID, id DocumentID, tags ...s
 }
 
 // RemoveTag disassociates the given tag from this document.
-func (_Documents) RemoveTag(otx *sql.Tx, dtype DocTypeID, id DocumentID, tag string) error {
+func (_Documents) RemoveTag(otx *sql.Tx, dtype DocTypeID, id DocumentID, tag string) (err error) {
+	defer observeQuery("Documents.RemoveTag", time.Now(), &err)
+
 	tag = strings.TrimSpace(tag)
 	if tag == "" {
-		return errors.New("tag should not be empty")
+		return invalidArg("document", "Documents.RemoveTag", "tag should not be empty")
 	}
 	tag = strings.ToLower(tag)
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("document", "Documents.RemoveTag")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -939,7 +1746,7 @@ func (_Documents) RemoveTag(otx *sql.Tx, dtype DocTypeID, id DocumentID, tag str
 	AND doc_id = ?
 	AND tag = ?
 	`
-	_, err = tx.Exec(q, dtype, id, tag)
+	_, err = tx.Exec(dbDialect().Rebind(q), dtype, id, tag)
 	if err != nil {
 		return err
 	}
@@ -954,11 +1761,70 @@ func (_Documents) RemoveTag(otx *sql.Tx, dtype DocTypeID, id DocumentID, tag str
 	return nil
 }
 
+// DocRef refers to a document, together with its type, since
+// document IDs are unique only within their type.
+type DocRef struct {
+	DocType DocTypeID  `json:"DocType"` // Type of the document
+	ID      DocumentID `json:"ID"`      // Unique within its type
+}
+
+// ListByTag answers the documents, across document types, that are
+// associated with the given tag, ordered by type and ID.
+//
+// Result set is paginated using `offset` and `limit`: it skips the
+// first `offset` documents, and has not more than `limit` elements.
+// A value of `0` for `limit` fetches until the end.
+func (_Documents) ListByTag(tag string, offset, limit int64) (_ []DocRef, err error) {
+	defer observeQuery("Documents.ListByTag", time.Now(), &err)
+
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return nil, invalidArg("document", "Documents.ListByTag", "tag should not be empty")
+	}
+	tag = strings.ToLower(tag)
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("document", "Documents.ListByTag", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT doctype_id, doc_id
+	FROM wf_document_tags
+	WHERE tag = ?
+	ORDER BY doctype_id, doc_id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), tag, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make([]DocRef, 0, 10)
+	for rows.Next() {
+		var ref DocRef
+		err = rows.Scan(&ref.DocType, &ref.ID)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
 // ChildrenIDs answers a list of this document's children IDs.
-func (_Documents) ChildrenIDs(dtype DocTypeID, id DocumentID) ([]struct {
+func (_Documents) ChildrenIDs(dtype DocTypeID, id DocumentID) (_ []struct {
 	DocTypeID
 	DocumentID
-}, error) {
+}, err error) {
+	defer observeQuery("Documents.ChildrenIDs", time.Now(), &err)
+
 	cids := make([]struct {
 		DocTypeID
 		DocumentID
@@ -970,7 +1836,7 @@ func (_Documents) ChildrenIDs(dtype DocTypeID, id DocumentID) ([]struct {
 	WHERE parent_doctype_id = ?
 	AND parent_id = ?
 	`
-	rows, err := db.Query(q, dtype, id)
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, id)
 	if err != nil {
 		return nil, err
 	}
@@ -993,3 +1859,91 @@ func (_Documents) ChildrenIDs(dtype DocTypeID, id DocumentID) ([]struct {
 
 	return cids, nil
 }
+
+// DocumentBundle holds a document together with all its associated
+// information, with names resolved.  It is intended to be serialised
+// as a whole, for offline analysis.
+type DocumentBundle struct {
+	Document *Document   `json:"Document"` // The document, including its data and the name of its access context
+	Tags     []string    `json:"Tags"`     // Tags of the document
+	Blobs    []*Blob     `json:"Blobs"`    // Blobs attached to the document
+	Events   []*DocEvent `json:"Events"`   // Complete event history of the document, oldest first
+}
+
+// Bundle assembles the given document, its tags, its blobs and its
+// complete event history into a single bundle.  The names of the
+// states, actions and groups of the events are filled in.
+func (_Documents) Bundle(dtype DocTypeID, id DocumentID) (_ *DocumentBundle, err error) {
+	defer observeQuery("Documents.Bundle", time.Now(), &err)
+
+	if dtype <= 0 || id <= 0 {
+		return nil, invalidArg("document", "Documents.Bundle", "all identifiers should be positive integers")
+	}
+
+	doc, err := Documents.Get(nil, dtype, id)
+	if err != nil {
+		return nil, err
+	}
+	b := &DocumentBundle{Document: doc}
+
+	row := db().QueryRow(dbDialect().Rebind("SELECT name FROM wf_access_contexts WHERE id = ?"), doc.AccCtx.ID)
+	err = row.Scan(&doc.AccCtx.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Tags, err = Documents.Tags(dtype, id)
+	if err != nil {
+		return nil, err
+	}
+	b.Blobs, err = Documents.Blobs(dtype, id)
+	if err != nil {
+		return nil, err
+	}
+
+	q := `
+	SELECT de.id, de.docstate_id, dsm.name, de.docaction_id, dam.name, de.group_id, gm.name, de.data, de.ctime, de.status
+	FROM wf_docevents de
+	JOIN wf_docstates_master dsm ON dsm.id = de.docstate_id
+	JOIN wf_docactions_master dam ON dam.id = de.docaction_id
+	JOIN wf_groups_master gm ON gm.id = de.group_id
+	WHERE de.doctype_id = ?
+	AND de.doc_id = ?
+	ORDER BY de.ctime, de.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var text sql.NullString
+	var dstatus string
+	b.Events = make([]*DocEvent, 0, 10)
+	for rows.Next() {
+		elem := DocEvent{DocType: dtype, DocID: id}
+		err = rows.Scan(&elem.ID, &elem.State, &elem.StateName, &elem.Action, &elem.ActionName, &elem.Group, &elem.GroupName, &text, &elem.Ctime, &dstatus)
+		if err != nil {
+			return nil, err
+		}
+		if text.Valid {
+			elem.Text = text.String
+		}
+		switch dstatus {
+		case "A":
+			elem.Status = EventStatusApplied
+
+		case "P":
+			elem.Status = EventStatusPending
+
+		default:
+			return nil, fmt.Errorf("unknown event status : %s", dstatus)
+		}
+		b.Events = append(b.Events, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
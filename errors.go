@@ -14,6 +14,12 @@
 
 package flow
 
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
 // Error defines `flow`-specific errors, and satisfies the `error`
 // interface.
 type Error string
@@ -29,6 +35,21 @@ const (
 	// ErrUnknown : unknown internal error
 	ErrUnknown = Error("ErrUnknown : unknown internal error")
 
+	// ErrNotFound : requested item does not exist
+	ErrNotFound = Error("ErrNotFound : requested item does not exist")
+
+	// ErrTxRequired : an explicit transaction is required
+	ErrTxRequired = Error("ErrTxRequired : an explicit transaction is required")
+	// ErrTxUntracked : transaction was not begun through WithTx
+	ErrTxUntracked = Error("ErrTxUntracked : transaction was not begun through WithTx")
+
+	// ErrInvalidName : name contains disallowed characters
+	ErrInvalidName = Error("ErrInvalidName : name contains disallowed characters")
+	// ErrNameTooLong : name is longer than its column allows
+	ErrNameTooLong = Error("ErrNameTooLong : name is longer than its column allows")
+	// ErrNameExists : another item with this name, ignoring case, already exists
+	ErrNameExists = Error("ErrNameExists : another item with this name, ignoring case, already exists")
+
 	// ErrDocEventRedundant : another equivalent event has already effected this action
 	ErrDocEventRedundant = Error("ErrDocEventRedundant : another equivalent event has already applied this action")
 	// ErrDocEventDocTypeMismatch : document's type does not match event's type
@@ -38,10 +59,20 @@ const (
 	// ErrDocEventAlreadyApplied : event already applied; nothing to do
 	ErrDocEventAlreadyApplied = Error("ErrDocEventAlreadyApplied : event already applied; nothing to do")
 
+	// ErrNoInitialState : document type does not have exactly one initial state
+	ErrNoInitialState = Error("ErrNoInitialState : document type does not have exactly one initial state")
+
 	// ErrDocumentNoParent : document is a root document
 	ErrDocumentNoParent = Error("ErrDocumentNoParent : document is a root document")
 	// ErrDocumentIsChild : cannot have its own state, title or tags
 	ErrDocumentIsChild = Error("ErrDocumentIsChild : cannot have its own state, title or tags")
+	// ErrDocumentClosed : document is in a terminal state
+	ErrDocumentClosed = Error("ErrDocumentClosed : document is in a terminal state")
+	// ErrConcurrentModification : document was modified since it was read
+	ErrConcurrentModification = Error("ErrConcurrentModification : document was modified since it was read")
+
+	// ErrTransitionExists : a transition is already defined for this state and action
+	ErrTransitionExists = Error("ErrTransitionExists : a transition is already defined for this state and action")
 
 	// ErrWorkflowInactive : this workflow is currently inactive
 	ErrWorkflowInactive = Error("ErrWorkflowInactive : this workflow is currently inactive")
@@ -51,3 +82,116 @@ const (
 	// ErrMessageNoRecipients : list of recipients is empty
 	ErrMessageNoRecipients = Error("ErrMessageNoRecipients : list of recipients is empty")
 )
+
+// ErrorCode classifies a `FlowError`, so that callers can handle
+// errors programmatically without matching their messages.
+type ErrorCode uint8
+
+// The following codes classify the errors answered by the entity
+// methods.
+const (
+	// CodeUnknown : the error could not be classified
+	CodeUnknown ErrorCode = iota
+	// CodeInvalidArg : an argument is malformed or out of range
+	CodeInvalidArg
+	// CodeNotFound : the requested item does not exist
+	CodeNotFound
+	// CodeConflict : the operation conflicts with existing data
+	CodeConflict
+)
+
+// String answers a short, human-readable name of the code.
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeInvalidArg:
+		return "invalid argument"
+	case CodeNotFound:
+		return "not found"
+	case CodeConflict:
+		return "conflict"
+	default:
+		return "unknown"
+	}
+}
+
+// FlowError is answered by the entity methods when an operation is
+// rejected.  It names the kind of item and the operation involved,
+// classifies the failure, and wraps its underlying cause.  Use
+// `errors.As` to extract it, and `errors.Is` to test the cause against
+// the sentinel errors above.
+type FlowError struct {
+	Entity string    // kind of item, e.g. "document type"
+	Op     string    // operation, e.g. "DocTypes.Rename"
+	Code   ErrorCode // classification of the failure
+	Err    error     // underlying cause
+}
+
+// Error implements the `error` interface.
+func (e *FlowError) Error() string {
+	return fmt.Sprintf("%s : %s : %v", e.Op, e.Entity, e.Err)
+}
+
+// Unwrap answers the underlying cause, for `errors.Is` and `errors.As`.
+func (e *FlowError) Unwrap() error {
+	return e.Err
+}
+
+// flowError wraps the given cause in a `FlowError`.
+func flowError(entity, op string, code ErrorCode, err error) error {
+	return &FlowError{Entity: entity, Op: op, Code: code, Err: err}
+}
+
+// invalidArg answers a `FlowError` with `CodeInvalidArg`, whose cause
+// carries the given message.
+func invalidArg(entity, op, msg string) error {
+	return flowError(entity, op, CodeInvalidArg, errors.New(msg))
+}
+
+// conflict answers a `FlowError` with `CodeConflict`, wrapping the
+// given cause.
+func conflict(entity, op string, err error) error {
+	return flowError(entity, op, CodeConflict, err)
+}
+
+// classify wraps the sentinel errors that the name checks answer in a
+// `FlowError` of the matching code.  Other errors are answered
+// unchanged.
+func classify(entity, op string, err error) error {
+	switch err {
+	case ErrInvalidName, ErrNameTooLong:
+		return flowError(entity, op, CodeInvalidArg, err)
+	case ErrNameExists, ErrTransitionExists:
+		return flowError(entity, op, CodeConflict, err)
+	}
+	return err
+}
+
+// txRequiredErr answers a `FlowError` that wraps `ErrTxRequired`, for
+// mutating methods that are given a `nil` transaction when explicit
+// transactions are required.
+func txRequiredErr(entity, op string) error {
+	return flowError(entity, op, CodeInvalidArg, ErrTxRequired)
+}
+
+// txUntrackedErr answers a `FlowError` that wraps `ErrTxUntracked`,
+// for methods whose effects depend on observing the end of the given
+// transaction.
+func txUntrackedErr(entity, op string) error {
+	return flowError(entity, op, CodeInvalidArg, ErrTxUntracked)
+}
+
+// notFound translates `sql.ErrNoRows` into a `FlowError` that wraps
+// `ErrNotFound`, naming the kind of item that was looked up.  Other
+// errors are answered unchanged.
+func notFound(err error, what, op string) error {
+	if err == sql.ErrNoRows {
+		return errNotFound(what, op)
+	}
+	return err
+}
+
+// errNotFound answers a `FlowError` that wraps `ErrNotFound`, naming
+// the kind of item that was looked up.
+func errNotFound(what, op string) error {
+	return flowError(what, op, CodeNotFound, ErrNotFound)
+}
@@ -0,0 +1,109 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build postgres
+// +build postgres
+
+package flow
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// openPostgres opens the test database on PostgreSQL, accessible to
+// the user `travis`, registers it with its dialect, and creates the
+// document actions master in it.  The answered function drops the
+// table, and restores the earlier registration.
+func openPostgres() (*sql.DB, func()) {
+	odb := db()
+	pdb := fatal1(sql.Open("postgres", "user=travis dbname=flow sslmode=disable")).(*sql.DB)
+	fatal0(RegisterDBDialect(pdb, Postgres))
+
+	fatal1(pdb.Exec(`
+	CREATE TABLE IF NOT EXISTS wf_docactions_master (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL UNIQUE,
+		reconfirm SMALLINT NOT NULL,
+		active SMALLINT NOT NULL DEFAULT 1,
+		ctime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		mtime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)
+	`))
+
+	return pdb, func() {
+		pdb.Exec("DROP TABLE IF EXISTS wf_docactions_master")
+		pdb.Close()
+		RegisterDB(odb)
+	}
+}
+
+// Document actions on PostgreSQL.  Run using `go test -tags postgres`,
+// against a database `flow` accessible to the user `travis`.
+func TestFlowPostgresDocActions(t *testing.T) {
+	gt = t
+
+	_, done := openPostgres()
+	defer done()
+
+	id := fatal1(DocActions.New(nil, "PG Approve", true)).(DocActionID)
+	da := fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual(id, da.ID)
+	assertEqual("PG Approve", da.Name)
+	assertEqual(true, da.Reconfirm)
+
+	eid, ok, err := DocActions.Exists("PG Approve")
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(id, eid)
+}
+
+// `LIKE` wildcards on PostgreSQL.
+func TestFlowPostgresLikeWildcards(t *testing.T) {
+	gt = t
+
+	_, done := openPostgres()
+	defer done()
+
+	checkLikeWildcards("PG LKW")
+}
+
+// Schema validation on PostgreSQL.
+func TestFlowPostgresRegisterDBWithCheck(t *testing.T) {
+	gt = t
+
+	odb := db()
+	defer RegisterDB(odb)
+
+	pdb := fatal1(sql.Open("postgres", "user=travis dbname=flow sslmode=disable")).(*sql.DB)
+	defer pdb.Close()
+
+	fatal1(pdb.Exec("CREATE TABLE IF NOT EXISTS wf_mailboxes (group_id INT NOT NULL)"))
+	defer pdb.Exec("DROP TABLE IF EXISTS wf_mailboxes")
+
+	err := RegisterDBDialectWithCheck(pdb, Postgres)
+	if err == nil {
+		t.Fatalf("expected an error for missing tables")
+	}
+	if !strings.Contains(err.Error(), "wf_docactions_master") {
+		t.Fatalf("missing table not named in error : %v", err)
+	}
+	if strings.Contains(err.Error(), "wf_mailboxes") {
+		t.Fatalf("existing table named in error : %v", err)
+	}
+	assertEqual(odb, db())
+}
@@ -15,9 +15,15 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -74,6 +80,17 @@ func assertNotEqual(expected, observed interface{}, msgs ...string) {
 	gt.Errorf("expected : '%v', observed : '%v'\n\t%s", expected, observed, strings.Join(msgs, "\n\t"))
 }
 
+// assertCode checks that the given error is a `FlowError` of the
+// given code.
+func assertCode(expected ErrorCode, err error, msgs ...string) {
+	var fe *FlowError
+	if !errors.As(err, &fe) {
+		gt.Errorf("expected a FlowError, observed : '%v'\n\t%s", err, strings.Join(msgs, "\n\t"))
+		return
+	}
+	assertEqual(expected, fe.Code, msgs...)
+}
+
 // Initialise DB connection.
 func TestFlowInit(t *testing.T) {
 	gt = t
@@ -101,7 +118,7 @@ func TestFlowCreate(t *testing.T) {
 	gt = t
 
 	t.Run("DocTypes", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		dtID1 = fatal1(DocTypes.New(tx, "Stor Request")).(DocTypeID)
@@ -111,7 +128,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("DocStates", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		dsID1 = fatal1(DocStates.New(tx, "Initial")).(DocStateID)
@@ -124,7 +141,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("DocActions", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		daID1 = fatal1(DocActions.New(tx, "Initialise", false)).(DocActionID)
@@ -141,7 +158,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("Workflows", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		wfID1 = fatal1(Workflows.New(tx, "Storage Management", dtID1, dsID1)).(WorkflowID)
@@ -151,7 +168,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("Users", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		res, err := tx.Exec(`INSERT INTO users_master(first_name, last_name, email, active)
@@ -194,7 +211,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("Groups", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		gID5 = fatal1(Groups.New(tx, "Analysts", "G")).(GroupID)
@@ -204,7 +221,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("GroupsAddUsers", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		fatal0(Groups.AddUser(tx, gID5, uID1))
@@ -219,7 +236,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("Roles", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		roleID1 = fatal1(Roles.New(tx, "Research Analyst")).(RoleID)
@@ -229,7 +246,7 @@ func TestFlowCreate(t *testing.T) {
 	})
 
 	t.Run("RolesAddPermissions", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		fatal0(Roles.AddPermissions(tx, roleID1, dtID1, []DocActionID{daID1, daID2, daID3, daID4, daID8, daID9}))
@@ -428,7 +445,7 @@ func TestFlowUpdate(t *testing.T) {
 	var res interface{}
 
 	t.Run("DocTypeRename", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if err := error0(DocTypes.Rename(tx, dtID1, "Storage Request")); err != nil {
@@ -445,7 +462,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("DocStateRename", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if err := error0(DocStates.Rename(tx, dsID1, "Draft")); err != nil {
@@ -462,7 +479,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("DocActionRename", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if res = error0(DocActions.Rename(tx, daID1, "List")); res != nil {
@@ -479,7 +496,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("WorkflowsSetActive", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if res = error0(Workflows.SetActive(tx, wfID1, false)); res != nil {
@@ -494,7 +511,7 @@ func TestFlowUpdate(t *testing.T) {
 		wf := res.(*Workflow)
 		assertEqual(false, wf.Active)
 
-		tx = fatal1(db.Begin()).(*sql.Tx)
+		tx = fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if res = error0(Workflows.SetActive(tx, wfID1, true)); res != nil {
@@ -511,7 +528,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("GroupRename", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if res = error0(Groups.Rename(tx, gID5, "Research Associates")); res != nil {
@@ -528,7 +545,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("GroupsDeleteUsers", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		error0(Groups.RemoveUser(tx, gID5, uID3))
@@ -543,7 +560,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("RolesRename", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if err := error0(Roles.Rename(tx, roleID1, "Analyst")); err != nil {
@@ -560,7 +577,7 @@ func TestFlowUpdate(t *testing.T) {
 	})
 
 	t.Run("RolesDeletePerm", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		if err := error0(Roles.RemovePermissions(tx, roleID1, dtID1, []DocActionID{daID8})); err != nil {
@@ -582,7 +599,7 @@ func TestFlowDelete(t *testing.T) {
 	var res interface{}
 
 	t.Run("GroupsDelete", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		assertNotEqual(nil, Groups.Delete(tx, gID1), "it should not be possible to delete a singleton group")
@@ -592,7 +609,7 @@ func TestFlowDelete(t *testing.T) {
 	})
 
 	t.Run("RolesDelete", func(t *testing.T) {
-		tx := fatal1(db.Begin()).(*sql.Tx)
+		tx := fatal1(db().Begin()).(*sql.Tx)
 		defer tx.Rollback()
 
 		assertEqual(nil, Roles.Delete(tx, roleID1))
@@ -608,28 +625,4430 @@ func TestFlowDelete(t *testing.T) {
 	})
 }
 
-// Tear down.
-func TestFlowTearDown(t *testing.T) {
+// Per-user activity feeds.
+func TestFlowDocEventsRecentByActor(t *testing.T) {
 	gt = t
 
-	tx := fatal1(db.Begin()).(*sql.Tx)
+	// Document types create their storage tables; hence, they cannot
+	// be a part of a larger transaction.
+	dtID := fatal1(DocTypes.New(nil, "RBA Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
 	defer tx.Rollback()
 
-	error1(tx.Exec(`DELETE FROM wf_ac_group_roles`))
-	error1(tx.Exec(`DELETE FROM wf_ac_group_hierarchy`))
-	error1(tx.Exec(`DELETE FROM wf_access_contexts`))
+	draft := fatal1(DocStates.New(tx, "RBA Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "RBA Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "RBA Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "RBA Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "RBA Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
 
-	error1(tx.Exec(`DELETE FROM wf_group_users`))
-	error1(tx.Exec(`DELETE FROM wf_groups_master`))
-	error1(tx.Exec(`DELETE FROM users_master`))
-	error1(tx.Exec(`DELETE FROM wf_role_docactions`))
-	error1(tx.Exec(`DELETE FROM wf_roles_master WHERE id > 2`))
+	acID := fatal1(AccessContexts.New(tx, "RBA Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "RBA Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "RBA Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "RBA Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "RBA Approved", NodeTypeEnd))
 
-	error1(tx.Exec(`DELETE FROM wf_workflow_nodes`))
-	error1(tx.Exec(`DELETE FROM wf_workflows`))
-	error1(tx.Exec(`DELETE FROM wf_docactions_master`))
-	error1(tx.Exec(`DELETE FROM wf_docstates_master WHERE id > 1`))
-	error1(tx.Exec(`DELETE FROM wf_doctypes_master`))
+	uid1 := fatal1(Users.New(tx, "RBA", "One", "rba.one@example.com", 1)).(UserID)
+	gid1 := fatal1(Groups.NewSingleton(tx, uid1)).(GroupID)
+	uid2 := fatal1(Users.New(tx, "RBA", "Two", "rba.two@example.com", 1)).(UserID)
+	gid2 := fatal1(Groups.NewSingleton(tx, uid2)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id1 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid1, Title: "RBA Document 1", Data: "Body"})).(DocumentID)
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid2, Title: "RBA Document 2", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id1, submit, uid1, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id2, submit, uid2, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id1, approve, uid1, "Approving"))
+
+	t.Run("ScopedToActor", func(t *testing.T) {
+		evs := fatal1(DocEvents.RecentByActor(uid1, 0)).([]*DocEvent)
+		assertEqual(2, len(evs))
+		for _, ev := range evs {
+			assertEqual(gid1, ev.Group)
+		}
+
+		evs = fatal1(DocEvents.RecentByActor(uid2, 0)).([]*DocEvent)
+		assertEqual(1, len(evs))
+		assertEqual("RBA Submit", evs[0].ActionName)
+	})
+
+	t.Run("NewestFirst", func(t *testing.T) {
+		evs := fatal1(DocEvents.RecentByActor(uid1, 1)).([]*DocEvent)
+		assertEqual(1, len(evs))
+		assertEqual(approve, evs[0].Action)
+		assertEqual("RBA Approve", evs[0].ActionName)
+	})
+}
+
+// Idempotent creation of vocabulary.
+func TestFlowEnsure(t *testing.T) {
+	gt = t
+
+	t.Run("DocTypes", func(t *testing.T) {
+		dt, created, err := DocTypes.Ensure(nil, "ENS Request")
+		fatal0(err)
+		assertEqual(true, created)
+
+		dt2, created, err := DocTypes.Ensure(nil, "ENS Request")
+		fatal0(err)
+		assertEqual(false, created)
+		assertEqual(dt.ID, dt2.ID)
+	})
+
+	t.Run("DocStates", func(t *testing.T) {
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		ds, created, err := DocStates.Ensure(tx, "ENS State")
+		fatal0(err)
+		assertEqual(true, created)
+
+		ds2, created, err := DocStates.Ensure(tx, "ENS State")
+		fatal0(err)
+		assertEqual(false, created)
+		assertEqual(ds.ID, ds2.ID)
+
+		fatal0(tx.Commit())
+	})
+
+	t.Run("DocActions", func(t *testing.T) {
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		da, created, err := DocActions.Ensure(tx, "ENS Action", true)
+		fatal0(err)
+		assertEqual(true, created)
+		assertEqual(true, da.Reconfirm)
+
+		da2, created, err := DocActions.Ensure(tx, "ENS Action", false)
+		fatal0(err)
+		assertEqual(false, created)
+		assertEqual(da.ID, da2.ID)
+		assertEqual(true, da2.Reconfirm, "existing action should be answered as is")
+
+		fatal0(tx.Commit())
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		r, created, err := Roles.Ensure(tx, "ENS Role")
+		fatal0(err)
+		assertEqual(true, created)
+
+		r2, created, err := Roles.Ensure(tx, "ENS Role")
+		fatal0(err)
+		assertEqual(false, created)
+		assertEqual(r.ID, r2.ID)
+
+		fatal0(tx.Commit())
+	})
+}
+
+// Initial states of document types.
+func TestFlowDocStatesInitial(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "INI Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "INI Draft")).(DocStateID)
+	wfID := fatal1(Workflows.New(tx, "INI Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, 0, wfID, "INI Draft", NodeTypeBegin))
+
+	fatal0(tx.Commit())
+
+	t.Run("Defined", func(t *testing.T) {
+		ds := fatal1(DocStates.Initial(dtID)).(*DocState)
+		assertEqual(draft, ds.ID)
+	})
+
+	t.Run("Undefined", func(t *testing.T) {
+		dtid := fatal1(DocTypes.New(nil, "INI Bare Request")).(DocTypeID)
+		_, err := DocStates.Initial(dtid)
+		assertEqual(true, errors.Is(err, ErrNoInitialState))
+	})
+
+	t.Run("Multiple", func(t *testing.T) {
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		dsid := fatal1(DocStates.New(tx, "INI Second Draft")).(DocStateID)
+		fatal1(Workflows.AddNode(tx, dtID, dsid, 0, wfID, "INI Second Draft", NodeTypeBegin))
+
+		fatal0(tx.Commit())
+
+		_, err := DocStates.Initial(dtID)
+		assertEqual(true, errors.Is(err, ErrNoInitialState))
+	})
+}
+
+// Batch transitions of documents.
+func TestFlowDocumentsApplyActionToMany(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "ATM Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "ATM Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "ATM Pending")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "ATM Submit", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+
+	acID := fatal1(AccessContexts.New(tx, "ATM Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "ATM Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "ATM Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "ATM Pending", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "ATM", "One", "atm.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	newDoc := func(title string) DocumentID {
+		return fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: title, Data: "Body"})).(DocumentID)
+	}
+
+	t.Run("AllValid", func(t *testing.T) {
+		ids := []DocumentID{newDoc("ATM Valid 1"), newDoc("ATM Valid 2")}
+		states := fatal1(Documents.ApplyActionToMany(nil, dtID, ids, submit, gid, "Submitting")).([]DocStateID)
+		assertEqual(2, len(states))
+		for i, id := range ids {
+			assertEqual(pending, states[i])
+			doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+			assertEqual(pending, doc.State.ID)
+		}
+	})
+
+	t.Run("OneInvalid", func(t *testing.T) {
+		id1 := newDoc("ATM Invalid 1")
+		id2 := newDoc("ATM Invalid 2")
+		fatal1(Documents.ApplyAction(nil, dtID, id2, submit, uid, "Submitting"))
+
+		_, err := Documents.ApplyActionToMany(nil, dtID, []DocumentID{id1, id2}, submit, gid, "Submitting")
+		assertEqual(true, errors.Is(err, ErrWorkflowInvalidAction), "action should be invalid for a pending document")
+
+		doc := fatal1(Documents.Get(nil, dtID, id1)).(*Document)
+		assertEqual(draft, doc.State.ID, "valid document should not transition when the batch fails")
+	})
+}
+
+// Roles without any permissions.
+func TestFlowRolesWithoutActions(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "RWA Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	submit := fatal1(DocActions.New(tx, "RWA Submit", false)).(DocActionID)
+	grid := fatal1(Roles.New(tx, "RWA Role")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, grid, dtID, []DocActionID{submit}))
+	rid := fatal1(Roles.New(tx, "RWA Idle Role")).(RoleID)
+
+	fatal0(tx.Commit())
+
+	rs := fatal1(Roles.WithoutActions(dtID)).([]*Role)
+	found := map[RoleID]bool{}
+	for _, r := range rs {
+		found[r.ID] = true
+	}
+	assertEqual(true, found[rid], "ungranted role should be listed")
+	assertEqual(false, found[grid], "granted role should not be listed")
+}
+
+// Combined timelines of correlated documents.
+func TestFlowDocEventsByCorrelation(t *testing.T) {
+	gt = t
+
+	dtID1 := fatal1(DocTypes.New(nil, "COR A Request")).(DocTypeID)
+	dtID2 := fatal1(DocTypes.New(nil, "COR B Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "COR Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "COR Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "COR Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "COR Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "COR Approve", false)).(DocActionID)
+	acID := fatal1(AccessContexts.New(tx, "COR Context")).(AccessContextID)
+	for _, dtID := range []DocTypeID{dtID1, dtID2} {
+		fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+		fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+		name := fmt.Sprintf("COR Flow %d", dtID)
+		wfID := fatal1(Workflows.New(tx, name, dtID, draft)).(WorkflowID)
+		fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, name+" Draft", NodeTypeBegin))
+		fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, name+" Pending", NodeTypeLinear))
+		fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, name+" Approved", NodeTypeEnd))
+	}
+
+	uid := fatal1(Users.New(tx, "COR", "One", "cor.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	newDoc := func(dtID DocTypeID, title, cid string) DocumentID {
+		return fatal1(Documents.New(nil, &DocumentsNewInput{
+			DocTypeID:       dtID,
+			AccessContextID: acID,
+			GroupID:         gid,
+			Title:           title,
+			Data:            "Body of " + title,
+			CorrelationID:   cid,
+		})).(DocumentID)
+	}
+	id1 := newDoc(dtID1, "COR Request", "COR-1")
+	id2 := newDoc(dtID2, "COR Sub-request", "COR-1")
+	id3 := newDoc(dtID1, "COR Unrelated", "")
+
+	doc := fatal1(Documents.Get(nil, dtID1, id1)).(*Document)
+	assertEqual("COR-1", doc.CorrelationID)
+
+	fatal1(Documents.ApplyAction(nil, dtID1, id1, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID2, id2, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID1, id3, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID1, id1, approve, uid, "Approving"))
+
+	evs := fatal1(DocEvents.ByCorrelation("COR-1")).([]*DocEvent)
+	assertEqual(3, len(evs))
+	for i, ev := range evs {
+		assertEqual(false, ev.DocType == dtID1 && ev.DocID == id3, "uncorrelated document's events should be excluded")
+		if i > 0 {
+			assertEqual(true, evs[i-1].ID < ev.ID, "events should be in time order")
+		}
+	}
+	assertEqual(dtID2, evs[1].DocType)
+}
+
+// Treatment of `NULL` names in legacy data.
+func TestFlowNullNames(t *testing.T) {
+	gt = t
+
+	fatal1(db().Exec(`ALTER TABLE wf_docactions_master MODIFY name VARCHAR(100) NULL`))
+	defer func() {
+		error1(db().Exec(`DELETE FROM wf_docactions_master WHERE name IS NULL`))
+		error1(db().Exec(`ALTER TABLE wf_docactions_master MODIFY name VARCHAR(100) NOT NULL`))
+	}()
+	res := fatal1(db().Exec(`INSERT INTO wf_docactions_master(name, reconfirm) VALUES(NULL, 0)`)).(sql.Result)
+	aid := DocActionID(fatal1(res.LastInsertId()).(int64))
+
+	t.Run("Strict", func(t *testing.T) {
+		_, err := DocActions.List(0, 0)
+		assertNotEqual(nil, err, "listing should fail on a NULL name")
+		_, err = DocActions.Get(aid)
+		assertNotEqual(nil, err, "retrieval should fail on a NULL name")
+	})
+
+	t.Run("Lenient", func(t *testing.T) {
+		SetNullNamesAsEmpty(true)
+		defer SetNullNamesAsEmpty(false)
+
+		das := fatal1(DocActions.List(0, 0)).([]*DocAction)
+		found := false
+		for _, da := range das {
+			if da.ID == aid {
+				found = true
+				assertEqual("", da.Name)
+			}
+		}
+		assertEqual(true, found, "action with a NULL name should be listed")
+
+		da := fatal1(DocActions.Get(aid)).(*DocAction)
+		assertEqual("", da.Name)
+	})
+}
+
+// Determinism of workflow graphs.
+func TestFlowWorkflowsIsDeterministic(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DET Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	pending := fatal1(DocStates.New(tx, "DET Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "DET Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "DET Rejected")).(DocStateID)
+	approve := fatal1(DocActions.New(tx, "DET Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "DET Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	fatal0(tx.Commit())
+
+	ok, ids, err := Workflows.IsDeterministic(dtID)
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(0, len(ids))
+
+	// A second target state for the same state and action.
+	fatal1(db().Exec(`INSERT INTO wf_docstate_transitions(doctype_id, from_state_id, docaction_id, to_state_id)
+		VALUES(?, ?, ?, ?)`, dtID, pending, approve, rejected))
+
+	ok, ids, err = Workflows.IsDeterministic(dtID)
+	fatal0(err)
+	assertEqual(false, ok)
+	assertEqual(2, len(ids))
+}
+
+// Document tags.
+func TestFlowDocumentsTags(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "TAG Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "TAG Draft")).(DocStateID)
+	acID := fatal1(AccessContexts.New(tx, "TAG Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "TAG Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "TAG Draft", NodeTypeBegin))
+
+	uid := fatal1(Users.New(tx, "TAG", "One", "tag.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id1 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "TAG Document 1", Data: "Body"})).(DocumentID)
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "TAG Document 2", Data: "Body"})).(DocumentID)
+
+	t.Run("Add", func(t *testing.T) {
+		fatal0(Documents.AddTags(nil, dtID, id1, " Urgent ", "urgent", "Finance", ""))
+		fatal0(Documents.AddTags(nil, dtID, id1, "URGENT"))
+		fatal0(Documents.AddTags(nil, dtID, id2, "urgent"))
+
+		ts := fatal1(Documents.Tags(dtID, id1)).([]string)
+		assertEqual(2, len(ts))
+		assertEqual("finance", ts[0])
+		assertEqual("urgent", ts[1])
+	})
+
+	t.Run("ListByTag", func(t *testing.T) {
+		refs := fatal1(Documents.ListByTag("Urgent", 0, 0)).([]DocRef)
+		assertEqual(2, len(refs))
+		assertEqual(DocRef{DocType: dtID, ID: id1}, refs[0])
+		assertEqual(id2, refs[1].ID)
+
+		refs = fatal1(Documents.ListByTag("Urgent", 1, 1)).([]DocRef)
+		assertEqual(1, len(refs))
+		assertEqual(id2, refs[0].ID)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		fatal0(Documents.RemoveTag(nil, dtID, id1, "urgent"))
+
+		ts := fatal1(Documents.Tags(dtID, id1)).([]string)
+		assertEqual(1, len(ts))
+
+		refs := fatal1(Documents.ListByTag("urgent", 0, 0)).([]DocRef)
+		assertEqual(1, len(refs))
+		assertEqual(id2, refs[0].ID)
+	})
+}
+
+// Current states of documents.
+func TestFlowDocumentsCurrentState(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "CST Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "CST Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "CST Pending")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "CST Submit", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+
+	acID := fatal1(AccessContexts.New(tx, "CST Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "CST Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "CST Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "CST Pending", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "CST", "One", "cst.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "CST Document", Data: "Body"})).(DocumentID)
+
+	ds := fatal1(Documents.CurrentState(dtID, id)).(*DocState)
+	assertEqual(draft, ds.ID)
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+
+	ds = fatal1(Documents.CurrentState(dtID, id)).(*DocState)
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(doc.State.ID, ds.ID)
+	assertEqual(doc.State.Name, ds.Name)
+	assertEqual("CST Pending", ds.Name)
+	sds := fatal1(DocStates.Get(pending)).(*DocState)
+	assertEqual(true, sds.CreatedAt().Equal(ds.CreatedAt()))
+	assertEqual(true, sds.UpdatedAt().Equal(ds.UpdatedAt()))
+	assertEqual(false, ds.CreatedAt().IsZero())
+
+	_, err := Documents.CurrentState(dtID, 1<<30)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+}
+
+// Validation of names.
+func TestFlowNameValidation(t *testing.T) {
+	gt = t
+	defer SetNameValidation(false, "")
+
+	// Default : anything non-empty is accepted.
+	SetNameValidation(false, "")
+	dsID := fatal1(DocStates.New(nil, "NAM Bell\aState")).(DocStateID)
+
+	// Control characters rejected.
+	SetNameValidation(true, "")
+	if _, err := DocStates.New(nil, "NAM Tab\tState"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	if _, err := DocActions.New(nil, "NAM Bell\aAction", false); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	if _, err := Roles.New(nil, "NAM Bell\aRole"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	if _, err := AccessContexts.New(nil, "NAM Bell\aContext"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	if _, err := Groups.New(nil, "NAM Bell\aGroup", "G"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	if err := DocStates.Rename(nil, dsID, "NAM Other\aState"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	fatal0(DocStates.Rename(nil, dsID, "NAM Plain State"))
+
+	// Configured characters rejected; control characters accepted.
+	SetNameValidation(false, ",\"")
+	if _, err := DocStates.New(nil, "NAM Comma, State"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	if err := DocStates.Rename(nil, dsID, `NAM "Quoted" State`); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected : %v, got : %v", ErrInvalidName, err)
+	}
+	fatal1(DocStates.New(nil, "NAM Tab\tState"))
+}
+
+// Transitions requiring a role.
+func TestFlowDocTypesTransitionsByRole(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "TBR Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "TBR Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "TBR Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "TBR Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "TBR Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "TBR Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "TBR Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "TBR Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	rid := fatal1(Roles.New(tx, "TBR Reviewer")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, rid, dtID, []DocActionID{approve, reject}))
+
+	fatal0(tx.Commit())
+
+	ary := fatal1(DocTypes.TransitionsByRole(rid)).([]*Transitionstruct)
+	assertEqual(2, len(ary))
+	seen := map[int64]bool{}
+	for _, tr := range ary {
+		assertEqual(int64(dtID), tr.DoctypeId)
+		assertEqual(int64(pending), tr.FromStateId)
+		seen[tr.DocactionId] = true
+	}
+	assertEqual(true, seen[int64(approve)])
+	assertEqual(true, seen[int64(reject)])
+
+	// A role without permissions requires no transitions.
+	rid = fatal1(Roles.New(nil, "TBR Idle")).(RoleID)
+	ary = fatal1(DocTypes.TransitionsByRole(rid)).([]*Transitionstruct)
+	assertEqual(0, len(ary))
+}
+
+// Paginated audit of a user's events.
+func TestFlowDocEventsByActorPaged(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "BAP Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "BAP Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "BAP Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "BAP Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "BAP Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "BAP Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "BAP Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "BAP Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "BAP Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "BAP Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "BAP Approved", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "BAP", "One", "bap.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	ouid := fatal1(Users.New(tx, "BAP", "Two", "bap.two@example.com", 1)).(UserID)
+	ogid := fatal1(Groups.NewSingleton(tx, ouid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id1 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "BAP Document 1", Data: "Body"})).(DocumentID)
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "BAP Document 2", Data: "Body"})).(DocumentID)
+	id3 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: ogid, Title: "BAP Document 3", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id1, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id2, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id1, approve, uid, "Approving"))
+	fatal1(Documents.ApplyAction(nil, dtID, id3, submit, ouid, "Submitting"))
+
+	// Spread the user's events over known days.
+	base := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	q := `
+	UPDATE wf_docevents
+	SET ctime = ?
+	WHERE doctype_id = ? AND doc_id = ? AND docaction_id = ?
+	`
+	fatal1(db().Exec(q, base, dtID, id1, submit))
+	fatal1(db().Exec(q, base.AddDate(0, 0, 1), dtID, id2, submit))
+	fatal1(db().Exec(q, base.AddDate(0, 0, 2), dtID, id1, approve))
+
+	t.Run("Unbounded", func(t *testing.T) {
+		evs, total, err := DocEvents.ByActorPaged(uid, time.Time{}, time.Time{}, 0, 0)
+		fatal0(err)
+		assertEqual(int64(3), total)
+		assertEqual(3, len(evs))
+		assertEqual(approve, evs[0].Action)
+		assertEqual("BAP Approve", evs[0].ActionName)
+		assertEqual("BAP Pending", evs[0].StateName)
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		evs, total, err := DocEvents.ByActorPaged(uid, base.AddDate(0, 0, 1), base.AddDate(0, 0, 2), 0, 0)
+		fatal0(err)
+		assertEqual(int64(1), total)
+		assertEqual(1, len(evs))
+		assertEqual(id2, evs[0].DocID)
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		evs, total, err := DocEvents.ByActorPaged(uid, base, time.Time{}, 1, 1)
+		fatal0(err)
+		assertEqual(int64(3), total)
+		assertEqual(1, len(evs))
+		assertEqual(id2, evs[0].DocID)
+	})
+}
+
+// Consistency of initial and final states.
+func TestFlowDocStatesConsistencyCheck(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "CCK Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "CCK Draft")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "CCK Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "CCK Rejected")).(DocStateID)
+	wfID := fatal1(Workflows.New(tx, "CCK Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, 0, wfID, "CCK Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, approved, 0, wfID, "CCK Approved", NodeTypeEnd))
+	fatal1(Workflows.AddNode(tx, dtID, rejected, 0, wfID, "CCK Rejected", NodeTypeEnd))
 
 	fatal0(tx.Commit())
+
+	t.Run("Valid", func(t *testing.T) {
+		sc := fatal1(DocStates.ConsistencyCheck(dtID)).(*StateConsistency)
+		assertEqual(int64(1), sc.InitialCount)
+		assertEqual(int64(2), sc.FinalCount)
+		assertEqual(true, sc.OK())
+	})
+
+	t.Run("ZeroInitial", func(t *testing.T) {
+		dtid := fatal1(DocTypes.New(nil, "CCK Bare Request")).(DocTypeID)
+		sc := fatal1(DocStates.ConsistencyCheck(dtid)).(*StateConsistency)
+		assertEqual(int64(0), sc.InitialCount)
+		assertEqual(false, sc.OK())
+	})
+
+	t.Run("MultipleInitial", func(t *testing.T) {
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		dsid := fatal1(DocStates.New(tx, "CCK Second Draft")).(DocStateID)
+		fatal1(Workflows.AddNode(tx, dtID, dsid, 0, wfID, "CCK Second Draft", NodeTypeBegin))
+
+		fatal0(tx.Commit())
+
+		sc := fatal1(DocStates.ConsistencyCheck(dtID)).(*StateConsistency)
+		assertEqual(int64(2), sc.InitialCount)
+		assertEqual(false, sc.OK())
+	})
+
+	t.Run("BeginStateMismatch", func(t *testing.T) {
+		dtid := fatal1(DocTypes.New(nil, "CCM Request")).(DocTypeID)
+
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		draft := fatal1(DocStates.New(tx, "CCM Draft")).(DocStateID)
+		pending := fatal1(DocStates.New(tx, "CCM Pending")).(DocStateID)
+		wfid := fatal1(Workflows.New(tx, "CCM Flow", dtid, draft)).(WorkflowID)
+		fatal1(Workflows.AddNode(tx, dtid, draft, 0, wfid, "CCM Draft", NodeTypeBegin))
+
+		fatal0(tx.Commit())
+
+		fatal1(db().Exec("UPDATE wf_workflows SET docstate_id = ? WHERE id = ?", pending, wfid))
+
+		sc := fatal1(DocStates.ConsistencyCheck(dtid)).(*StateConsistency)
+		assertEqual(int64(1), sc.InitialCount)
+		assertEqual(false, sc.OK())
+	})
+}
+
+// Escaping of `LIKE` patterns.
+func TestFlowLikeEscape(t *testing.T) {
+	gt = t
+
+	cases := []struct {
+		in, prefix, contains string
+	}{
+		{"plain", "plain%", "%plain%"},
+		{"100%", "100!%%", "%100!%%"},
+		{"snake_case", "snake!_case%", "%snake!_case%"},
+		{"wow!", "wow!!%", "%wow!!%"},
+		{`back\slash`, `back\slash%`, `%back\slash%`},
+		{"!%_", "!!!%!_%", "%!!!%!_%"},
+	}
+	for _, c := range cases {
+		assertEqual(c.prefix, likePrefix(c.in), c.in)
+		assertEqual(c.contains, likeContains(c.in), c.in)
+	}
+	assertEqual(" ESCAPE '!'", likeEscapeClause)
+
+	// Wildcards in a prefix match only themselves.
+	fatal1(AccessContexts.New(nil, "LKE 100% Context"))
+	fatal1(AccessContexts.New(nil, "LKE 1000 Context"))
+	fatal1(AccessContexts.New(nil, "LKE a_b! Context"))
+	fatal1(AccessContexts.New(nil, "LKE axb! Context"))
+
+	acs := fatal1(AccessContexts.List("LKE 100%", 0, 0)).([]*AccessContext)
+	assertEqual(1, len(acs))
+	assertEqual("LKE 100% Context", acs[0].Name)
+
+	acs = fatal1(AccessContexts.List("LKE a_b!", 0, 0)).([]*AccessContext)
+	assertEqual(1, len(acs))
+	assertEqual("LKE a_b! Context", acs[0].Name)
+}
+
+// checkLikeWildcards verifies, against the registered database, that
+// each of `%`, `_` and `!` in a prefix matches only itself.  Every
+// case defines a name that the prefix should match, and a decoy that
+// it would match were the character not escaped.
+func checkLikeWildcards(tag string) {
+	cases := []struct {
+		prefix, match, decoy string
+	}{
+		{" 5%", " 5% Off", " 50 Off"},
+		{" a_c", " a_c Action", " abc Action"},
+		{" x!", " x!y Action", " x%y Action"},
+	}
+	for _, c := range cases {
+		fatal1(DocActions.New(nil, tag+c.match, false))
+		fatal1(DocActions.New(nil, tag+c.decoy, false))
+
+		das := fatal1(DocActions.ListByPrefix(tag+c.prefix, 0, 0)).([]*DocAction)
+		names := make([]string, 0, len(das))
+		for _, da := range das {
+			names = append(names, da.Name)
+		}
+		assertEqual(tag+c.match, strings.Join(names, ","), c.prefix)
+	}
+}
+
+// `LIKE` wildcards on MySQL.
+func TestFlowLikeWildcards(t *testing.T) {
+	gt = t
+
+	checkLikeWildcards("LKW")
+}
+
+// Bulk permission checks.
+func TestFlowAccessContextsCanPerformMany(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "CPM Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "CPM Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "CPM Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "CPM Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "CPM Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "CPM Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "CPM Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "CPM Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	acID := fatal1(AccessContexts.New(tx, "CPM Context")).(AccessContextID)
+
+	// One user holds a role with all the actions.
+	rid := fatal1(Roles.New(tx, "CPM Role")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, rid, dtID, []DocActionID{submit, approve, reject}))
+	uid := fatal1(Users.New(tx, "CPM", "One", "cpm.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, gid, rid))
+
+	// A second user holds a role with only `Approve`.
+	prid := fatal1(Roles.New(tx, "CPM Approver")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, prid, dtID, []DocActionID{approve}))
+	puid := fatal1(Users.New(tx, "CPM", "Partial", "cpm.partial@example.com", 1)).(UserID)
+	pgid := fatal1(Groups.NewSingleton(tx, puid)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, pgid, prid))
+
+	fatal0(tx.Commit())
+
+	actions := []DocActionID{submit, approve, reject}
+
+	t.Run("FullGrants", func(t *testing.T) {
+		res := fatal1(AccessContexts.CanPerformMany(acID, uid, dtID, pending, actions)).(map[DocActionID]bool)
+		assertEqual(3, len(res))
+		assertEqual(false, res[submit]) // No transition from `Pending`.
+		assertEqual(true, res[approve])
+		assertEqual(true, res[reject])
+	})
+
+	t.Run("PartialGrants", func(t *testing.T) {
+		res := fatal1(AccessContexts.CanPerformMany(acID, puid, dtID, pending, actions)).(map[DocActionID]bool)
+		assertEqual(3, len(res))
+		assertEqual(false, res[submit])
+		assertEqual(true, res[approve])
+		assertEqual(false, res[reject])
+
+		res = fatal1(AccessContexts.CanPerformMany(acID, puid, dtID, draft, actions)).(map[DocActionID]bool)
+		assertEqual(false, res[submit])
+		assertEqual(false, res[approve])
+	})
+}
+
+// All users of an access context.
+func TestFlowAccessContextsAllUsers(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	acID := fatal1(AccessContexts.New(tx, "ALU Context")).(AccessContextID)
+
+	// Two users, holding a role each.
+	rid := fatal1(Roles.New(tx, "ALU Role")).(RoleID)
+	uid1 := fatal1(Users.New(tx, "ALU", "One", "alu.one@example.com", 1)).(UserID)
+	gid1 := fatal1(Groups.NewSingleton(tx, uid1)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, gid1, rid))
+	uid2 := fatal1(Users.New(tx, "ALU", "Two", "alu.two@example.com", 1)).(UserID)
+	gid2 := fatal1(Groups.NewSingleton(tx, uid2)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, gid2, rid))
+
+	// A general group with both users, holding a second role.
+	ggid := fatal1(Groups.New(tx, "ALU Team", "G")).(GroupID)
+	fatal0(Groups.AddUser(tx, ggid, uid1))
+	fatal0(Groups.AddUser(tx, ggid, uid2))
+	vrid := fatal1(Roles.New(tx, "ALU Viewer")).(RoleID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, ggid, vrid))
+
+	// A user present only in the reporting hierarchy.
+	uid3 := fatal1(Users.New(tx, "ALU", "Three", "alu.three@example.com", 1)).(UserID)
+	gid3 := fatal1(Groups.NewSingleton(tx, uid3)).(GroupID)
+	fatal0(AccessContexts.AddGroup(tx, acID, gid3, gid1))
+
+	// A user outside the context.
+	fatal1(Users.New(tx, "ALU", "Outsider", "alu.outsider@example.com", 1))
+
+	fatal0(tx.Commit())
+
+	uids := fatal1(AccessContexts.AllUsers(acID)).([]UserID)
+	assertEqual(3, len(uids))
+	assertEqual(uid1, uids[0])
+	assertEqual(uid2, uids[1])
+	assertEqual(uid3, uids[2])
+}
+
+// Transactions with explicit options.
+func TestFlowWithTxOpts(t *testing.T) {
+	gt = t
+
+	t.Run("ReadOnlyRejectsWrite", func(t *testing.T) {
+		opts := &sql.TxOptions{ReadOnly: true}
+		err := WithTxOpts(opts, func(tx *sql.Tx) error {
+			_, err := DocStates.New(tx, "TXO Read Only State")
+			return err
+		})
+		if err == nil {
+			t.Fatalf("expected write in a read-only transaction to fail")
+		}
+		_, err = DocStates.GetByName("TXO Read Only State")
+		assertEqual(true, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("ReadOnlyReads", func(t *testing.T) {
+		opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+		var count int64
+		fatal0(WithTxOpts(opts, func(tx *sql.Tx) error {
+			return tx.QueryRow("SELECT COUNT(*) FROM wf_docstates_master").Scan(&count)
+		}))
+		if count == 0 {
+			t.Fatalf("expected at least one document state")
+		}
+	})
+
+	t.Run("ReadCommittedWrites", func(t *testing.T) {
+		opts := &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+		var dsid DocStateID
+		fatal0(WithTxOpts(opts, func(tx *sql.Tx) error {
+			var err error
+			dsid, err = DocStates.New(tx, "TXO Committed State")
+			return err
+		}))
+		ds := fatal1(DocStates.GetByName("TXO Committed State")).(*DocState)
+		assertEqual(dsid, ds.ID)
+	})
+}
+
+// Average dwell times per state.
+func TestFlowWorkflowsDwellTimes(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DWL Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "DWL Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "DWL Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "DWL Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "DWL Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "DWL Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "DWL Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "DWL Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "DWL Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "DWL Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "DWL Approved", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "DWL", "One", "dwl.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id1 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "DWL Document 1", Data: "Body"})).(DocumentID)
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "DWL Document 2", Data: "Body"})).(DocumentID)
+	for _, id := range []DocumentID{id1, id2} {
+		fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+		fatal1(Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving"))
+	}
+
+	// Document 1 : 1h in `Draft`, 2h in `Pending`.
+	// Document 2 : 3h in `Draft`, 4h in `Pending`.
+	base := time.Date(2017, time.March, 1, 8, 0, 0, 0, time.UTC)
+	tbl := DocTypes.docStorName(dtID)
+	qe := `
+	UPDATE wf_docevents
+	SET ctime = ?
+	WHERE doctype_id = ? AND doc_id = ? AND docaction_id = ?
+	`
+	for _, d := range []struct {
+		id              DocumentID
+		submit, approve time.Duration
+	}{
+		{id1, 1 * time.Hour, 3 * time.Hour},
+		{id2, 3 * time.Hour, 7 * time.Hour},
+	} {
+		fatal1(db().Exec("UPDATE "+tbl+" SET ctime = ? WHERE id = ?", base, d.id))
+		fatal1(db().Exec(qe, base.Add(d.submit), dtID, d.id, submit))
+		fatal1(db().Exec(qe, base.Add(d.approve), dtID, d.id, approve))
+	}
+
+	t.Run("Unbounded", func(t *testing.T) {
+		res := fatal1(Workflows.DwellTimes(dtID, time.Time{}, time.Time{})).(map[DocStateID]time.Duration)
+		assertEqual(2, len(res))
+		assertEqual(2*time.Hour, res[draft])
+		assertEqual(3*time.Hour, res[pending])
+		_, ok := res[approved]
+		assertEqual(false, ok)
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		res := fatal1(Workflows.DwellTimes(dtID, base.Add(2*time.Hour), time.Time{})).(map[DocStateID]time.Duration)
+		assertEqual(3*time.Hour, res[draft])
+		assertEqual(3*time.Hour, res[pending])
+
+		res = fatal1(Workflows.DwellTimes(dtID, time.Time{}, base.Add(2*time.Hour))).(map[DocStateID]time.Duration)
+		assertEqual(1, len(res))
+		assertEqual(1*time.Hour, res[draft])
+	})
+}
+
+// Explicit transactions.
+func TestFlowRequireExplicitTx(t *testing.T) {
+	gt = t
+	defer RequireExplicitTx(false)
+
+	t.Run("Implicit", func(t *testing.T) {
+		RequireExplicitTx(false)
+		fatal1(DocStates.New(nil, "ETX Implicit State"))
+	})
+
+	t.Run("Explicit", func(t *testing.T) {
+		RequireExplicitTx(true)
+
+		_, err := DocStates.New(nil, "ETX Forgotten State")
+		assertEqual(true, errors.Is(err, ErrTxRequired))
+		assertCode(CodeInvalidArg, err)
+		_, err = Roles.New(nil, "ETX Forgotten Role")
+		assertEqual(true, errors.Is(err, ErrTxRequired))
+		_, _, err = DocActions.Ensure(nil, "ETX Forgotten Action", false)
+		assertEqual(true, errors.Is(err, ErrTxRequired))
+		ds := fatal1(DocStates.GetByName("ETX Implicit State")).(*DocState)
+		assertEqual(true, errors.Is(DocStates.Rename(nil, ds.ID, "ETX Renamed State"), ErrTxRequired))
+
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+		fatal1(DocStates.New(tx, "ETX Explicit State"))
+		fatal0(DocStates.Rename(tx, ds.ID, "ETX Renamed State"))
+		fatal0(tx.Commit())
+
+		fatal1(DocStates.GetByName("ETX Explicit State"))
+		fatal1(DocStates.GetByName("ETX Renamed State"))
+	})
+}
+
+// Document types of documents.
+func TestFlowDocumentsDocType(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DDT Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "DDT Draft")).(DocStateID)
+	acID := fatal1(AccessContexts.New(tx, "DDT Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "DDT Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "DDT Draft", NodeTypeBegin))
+
+	uid := fatal1(Users.New(tx, "DDT", "One", "ddt.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "DDT Document", Data: "Body"})).(DocumentID)
+
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(dtID, doc.DocType.ID)
+	assertEqual("DDT Request", doc.DocType.Name)
+
+	_, err := Documents.Get(nil, dtID, id+1000)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+}
+
+// Revocation of all the actions of a role.
+func TestFlowRolesRevokeAllActions(t *testing.T) {
+	gt = t
+
+	dtID1 := fatal1(DocTypes.New(nil, "RAA Request")).(DocTypeID)
+	dtID2 := fatal1(DocTypes.New(nil, "RAA Other Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	submit := fatal1(DocActions.New(tx, "RAA Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "RAA Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "RAA Reject", true)).(DocActionID)
+	rid := fatal1(Roles.New(tx, "RAA Role")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, rid, dtID1, []DocActionID{submit, approve, reject}))
+	fatal0(Roles.AddPermissions(tx, rid, dtID2, []DocActionID{submit}))
+
+	fatal0(tx.Commit())
+
+	n := fatal1(Roles.RevokeAllActions(nil, rid, dtID1)).(int64)
+	assertEqual(int64(3), n)
+
+	perms := fatal1(Roles.Permissions(rid)).(map[string]struct {
+		DocTypeID DocTypeID
+		Actions   []*DocAction
+	})
+	assertEqual(1, len(perms))
+	assertEqual(dtID2, perms["RAA Other Request"].DocTypeID)
+
+	// Nothing is left to revoke.
+	n = fatal1(Roles.RevokeAllActions(nil, rid, dtID1)).(int64)
+	assertEqual(int64(0), n)
+}
+
+// Documents created in a time window.
+func TestFlowDocumentsCreatedBetween(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "CRB Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "CRB Draft")).(DocStateID)
+	acID := fatal1(AccessContexts.New(tx, "CRB Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "CRB Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "CRB Draft", NodeTypeBegin))
+
+	uid := fatal1(Users.New(tx, "CRB", "One", "crb.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	base := time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC)
+	tbl := DocTypes.docStorName(dtID)
+	ids := make([]DocumentID, 0, 3)
+	for i, offset := range []time.Duration{-time.Second, 0, 24 * time.Hour} {
+		id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: fmt.Sprintf("CRB Document %d", i+1), Data: "Body"})).(DocumentID)
+		fatal1(db().Exec("UPDATE "+tbl+" SET ctime = ? WHERE id = ?", base.Add(offset), id))
+		ids = append(ids, id)
+	}
+
+	t.Run("Boundaries", func(t *testing.T) {
+		docs, total, err := Documents.CreatedBetween(dtID, base, base.Add(24*time.Hour), 0, 0)
+		fatal0(err)
+		assertEqual(int64(1), total)
+		assertEqual(1, len(docs))
+		assertEqual(ids[1], docs[0].ID)
+		assertEqual("CRB Request", docs[0].DocType.Name)
+
+		docs, total, err = Documents.CreatedBetween(dtID, base, base.Add(24*time.Hour+time.Second), 0, 0)
+		fatal0(err)
+		assertEqual(int64(2), total)
+		assertEqual(ids[2], docs[1].ID)
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		docs, total, err := Documents.CreatedBetween(dtID, time.Time{}, time.Time{}, 1, 1)
+		fatal0(err)
+		assertEqual(int64(3), total)
+		assertEqual(1, len(docs))
+		assertEqual(ids[1], docs[0].ID)
+	})
+}
+
+// Seeding of the standard workflow.
+func TestFlowWorkflowsSeedStandard(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "SSD Request")).(DocTypeID)
+
+	sw1 := fatal1(Workflows.SeedStandard(nil, dtID)).(*StandardWorkflow)
+	sw2 := fatal1(Workflows.SeedStandard(nil, dtID)).(*StandardWorkflow)
+	assertEqual(*sw1, *sw2)
+
+	var count int64
+	fatal0(db().QueryRow("SELECT COUNT(*) FROM wf_docstate_transitions WHERE doctype_id = ?", dtID).Scan(&count))
+	assertEqual(int64(3), count)
+	fatal0(db().QueryRow("SELECT COUNT(*) FROM wf_docstates_master WHERE name IN ('DRAFT', 'PENDING', 'APPROVED', 'REJECTED')").Scan(&count))
+	assertEqual(int64(4), count)
+	fatal0(db().QueryRow("SELECT COUNT(*) FROM wf_docactions_master WHERE name IN ('SUBMIT', 'APPROVE', 'REJECT')").Scan(&count))
+	assertEqual(int64(3), count)
+
+	tm := fatal1(DocTypes._Transitions(dtID, sw1.Pending)).(map[DocActionID]DocStateID)
+	assertEqual(2, len(tm))
+	assertEqual(sw1.Approved, tm[sw1.Approve])
+	assertEqual(sw1.Rejected, tm[sw1.Reject])
+
+	wf := fatal1(Workflows.GetByDocType(dtID)).(*Workflow)
+	assertEqual(sw1.Workflow, wf.ID)
+	assertEqual(sw1.Draft, wf.BeginState.ID)
+	nodes := fatal1(Nodes.List(wf.ID)).([]*Node)
+	assertEqual(4, len(nodes))
+
+	// Documents of the seeded type can be created, and moved along.
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	acID := fatal1(AccessContexts.New(tx, "SSD Context")).(AccessContextID)
+	uid := fatal1(Users.New(tx, "SSD", "Tester", "ssd@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{
+		DocTypeID:       dtID,
+		AccessContextID: acID,
+		GroupID:         gid,
+		Title:           "SSD Document",
+		Data:            "SSD Body",
+	})).(DocumentID)
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(sw1.Draft, doc.State.ID)
+
+	assertEqual(sw1.Pending, fatal1(Documents.ApplyAction(nil, dtID, id, sw1.Submit, uid, "Submitted")).(DocStateID))
+}
+
+// Last event of a document.
+func TestFlowDocEventsLast(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "LST Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "LST Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "LST Pending")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "LST Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "LST Submit", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "LST Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	acID := fatal1(AccessContexts.New(tx, "LST Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "LST Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "LST Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "LST Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, rejected, acID, wfID, "LST Rejected", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "LST", "One", "lst.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "LST Document", Data: "Body"})).(DocumentID)
+
+	_, err := DocEvents.Last(dtID, id)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+	ev := fatal1(DocEvents.Last(dtID, id)).(*DocEvent)
+	assertEqual(submit, ev.Action)
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, reject, uid, "Rejecting"))
+	ev = fatal1(DocEvents.Last(dtID, id)).(*DocEvent)
+	assertEqual(reject, ev.Action)
+	assertEqual("LST Reject", ev.ActionName)
+	assertEqual(pending, ev.State)
+	assertEqual(gid, ev.Group)
+	assertEqual(EventStatusApplied, ev.Status)
+}
+
+// Documents actionable by a user, across types.
+func TestFlowDocumentsActionableBy(t *testing.T) {
+	gt = t
+
+	dtID1 := fatal1(DocTypes.New(nil, "ACT Request")).(DocTypeID)
+	dtID2 := fatal1(DocTypes.New(nil, "ACU Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "ACT Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "ACT Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "ACT Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "ACT Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "ACT Approve", false)).(DocActionID)
+	acID := fatal1(AccessContexts.New(tx, "ACT Context")).(AccessContextID)
+	rid := fatal1(Roles.New(tx, "ACT Role")).(RoleID)
+	for _, dtID := range []DocTypeID{dtID1, dtID2} {
+		fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+		fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+		fatal0(Roles.AddPermissions(tx, rid, dtID, []DocActionID{submit, approve}))
+
+		name := fmt.Sprintf("ACT Flow %d", dtID)
+		wfID := fatal1(Workflows.New(tx, name, dtID, draft)).(WorkflowID)
+		fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, name+" Draft", NodeTypeBegin))
+		fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, name+" Pending", NodeTypeLinear))
+		fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, name+" Approved", NodeTypeEnd))
+	}
+
+	uid := fatal1(Users.New(tx, "ACT", "One", "act.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, gid, rid))
+	ouid := fatal1(Users.New(tx, "ACU", "Other", "acu.other@example.com", 1)).(UserID)
+	ogid := fatal1(Groups.NewSingleton(tx, ouid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	newDoc := func(dtID DocTypeID, gid GroupID, title string) DocumentID {
+		return fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: title, Data: "Body"})).(DocumentID)
+	}
+	dft := newDoc(dtID1, gid, "ACT Draft")
+	done := newDoc(dtID1, gid, "ACT Done")
+	fatal1(Documents.ApplyAction(nil, dtID1, done, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID1, done, approve, uid, "Approving"))
+	pnd := newDoc(dtID2, ogid, "ACU Pending")
+	fatal1(Documents.ApplyAction(nil, dtID2, pnd, submit, ouid, "Submitting"))
+
+	docs, total, err := Documents.ActionableBy(uid, 0, 0)
+	fatal0(err)
+	assertEqual(int64(2), total)
+	assertEqual(2, len(docs))
+	found := map[DocTypeID]DocumentID{}
+	for _, doc := range docs {
+		found[doc.DocType.ID] = doc.ID
+	}
+	assertEqual(dft, found[dtID1])
+	assertEqual(pnd, found[dtID2])
+
+	docs, total, err = Documents.ActionableBy(uid, 1, 1)
+	fatal0(err)
+	assertEqual(int64(2), total)
+	assertEqual(1, len(docs))
+
+	// Documents in terminal states are closed, even when a transition
+	// leads out of those states.
+	fatal0(DocTypes.AddTransition(nil, dtID1, approved, submit, pending))
+	_, total, err = Documents.ActionableBy(uid, 0, 0)
+	fatal0(err)
+	assertEqual(int64(3), total)
+	fatal0(DocStates.SetTerminal(nil, dtID1, approved, true))
+	assertEqual(true, fatal1(Documents.IsClosed(dtID1, done)).(bool))
+	docs, total, err = Documents.ActionableBy(uid, 0, 0)
+	fatal0(err)
+	assertEqual(int64(2), total)
+	assertEqual(2, len(docs))
+}
+
+// Removal of duplicate group memberships.
+func TestFlowGroupsDeduplicateMemberships(t *testing.T) {
+	gt = t
+
+	// Duplicates are possible only without the uniqueness constraint.
+	// The foreign key on `group_id` needs an index of its own meanwhile.
+	var idx string
+	q := `
+	SELECT DISTINCT index_name
+	FROM information_schema.statistics
+	WHERE table_schema = DATABASE()
+	AND table_name = 'wf_group_users'
+	AND non_unique = 0
+	AND index_name <> 'PRIMARY'
+	`
+	fatal0(db().QueryRow(q).Scan(&idx))
+	fatal1(db().Exec("ALTER TABLE wf_group_users ADD INDEX ddm_group_id (group_id)"))
+	fatal1(db().Exec("ALTER TABLE wf_group_users DROP INDEX " + idx))
+	defer func() {
+		fatal1(db().Exec("ALTER TABLE wf_group_users ADD UNIQUE " + idx + " (group_id, user_id)"))
+		fatal1(db().Exec("ALTER TABLE wf_group_users DROP INDEX ddm_group_id"))
+	}()
+
+	uid1 := fatal1(Users.New(nil, "DDM", "One", "ddm.one@example.com", 1)).(UserID)
+	uid2 := fatal1(Users.New(nil, "DDM", "Two", "ddm.two@example.com", 1)).(UserID)
+	gid := fatal1(Groups.New(nil, "DDM Team", "G")).(GroupID)
+	fatal0(Groups.AddUser(nil, gid, uid1))
+	fatal0(Groups.AddUser(nil, gid, uid2))
+
+	ins := "INSERT INTO wf_group_users(group_id, user_id) VALUES(?, ?)"
+	fatal1(db().Exec(ins, gid, uid1))
+	fatal1(db().Exec(ins, gid, uid1))
+	fatal1(db().Exec(ins, gid, uid2))
+
+	n := fatal1(Groups.DeduplicateMemberships(nil)).(int64)
+	assertEqual(int64(3), n)
+
+	var count int64
+	fatal0(db().QueryRow("SELECT COUNT(*) FROM wf_group_users WHERE group_id = ?", gid).Scan(&count))
+	assertEqual(int64(2), count)
+
+	n = fatal1(Groups.DeduplicateMemberships(nil)).(int64)
+	assertEqual(int64(0), n)
+}
+
+// SLA breaches of documents.
+func TestFlowDocumentsSLABreaches(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "SLA Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "SLA Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "SLA Pending")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "SLA Submit", false)).(DocActionID)
+	trID := fatal1(DocStateTransitions.New(tx, dtID, draft, submit, pending)).(DocTransitionID)
+
+	acID := fatal1(AccessContexts.New(tx, "SLA Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "SLA Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "SLA Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "SLA Pending", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "SLA", "One", "sla.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	fatal0(DocTypes.SetTransitionSLA(nil, trID, time.Minute))
+
+	newDoc := func(title string) DocumentID {
+		return fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: title, Data: "Body"})).(DocumentID)
+	}
+	aged := newDoc("SLA Aged")
+	newDoc("SLA Fresh")
+	moved := newDoc("SLA Moved")
+	tbl := DocTypes.docStorName(dtID)
+	for _, id := range []DocumentID{aged, moved} {
+		fatal1(db().Exec("UPDATE "+tbl+" SET ctime = NOW() - INTERVAL 1 HOUR WHERE id = ?", id))
+	}
+	fatal1(Documents.ApplyAction(nil, dtID, moved, submit, uid, "Submitting"))
+
+	brs := fatal1(Documents.SLABreaches(dtID)).([]SLABreach)
+	assertEqual(1, len(brs))
+	assertEqual(aged, brs[0].DocID)
+	assertEqual(draft, brs[0].State)
+	assertEqual(time.Minute, brs[0].SLA)
+	if brs[0].Elapsed < 59*time.Minute {
+		t.Fatalf("expected elapsed time of about an hour; got : %v", brs[0].Elapsed)
+	}
+
+	// Without an SLA, there are no breaches.
+	fatal0(DocTypes.SetTransitionSLA(nil, trID, 0))
+	brs = fatal1(Documents.SLABreaches(dtID)).([]SLABreach)
+	assertEqual(0, len(brs))
+}
+
+// Portable document bundles.
+func TestFlowDocumentsBundle(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "BND Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "BND Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "BND Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "BND Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "BND Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "BND Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "BND Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "BND Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "BND Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "BND Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "BND Approved", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "BND", "One", "bnd.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "BND Document", Data: "Body of BND Document"})).(DocumentID)
+	fatal0(Documents.AddTags(nil, dtID, id, "urgent"))
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving"))
+
+	b := fatal1(Documents.Bundle(dtID, id)).(*DocumentBundle)
+	assertEqual(id, b.Document.ID)
+	assertEqual("Body of BND Document", b.Document.Data)
+	assertEqual("BND Context", b.Document.AccCtx.Name)
+	assertEqual(approved, b.Document.State.ID)
+	assertEqual(1, len(b.Tags))
+	assertEqual("urgent", b.Tags[0])
+	assertEqual(0, len(b.Blobs))
+
+	assertEqual(2, len(b.Events))
+	assertEqual(submit, b.Events[0].Action)
+	assertEqual("BND Submit", b.Events[0].ActionName)
+	assertEqual("BND Draft", b.Events[0].StateName)
+	assertEqual(approve, b.Events[1].Action)
+	assertEqual("BND Pending", b.Events[1].StateName)
+	assertEqual(gid, b.Events[1].Group)
+
+	// The bundle survives a round trip through JSON.
+	buf := fatal1(json.Marshal(b)).([]byte)
+	var b2 DocumentBundle
+	fatal0(json.Unmarshal(buf, &b2))
+	assertEqual(2, len(b2.Events))
+	assertEqual(b.Events[1].ActionName, b2.Events[1].ActionName)
+	assertEqual(b.Document.Data, b2.Document.Data)
+}
+
+// Document types available to a user.
+func TestFlowDocTypesForUser(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DFU Request")).(DocTypeID)
+	fatal1(DocTypes.New(nil, "DFU Other Request"))
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	submit := fatal1(DocActions.New(tx, "DFU Submit", false)).(DocActionID)
+	acID := fatal1(AccessContexts.New(tx, "DFU Context")).(AccessContextID)
+	rid := fatal1(Roles.New(tx, "DFU Role")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, rid, dtID, []DocActionID{submit}))
+	uid := fatal1(Users.New(tx, "DFU", "One", "dfu.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, gid, rid))
+
+	fatal0(tx.Commit())
+
+	dts := fatal1(DocTypes.ForUser(uid)).([]*DocType)
+	assertEqual(1, len(dts))
+	assertEqual(dtID, dts[0].ID)
+	assertEqual("DFU Request", dts[0].Name)
+}
+
+// Optimistic application of actions.
+func TestFlowDocumentsApplyActionCAS(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "CAS Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "CAS Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "CAS Pending")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "CAS Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "CAS Submit", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "CAS Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	// `Reject` is valid from `Draft` as well.
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, reject, rejected))
+
+	acID := fatal1(AccessContexts.New(tx, "CAS Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "CAS Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "CAS Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "CAS Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, rejected, acID, wfID, "CAS Rejected", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "CAS", "One", "cas.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	newDoc := func(title string) DocumentID {
+		return fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: title, Data: "Body"})).(DocumentID)
+	}
+
+	// This submits the document once, concurrently.
+	submitOnce := func(id DocumentID) func() {
+		done := false
+		return func() {
+			if !done {
+				done = true
+				fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+			}
+		}
+	}
+
+	t.Run("RetrySucceeds", func(t *testing.T) {
+		id := newDoc("CAS Retried")
+		state := fatal1(Documents.applyActionCAS(dtID, id, reject, gid, "Rejecting", 2, submitOnce(id))).(DocStateID)
+		assertEqual(rejected, state)
+
+		ev := fatal1(DocEvents.Last(dtID, id)).(*DocEvent)
+		assertEqual(reject, ev.Action)
+		assertEqual(pending, ev.State)
+	})
+
+	t.Run("AttemptsExhausted", func(t *testing.T) {
+		id := newDoc("CAS Exhausted")
+		_, err := Documents.applyActionCAS(dtID, id, reject, gid, "Rejecting", 1, submitOnce(id))
+		assertEqual(true, errors.Is(err, ErrDocEventStateMismatch))
+	})
+
+	t.Run("NoLongerValid", func(t *testing.T) {
+		id := newDoc("CAS Invalid")
+		_, err := Documents.applyActionCAS(dtID, id, submit, gid, "Submitting", 3, submitOnce(id))
+		assertEqual(true, errors.Is(err, ErrWorkflowInvalidAction))
+	})
+
+	t.Run("TxRequired", func(t *testing.T) {
+		id := newDoc("CAS Explicit")
+		RequireExplicitTx(true)
+		defer RequireExplicitTx(false)
+		_, err := Documents.ApplyActionCAS(dtID, id, submit, gid, "Submitting", 1)
+		assertEqual(true, errors.Is(err, ErrTxRequired))
+	})
+}
+
+// Self-managed transactions of document actions.
+func TestFlowDocActionsImplicitTx(t *testing.T) {
+	gt = t
+
+	t.Run("Commit", func(t *testing.T) {
+		id := fatal1(DocActions.New(nil, "ITX Foo", false)).(DocActionID)
+		da := fatal1(DocActions.GetByName("ITX Foo")).(*DocAction)
+		assertEqual(id, da.ID)
+
+		fatal0(DocActions.Rename(nil, id, "ITX Bar"))
+		da = fatal1(DocActions.Get(id)).(*DocAction)
+		assertEqual("ITX Bar", da.Name)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		_, err := DocActions.New(nil, "ITX Bar", true)
+		if err == nil {
+			t.Fatalf("expected duplicate document action to be rejected")
+		}
+
+		var count int64
+		fatal0(db().QueryRow("SELECT COUNT(*) FROM wf_docactions_master WHERE name = 'ITX Bar'").Scan(&count))
+		assertEqual(int64(1), count)
+		da := fatal1(DocActions.GetByName("ITX Bar")).(*DocAction)
+		assertEqual(false, da.Reconfirm)
+	})
+}
+
+// Context-aware document action methods.
+func TestFlowDocActionsContext(t *testing.T) {
+	gt = t
+
+	ctx := context.Background()
+	id := fatal1(DocActions.NewContext(ctx, nil, "CTX Action", false)).(DocActionID)
+	da := fatal1(DocActions.GetContext(ctx, id)).(*DocAction)
+	assertEqual("CTX Action", da.Name)
+	fatal0(DocActions.RenameContext(ctx, nil, id, "CTX Renamed Action"))
+	da = fatal1(DocActions.GetByNameContext(ctx, "CTX Renamed Action")).(*DocAction)
+	assertEqual(id, da.ID)
+
+	// A cancelled context stops both reads and writes.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := DocActions.GetContext(cctx, id); err == nil {
+		t.Fatalf("expected a cancelled context to fail the read")
+	}
+	if _, err := DocActions.ListContext(cctx, 0, 0); err == nil {
+		t.Fatalf("expected a cancelled context to fail the listing")
+	}
+	if _, err := DocActions.NewContext(cctx, nil, "CTX Cancelled Action", false); err == nil {
+		t.Fatalf("expected a cancelled context to fail the write")
+	}
+	_, err := DocActions.GetByName("CTX Cancelled Action")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+}
+
+// Deletion of document actions.
+func TestFlowDocActionsDelete(t *testing.T) {
+	gt = t
+
+	t.Run("Unused", func(t *testing.T) {
+		id := fatal1(DocActions.New(nil, "DEL Unused", false)).(DocActionID)
+		fatal0(DocActions.Delete(nil, id))
+		_, err := DocActions.Get(id)
+		assertEqual(true, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("InUse", func(t *testing.T) {
+		dtID := fatal1(DocTypes.New(nil, "DEL Request")).(DocTypeID)
+
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+
+		draft := fatal1(DocStates.New(tx, "DEL Draft")).(DocStateID)
+		pending := fatal1(DocStates.New(tx, "DEL Pending")).(DocStateID)
+		submit := fatal1(DocActions.New(tx, "DEL Submit", false)).(DocActionID)
+		fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+
+		fatal0(tx.Commit())
+
+		err := DocActions.Delete(nil, submit)
+		if err == nil || !strings.Contains(err.Error(), "in use by 1 transitions") {
+			t.Fatalf("expected in-use error; got : %v", err)
+		}
+		fatal1(DocActions.Get(submit))
+	})
+}
+
+// Existence of document actions.
+func TestFlowDocActionsExists(t *testing.T) {
+	gt = t
+
+	id := fatal1(DocActions.New(nil, "EXS Present", false)).(DocActionID)
+
+	aid, ok, err := DocActions.Exists("EXS Present")
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(id, aid)
+
+	aid, ok, err = DocActions.Exists("EXS Absent")
+	fatal0(err)
+	assertEqual(false, ok)
+	assertEqual(DocActionID(0), aid)
+
+	// A failing query is reported as an error, not as absence.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok, err = DocActions.ExistsContext(ctx, "EXS Present")
+	if err == nil {
+		t.Fatalf("expected a cancelled context to fail the query")
+	}
+	assertEqual(false, ok)
+}
+
+// Lookups by name.
+func TestFlowGetByName(t *testing.T) {
+	gt = t
+
+	daID := fatal1(DocActions.New(nil, "GBN Action", false)).(DocActionID)
+	dsID := fatal1(DocStates.New(nil, "GBN State")).(DocStateID)
+	dtID := fatal1(DocTypes.New(nil, "GBN Request")).(DocTypeID)
+
+	// Names are trimmed before lookup.
+	da := fatal1(DocActions.GetByName("  GBN Action ")).(*DocAction)
+	assertEqual(daID, da.ID)
+	ds := fatal1(DocStates.GetByName("\tGBN State")).(*DocState)
+	assertEqual(dsID, ds.ID)
+	dt := fatal1(DocTypes.GetByName("GBN Request\n")).(*DocType)
+	assertEqual(dtID, dt.ID)
+
+	// Empty names are rejected outright.
+	if _, err := DocActions.GetByName(" "); err == nil {
+		t.Fatalf("expected an empty document action name to be rejected")
+	}
+	if _, err := DocStates.GetByName(""); err == nil {
+		t.Fatalf("expected an empty document state name to be rejected")
+	}
+	if _, err := DocTypes.GetByName(""); err == nil {
+		t.Fatalf("expected an empty document type name to be rejected")
+	}
+}
+
+// Counts of resources.
+func TestFlowCount(t *testing.T) {
+	gt = t
+
+	t.Run("DocActions", func(t *testing.T) {
+		n0 := fatal1(DocActions.Count()).(int64)
+		fatal1(DocActions.New(nil, "CNT Action 1", false))
+		fatal1(DocActions.New(nil, "CNT Action 2", false))
+		n := fatal1(DocActions.Count()).(int64)
+		assertEqual(n0+2, n)
+		das := fatal1(DocActions.List(0, 0)).([]*DocAction)
+		assertEqual(int64(len(das)), n)
+	})
+
+	t.Run("DocStates", func(t *testing.T) {
+		n0 := fatal1(DocStates.Count()).(int64)
+		fatal1(DocStates.New(nil, "CNT State"))
+		assertEqual(n0+1, fatal1(DocStates.Count()).(int64))
+	})
+
+	t.Run("DocTypes", func(t *testing.T) {
+		n0 := fatal1(DocTypes.Count()).(int64)
+		fatal1(DocTypes.New(nil, "CNT Request"))
+		assertEqual(n0+1, fatal1(DocTypes.Count()).(int64))
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		n0 := fatal1(Roles.Count()).(int64)
+		fatal1(Roles.New(nil, "CNT Role"))
+		assertEqual(n0+1, fatal1(Roles.Count()).(int64))
+	})
+
+	t.Run("GroupsAndUsers", func(t *testing.T) {
+		ng0 := fatal1(Groups.Count()).(int64)
+		nu0 := fatal1(Users.Count("")).(int64)
+		uid := fatal1(Users.New(nil, "Cntfirst", "Cntlast", "cnt.user@example.com", 1)).(UserID)
+		fatal1(Groups.NewSingleton(nil, uid))
+		fatal1(Groups.New(nil, "CNT Group", "G"))
+		assertEqual(ng0+2, fatal1(Groups.Count()).(int64))
+		assertEqual(nu0+1, fatal1(Users.Count("")).(int64))
+
+		assertEqual(int64(1), fatal1(Users.Count("Cntfirst")).(int64))
+		assertEqual(int64(1), fatal1(Users.Count("Cntlast")).(int64))
+		us := fatal1(Users.List("Cntlast", 0, 0)).([]*User)
+		assertEqual(1, len(us))
+	})
+}
+
+// Listing document actions by prefix.
+func TestFlowDocActionsListByPrefix(t *testing.T) {
+	gt = t
+
+	id1 := fatal1(DocActions.New(nil, "LBP Approve", false)).(DocActionID)
+	id2 := fatal1(DocActions.New(nil, "LBP Archive", false)).(DocActionID)
+	id3 := fatal1(DocActions.New(nil, "LBP_Reject", false)).(DocActionID)
+	fatal1(DocActions.New(nil, "LBPX Other", false))
+
+	das := fatal1(DocActions.ListByPrefix("LBP A", 0, 0)).([]*DocAction)
+	assertEqual(2, len(das))
+	assertEqual(id1, das[0].ID)
+	assertEqual(id2, das[1].ID)
+
+	das = fatal1(DocActions.ListByPrefix("LBP A", 1, 1)).([]*DocAction)
+	assertEqual(1, len(das))
+	assertEqual(id2, das[0].ID)
+
+	// `_` is matched literally.
+	das = fatal1(DocActions.ListByPrefix("LBP_", 0, 0)).([]*DocAction)
+	assertEqual(1, len(das))
+	assertEqual(id3, das[0].ID)
+
+	_, err := DocActions.ListByPrefix("LBP", -1, 0)
+	if err == nil {
+		t.Fatalf("expected a negative offset to be rejected")
+	}
+}
+
+// JSON round trips of vocabulary.
+func TestFlowJSONRoundTrip(t *testing.T) {
+	gt = t
+
+	da := DocAction{ID: 7, Name: "JSN Approve", Reconfirm: true}
+	buf := fatal1(json.Marshal(da)).([]byte)
+	assertEqual(`{"ID":7,"Name":"JSN Approve","Reconfirm":true}`, string(buf))
+	var da2 DocAction
+	fatal0(json.Unmarshal(buf, &da2))
+	assertEqual(da, da2)
+
+	ds := DocState{ID: 8, Name: "JSN Approved"}
+	buf = fatal1(json.Marshal(ds)).([]byte)
+	var ds2 DocState
+	fatal0(json.Unmarshal(buf, &ds2))
+	assertEqual(ds, ds2)
+
+	dt := DocType{ID: 9, Name: "JSN Request"}
+	buf = fatal1(json.Marshal(dt)).([]byte)
+	var dt2 DocType
+	fatal0(json.Unmarshal(buf, &dt2))
+	assertEqual(dt, dt2)
+}
+
+// Bulk creation of document actions.
+func TestFlowDocActionsNewBatch(t *testing.T) {
+	gt = t
+
+	names := []string{"NB Submit ", "NB Approve", "nb reject"}
+	ids := fatal1(DocActions.NewBatch(nil, names)).([]DocActionID)
+	assertEqual(3, len(ids))
+	for i, id := range ids {
+		da := fatal1(DocActions.Get(id)).(*DocAction)
+		assertEqual(strings.TrimSpace(names[i]), da.Name)
+		assertEqual(false, da.Reconfirm)
+	}
+
+	_, err := DocActions.NewBatch(nil, nil)
+	assertCode(CodeInvalidArg, err)
+	_, err = DocActions.NewBatch(nil, []string{"NB Dup", " NB Dup"})
+	assertCode(CodeInvalidArg, err)
+	_, err = DocActions.NewBatch(nil, []string{"NB Dup", "nb DUP"})
+	assertCode(CodeInvalidArg, err)
+	_, ok, err := DocActions.Exists("NB Dup")
+	fatal0(err)
+	assertEqual(false, ok)
+
+	for _, id := range ids {
+		fatal0(DocActions.Delete(nil, id))
+	}
+}
+
+// Schema validation on registration.
+func TestFlowRegisterDBWithCheck(t *testing.T) {
+	gt = t
+
+	odb := db()
+	defer RegisterDB(odb)
+
+	fatal0(RegisterDBWithCheck(odb))
+
+	error1(odb.Exec("DROP DATABASE IF EXISTS flow_check"))
+	fatal1(odb.Exec("CREATE DATABASE flow_check CHARACTER SET = 'utf8mb4' COLLATE = 'utf8mb4_unicode_ci'"))
+	defer odb.Exec("DROP DATABASE IF EXISTS flow_check")
+
+	sdb := fatal1(sql.Open("mysql", "travis@/flow_check?charset=utf8&parseTime=true")).(*sql.DB)
+	defer sdb.Close()
+
+	fatal0(execSchemaFile(sdb, "sql/users_master.sql"))
+	fatal0(CreateSchema(sdb))
+	fatal1(sdb.Exec("DROP TABLE wf_mailboxes"))
+
+	err := RegisterDBWithCheck(sdb)
+	if err == nil {
+		t.Fatalf("expected an error for a missing table")
+	}
+	if !strings.Contains(err.Error(), "wf_mailboxes") {
+		t.Fatalf("missing table not named in error : %v", err)
+	}
+	assertEqual(odb, db())
+}
+
+// Schema bootstrap in a fresh database.
+func TestFlowCreateSchema(t *testing.T) {
+	gt = t
+
+	odb := db()
+	defer RegisterDB(odb)
+
+	error1(odb.Exec("DROP DATABASE IF EXISTS flow_schema"))
+	fatal1(odb.Exec("CREATE DATABASE flow_schema CHARACTER SET = 'utf8mb4' COLLATE = 'utf8mb4_unicode_ci'"))
+	defer odb.Exec("DROP DATABASE IF EXISTS flow_schema")
+
+	sdb := fatal1(sql.Open("mysql", "travis@/flow_schema?charset=utf8&parseTime=true")).(*sql.DB)
+	defer sdb.Close()
+
+	fatal0(execSchemaFile(sdb, "sql/users_master.sql"))
+	fatal0(CreateSchema(sdb))
+	fatal0(CreateSchema(sdb))
+	fatal0(RegisterDBWithCheck(sdb))
+
+	var n int64
+	fatal0(sdb.QueryRow("SELECT COUNT(*) FROM wf_roles_master").Scan(&n))
+	assertEqual(int64(2), n)
+
+	id := fatal1(DocActions.New(nil, "SCH Approve", false)).(DocActionID)
+	da := fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("SCH Approve", da.Name)
+
+	fatal1(DocTypes.New(nil, "SCH Request"))
+	fatal0(DropSchema(sdb))
+	if err := RegisterDBWithCheck(sdb); err == nil {
+		t.Fatalf("expected an error after dropping the schema")
+	}
+}
+
+// Upgrade of a schema created by an earlier version.
+func TestFlowMigrateSchema(t *testing.T) {
+	gt = t
+
+	odb := db()
+	defer RegisterDB(odb)
+
+	error1(odb.Exec("DROP DATABASE IF EXISTS flow_migrate"))
+	fatal1(odb.Exec("CREATE DATABASE flow_migrate CHARACTER SET = 'utf8mb4' COLLATE = 'utf8mb4_unicode_ci'"))
+	defer odb.Exec("DROP DATABASE IF EXISTS flow_migrate")
+
+	sdb := fatal1(sql.Open("mysql", "travis@/flow_migrate?charset=utf8&parseTime=true")).(*sql.DB)
+	defer sdb.Close()
+
+	fatal0(execSchemaFile(sdb, "sql/users_master.sql"))
+	fatal0(CreateSchema(sdb))
+	RegisterDB(sdb)
+
+	dtID := fatal1(DocTypes.New(nil, "MIG Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "MIG Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "MIG Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "MIG Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "MIG Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "MIG Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "MIG Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "MIG Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "MIG Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "MIG Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "MIG Approved", NodeTypeEnd))
+
+	fatal0(tx.Commit())
+
+	// Regress to the older schema.
+	for _, q := range []string{
+		"ALTER TABLE wf_docactions_master DROP COLUMN active, DROP COLUMN ctime, DROP COLUMN mtime",
+		"ALTER TABLE wf_docstates_master DROP COLUMN ctime, DROP COLUMN mtime",
+		"ALTER TABLE wf_docstate_transitions DROP COLUMN sla_seconds",
+		"ALTER TABLE " + DocTypes.docStorName(dtID) + " DROP COLUMN version",
+		"ALTER TABLE " + DocTypes.docStorName(dtID) + " DROP INDEX correlation_id, DROP COLUMN correlation_id",
+	} {
+		fatal1(sdb.Exec(q))
+	}
+
+	fatal0(MigrateSchema(sdb))
+	fatal0(MigrateSchema(sdb))
+	for _, c := range schemaColumns {
+		tbl := c.table
+		if tbl == "" {
+			tbl = DocTypes.docStorName(dtID)
+		}
+		assertEqual(true, fatal1(schemaHasColumn(sdb, MySQL, tbl, c.name)).(bool), tbl+"."+c.name)
+	}
+
+	// The upgraded schema is usable.
+	uid := fatal1(Users.New(nil, "MIG", "User", "mig.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(nil, uid)).(GroupID)
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "MIG Request", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving"))
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(approved, doc.State.ID)
+	assertEqual(int64(3), doc.Version)
+}
+
+// Placeholder rendering of dialects.
+func TestFlowDialectRebind(t *testing.T) {
+	gt = t
+
+	q := "SELECT id FROM t WHERE a = ? AND b LIKE '?%' AND c IN (?, ?)"
+	assertEqual(q, MySQL.Rebind(q))
+	assertEqual("SELECT id FROM t WHERE a = $1 AND b LIKE '?%' AND c IN ($2, $3)", Postgres.Rebind(q))
+}
+
+// Document states used by a document type.
+func TestFlowListByDocType(t *testing.T) {
+	gt = t
+
+	dtID1 := fatal1(DocTypes.New(nil, "LBD One Request")).(DocTypeID)
+	dtID2 := fatal1(DocTypes.New(nil, "LBD Two Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	submit := fatal1(DocActions.New(tx, "LBD Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "LBD Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "LBD Reject", true)).(DocActionID)
+
+	// The first type uses its last state only in its workflow.
+	draft1 := fatal1(DocStates.New(tx, "LBD One Draft")).(DocStateID)
+	pending1 := fatal1(DocStates.New(tx, "LBD One Pending")).(DocStateID)
+	approved1 := fatal1(DocStates.New(tx, "LBD One Approved")).(DocStateID)
+	archived1 := fatal1(DocStates.New(tx, "LBD One Archived")).(DocStateID)
+	fatal0(DocTypes.AddTransition(tx, dtID1, draft1, submit, pending1))
+	fatal0(DocTypes.AddTransition(tx, dtID1, pending1, approve, approved1))
+	wfID := fatal1(Workflows.New(tx, "LBD One Flow", dtID1, draft1)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID1, archived1, 0, wfID, "LBD One Archived", NodeTypeEnd))
+
+	draft2 := fatal1(DocStates.New(tx, "LBD Two Draft")).(DocStateID)
+	pending2 := fatal1(DocStates.New(tx, "LBD Two Pending")).(DocStateID)
+	approved2 := fatal1(DocStates.New(tx, "LBD Two Approved")).(DocStateID)
+	rejected2 := fatal1(DocStates.New(tx, "LBD Two Rejected")).(DocStateID)
+	fatal0(DocTypes.AddTransition(tx, dtID2, draft2, submit, pending2))
+	fatal0(DocTypes.AddTransition(tx, dtID2, pending2, approve, approved2))
+	fatal0(DocTypes.AddTransition(tx, dtID2, pending2, reject, rejected2))
+
+	fatal0(tx.Commit())
+
+	dss := fatal1(DocStates.ListByDocType(dtID1, 0, 0)).([]*DocState)
+	assertEqual(4, len(dss))
+	want := []DocStateID{draft1, pending1, approved1, archived1}
+	for i, ds := range dss {
+		assertEqual(want[i], ds.ID)
+	}
+
+	dss = fatal1(DocStates.ListByDocType(dtID2, 1, 2)).([]*DocState)
+	assertEqual(2, len(dss))
+	assertEqual(pending2, dss[0].ID)
+	assertEqual(approved2, dss[1].ID)
+
+	if _, err := DocStates.ListByDocType(0, 0, 0); err == nil {
+		t.Fatalf("expected an error for an invalid document type")
+	}
+}
+
+// Registration and lookup of transitions.
+func TestFlowDocStateTransitions(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DST Request")).(DocTypeID)
+	draft := fatal1(DocStates.New(nil, "DST Draft")).(DocStateID)
+	approved := fatal1(DocStates.New(nil, "DST Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(nil, "DST Rejected")).(DocStateID)
+	approve := fatal1(DocActions.New(nil, "DST Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(nil, "DST Reject", true)).(DocActionID)
+
+	id1 := fatal1(DocStateTransitions.New(nil, dtID, draft, approve, approved)).(DocTransitionID)
+	id2 := fatal1(DocStateTransitions.New(nil, dtID, draft, reject, rejected)).(DocTransitionID)
+
+	_, err := DocStateTransitions.New(nil, dtID, draft, approve, rejected)
+	assertEqual(true, errors.Is(err, ErrTransitionExists))
+
+	// `AddTransition` allows several target states.
+	fatal0(DocTypes.AddTransition(nil, dtID, rejected, approve, approved))
+	fatal0(DocTypes.AddTransition(nil, dtID, rejected, approve, draft))
+	_, err = DocStateTransitions.New(nil, dtID, rejected, approve, rejected)
+	assertEqual(true, errors.Is(err, ErrTransitionExists))
+
+	dst := fatal1(DocStateTransitions.Get(id1)).(*DocStateTransition)
+	assertEqual(DocStateTransition{ID: id1, DocType: dtID, FromState: draft, Action: approve, ToState: approved}, *dst)
+
+	dsts := fatal1(DocStateTransitions.List(dtID, 0, 0)).([]*DocStateTransition)
+	assertEqual(4, len(dsts))
+	assertEqual(id1, dsts[0].ID)
+	assertEqual(id2, dsts[1].ID)
+	assertEqual(rejected, dsts[1].ToState)
+	dsts = fatal1(DocStateTransitions.List(dtID, 1, 2)).([]*DocStateTransition)
+	assertEqual(2, len(dsts))
+	assertEqual(id2, dsts[0].ID)
+
+	fatal0(DocStateTransitions.Delete(nil, id2))
+	_, err = DocStateTransitions.Get(id2)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	dsts = fatal1(DocStateTransitions.List(dtID, 0, 0)).([]*DocStateTransition)
+	assertEqual(3, len(dsts))
+	if err = DocStateTransitions.Delete(nil, id2); err == nil {
+		t.Fatalf("expected an error deleting a missing transition")
+	}
+}
+
+// Target states of transitions.
+func TestFlowNextState(t *testing.T) {
+	gt = t
+
+	dtID1 := fatal1(DocTypes.New(nil, "NXT One Request")).(DocTypeID)
+	dtID2 := fatal1(DocTypes.New(nil, "NXT Two Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft1 := fatal1(DocStates.New(tx, "NXT One Draft")).(DocStateID)
+	pending1 := fatal1(DocStates.New(tx, "NXT One Pending")).(DocStateID)
+	approved1 := fatal1(DocStates.New(tx, "NXT One Approved")).(DocStateID)
+	submit1 := fatal1(DocActions.New(tx, "NXT One Submit", false)).(DocActionID)
+	approve1 := fatal1(DocActions.New(tx, "NXT One Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID1, draft1, submit1, pending1))
+	fatal0(DocTypes.AddTransition(tx, dtID1, pending1, approve1, approved1))
+
+	pending2 := fatal1(DocStates.New(tx, "NXT Two Pending")).(DocStateID)
+	approved2 := fatal1(DocStates.New(tx, "NXT Two Approved")).(DocStateID)
+	approve2 := fatal1(DocActions.New(tx, "NXT Two Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID2, pending2, approve2, approved2))
+
+	fatal0(tx.Commit())
+
+	to, ok, err := DocStateTransitions.NextState(dtID1, pending1, approve1)
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(approved1, to)
+
+	to, ok, err = DocStateTransitions.NextState(dtID1, draft1, approve1)
+	fatal0(err)
+	assertEqual(false, ok)
+	assertEqual(DocStateID(0), to)
+
+	// The second type's vocabulary is not wired into the first type.
+	_, ok, err = DocStateTransitions.NextState(dtID1, pending2, approve2)
+	fatal0(err)
+	assertEqual(false, ok)
+	_, ok, err = DocStateTransitions.NextState(dtID2, pending1, approve1)
+	fatal0(err)
+	assertEqual(false, ok)
+}
+
+// Actions legal from a state.
+func TestFlowActionsFrom(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "AFR Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	pending := fatal1(DocStates.New(tx, "AFR Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "AFR Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "AFR Rejected")).(DocStateID)
+	approve := fatal1(DocActions.New(tx, "AFR Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "AFR Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	fatal0(tx.Commit())
+
+	das := fatal1(DocStateTransitions.ActionsFrom(dtID, pending)).([]*DocAction)
+	assertEqual(2, len(das))
+	assertEqual(approve, das[0].ID)
+	assertEqual(reject, das[1].ID)
+	assertEqual(true, das[1].Reconfirm)
+
+	das = fatal1(DocStateTransitions.ActionsFrom(dtID, approved)).([]*DocAction)
+	assertEqual(0, len(das))
+}
+
+// Members of a group.
+func TestFlowGroupsListUsers(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	gid := fatal1(Groups.New(tx, "GLU Members", "G")).(GroupID)
+	uids := make([]UserID, 0, 3)
+	for _, name := range []string{"Anu", "Bala", "Chitra"} {
+		uid := fatal1(Users.New(tx, name, "GLU", strings.ToLower(name)+".glu@example.com", 1)).(UserID)
+		fatal0(Groups.AddUser(tx, gid, uid))
+		uids = append(uids, uid)
+	}
+	inactive := fatal1(Users.New(tx, "Dinesh", "GLU", "dinesh.glu@example.com", 0)).(UserID)
+	fatal0(Groups.AddUser(tx, gid, inactive))
+	fatal0(tx.Commit())
+
+	us := fatal1(Groups.ListUsers(gid, 0, 0)).([]*User)
+	assertEqual(3, len(us))
+	for i, u := range us {
+		assertEqual(uids[i], u.ID)
+		assertEqual(true, u.Active)
+	}
+	assertEqual("bala.glu@example.com", us[1].Email)
+
+	us = fatal1(Groups.ListUsers(gid, 2, 5)).([]*User)
+	assertEqual(1, len(us))
+	assertEqual(uids[2], us[0].ID)
+}
+
+// Groups of a user.
+func TestFlowGroupsListByUser(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	uid := fatal1(Users.New(tx, "Esha", "GLB", "esha.glb@example.com", 1)).(UserID)
+	sgid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	gid1 := fatal1(Groups.New(tx, "GLB Reviewers", "G")).(GroupID)
+	gid2 := fatal1(Groups.New(tx, "GLB Approvers", "G")).(GroupID)
+	fatal0(Groups.AddUser(tx, gid1, uid))
+	fatal0(Groups.AddUser(tx, gid2, uid))
+	fatal1(Groups.New(tx, "GLB Others", "G"))
+	fatal0(tx.Commit())
+
+	gs := fatal1(Groups.ListByUser(uid)).([]*Group)
+	assertEqual(3, len(gs))
+	assertEqual(sgid, gs[0].ID)
+	assertEqual(GroupTypeSingleton, gs[0].GroupType)
+	assertEqual(gid1, gs[1].ID)
+	assertEqual(gid2, gs[2].ID)
+}
+
+// Group membership checks.
+func TestFlowGroupsIsMember(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	uid1 := fatal1(Users.New(tx, "Farah", "GIM", "farah.gim@example.com", 1)).(UserID)
+	uid2 := fatal1(Users.New(tx, "Gopi", "GIM", "gopi.gim@example.com", 1)).(UserID)
+	gid := fatal1(Groups.New(tx, "GIM Members", "G")).(GroupID)
+	fatal0(Groups.AddUser(tx, gid, uid1))
+	fatal0(tx.Commit())
+
+	ok, err := Groups.IsMember(gid, uid1)
+	fatal0(err)
+	assertEqual(true, ok)
+
+	ok, err = Groups.IsMember(gid, uid2)
+	fatal0(err)
+	assertEqual(false, ok)
+
+	ok, err = Groups.IsMember(gid+1000000, uid1)
+	fatal0(err)
+	assertEqual(false, ok)
+
+	if _, err = Groups.IsMember(0, uid1); err == nil {
+		t.Fatalf("expected an error for an invalid group ID")
+	}
+}
+
+// Removal of users from groups.
+func TestFlowGroupsRemoveUser(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	uid := fatal1(Users.New(tx, "Hema", "GRU", "hema.gru@example.com", 1)).(UserID)
+	sgid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	gid := fatal1(Groups.New(tx, "GRU Members", "G")).(GroupID)
+	fatal0(Groups.AddUser(tx, gid, uid))
+	fatal0(tx.Commit())
+
+	fatal0(Groups.RemoveUser(nil, gid, uid))
+	ok := fatal1(Groups.IsMember(gid, uid)).(bool)
+	assertEqual(false, ok)
+
+	if err := Groups.RemoveUser(nil, sgid, uid); err == nil {
+		t.Fatalf("expected an error removing the user of a singleton group")
+	}
+	ok = fatal1(Groups.IsMember(sgid, uid)).(bool)
+	assertEqual(true, ok)
+}
+
+// Group types.
+func TestFlowGroupType(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	uid := fatal1(Users.New(tx, "Indu", "GTY", "indu.gty@example.com", 1)).(UserID)
+	sgid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	gid := fatal1(Groups.New(tx, "GTY Members", GroupTypeGeneral)).(GroupID)
+	if _, err := Groups.New(tx, "GTY Single", GroupTypeSingleton); err == nil {
+		t.Fatalf("expected an error creating a singleton group directly")
+	}
+	fatal0(tx.Commit())
+
+	g := fatal1(Groups.Get(gid)).(*Group)
+	assertEqual(GroupTypeGeneral, g.GroupType)
+	assertEqual("general", g.GroupType.String())
+	g = fatal1(Groups.Get(sgid)).(*Group)
+	assertEqual(GroupTypeSingleton, g.GroupType)
+	assertEqual("singleton", g.GroupType.String())
+
+	for _, s := range []string{"G", "general", " Singleton "} {
+		fatal1(ParseGroupType(s))
+	}
+	if _, err := ParseGroupType("X"); err == nil {
+		t.Fatalf("expected an error for an unknown group type")
+	}
+}
+
+// Archival of document actions.
+func TestFlowDocActionsArchive(t *testing.T) {
+	gt = t
+
+	id1 := fatal1(DocActions.New(nil, "ARC Keep", false)).(DocActionID)
+	id2 := fatal1(DocActions.New(nil, "ARC Retire", false)).(DocActionID)
+	n0 := fatal1(DocActions.Count()).(int64)
+
+	fatal0(DocActions.Archive(nil, id2))
+
+	has := func(das []*DocAction, id DocActionID) bool {
+		for _, da := range das {
+			if da.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	das := fatal1(DocActions.List(0, 0)).([]*DocAction)
+	assertEqual(true, has(das, id1))
+	assertEqual(false, has(das, id2))
+	das = fatal1(DocActions.ListByPrefix("ARC ", 0, 0)).([]*DocAction)
+	assertEqual(1, len(das))
+	das = fatal1(DocActions.ListAll(0, 0)).([]*DocAction)
+	assertEqual(true, has(das, id2))
+	assertEqual(n0-1, fatal1(DocActions.Count()).(int64))
+	assertEqual(int64(len(das)), fatal1(DocActions.CountAll()).(int64))
+	das = fatal1(DocActions.List(0, 0)).([]*DocAction)
+	assertEqual(int64(len(das)), fatal1(DocActions.Count()).(int64))
+
+	da := fatal1(DocActions.Get(id2)).(*DocAction)
+	assertEqual("ARC Retire", da.Name)
+	assertEqual(true, da.Archived)
+	da = fatal1(DocActions.Get(id1)).(*DocAction)
+	assertEqual(false, da.Archived)
+
+	fatal0(DocActions.Unarchive(nil, id2))
+	fatal0(DocActions.Unarchive(nil, id2))
+	das = fatal1(DocActions.ListByPrefix("ARC ", 0, 0)).([]*DocAction)
+	assertEqual(2, len(das))
+
+	fatal0(DocActions.Delete(nil, id1))
+	fatal0(DocActions.Delete(nil, id2))
+	assertEqual(true, errors.Is(DocActions.Archive(nil, id2), ErrNotFound))
+	assertEqual(true, errors.Is(DocActions.Unarchive(nil, id2), ErrNotFound))
+}
+
+// Creation and modification times of vocabulary.
+func TestFlowTimestamps(t *testing.T) {
+	gt = t
+
+	aid := fatal1(DocActions.New(nil, "TSP Approve", false)).(DocActionID)
+	sid := fatal1(DocStates.New(nil, "TSP Approved")).(DocStateID)
+
+	da := fatal1(DocActions.Get(aid)).(*DocAction)
+	ds := fatal1(DocStates.Get(sid)).(*DocState)
+	assertEqual(false, da.CreatedAt().IsZero())
+	assertEqual(false, ds.CreatedAt().IsZero())
+	assertEqual(true, da.UpdatedAt().Equal(da.CreatedAt()))
+	assertEqual(true, ds.UpdatedAt().Equal(ds.CreatedAt()))
+
+	// `Ensure` answers the times of the rows it creates.
+	eda, created, err := DocActions.Ensure(nil, "TSP Return", false)
+	fatal0(err)
+	assertEqual(true, created)
+	assertEqual(true, eda.CreatedAt().Equal(fatal1(DocActions.Get(eda.ID)).(*DocAction).CreatedAt()))
+	eds, created, err := DocStates.Ensure(nil, "TSP Returned")
+	fatal0(err)
+	assertEqual(true, created)
+	assertEqual(false, eds.CreatedAt().IsZero())
+	assertEqual(true, eds.UpdatedAt().Equal(eds.CreatedAt()))
+
+	// Timestamps have a resolution of one second; hence, the rows are
+	// backdated instead of waiting.
+	fatal1(db().Exec("UPDATE wf_docactions_master SET ctime = ctime - INTERVAL 1 HOUR, mtime = mtime - INTERVAL 1 HOUR WHERE id = ?", aid))
+	fatal1(db().Exec("UPDATE wf_docstates_master SET ctime = ctime - INTERVAL 1 HOUR, mtime = mtime - INTERVAL 1 HOUR WHERE id = ?", sid))
+	var now time.Time
+	fatal0(db().QueryRow("SELECT NOW()").Scan(&now))
+	fatal0(DocActions.Rename(nil, aid, "TSP Approve Now"))
+	fatal0(DocStates.Rename(nil, sid, "TSP Approved Now"))
+
+	da = fatal1(DocActions.GetByName("TSP Approve Now")).(*DocAction)
+	ds = fatal1(DocStates.GetByName("TSP Approved Now")).(*DocState)
+	assertEqual(true, da.UpdatedAt().After(da.CreatedAt()))
+	assertEqual(true, ds.UpdatedAt().After(ds.CreatedAt()))
+	assertEqual(false, da.UpdatedAt().Before(now))
+	assertEqual(false, ds.UpdatedAt().Before(now))
+
+	fatal0(DocActions.Delete(nil, aid))
+	fatal0(DocActions.Delete(nil, eda.ID))
+}
+
+// Construction of an access context.
+func TestFlowAccessContextBuild(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	acID := fatal1(AccessContexts.New(tx, "ACB Context")).(AccessContextID)
+	rid := fatal1(Roles.New(tx, "ACB Role")).(RoleID)
+	pgid := fatal1(Groups.New(tx, "ACB Managers", "G")).(GroupID)
+	cgid := fatal1(Groups.New(tx, "ACB Clerks", "G")).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, cgid, rid))
+	fatal0(AccessContexts.AddChildGroup(tx, acID, pgid, cgid))
+	fatal0(tx.Commit())
+
+	ac := fatal1(AccessContexts.Get(acID)).(*AccessContext)
+	assertEqual("ACB Context", ac.Name)
+
+	grs := fatal1(AccessContexts.GroupRoles(acID, []GroupID{cgid}, 0, 0)).(map[GroupID]*AcGroupRoles)
+	assertEqual(1, len(grs[cgid].Roles))
+	assertEqual(rid, grs[cgid].Roles[0].ID)
+
+	assertEqual(pgid, fatal1(AccessContexts.GroupReportsTo(acID, cgid)).(GroupID))
+
+	fatal0(AccessContexts.RemoveGroupRole(nil, acID, cgid, rid))
+	grs = fatal1(AccessContexts.GroupRoles(acID, []GroupID{cgid}, 0, 0)).(map[GroupID]*AcGroupRoles)
+	assertEqual(0, len(grs))
+}
+
+// Role checks through the group hierarchy.
+func TestFlowHasRole(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	acID := fatal1(AccessContexts.New(tx, "HRL Context")).(AccessContextID)
+	rid1 := fatal1(Roles.New(tx, "HRL Reviewer")).(RoleID)
+	rid2 := fatal1(Roles.New(tx, "HRL Approver")).(RoleID)
+	rid3 := fatal1(Roles.New(tx, "HRL Auditor")).(RoleID)
+
+	uid := fatal1(Users.New(tx, "Jaya", "HRL", "jaya.hrl@example.com", 1)).(UserID)
+	sgid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	pgid := fatal1(Groups.New(tx, "HRL Managers", "G")).(GroupID)
+	tgid := fatal1(Groups.New(tx, "HRL Directors", "G")).(GroupID)
+
+	fatal0(AccessContexts.AddChildGroup(tx, acID, tgid, pgid))
+	fatal0(AccessContexts.AddChildGroup(tx, acID, pgid, sgid))
+	fatal0(AccessContexts.AddGroupRole(tx, acID, sgid, rid1))
+	fatal0(AccessContexts.AddGroupRole(tx, acID, tgid, rid2))
+	fatal0(tx.Commit())
+
+	ok := fatal1(AccessContexts.HasRole(acID, uid, rid1)).(bool)
+	assertEqual(true, ok)
+	ok = fatal1(AccessContexts.HasRole(acID, uid, rid2)).(bool)
+	assertEqual(true, ok)
+	ok = fatal1(AccessContexts.HasRole(acID, uid, rid3)).(bool)
+	assertEqual(false, ok)
+}
+
+// Roles of a group, by access context.
+func TestFlowRolesListByGroupInContext(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	acID1 := fatal1(AccessContexts.New(tx, "RBG Context One")).(AccessContextID)
+	acID2 := fatal1(AccessContexts.New(tx, "RBG Context Two")).(AccessContextID)
+	rid1 := fatal1(Roles.New(tx, "RBG Reviewer")).(RoleID)
+	rid2 := fatal1(Roles.New(tx, "RBG Approver")).(RoleID)
+	rid3 := fatal1(Roles.New(tx, "RBG Auditor")).(RoleID)
+	gid := fatal1(Groups.New(tx, "RBG Members", "G")).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID1, gid, rid2))
+	fatal0(AccessContexts.AddGroupRole(tx, acID1, gid, rid1))
+	fatal0(AccessContexts.AddGroupRole(tx, acID2, gid, rid3))
+	fatal0(tx.Commit())
+
+	rs := fatal1(Roles.ListByGroupInContext(acID1, gid)).([]*Role)
+	assertEqual(2, len(rs))
+	assertEqual(rid1, rs[0].ID)
+	assertEqual(rid2, rs[1].ID)
+
+	rs = fatal1(Roles.ListByGroupInContext(acID2, gid)).([]*Role)
+	assertEqual(1, len(rs))
+	assertEqual("RBG Auditor", rs[0].Name)
+
+	if _, err := Roles.ListByGroupInContext(acID1, 0); err == nil {
+		t.Fatalf("expected an error for an invalid group ID")
+	}
+}
+
+// Management of users.
+func TestFlowUsers(t *testing.T) {
+	gt = t
+
+	uid := fatal1(Users.New(nil, "Kavya", "USR", "kavya.usr@example.com", 1)).(UserID)
+
+	u := fatal1(Users.Get(uid)).(*User)
+	assertEqual("Kavya", u.FirstName)
+	assertEqual(true, u.Active)
+	u = fatal1(Users.GetByEmail("kavya.usr@example.com")).(*User)
+	assertEqual(uid, u.ID)
+
+	if _, err := Users.New(nil, "Kavya", "Other", "kavya.usr@example.com", 1); err == nil {
+		t.Fatalf("expected an error for a duplicate e-mail address")
+	}
+
+	fatal0(Users.Deactivate(nil, uid))
+	assertEqual(false, fatal1(Users.IsActive(uid)).(bool))
+	fatal0(Users.Activate(nil, uid))
+	fatal0(Users.Activate(nil, uid))
+	assertEqual(true, fatal1(Users.IsActive(uid)).(bool))
+	assertEqual(true, errors.Is(Users.Deactivate(nil, UserID(1<<30)), ErrNotFound))
+
+	us := fatal1(Users.List("Kavya", 0, 0)).([]*User)
+	assertEqual(1, len(us))
+}
+
+// A new document starts in its workflow's initial state.
+func TestFlowDocumentsInitialState(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DIS Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "DIS Draft")).(DocStateID)
+	acID := fatal1(AccessContexts.New(tx, "DIS Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "DIS Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "DIS Draft", NodeTypeBegin))
+
+	uid := fatal1(Users.New(tx, "DIS", "User", "dis.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{
+		DocTypeID:       dtID,
+		AccessContextID: acID,
+		GroupID:         gid,
+		Title:           "DIS Expense Claim",
+		Data:            "Body of DIS Expense Claim",
+	})).(DocumentID)
+
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(id, doc.ID)
+	assertEqual(dtID, doc.DocType.ID)
+	assertEqual(draft, doc.State.ID)
+	assertEqual("DIS Expense Claim", doc.Title)
+	assertEqual("Body of DIS Expense Claim", doc.Data)
+
+	ds := fatal1(Documents.CurrentState(dtID, id)).(*DocState)
+	assertEqual(draft, ds.ID)
+	assertEqual("DIS Draft", ds.Name)
+}
+
+// Applying actions on behalf of users.
+func TestFlowDocumentsApplyAction(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DAA Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "DAA Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "DAA Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "DAA Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "DAA Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "DAA Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "DAA Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "DAA Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "DAA Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "DAA Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "DAA Approved", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "DAA", "User", "daa.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "DAA Leave Request", Data: "Body"})).(DocumentID)
+
+	_, err := Documents.ApplyAction(nil, dtID, id, approve, uid, "Too early")
+	assertEqual(true, errors.Is(err, ErrWorkflowInvalidAction))
+	_, err = DocEvents.Last(dtID, id)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	state := fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting")).(DocStateID)
+	assertEqual(pending, state)
+	state = fatal1(Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving")).(DocStateID)
+	assertEqual(approved, state)
+
+	ds := fatal1(Documents.CurrentState(dtID, id)).(*DocState)
+	assertEqual(approved, ds.ID)
+}
+
+// Event log of a document.
+func TestFlowDocEventsListByDocument(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "ELD Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "ELD Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "ELD Pending")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "ELD Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "ELD Submit", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "ELD Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	acID := fatal1(AccessContexts.New(tx, "ELD Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "ELD Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "ELD Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "ELD Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, rejected, acID, wfID, "ELD Rejected", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "ELD", "User", "eld.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "ELD Purchase Order", Data: "Body"})).(DocumentID)
+	other := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "ELD Other Order", Data: "Body"})).(DocumentID)
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, other, submit, uid, "Submitting other"))
+	fatal1(Documents.ApplyAction(nil, dtID, id, reject, uid, "Rejecting"))
+
+	evs := fatal1(DocEvents.ListByDocument(dtID, id)).([]*DocEvent)
+	assertEqual(2, len(evs))
+
+	assertEqual(submit, evs[0].Action)
+	assertEqual(draft, evs[0].State)
+	assertEqual(pending, evs[0].ToState)
+	assertEqual(gid, evs[0].Group)
+	assertEqual("ELD Submit", evs[0].ActionName)
+	assertEqual("Submitting", evs[0].Text)
+
+	assertEqual(reject, evs[1].Action)
+	assertEqual(pending, evs[1].State)
+	assertEqual(rejected, evs[1].ToState)
+	assertEqual(EventStatusApplied, evs[1].Status)
+	assertEqual(false, evs[1].Ctime.Before(evs[0].Ctime))
+}
+
+// Reads within an open transaction.
+func TestFlowGetTx(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	daID := fatal1(DocActions.New(tx, "GTX Forward", false)).(DocActionID)
+	dsID := fatal1(DocStates.New(tx, "GTX Forwarded")).(DocStateID)
+	rid := fatal1(Roles.New(tx, "GTX Forwarder")).(RoleID)
+	gid := fatal1(Groups.New(tx, "GTX Forwarders", GroupTypeGeneral)).(GroupID)
+
+	da := fatal1(DocActions.GetTx(tx, daID)).(*DocAction)
+	assertEqual("GTX Forward", da.Name)
+	ds := fatal1(DocStates.GetTx(tx, dsID)).(*DocState)
+	assertEqual("GTX Forwarded", ds.Name)
+	r := fatal1(Roles.GetTx(tx, rid)).(*Role)
+	assertEqual("GTX Forwarder", r.Name)
+	g := fatal1(Groups.GetTx(tx, gid)).(*Group)
+	assertEqual("GTX Forwarders", g.Name)
+
+	// Lookups by name, and listings.
+	da = fatal1(DocActions.GetByNameTx(tx, "GTX Forward")).(*DocAction)
+	assertEqual(daID, da.ID)
+	id, ok, err := DocActions.ExistsTx(tx, "GTX Forward")
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(daID, id)
+	das := fatal1(DocActions.ListByPrefixTx(tx, "GTX ", 0, 0)).([]*DocAction)
+	assertEqual(1, len(das))
+	das = fatal1(DocActions.ListTx(tx, 0, 0)).([]*DocAction)
+	assertEqual(daID, das[len(das)-1].ID)
+	ds = fatal1(DocStates.GetByNameTx(tx, "GTX Forwarded")).(*DocState)
+	assertEqual(dsID, ds.ID)
+	dss := fatal1(DocStates.ListTx(tx, 0, 0)).([]*DocState)
+	assertEqual(dsID, dss[len(dss)-1].ID)
+	r = fatal1(Roles.GetByNameTx(tx, "GTX Forwarder")).(*Role)
+	assertEqual(rid, r.ID)
+	rs := fatal1(Roles.ListTx(tx, 0, 0)).([]*Role)
+	assertEqual(rid, rs[len(rs)-1].ID)
+	gs := fatal1(Groups.ListTx(tx, 0, 0)).([]*Group)
+	assertEqual(gid, gs[len(gs)-1].ID)
+
+	fatal0(tx.Rollback())
+	_, err = Roles.Get(rid)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, ok, err = DocActions.Exists("GTX Forward")
+	fatal0(err)
+	assertEqual(false, ok)
+}
+
+// Lookups of missing items.
+func TestFlowGetNotFound(t *testing.T) {
+	gt = t
+
+	const missing = 1 << 30
+	var err error
+	_, err = DocActions.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = DocActions.GetByName("NFD No Such Action")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = DocStates.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = DocStates.GetByName("NFD No Such State")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = DocTypes.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = DocTypes.GetByName("NFD No Such Type")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Roles.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Roles.GetByName("NFD No Such Role")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Groups.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Users.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Users.GetByEmail("nfd.nobody@example.com")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = AccessContexts.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Workflows.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Workflows.GetByName("NFD No Such Workflow")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Nodes.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = DocEvents.Get(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	_, err = Users.IsActive(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Users.SingletonGroupOf(missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	// A document type without a workflow.
+	dtID := fatal1(DocTypes.New(nil, "NFD Bare Type")).(DocTypeID)
+	_, err = Documents.Get(nil, dtID, missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Nodes.GetByState(dtID, missing)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	_, err = Workflows.GetByDocType(dtID)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	uid := fatal1(Users.New(nil, "NFD", "User", "nfd.user@example.com", 1)).(UserID)
+	fatal1(Groups.NewSingleton(nil, uid))
+	submit := fatal1(DocActions.New(nil, "NFD Submit", false)).(DocActionID)
+	_, err = Documents.ApplyAction(nil, dtID, missing, submit, uid, "Submitting")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	assertCode(CodeNotFound, err)
+}
+
+// Names at and over the length limit.
+func TestFlowMaxNameLen(t *testing.T) {
+	gt = t
+
+	pad := func(prefix string, n int) string {
+		return prefix + strings.Repeat("x", n-len(prefix))
+	}
+
+	fatal1(DocActions.New(nil, pad("MNL Action ", MaxNameLen), false))
+	fatal1(DocStates.New(nil, pad("MNL State ", MaxNameLen)))
+	fatal1(DocTypes.New(nil, pad("MNL Type ", MaxNameLen)))
+	fatal1(Roles.New(nil, pad("MNL Role ", MaxRoleNameLen)))
+	fatal1(Groups.New(nil, pad("MNL Group ", MaxNameLen), GroupTypeGeneral))
+
+	var err error
+	_, err = DocActions.New(nil, pad("MNL Action ", MaxNameLen+1), false)
+	assertEqual(true, errors.Is(err, ErrNameTooLong))
+	_, err = DocStates.New(nil, pad("MNL State ", MaxNameLen+1))
+	assertEqual(true, errors.Is(err, ErrNameTooLong))
+	_, err = DocTypes.New(nil, pad("MNL Type ", MaxNameLen+1))
+	assertEqual(true, errors.Is(err, ErrNameTooLong))
+	_, err = Roles.New(nil, pad("MNL Role ", MaxRoleNameLen+1))
+	assertEqual(true, errors.Is(err, ErrNameTooLong))
+	_, err = Groups.New(nil, pad("MNL Group ", MaxNameLen+1), GroupTypeGeneral)
+	assertEqual(true, errors.Is(err, ErrNameTooLong))
+
+	// Length is counted in characters, not bytes.
+	fatal1(DocStates.New(nil, "MNL "+strings.Repeat("é", MaxNameLen-4)))
+}
+
+// Names differing only in case.
+func TestFlowNameCaseInsensitive(t *testing.T) {
+	gt = t
+
+	var err error
+	fwd := fatal1(DocActions.New(nil, "NCI Forward", false)).(DocActionID)
+	_, err = DocActions.New(nil, "NCI FORWARD", false)
+	assertEqual(true, errors.Is(err, ErrNameExists))
+	_, err = DocActions.NewBatch(nil, []string{"NCI Return", "nci forward"})
+	assertEqual(true, errors.Is(err, ErrNameExists))
+	_, err = DocActions.NewBatch(nil, []string{"NCI Return", "NCI RETURN"})
+	assertCode(CodeInvalidArg, err)
+
+	// Renames are checked likewise, but a change of case alone is
+	// allowed.
+	ret := fatal1(DocActions.New(nil, "NCI Return", false)).(DocActionID)
+	assertEqual(true, errors.Is(DocActions.Rename(nil, ret, "nci FORWARD"), ErrNameExists))
+	assertEqual(true, errors.Is(DocActions.RenameByName(nil, "NCI Return", "NCI forward"), ErrNameExists))
+	assertEqual(true, errors.Is(DocActions.RenameMany(nil, map[DocActionID]string{ret: "NCI FORWARD"}), ErrNameExists))
+	fatal0(DocActions.Rename(nil, fwd, "NCI FORWARD"))
+	fatal0(DocActions.RenameByName(nil, "NCI Return", "NCI RETURN"))
+
+	fatal1(DocStates.New(nil, "NCI Forwarded"))
+	_, err = DocStates.New(nil, "nci forwarded")
+	assertEqual(true, errors.Is(err, ErrNameExists))
+	sid := fatal1(DocStates.New(nil, "NCI Returned")).(DocStateID)
+	assertEqual(true, errors.Is(DocStates.Rename(nil, sid, "NCI FORWARDED"), ErrNameExists))
+
+	fatal1(DocTypes.New(nil, "NCI:MEMO"))
+	_, err = DocTypes.New(nil, "nci:memo")
+	assertEqual(true, errors.Is(err, ErrNameExists))
+
+	fatal1(Roles.New(nil, "NCI Forwarder"))
+	_, err = Roles.New(nil, "NCI FORWARDER")
+	assertEqual(true, errors.Is(err, ErrNameExists))
+
+	fatal1(Groups.New(nil, "NCI Forwarders", GroupTypeGeneral))
+	_, err = Groups.New(nil, "nci forwarders", GroupTypeGeneral)
+	assertEqual(true, errors.Is(err, ErrNameExists))
+
+	fatal1(AccessContexts.New(nil, "NCI Context"))
+	_, err = AccessContexts.New(nil, "NCI CONTEXT")
+	assertEqual(true, errors.Is(err, ErrNameExists))
+}
+
+// Explicitly chosen initial states.
+func TestFlowDocStatesSetInitial(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DSI Request")).(DocTypeID)
+	otherID := fatal1(DocTypes.New(nil, "DSO Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "DSI Draft")).(DocStateID)
+	review := fatal1(DocStates.New(tx, "DSI Review")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "DSI Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "DSI Approved")).(DocStateID)
+	otherDraft := fatal1(DocStates.New(tx, "DSO Draft")).(DocStateID)
+
+	acID := fatal1(AccessContexts.New(tx, "DSI Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "DSI Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "DSI Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, review, acID, wfID, "DSI Review", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "DSI Pending", NodeTypeBranch))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "DSI Approved", NodeTypeEnd))
+	owfID := fatal1(Workflows.New(tx, "DSO Flow", otherID, otherDraft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, otherID, otherDraft, acID, owfID, "DSO Draft", NodeTypeBegin))
+
+	uid := fatal1(Users.New(tx, "DSI", "User", "dsi.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	ds := fatal1(DocStates.InitialState(dtID)).(*DocState)
+	assertEqual(draft, ds.ID)
+
+	fatal0(DocStates.SetInitial(nil, dtID, review))
+	ds = fatal1(DocStates.InitialState(dtID)).(*DocState)
+	assertEqual(review, ds.ID)
+	wf := fatal1(Workflows.GetByDocType(dtID)).(*Workflow)
+	assertEqual(review, wf.BeginState.ID)
+	sc := fatal1(DocStates.ConsistencyCheck(dtID)).(*StateConsistency)
+	assertEqual(true, sc.OK())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "DSI Quick Note", Data: "Body"})).(DocumentID)
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(review, doc.State.ID)
+
+	fatal0(DocStates.SetInitial(nil, dtID, draft))
+	ds = fatal1(DocStates.InitialState(dtID)).(*DocState)
+	assertEqual(draft, ds.ID)
+
+	// Only one node begins the workflow.
+	n := fatal1(Nodes.GetByState(dtID, review)).(*Node)
+	assertEqual(NodeType(NodeTypeLinear), n.NodeType)
+	sc = fatal1(DocStates.ConsistencyCheck(dtID)).(*StateConsistency)
+	assertEqual(int64(1), sc.InitialCount)
+	assertEqual(true, sc.OK())
+
+	// The state must have a linear node in the type's workflow.
+	assertCode(CodeInvalidArg, DocStates.SetInitial(nil, dtID, otherDraft))
+	assertCode(CodeInvalidArg, DocStates.SetInitial(nil, dtID, pending))
+	assertCode(CodeInvalidArg, DocStates.SetInitial(nil, dtID, approved))
+	n = fatal1(Nodes.GetByState(dtID, pending)).(*Node)
+	assertEqual(NodeType(NodeTypeBranch), n.NodeType)
+	ds = fatal1(DocStates.Initial(otherID)).(*DocState)
+	assertEqual(otherDraft, ds.ID)
+}
+
+// Documents in terminal states.
+func TestFlowDocumentsIsClosed(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "TRM Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "TRM Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "TRM Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "TRM Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "TRM Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "TRM Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "TRM Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "TRM Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "TRM Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "TRM Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "TRM Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "TRM Approved", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "TRM", "User", "trm.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "TRM Travel Request", Data: "Body"})).(DocumentID)
+	fatal0(DocStates.SetTerminal(nil, dtID, approved, true))
+
+	assertEqual(false, fatal1(Documents.IsClosed(dtID, id)).(bool))
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+
+	// Transitions out of a terminal state are blocked.
+	fatal0(DocStates.SetTerminal(nil, dtID, pending, true))
+	assertEqual(true, fatal1(Documents.IsClosed(dtID, id)).(bool))
+	_, err := Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving")
+	assertEqual(true, errors.Is(err, ErrDocumentClosed))
+	assertCode(CodeConflict, err)
+	fatal0(DocStates.SetTerminal(nil, dtID, pending, false))
+
+	state := fatal1(Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving")).(DocStateID)
+	assertEqual(approved, state)
+	assertEqual(true, fatal1(Documents.IsClosed(dtID, id)).(bool))
+
+	_, err = Documents.IsClosed(dtID, id+1000)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	// The bulk, optimistic and event paths are blocked as well.
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "TRM Second Request", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id2, submit, uid, "Submitting"))
+	fatal0(DocStates.SetTerminal(nil, dtID, pending, true))
+	_, err = Documents.ApplyActionToMany(nil, dtID, []DocumentID{id2}, approve, gid, "Approving")
+	assertEqual(true, errors.Is(err, ErrDocumentClosed))
+	_, err = Documents.ApplyActionCAS(dtID, id2, approve, gid, "Approving", 3)
+	assertEqual(true, errors.Is(err, ErrDocumentClosed))
+	wf := fatal1(Workflows.Get(wfID)).(*Workflow)
+	event := &DocEvent{DocType: dtID, DocID: id2, State: pending, Action: approve, Group: gid, Status: EventStatusPending}
+	_, err = wf.ApplyEvent(nil, event, nil)
+	assertEqual(true, errors.Is(err, ErrDocumentClosed))
+
+	// Terminal states are per document type.
+	tx = fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	other := fatal1(DocTypes.New(tx, "TRM Other Request")).(DocTypeID)
+	fatal1(DocStateTransitions.New(tx, other, approved, reject, pending))
+	fatal0(tx.Commit())
+	fatal0(DocStates.SetTerminal(nil, dtID, pending, false))
+	fatal0(DocStates.SetTerminal(nil, other, pending, true))
+	assertEqual(false, fatal1(Documents.IsClosed(dtID, id2)).(bool))
+
+	// The state should exist, and be used by the document type.
+	assertCode(CodeNotFound, DocStates.SetTerminal(nil, dtID, pending+1000, true))
+	assertCode(CodeInvalidArg, DocStates.SetTerminal(nil, other, draft, true))
+}
+
+// Graphviz export of a state machine.
+func TestFlowExportDOT(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DOT Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "DOT Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "DOT Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "DOT Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "DOT Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "DOT Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "DOT Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "DOT Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	wfID := fatal1(Workflows.New(tx, "DOT Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, 0, wfID, "DOT Draft", NodeTypeBegin))
+
+	fatal0(tx.Commit())
+
+	fatal0(DocStates.SetTerminal(nil, dtID, approved, true))
+	fatal0(DocStates.SetTerminal(nil, dtID, rejected, true))
+
+	out := fatal1(DocStateTransitions.ExportDOT(dtID)).(string)
+	for _, want := range []string{
+		`digraph "DOT Request" {`,
+		fmt.Sprintf(`s%d [label="DOT Draft", shape=doublecircle];`, draft),
+		fmt.Sprintf(`s%d [label="DOT Pending"];`, pending),
+		fmt.Sprintf(`s%d [label="DOT Approved", style=filled, fillcolor=lightgrey];`, approved),
+		fmt.Sprintf(`s%d -> s%d [label="DOT Submit"];`, draft, pending),
+		fmt.Sprintf(`s%d -> s%d [label="DOT Approve"];`, pending, approved),
+		fmt.Sprintf(`s%d -> s%d [label="DOT Reject"];`, pending, rejected),
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected output to contain : %s\ngot : %s", want, out)
+		}
+	}
+	assertEqual(true, strings.HasSuffix(out, "}\n"))
+	assertEqual(`"say \"hi\""`, dotQuote(`say "hi"`))
+}
+
+// Validation of state machines.
+func TestFlowDocStateTransitionsValidate(t *testing.T) {
+	gt = t
+
+	t.Run("Valid", func(t *testing.T) {
+		dtID := fatal1(DocTypes.New(nil, "VLD Request")).(DocTypeID)
+
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+		draft := fatal1(DocStates.New(tx, "VLD Draft")).(DocStateID)
+		approved := fatal1(DocStates.New(tx, "VLD Approved")).(DocStateID)
+		approve := fatal1(DocActions.New(tx, "VLD Approve", false)).(DocActionID)
+		fatal0(DocTypes.AddTransition(tx, dtID, draft, approve, approved))
+		wfID := fatal1(Workflows.New(tx, "VLD Flow", dtID, draft)).(WorkflowID)
+		fatal1(Workflows.AddNode(tx, dtID, draft, 0, wfID, "VLD Draft", NodeTypeBegin))
+		fatal0(tx.Commit())
+		fatal0(DocStates.SetTerminal(nil, dtID, approved, true))
+
+		ps := fatal1(DocStateTransitions.Validate(dtID)).([]string)
+		assertEqual(0, len(ps))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		dtID := fatal1(DocTypes.New(nil, "VLU Request")).(DocTypeID)
+
+		tx := fatal1(db().Begin()).(*sql.Tx)
+		defer tx.Rollback()
+		draft := fatal1(DocStates.New(tx, "VLU Draft")).(DocStateID)
+		approved := fatal1(DocStates.New(tx, "VLU Approved")).(DocStateID)
+		orphan := fatal1(DocStates.New(tx, "VLU Orphan")).(DocStateID)
+		approve := fatal1(DocActions.New(tx, "VLU Approve", false)).(DocActionID)
+		unused := fatal1(DocActions.New(tx, "VLU Recall", false)).(DocActionID)
+		fatal0(DocTypes.AddTransition(tx, dtID, draft, approve, approved))
+		fatal1(DocStateTransitions.New(tx, dtID, orphan, approve, approved))
+		wfID := fatal1(Workflows.New(tx, "VLU Flow", dtID, draft)).(WorkflowID)
+		fatal1(Workflows.AddNode(tx, dtID, draft, 0, wfID, "VLU Draft", NodeTypeBegin))
+		roleID := fatal1(Roles.New(tx, "VLU Role")).(RoleID)
+		fatal0(Roles.AddPermissions(tx, roleID, dtID, []DocActionID{approve, unused}))
+		fatal0(tx.Commit())
+		fatal0(DocStates.SetTerminal(nil, dtID, approved, true))
+
+		ps := fatal1(DocStateTransitions.Validate(dtID)).([]string)
+		assertEqual(2, len(ps))
+		assertEqual(`state "VLU Orphan" is unreachable from the initial state`, ps[0])
+		assertEqual(`action "VLU Recall" is used by no transition`, ps[1])
+	})
+}
+
+// Transactions around a function.
+func TestFlowWithTx(t *testing.T) {
+	gt = t
+
+	t.Run("CommitOnSuccess", func(t *testing.T) {
+		fatal0(WithTx(func(tx *sql.Tx) error {
+			_, err := DocStates.New(tx, "WTX Committed State")
+			return err
+		}))
+		fatal1(DocStates.GetByName("WTX Committed State"))
+	})
+
+	t.Run("RollbackOnError", func(t *testing.T) {
+		errTest := errors.New("deliberate failure")
+		err := WithTx(func(tx *sql.Tx) error {
+			fatal1(DocStates.New(tx, "WTX Failed State"))
+			return errTest
+		})
+		assertEqual(errTest, err)
+		_, err = DocStates.GetByName("WTX Failed State")
+		assertEqual(true, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("RollbackOnPanic", func(t *testing.T) {
+		func() {
+			defer func() {
+				assertEqual("deliberate panic", recover())
+			}()
+			WithTx(func(tx *sql.Tx) error {
+				fatal1(DocStates.New(tx, "WTX Panicked State"))
+				panic("deliberate panic")
+			})
+		}()
+		_, err := DocStates.GetByName("WTX Panicked State")
+		assertEqual(true, errors.Is(err, ErrNotFound))
+	})
+}
+
+// Registration of the database handle while queries are in flight.
+// Run using `go test -race` to detect unsynchronised access.
+func TestFlowRegisterDBConcurrent(t *testing.T) {
+	gt = t
+
+	// Alternating between two handles resets the statement cache each
+	// time, while `Get` and `Exists` use cached statements.
+	sdb := db()
+	odb := fatal1(sql.Open("mysql", "travis@/flow")).(*sql.DB)
+	defer odb.Close()
+	daID := fatal1(DocActions.New(nil, "RDC Submit", false)).(DocActionID)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			RegisterDB(odb)
+			RegisterDBDialect(sdb, MySQL)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		fatal1(DocActions.List(0, 10))
+		da := fatal1(DocActions.Get(daID)).(*DocAction)
+		assertEqual("RDC Submit", da.Name)
+		_, ok, err := DocActions.Exists("RDC Submit")
+		fatal0(err)
+		assertEqual(true, ok)
+	}
+	wg.Wait()
+	assertEqual(sdb, db())
+}
+
+// Listings in chosen orders.
+func TestFlowListOrdered(t *testing.T) {
+	gt = t
+
+	for _, name := range []string{"ORD Charlie", "ORD Alpha", "ORD Bravo"} {
+		fatal1(DocActions.New(nil, name, false))
+		fatal1(Roles.New(nil, name))
+	}
+	names := func(all []string) string {
+		ns := make([]string, 0, 3)
+		for _, n := range all {
+			if strings.HasPrefix(n, "ORD ") {
+				ns = append(ns, strings.TrimPrefix(n, "ORD "))
+			}
+		}
+		return strings.Join(ns, ",")
+	}
+	actionNames := func(order OrderBy) string {
+		das := fatal1(DocActions.ListOrdered(order, 0, 0)).([]*DocAction)
+		all := make([]string, 0, len(das))
+		for _, da := range das {
+			all = append(all, da.Name)
+		}
+		return names(all)
+	}
+	roleNames := func(order OrderBy) string {
+		rs := fatal1(Roles.ListOrdered(order, 0, 0)).([]*Role)
+		all := make([]string, 0, len(rs))
+		for _, r := range rs {
+			all = append(all, r.Name)
+		}
+		return names(all)
+	}
+
+	assertEqual("Charlie,Alpha,Bravo", actionNames(OrderByID))
+	assertEqual("Bravo,Alpha,Charlie", actionNames(OrderByIDDesc))
+	assertEqual("Alpha,Bravo,Charlie", actionNames(OrderByName))
+	assertEqual("Charlie,Bravo,Alpha", actionNames(OrderByNameDesc))
+	assertEqual("Alpha,Bravo,Charlie", roleNames(OrderByName))
+	assertEqual("Bravo,Alpha,Charlie", roleNames(OrderByIDDesc))
+
+	if _, err := DocStates.ListOrdered(OrderBy(99), 0, 0); err == nil {
+		t.Fatalf("expected an error for an unknown ordering")
+	}
+}
+
+// Renaming document actions by name.
+func TestFlowDocActionsRenameByName(t *testing.T) {
+	gt = t
+
+	id := fatal1(DocActions.New(nil, "RBN Forward", false)).(DocActionID)
+	fatal0(DocActions.RenameByName(nil, " RBN Forward ", "RBN Send On"))
+	da := fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("RBN Send On", da.Name)
+
+	// Renaming to the same name is not an error.
+	fatal0(DocActions.RenameByName(nil, "RBN Send On", "RBN Send On"))
+
+	err := DocActions.RenameByName(nil, "RBN No Such Action", "RBN Other")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	if err = DocActions.RenameByName(nil, "RBN Send On", " "); err == nil {
+		t.Fatalf("expected an error for an empty new name")
+	}
+}
+
+// Renaming and deleting missing items.
+func TestFlowRenameDeleteNotFound(t *testing.T) {
+	gt = t
+
+	const missing = 1 << 30
+	for _, err := range []error{
+		DocActions.Rename(nil, missing, "RDN Action"),
+		DocStates.Rename(nil, missing, "RDN State"),
+		DocTypes.Rename(nil, missing, "RDN Type"),
+		Roles.Rename(nil, missing, "RDN Role"),
+		Groups.Rename(nil, missing, "RDN Group"),
+		AccessContexts.Rename(nil, missing, "RDN Context"),
+		Workflows.Rename(nil, missing, "RDN Flow"),
+		DocActions.Delete(nil, missing),
+		Roles.Delete(nil, missing),
+		Groups.Delete(nil, missing),
+		DocStateTransitions.Delete(nil, missing),
+	} {
+		assertEqual(true, errors.Is(err, ErrNotFound))
+	}
+
+	// Renaming to the current name is not an error.
+	rid := fatal1(Roles.New(nil, "RDN Same")).(RoleID)
+	fatal0(Roles.Rename(nil, rid, "RDN Same"))
+}
+
+// Cached document actions.
+func TestFlowDocActionCache(t *testing.T) {
+	gt = t
+
+	id := fatal1(DocActions.New(nil, "DAC Escalate", false)).(DocActionID)
+	EnableDocActionCache()
+	defer DisableDocActionCache()
+
+	da := fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Escalate", da.Name)
+
+	// Hits do not go to the database, which is changed behind the
+	// back of `flow` here.
+	fatal1(db().Exec("UPDATE wf_docactions_master SET name = 'DAC Behind' WHERE id = ?", id))
+	da = fatal1(DocActions.GetByName("DAC Escalate")).(*DocAction)
+	assertEqual(id, da.ID)
+	eid, ok, err := DocActions.Exists("DAC Escalate")
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(id, eid)
+
+	// Answers are copies.
+	da.Name = "DAC Tampered"
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Escalate", da.Name)
+
+	// Mutations invalidate.
+	fatal0(DocActions.Rename(nil, id, "DAC Raise"))
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Raise", da.Name)
+	_, ok, err = DocActions.Exists("DAC Escalate")
+	fatal0(err)
+	assertEqual(false, ok)
+
+	// A rename in a caller's transaction is not cached before it is
+	// committed, nor is the old name served after.
+	fatal0(WithTx(func(tx *sql.Tx) error {
+		if err := DocActions.Rename(tx, id, "DAC Lift"); err != nil {
+			return err
+		}
+		da := fatal1(DocActions.Get(id)).(*DocAction)
+		assertEqual("DAC Raise", da.Name)
+		return nil
+	}))
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Lift", da.Name)
+	fatal1(db().Exec("UPDATE wf_docactions_master SET name = 'DAC Behind' WHERE id = ?", id))
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Lift", da.Name)
+
+	// The same in a transaction that is rolled back.
+	err = WithTx(func(tx *sql.Tx) error {
+		fatal0(DocActions.Rename(tx, id, "DAC Hoist"))
+		return errors.New("roll back")
+	})
+	assertNotEqual(nil, err)
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Behind", da.Name)
+
+	// The end of other transactions cannot be observed, so changes
+	// in them are refused, and the cache stays in use.
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	err = DocActions.Rename(tx, id, "DAC Elevate")
+	assertEqual(true, errors.Is(err, ErrTxUntracked))
+	_, _, err = DocActions.Ensure(tx, "DAC Elevate", false)
+	assertEqual(true, errors.Is(err, ErrTxUntracked))
+	fatal0(tx.Rollback())
+	fatal1(db().Exec("UPDATE wf_docactions_master SET name = 'DAC Elevate' WHERE id = ?", id))
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Behind", da.Name)
+
+	// Creating an action in a self-managed transaction leaves the
+	// cache in use, too.
+	eda, created, err := DocActions.Ensure(nil, "DAC Ensured", false)
+	fatal0(err)
+	assertEqual(true, created)
+	da = fatal1(DocActions.Get(eda.ID)).(*DocAction)
+	assertEqual("DAC Ensured", da.Name)
+	fatal1(db().Exec("UPDATE wf_docactions_master SET name = 'DAC Behind Ensured' WHERE id = ?", eda.ID))
+	da = fatal1(DocActions.Get(eda.ID)).(*DocAction)
+	assertEqual("DAC Ensured", da.Name)
+	fatal0(DocActions.Delete(nil, eda.ID))
+	EnableDocActionCache()
+	da = fatal1(DocActions.Get(id)).(*DocAction)
+	assertEqual("DAC Elevate", da.Name)
+
+	fatal0(DocActions.Delete(nil, id))
+	_, err = DocActions.Get(id)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+}
+
+// Concurrent preparation of cached statements.
+func TestFlowStmtCacheConcurrent(t *testing.T) {
+	gt = t
+
+	id := fatal1(DocActions.New(nil, "SCC Action", false)).(DocActionID)
+	resetStmtCache()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := DocActions.Get(id)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		fatal0(err)
+	}
+
+	// The losers of the race close their statements.
+	stmtCache.Lock()
+	n := len(stmtCache.cur.m)
+	users := stmtCache.cur.users
+	stmtCache.Unlock()
+	assertEqual(1, n)
+	assertEqual(0, users)
+}
+
+// recordingObserver remembers the names of the operations it sees.
+type recordingObserver struct {
+	sync.Mutex
+	names []string
+	errs  int
+}
+
+func (o *recordingObserver) ObserveQuery(name string, d time.Duration, err error) {
+	o.Lock()
+	defer o.Unlock()
+	o.names = append(o.names, name)
+	if err != nil {
+		o.errs++
+	}
+}
+
+// Observation of database operations.
+func TestFlowObserver(t *testing.T) {
+	gt = t
+
+	o := &recordingObserver{}
+	SetObserver(o)
+	defer SetObserver(nil)
+
+	id := fatal1(DocActions.New(nil, "OBS Forward", false)).(DocActionID)
+	fatal1(DocActions.GetContext(context.Background(), id))
+	fatal1(DocStates.List(0, 1))
+	_, err := Roles.Get(1 << 30)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	fatal1(Groups.Count())
+	fatal1(Nodes.NodeList(0, 1))
+	SetObserver(nil)
+	fatal1(DocActions.Get(id))
+
+	o.Lock()
+	defer o.Unlock()
+	assertEqual("DocActions.New,DocActions.Get,DocStates.List,Roles.Get,Groups.Count,Nodes.NodeList", strings.Join(o.names, ","))
+	assertEqual(1, o.errs)
+}
+
+func TestFlowFlowError(t *testing.T) {
+	gt = t
+
+	var fe *FlowError
+	_, err := DocTypes.New(nil, "")
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeInvalidArg, fe.Code)
+	assertEqual("document type", fe.Entity)
+	assertEqual("DocTypes.New", fe.Op)
+
+	fatal1(DocTypes.New(nil, "FER Type"))
+	_, err = DocTypes.New(nil, "fer type")
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+	assertEqual("DocTypes.New", fe.Op)
+	assertEqual(true, errors.Is(err, ErrNameExists))
+
+	_, err = Roles.Get(1 << 30)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeNotFound, fe.Code)
+	assertEqual("Roles.Get", fe.Op)
+}
+
+func TestFlowGroupsAddUsers(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	uid1 := fatal1(Users.New(tx, "GAU", "One", "gau.one@example.com", 1)).(UserID)
+	uid2 := fatal1(Users.New(tx, "GAU", "Two", "gau.two@example.com", 1)).(UserID)
+	uid3 := fatal1(Users.New(tx, "GAU", "Three", "gau.three@example.com", 1)).(UserID)
+	uid4 := fatal1(Users.New(tx, "GAU", "Four", "gau.four@example.com", 1)).(UserID)
+	gid := fatal1(Groups.New(tx, "GAU Group", "G")).(GroupID)
+	fatal0(tx.Commit())
+
+	fatal0(Groups.AddUsers(nil, gid, []UserID{uid1, uid2, uid3, uid2}))
+	us := fatal1(Groups.Users(gid)).([]*User)
+	assertEqual(3, len(us))
+
+	// One of these is already a member.
+	fatal0(Groups.AddUsers(nil, gid, []UserID{uid3, uid4}))
+	us = fatal1(Groups.Users(gid)).([]*User)
+	assertEqual(4, len(us))
+	fatal0(Groups.AddUsers(nil, gid, []UserID{uid1, uid4}))
+	us = fatal1(Groups.Users(gid)).([]*User)
+	assertEqual(4, len(us))
+
+	var fe *FlowError
+	err := Groups.AddUsers(nil, gid, nil)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeInvalidArg, fe.Code)
+}
+
+func TestFlowGroupsAddUserIdempotent(t *testing.T) {
+	gt = t
+
+	uid := fatal1(Users.New(nil, "GAI", "One", "gai.one@example.com", 1)).(UserID)
+	gid := fatal1(Groups.New(nil, "GAI Group", "G")).(GroupID)
+
+	fatal0(Groups.AddUser(nil, gid, uid))
+	assertEqual(nil, Groups.AddUser(nil, gid, uid))
+	us := fatal1(Groups.Users(gid)).([]*User)
+	assertEqual(1, len(us))
+
+	err := Groups.AddUser(nil, 1<<30, uid)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	err = Groups.AddUser(nil, gid, 1<<30)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+}
+
+func TestFlowDocTypesListWithStateCounts(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DSC Request")).(DocTypeID)
+	empty := fatal1(DocTypes.New(nil, "DSC Empty")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	draft := fatal1(DocStates.New(tx, "DSC Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "DSC Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "DSC Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "DSC Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "DSC Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "DSC Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "DSC Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+	fatal0(tx.Commit())
+
+	cs := fatal1(DocTypes.ListWithStateCounts()).([]DocTypeStateCount)
+	counts := make(map[DocTypeID]int64, len(cs))
+	for _, c := range cs {
+		counts[c.DocType.ID] = c.StateCount
+	}
+	n, ok := counts[dtID]
+	assertEqual(true, ok)
+	assertEqual(int64(4), n)
+	n, ok = counts[empty]
+	assertEqual(true, ok)
+	assertEqual(int64(0), n)
+}
+
+func TestFlowTransitionGuard(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "GRD Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "GRD Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "GRD Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "GRD Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "GRD Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "GRD Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "GRD Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "GRD Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	acID := fatal1(AccessContexts.New(tx, "GRD Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "GRD Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "GRD Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "GRD Pending", NodeTypeBranch))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "GRD Approved", NodeTypeEnd))
+	fatal1(Workflows.AddNode(tx, dtID, rejected, acID, wfID, "GRD Rejected", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "GRD", "User", "grd.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "GRD Purchase Order", Data: "Body"})).(DocumentID)
+
+	errVeto := errors.New("second approver required")
+	var order []string
+	RegisterTransitionGuard(func(DocTypeID, DocumentID, DocStateID, DocStateID, DocActionID, UserID) error {
+		order = append(order, "first")
+		return nil
+	})
+	RegisterTransitionGuard(func(dtype DocTypeID, did DocumentID, from, to DocStateID, action DocActionID, by UserID) error {
+		order = append(order, "second")
+		if dtype == dtID && from == pending && to == approved && action == approve && by == uid {
+			return errVeto
+		}
+		return nil
+	})
+	defer ResetTransitionGuards()
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+	assertEqual("first,second", strings.Join(order, ","))
+
+	_, err := Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving")
+	assertEqual(errVeto, err)
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(pending, doc.State.ID)
+	ev := fatal1(DocEvents.Last(dtID, id)).(*DocEvent)
+	assertEqual(draft, ev.State)
+
+	// The bulk, optimistic and event paths consult the guards, too.
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "GRD Second Order", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id2, submit, uid, "Submitting"))
+	_, err = Documents.ApplyActionToMany(nil, dtID, []DocumentID{id, id2}, approve, gid, "Approving")
+	assertEqual(true, errors.Is(err, errVeto))
+	_, err = Documents.ApplyActionCAS(dtID, id2, approve, gid, "Approving", 3)
+	assertEqual(errVeto, err)
+	wf := fatal1(Workflows.Get(wfID)).(*Workflow)
+	event := &DocEvent{DocType: dtID, DocID: id2, State: pending, Action: approve, Group: gid, Status: EventStatusPending}
+	_, err = wf.ApplyEvent(nil, event, nil)
+	assertEqual(errVeto, err)
+	doc = fatal1(Documents.Get(nil, dtID, id2)).(*Document)
+	assertEqual(pending, doc.State.ID)
+
+	state := fatal1(Documents.ApplyAction(nil, dtID, id, reject, uid, "Rejecting")).(DocStateID)
+	assertEqual(rejected, state)
+}
+
+func TestFlowAfterTransition(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "ATL Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "ATL Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "ATL Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "ATL Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "ATL Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "ATL Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "ATL Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "ATL Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "ATL Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "ATL Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "ATL Approved", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "ATL", "User", "atl.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	newDoc := func(title string) DocumentID {
+		return fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: title, Data: "Body"})).(DocumentID)
+	}
+	id := newDoc("ATL Leave Request")
+
+	var evs []*DocEvent
+	RegisterAfterTransition(func(ev *DocEvent) {
+		evs = append(evs, ev)
+	})
+	defer ResetAfterTransitions()
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting"))
+	assertEqual(1, len(evs))
+	assertEqual(id, evs[0].DocID)
+	assertEqual(draft, evs[0].State)
+	assertEqual(pending, evs[0].ToState)
+	assertEqual(submit, evs[0].Action)
+	assertEqual(EventStatusApplied, evs[0].Status)
+	assertEqual(false, evs[0].Ctime.IsZero())
+
+	// Rejected transitions are not reported.
+	_, err := Documents.ApplyAction(nil, dtID, id, submit, uid, "Submitting again")
+	assertEqual(true, errors.Is(err, ErrWorkflowInvalidAction))
+	assertEqual(1, len(evs))
+
+	// Transitions in a caller's transaction are reported once it
+	// commits; hence, it must have been begun through `WithTx`.
+	id2 := newDoc("ATL Second Request")
+	tx = fatal1(db().Begin()).(*sql.Tx)
+	_, err = Documents.ApplyAction(tx, dtID, id2, submit, uid, "Submitting")
+	assertEqual(true, errors.Is(err, ErrTxUntracked))
+	_, err = Documents.ApplyActionToMany(tx, dtID, []DocumentID{id2}, submit, gid, "Submitting")
+	assertEqual(true, errors.Is(err, ErrTxUntracked))
+	fatal0(tx.Rollback())
+	assertEqual(1, len(evs))
+	doc := fatal1(Documents.Get(nil, dtID, id2)).(*Document)
+	assertEqual(draft, doc.State.ID)
+
+	err = WithTx(func(tx *sql.Tx) error {
+		_, err := Documents.ApplyAction(tx, dtID, id, approve, uid, "Approving")
+		assertEqual(1, len(evs))
+		if err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	assertNotEqual(nil, err)
+	assertEqual(1, len(evs))
+	fatal0(WithTx(func(tx *sql.Tx) error {
+		_, err := Documents.ApplyAction(tx, dtID, id, approve, uid, "Approving")
+		assertEqual(1, len(evs))
+		return err
+	}))
+	assertEqual(2, len(evs))
+	assertEqual(approved, evs[1].ToState)
+	assertEqual(false, evs[1].Ctime.IsZero())
+	fatal0(WithTx(func(tx *sql.Tx) error {
+		_, err := Documents.ApplyAction(tx, dtID, id2, submit, uid, "Submitting")
+		return err
+	}))
+	assertEqual(3, len(evs))
+	assertEqual(id2, evs[2].DocID)
+
+	// The bulk and optimistic variants report their transitions, too.
+	id3 := newDoc("ATL Third Request")
+	fatal1(Documents.ApplyActionCAS(dtID, id3, submit, gid, "Submitting", 3))
+	assertEqual(4, len(evs))
+	assertEqual(pending, evs[3].ToState)
+	fatal1(Documents.ApplyActionToMany(nil, dtID, []DocumentID{id2, id3}, approve, gid, "Approving"))
+	assertEqual(6, len(evs))
+	assertEqual(id2, evs[4].DocID)
+	assertEqual(id3, evs[5].DocID)
+
+	// Without listeners, any transaction of the caller will do.
+	ResetAfterTransitions()
+	id4 := newDoc("ATL Fourth Request")
+	tx = fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	fatal1(Documents.ApplyAction(tx, dtID, id4, submit, uid, "Submitting"))
+	fatal0(tx.Commit())
+}
+
+func TestFlowGroupsDeleteCleanup(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "GDL Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	draft := fatal1(DocStates.New(tx, "GDL Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "GDL Pending")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "GDL Submit", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	acID := fatal1(AccessContexts.New(tx, "GDL Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "GDL Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "GDL Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "GDL Pending", NodeTypeEnd))
+	roleID := fatal1(Roles.New(tx, "GDL Role")).(RoleID)
+	uid1 := fatal1(Users.New(tx, "GDL", "One", "gdl.one@example.com", 1)).(UserID)
+	gid1 := fatal1(Groups.NewSingleton(tx, uid1)).(GroupID)
+	uid2 := fatal1(Users.New(tx, "GDL", "Two", "gdl.two@example.com", 1)).(UserID)
+	gid2 := fatal1(Groups.NewSingleton(tx, uid2)).(GroupID)
+	ggid := fatal1(Groups.New(tx, "GDL Team", "G")).(GroupID)
+	fatal0(Groups.AddUser(tx, ggid, uid1))
+	fatal0(AccessContexts.AddGroupRole(tx, acID, ggid, roleID))
+	fatal0(AccessContexts.AddGroup(tx, acID, ggid, gid1))
+	fatal0(AccessContexts.AddGroup(tx, acID, gid2, ggid))
+	fatal0(tx.Commit())
+
+	// Its mailbox goes with it.
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid1, Title: "GDL Expense Claim", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id, submit, uid1, "Submitting"))
+	var mid int64
+	fatal0(db().QueryRow("SELECT id FROM wf_messages WHERE doctype_id = ? AND doc_id = ?", dtID, id).Scan(&mid))
+	fatal1(db().Exec("INSERT INTO wf_mailboxes(group_id, message_id, unread, ctime) VALUES(?, ?, 1, NOW())", ggid, mid))
+
+	fatal0(Groups.Delete(nil, ggid))
+	for _, tbl := range []string{"wf_group_users", "wf_ac_group_roles", "wf_ac_group_hierarchy", "wf_mailboxes"} {
+		var n int64
+		fatal0(db().QueryRow(`SELECT COUNT(*) FROM `+tbl+` WHERE group_id = ?`, ggid).Scan(&n))
+		assertEqual(int64(0), n)
+	}
+	_, err := Groups.Get(ggid)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	assertEqual(gid1, fatal1(AccessContexts.GroupReportsTo(acID, gid2)).(GroupID))
+
+	var fe *FlowError
+	err = Groups.Delete(nil, gid1)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+	fatal1(Groups.Get(gid1))
+
+	// The singleton group of an inactive user can go, but not if the
+	// user acted on, or owns, documents.
+	tx = fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	uid3 := fatal1(Users.New(tx, "GDL", "Three", "gdl.three@example.com", 0)).(UserID)
+	gid3 := fatal1(Groups.NewSingleton(tx, uid3)).(GroupID)
+	fatal0(tx.Commit())
+	fatal0(Users.Deactivate(nil, uid1))
+	assertCode(CodeConflict, Groups.Delete(nil, gid1))
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid2, Title: "GDL Leave Request", Data: "Body"})).(DocumentID)
+	fatal1(db().Exec(`UPDATE `+DocTypes.docStorName(dtID)+` SET group_id = ? WHERE id = ?`, gid3, id2))
+	assertCode(CodeConflict, Groups.Delete(nil, gid3))
+	fatal1(db().Exec(`UPDATE `+DocTypes.docStorName(dtID)+` SET group_id = ? WHERE id = ?`, gid2, id2))
+	fatal0(Groups.Delete(nil, gid3))
+	_, err = Users.SingletonGroupOf(uid3)
+	assertNotEqual(nil, err)
+}
+
+func TestFlowRolesDeleteInUse(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "RDL Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	submit := fatal1(DocActions.New(tx, "RDL Submit", false)).(DocActionID)
+	acID := fatal1(AccessContexts.New(tx, "RDL Context")).(AccessContextID)
+	uid := fatal1(Users.New(tx, "RDL", "User", "rdl.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	fatal0(tx.Commit())
+
+	rid := fatal1(Roles.New(nil, "RDL Unused")).(RoleID)
+	fatal0(Roles.AddPermissions(nil, rid, dtID, []DocActionID{submit}))
+	fatal0(Roles.Delete(nil, rid))
+	_, err := Roles.Get(rid)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	rid = fatal1(Roles.New(nil, "RDL Assigned")).(RoleID)
+	fatal0(AccessContexts.AddGroupRole(nil, acID, gid, rid))
+	var fe *FlowError
+	err = Roles.Delete(nil, rid)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+	assertEqual(true, strings.Contains(err.Error(), "role is assigned in 1 access contexts"))
+	fatal1(Roles.Get(rid))
+}
+
+func TestFlowDefineWorkflow(t *testing.T) {
+	gt = t
+
+	spec := &WorkflowSpec{
+		DocType: "DWF Expense Claim",
+		States: []WorkflowSpecState{
+			{Name: "DWF Draft", Initial: true},
+			{Name: "DWF Pending"},
+			{Name: "DWF Approved", Terminal: true},
+			{Name: "DWF Rejected", Terminal: true},
+		},
+		Actions: []WorkflowSpecAction{
+			{Name: "DWF Submit"},
+			{Name: "DWF Approve"},
+			{Name: "DWF Reject", Reconfirm: true},
+		},
+		Transitions: []WorkflowSpecTransition{
+			{From: "DWF Draft", Action: "DWF Submit", To: "DWF Pending"},
+			{From: "DWF Pending", Action: "DWF Approve", To: "DWF Approved"},
+			{From: "DWF Pending", Action: "DWF Reject", To: "DWF Rejected"},
+		},
+	}
+	dw := fatal1(DefineWorkflow(nil, spec)).(*DefinedWorkflow)
+	assertEqual(3, len(dw.Transitions))
+
+	dt := fatal1(DocTypes.Get(dw.DocType)).(*DocType)
+	assertEqual("DWF Expense Claim", dt.Name)
+	ds := fatal1(DocStates.Initial(dw.DocType)).(*DocState)
+	assertEqual(dw.States["DWF Draft"], ds.ID)
+	da := fatal1(DocActions.Get(dw.Actions["DWF Reject"])).(*DocAction)
+	assertEqual(true, da.Reconfirm)
+	next, ok, err := DocStateTransitions.NextState(dw.DocType, dw.States["DWF Pending"], dw.Actions["DWF Approve"])
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(dw.States["DWF Approved"], next)
+	ps := fatal1(DocStateTransitions.Validate(dw.DocType)).([]string)
+	assertEqual(0, len(ps))
+
+	// The workflow has a node for each state.
+	wf := fatal1(Workflows.GetByDocType(dw.DocType)).(*Workflow)
+	assertEqual(dw.Workflow, wf.ID)
+	assertEqual(dw.States["DWF Draft"], wf.BeginState.ID)
+	assertEqual(4, len(fatal1(Nodes.List(wf.ID)).([]*Node)))
+	n := fatal1(Nodes.GetByState(dw.DocType, dw.States["DWF Pending"])).(*Node)
+	assertEqual(NodeType(NodeTypeBranch), n.NodeType)
+	n = fatal1(Nodes.GetByState(dw.DocType, dw.States["DWF Approved"])).(*Node)
+	assertEqual(NodeType(NodeTypeEnd), n.NodeType)
+	sc := fatal1(DocStates.ConsistencyCheck(dw.DocType)).(*StateConsistency)
+	assertEqual(true, sc.OK())
+
+	// Documents of the new type can be created, and moved along.
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	acID := fatal1(AccessContexts.New(tx, "DWF Context")).(AccessContextID)
+	uid := fatal1(Users.New(tx, "DWF", "Tester", "dwf@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+	fatal0(tx.Commit())
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{
+		DocTypeID:       dw.DocType,
+		AccessContextID: acID,
+		GroupID:         gid,
+		Title:           "DWF Claim",
+		Data:            "DWF Body",
+	})).(DocumentID)
+	doc := fatal1(Documents.Get(nil, dw.DocType, id)).(*Document)
+	assertEqual(dw.States["DWF Draft"], doc.State.ID)
+	state := fatal1(Documents.ApplyAction(nil, dw.DocType, id, dw.Actions["DWF Submit"], uid, "Submitting")).(DocStateID)
+	assertEqual(dw.States["DWF Pending"], state)
+
+	// A caller's transaction suffices when one is required.
+	RequireExplicitTx(true)
+	defer RequireExplicitTx(false)
+	etx := fatal1(db().Begin()).(*sql.Tx)
+	defer etx.Rollback()
+	espec := *spec
+	espec.DocType = "DWF Travel Claim"
+	ew := fatal1(DefineWorkflow(etx, &espec)).(*DefinedWorkflow)
+	fatal0(etx.Commit())
+	assertEqual(true, ew.DocType != dw.DocType)
+	fatal1(Workflows.GetByDocType(ew.DocType))
+	RequireExplicitTx(false)
+
+	// Invalid specifications are rejected before anything is created.
+	var fe *FlowError
+	bad := *spec
+	bad.DocType = "DWF Bad Claim"
+	bad.Transitions = append([]WorkflowSpecTransition{{From: "DWF Draft", Action: "DWF Cancel", To: "DWF Rejected"}}, spec.Transitions...)
+	_, err = DefineWorkflow(nil, &bad)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeInvalidArg, fe.Code)
+	bad = *spec
+	bad.DocType = "DWF Bad Claim"
+	bad.States = []WorkflowSpecState{{Name: "DWF Draft", Initial: true}, {Name: "DWF Pending", Initial: true}}
+	_, err = DefineWorkflow(nil, &bad)
+	assertEqual(true, errors.As(err, &fe))
+	_, err = DocTypes.GetByName("DWF Bad Claim")
+	assertEqual(true, errors.Is(err, ErrNotFound))
+}
+
+func TestFlowExportWorkflow(t *testing.T) {
+	gt = t
+
+	spec := &WorkflowSpec{
+		DocType: "EXP Purchase Request",
+		States: []WorkflowSpecState{
+			{Name: "EXP Draft", Initial: true},
+			{Name: "EXP Pending"},
+			{Name: "EXP Approved", Terminal: true},
+			{Name: "EXP Rejected", Terminal: true},
+		},
+		Actions: []WorkflowSpecAction{
+			{Name: "EXP Submit"},
+			{Name: "EXP Approve"},
+			{Name: "EXP Reject", Reconfirm: true},
+		},
+		Transitions: []WorkflowSpecTransition{
+			{From: "EXP Draft", Action: "EXP Submit", To: "EXP Pending"},
+			{From: "EXP Pending", Action: "EXP Approve", To: "EXP Approved"},
+			{From: "EXP Pending", Action: "EXP Reject", To: "EXP Rejected"},
+		},
+	}
+	dw := fatal1(DefineWorkflow(nil, spec)).(*DefinedWorkflow)
+
+	out := fatal1(ExportWorkflow(dw.DocType)).(*WorkflowSpec)
+	want := fatal1(json.Marshal(spec)).([]byte)
+	got := fatal1(json.Marshal(out)).([]byte)
+	assertEqual(string(want), string(got))
+
+	// Round trip, into a fresh document type.
+	out.DocType = "EXP Purchase Request Copy"
+	cw := fatal1(DefineWorkflow(nil, out)).(*DefinedWorkflow)
+	assertEqual(true, cw.DocType != dw.DocType)
+	cp := fatal1(ExportWorkflow(cw.DocType)).(*WorkflowSpec)
+	assertEqual("EXP Purchase Request Copy", cp.DocType)
+	cp.DocType = spec.DocType
+	got = fatal1(json.Marshal(cp)).([]byte)
+	assertEqual(string(want), string(got))
+}
+
+func TestFlowDocumentsListByState(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "LBS Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "LBS Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "LBS Pending")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "LBS Submit", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+
+	acID := fatal1(AccessContexts.New(tx, "LBS Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "LBS Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "LBS Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "LBS Pending", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "LBS", "User", "lbs.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id1 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "LBS One", Data: "Body"})).(DocumentID)
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "LBS Two", Data: "Body"})).(DocumentID)
+	id3 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "LBS Three", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id1, submit, uid, "Submitting"))
+	fatal1(Documents.ApplyAction(nil, dtID, id3, submit, uid, "Submitting"))
+
+	docs := fatal1(Documents.ListByState(dtID, pending, 0, 0)).([]*Document)
+	assertEqual(2, len(docs))
+	assertEqual(id1, docs[0].ID)
+	assertEqual(id3, docs[1].ID)
+	assertEqual(pending, docs[1].State.ID)
+	assertEqual("LBS Request", docs[1].DocType.Name)
+
+	docs = fatal1(Documents.ListByState(dtID, draft, 0, 0)).([]*Document)
+	assertEqual(1, len(docs))
+	assertEqual(id2, docs[0].ID)
+
+	docs = fatal1(Documents.ListByState(dtID, pending, 1, 1)).([]*Document)
+	assertEqual(1, len(docs))
+	assertEqual(id3, docs[0].ID)
+
+	_, err := Documents.ListByState(dtID, pending, -1, 0)
+	assertNotEqual(nil, err)
+}
+
+func TestFlowDocumentsActionableByRole(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "LAC Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draftState := fatal1(DocStates.New(tx, "LAC Draft")).(DocStateID)
+	pendingState := fatal1(DocStates.New(tx, "LAC Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "LAC Approved")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "LAC Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "LAC Approve", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draftState, submit, pendingState))
+	fatal0(DocTypes.AddTransition(tx, dtID, pendingState, approve, approved))
+
+	acID := fatal1(AccessContexts.New(tx, "LAC Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "LAC Flow", dtID, draftState)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draftState, acID, wfID, "LAC Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pendingState, acID, wfID, "LAC Pending", NodeTypeLinear))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "LAC Approved", NodeTypeEnd))
+
+	srid := fatal1(Roles.New(tx, "LAC Submitter")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, srid, dtID, []DocActionID{submit}))
+	arid := fatal1(Roles.New(tx, "LAC Approver")).(RoleID)
+	fatal0(Roles.AddPermissions(tx, arid, dtID, []DocActionID{approve}))
+	ouid := fatal1(Users.New(tx, "LAC", "Owner", "lac.owner@example.com", 1)).(UserID)
+	ogid := fatal1(Groups.NewSingleton(tx, ouid)).(GroupID)
+	suid := fatal1(Users.New(tx, "LAC", "Submitter", "lac.submitter@example.com", 1)).(UserID)
+	sgid := fatal1(Groups.NewSingleton(tx, suid)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, sgid, srid))
+	auid := fatal1(Users.New(tx, "LAC", "Approver", "lac.approver@example.com", 1)).(UserID)
+	agid := fatal1(Groups.NewSingleton(tx, auid)).(GroupID)
+	fatal0(AccessContexts.AddGroupRole(tx, acID, agid, arid))
+
+	fatal0(tx.Commit())
+
+	draft := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: ogid, Title: "LAC Draft", Data: "Body"})).(DocumentID)
+	pending := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: ogid, Title: "LAC Pending", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, pending, submit, ouid, "Submitting"))
+
+	docs, total, err := Documents.ActionableBy(suid, 0, 0)
+	fatal0(err)
+	assertEqual(int64(1), total)
+	assertEqual(1, len(docs))
+	assertEqual(draft, docs[0].ID)
+	docs, total, err = Documents.ActionableBy(auid, 0, 0)
+	fatal0(err)
+	assertEqual(int64(1), total)
+	assertEqual(1, len(docs))
+	assertEqual(pending, docs[0].ID)
+	assertEqual(pendingState, docs[0].State.ID)
+}
+
+func TestFlowDocumentsVersion(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "VER Request")).(DocTypeID)
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	draft := fatal1(DocStates.New(tx, "VER Draft")).(DocStateID)
+	pending := fatal1(DocStates.New(tx, "VER Pending")).(DocStateID)
+	approved := fatal1(DocStates.New(tx, "VER Approved")).(DocStateID)
+	rejected := fatal1(DocStates.New(tx, "VER Rejected")).(DocStateID)
+	submit := fatal1(DocActions.New(tx, "VER Submit", false)).(DocActionID)
+	approve := fatal1(DocActions.New(tx, "VER Approve", false)).(DocActionID)
+	reject := fatal1(DocActions.New(tx, "VER Reject", true)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, submit, pending))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, approve, approved))
+	fatal0(DocTypes.AddTransition(tx, dtID, pending, reject, rejected))
+
+	acID := fatal1(AccessContexts.New(tx, "VER Context")).(AccessContextID)
+	wfID := fatal1(Workflows.New(tx, "VER Flow", dtID, draft)).(WorkflowID)
+	fatal1(Workflows.AddNode(tx, dtID, draft, acID, wfID, "VER Draft", NodeTypeBegin))
+	fatal1(Workflows.AddNode(tx, dtID, pending, acID, wfID, "VER Pending", NodeTypeBranch))
+	fatal1(Workflows.AddNode(tx, dtID, approved, acID, wfID, "VER Approved", NodeTypeEnd))
+	fatal1(Workflows.AddNode(tx, dtID, rejected, acID, wfID, "VER Rejected", NodeTypeEnd))
+
+	uid := fatal1(Users.New(tx, "VER", "User", "ver.user@example.com", 1)).(UserID)
+	gid := fatal1(Groups.NewSingleton(tx, uid)).(GroupID)
+
+	fatal0(tx.Commit())
+
+	id := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "VER Order", Data: "Body"})).(DocumentID)
+
+	doc := fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(int64(1), doc.Version)
+	fatal1(Documents.ApplyActionVersion(nil, dtID, id, submit, uid, "Submitting", doc.Version))
+	doc = fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(int64(2), doc.Version)
+
+	// A second approver acting on what they read earlier loses.
+	_, err := Documents.ApplyActionVersion(nil, dtID, id, approve, uid, "Approving", 1)
+	assertEqual(true, errors.Is(err, ErrConcurrentModification))
+	var fe *FlowError
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+	doc = fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(pending, doc.State.ID)
+	assertEqual(int64(2), doc.Version)
+
+	// The version is checked before the action.
+	_, err = Documents.ApplyActionVersion(nil, dtID, id, submit, uid, "Submitting", 1)
+	assertEqual(true, errors.Is(err, ErrConcurrentModification))
+
+	fatal1(Documents.ApplyAction(nil, dtID, id, approve, uid, "Approving"))
+	doc = fatal1(Documents.Get(nil, dtID, id)).(*Document)
+	assertEqual(approved, doc.State.ID)
+	assertEqual(int64(3), doc.Version)
+
+	// A concurrent application waits for the first to commit, and
+	// then sees its version.
+	id2 := fatal1(Documents.New(nil, &DocumentsNewInput{DocTypeID: dtID, AccessContextID: acID, GroupID: gid, Title: "VER Second Order", Data: "Body"})).(DocumentID)
+	fatal1(Documents.ApplyAction(nil, dtID, id2, submit, uid, "Submitting"))
+	tx = fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	fatal1(Documents.ApplyActionVersion(tx, dtID, id2, approve, uid, "Approving", 2))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Documents.ApplyActionVersion(nil, dtID, id2, reject, uid, "Rejecting", 2)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("expected to wait for the first transaction; got : %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	fatal0(tx.Commit())
+	err = <-done
+	assertEqual(true, errors.Is(err, ErrConcurrentModification))
+	doc = fatal1(Documents.Get(nil, dtID, id2)).(*Document)
+	assertEqual(approved, doc.State.ID)
+
+	// The user and the transition can be defined earlier in the same
+	// transaction.
+	tx = fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+	withdraw := fatal1(DocActions.New(tx, "VER Withdraw", false)).(DocActionID)
+	fatal0(DocTypes.AddTransition(tx, dtID, draft, withdraw, rejected))
+	uid3 := fatal1(Users.New(tx, "VER", "Newcomer", "ver.newcomer@example.com", 1)).(UserID)
+	gid3 := fatal1(Groups.NewSingleton(tx, uid3)).(GroupID)
+	id3 := fatal1(Documents.New(tx, &DocumentsNewInput{
+		DocTypeID:       dtID,
+		AccessContextID: acID,
+		GroupID:         gid3,
+		Title:           "VER Third Order",
+		Data:            "Body of VER Third Order",
+	})).(DocumentID)
+	state := fatal1(Documents.ApplyActionVersion(tx, dtID, id3, withdraw, uid3, "Withdrawing", 1)).(DocStateID)
+	assertEqual(rejected, state)
+	fatal0(tx.Commit())
+}
+
+func TestFlowDocTypesExists(t *testing.T) {
+	gt = t
+
+	dtID := fatal1(DocTypes.New(nil, "DTE Invoice")).(DocTypeID)
+	id, ok, err := DocTypes.Exists("  DTE Invoice ")
+	fatal0(err)
+	assertEqual(true, ok)
+	assertEqual(dtID, id)
+
+	id, ok, err = DocTypes.Exists("DTE Missing")
+	fatal0(err)
+	assertEqual(false, ok)
+	assertEqual(DocTypeID(0), id)
+
+	_, _, err = DocTypes.Exists(" ")
+	assertNotEqual(nil, err)
+}
+
+func TestFlowDocActionsGetMany(t *testing.T) {
+	gt = t
+
+	a1 := fatal1(DocActions.New(nil, "GMA Sign", false)).(DocActionID)
+	a2 := fatal1(DocActions.New(nil, "GMA Seal", true)).(DocActionID)
+	a3 := fatal1(DocActions.New(nil, "GMA Stamp", false)).(DocActionID)
+
+	m := fatal1(DocActions.GetMany([]DocActionID{a1, a2, a3, a2})).(map[DocActionID]*DocAction)
+	assertEqual(3, len(m))
+	assertEqual("GMA Sign", m[a1].Name)
+	assertEqual("GMA Seal", m[a2].Name)
+	assertEqual(true, m[a2].Reconfirm)
+	assertEqual("GMA Stamp", m[a3].Name)
+
+	m = fatal1(DocActions.GetMany(nil)).(map[DocActionID]*DocAction)
+	assertEqual(0, len(m))
+
+	_, err := DocActions.GetMany([]DocActionID{a1, 0})
+	assertNotEqual(nil, err)
+}
+
+func TestFlowUsersEmailNormalized(t *testing.T) {
+	gt = t
+
+	uid := fatal1(Users.New(nil, "UEN", "Mixed", " Foo@Example.com ", 1)).(UserID)
+
+	_, err := Users.New(nil, "UEN", "Lower", "foo@example.com", 1)
+	var fe *FlowError
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+
+	u := fatal1(Users.GetByEmail("foo@example.com")).(*User)
+	assertEqual(uid, u.ID)
+	assertEqual("foo@example.com", u.Email)
+
+	u = fatal1(Users.GetByEmail("FOO@EXAMPLE.COM")).(*User)
+	assertEqual(uid, u.ID)
+}
+
+func TestFlowStats(t *testing.T) {
+	gt = t
+
+	fatal1(DocTypes.New(nil, "STS Memo"))
+	fatal1(Users.New(nil, "STS", "Seed", "sts.seed@example.com", 1))
+
+	st := fatal1(Stats()).(map[string]int64)
+	for _, tbl := range wfTables {
+		_, ok := st[tbl]
+		assertEqual(!schemaViews[tbl], ok, "unexpected presence of : "+tbl)
+	}
+	assertEqual(len(wfTables)-len(schemaViews)+1, len(st))
+	assertEqual(true, st["users_master"] >= 1)
+	assertEqual(true, st["wf_doctypes_master"] >= 1)
+}
+
+func TestFlowGroupsMoveUser(t *testing.T) {
+	gt = t
+
+	uid := fatal1(Users.New(nil, "GMU", "One", "gmu.one@example.com", 1)).(UserID)
+	g1 := fatal1(Groups.New(nil, "GMU Source", "G")).(GroupID)
+	g2 := fatal1(Groups.New(nil, "GMU Target", "G")).(GroupID)
+	fatal0(Groups.AddUser(nil, g1, uid))
+
+	fatal0(Groups.MoveUser(nil, g1, g2, uid))
+	assertEqual(false, fatal1(Groups.HasUser(g1, uid)).(bool))
+	assertEqual(true, fatal1(Groups.HasUser(g2, uid)).(bool))
+
+	// The user is no longer in the source group.
+	err := Groups.MoveUser(nil, g1, g2, uid)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	assertEqual(true, fatal1(Groups.HasUser(g2, uid)).(bool))
+
+	// A failure to add to the target leaves the source untouched.
+	err = Groups.MoveUser(nil, g2, 1<<30, uid)
+	assertEqual(true, errors.Is(err, ErrNotFound))
+	assertEqual(true, fatal1(Groups.HasUser(g2, uid)).(bool))
+}
+
+func TestFlowGroupsHierarchyWalk(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	acID := fatal1(AccessContexts.New(tx, "GHW Context")).(AccessContextID)
+	top := fatal1(Groups.New(tx, "GHW Directors", "G")).(GroupID)
+	mid := fatal1(Groups.New(tx, "GHW Managers", "G")).(GroupID)
+	low := fatal1(Groups.New(tx, "GHW Clerks", "G")).(GroupID)
+	fatal0(AccessContexts.AddChildGroup(tx, acID, top, mid))
+	fatal0(AccessContexts.AddChildGroup(tx, acID, mid, low))
+	fatal0(tx.Commit())
+
+	ids := func(gs []*Group) []GroupID {
+		ary := make([]GroupID, 0, len(gs))
+		for _, g := range gs {
+			ary = append(ary, g.ID)
+		}
+		return ary
+	}
+
+	gs := fatal1(Groups.Ancestors(acID, low)).([]*Group)
+	assertEqual(fmt.Sprint([]GroupID{mid, top}), fmt.Sprint(ids(gs)))
+	assertEqual("GHW Managers", gs[0].Name)
+	gs = fatal1(Groups.Ancestors(acID, top)).([]*Group)
+	assertEqual(0, len(gs))
+
+	gs = fatal1(Groups.Descendants(acID, top)).([]*Group)
+	assertEqual(fmt.Sprint([]GroupID{mid, low}), fmt.Sprint(ids(gs)))
+	gs = fatal1(Groups.Descendants(acID, low)).([]*Group)
+	assertEqual(0, len(gs))
+
+	// Hierarchies of other access contexts are not mixed in.
+	ac2 := fatal1(AccessContexts.New(nil, "GHW Other Context")).(AccessContextID)
+	fatal0(AccessContexts.AddGroup(nil, ac2, top, low))
+	gs = fatal1(Groups.Ancestors(acID, low)).([]*Group)
+	assertEqual(fmt.Sprint([]GroupID{mid, top}), fmt.Sprint(ids(gs)))
+	gs = fatal1(Groups.Descendants(acID, mid)).([]*Group)
+	assertEqual(fmt.Sprint([]GroupID{low}), fmt.Sprint(ids(gs)))
+	gs = fatal1(Groups.Ancestors(ac2, top)).([]*Group)
+	assertEqual(fmt.Sprint([]GroupID{low}), fmt.Sprint(ids(gs)))
+	gs = fatal1(Groups.Ancestors(ac2, low)).([]*Group)
+	assertEqual(0, len(gs))
+
+	_, err := Groups.Ancestors(0, low)
+	assertCode(CodeInvalidArg, err)
+}
+
+func TestFlowAccessContextHierarchyCycle(t *testing.T) {
+	gt = t
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	acID := fatal1(AccessContexts.New(tx, "AHC Context")).(AccessContextID)
+	a := fatal1(Groups.New(tx, "AHC A", "G")).(GroupID)
+	b := fatal1(Groups.New(tx, "AHC B", "G")).(GroupID)
+	c := fatal1(Groups.New(tx, "AHC C", "G")).(GroupID)
+	fatal0(AccessContexts.AddChildGroup(tx, acID, a, b))
+	fatal0(AccessContexts.AddChildGroup(tx, acID, b, c))
+	fatal0(tx.Commit())
+
+	var fe *FlowError
+	err := AccessContexts.AddChildGroup(nil, acID, c, a)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+	ok := fatal1(AccessContexts.IncludesGroup(acID, a)).(bool)
+	assertEqual(false, ok)
+
+	err = AccessContexts.ChangeReporting(nil, acID, b, c)
+	assertEqual(true, errors.As(err, &fe))
+	assertEqual(CodeConflict, fe.Code)
+	assertEqual(a, fatal1(AccessContexts.GroupReportsTo(acID, b)).(GroupID))
+
+	err = AccessContexts.AddChildGroup(nil, acID, c, c)
+	assertEqual(true, errors.As(err, &fe))
+}
+
+func TestFlowDocActionsRenameMany(t *testing.T) {
+	gt = t
+
+	a1 := fatal1(DocActions.New(nil, "RMA open", false)).(DocActionID)
+	a2 := fatal1(DocActions.New(nil, "RMA close", false)).(DocActionID)
+	a3 := fatal1(DocActions.New(nil, "RMA hold", false)).(DocActionID)
+
+	fatal0(DocActions.RenameMany(nil, map[DocActionID]string{
+		a1: "RMA OPEN",
+		a2: " RMA CLOSE ",
+		a3: "RMA HOLD",
+	}))
+	m := fatal1(DocActions.GetMany([]DocActionID{a1, a2, a3})).(map[DocActionID]*DocAction)
+	assertEqual("RMA OPEN", m[a1].Name)
+	assertEqual("RMA CLOSE", m[a2].Name)
+	assertEqual("RMA HOLD", m[a3].Name)
+	da := fatal1(DocActions.Get(a2)).(*DocAction)
+	assertEqual("RMA CLOSE", da.Name)
+}
+
+func TestFlowDocActionsRenameManyAbort(t *testing.T) {
+	gt = t
+
+	a1 := fatal1(DocActions.New(nil, "RMB open", false)).(DocActionID)
+	a2 := fatal1(DocActions.New(nil, "RMB close", false)).(DocActionID)
+	a3 := fatal1(DocActions.New(nil, "RMB hold", false)).(DocActionID)
+
+	err := DocActions.RenameMany(nil, map[DocActionID]string{
+		a1: "RMB OPEN",
+		a2: "RMB CLOSE",
+		a3: "  ",
+	})
+	assertNotEqual(nil, err)
+
+	err = DocActions.RenameMany(nil, map[DocActionID]string{
+		a1: "RMB Same",
+		a2: "rmb same",
+	})
+	assertNotEqual(nil, err)
+
+	// A failure in the database rolls back the earlier updates too.
+	err = DocActions.RenameMany(nil, map[DocActionID]string{
+		a1:      "RMB OPEN",
+		1 << 30: "RMB Missing",
+	})
+	assertEqual(true, errors.Is(err, ErrNotFound))
+
+	m := fatal1(DocActions.GetMany([]DocActionID{a1, a2, a3})).(map[DocActionID]*DocAction)
+	assertEqual("RMB open", m[a1].Name)
+	assertEqual("RMB close", m[a2].Name)
+	assertEqual("RMB hold", m[a3].Name)
+}
+
+// Tear down.
+func TestFlowTearDown(t *testing.T) {
+	gt = t
+
+	// Document storage tables are specific to their types.
+	dts := fatal1(DocTypes.List(0, 0)).([]*DocType)
+	for _, dt := range dts {
+		error1(db().Exec(`DROP TABLE IF EXISTS ` + DocTypes.docStorName(dt.ID)))
+	}
+
+	tx := fatal1(db().Begin()).(*sql.Tx)
+	defer tx.Rollback()
+
+	error1(tx.Exec(`DELETE FROM wf_mailboxes`))
+	error1(tx.Exec(`DELETE FROM wf_messages`))
+	error1(tx.Exec(`DELETE FROM wf_docevent_application`))
+	error1(tx.Exec(`DELETE FROM wf_docevents`))
+	error1(tx.Exec(`DELETE FROM wf_document_children`))
+	error1(tx.Exec(`DELETE FROM wf_document_blobs`))
+	error1(tx.Exec(`DELETE FROM wf_document_tags`))
+	error1(tx.Exec(`DELETE FROM wf_doctype_terminal_states`))
+	error1(tx.Exec(`DELETE FROM wf_docstate_transitions`))
+	error1(tx.Exec(`DELETE FROM wf_workflow_nodes`))
+	error1(tx.Exec(`DELETE FROM wf_workflows`))
+
+	error1(tx.Exec(`DELETE FROM wf_ac_group_roles`))
+	error1(tx.Exec(`DELETE FROM wf_ac_group_hierarchy`))
+	error1(tx.Exec(`DELETE FROM wf_access_contexts`))
+
+	error1(tx.Exec(`DELETE FROM wf_group_users`))
+	error1(tx.Exec(`DELETE FROM wf_groups_master`))
+	error1(tx.Exec(`DELETE FROM users_master`))
+	error1(tx.Exec(`DELETE FROM wf_role_docactions`))
+	error1(tx.Exec(`DELETE FROM wf_roles_master WHERE id > 2`))
+
+	error1(tx.Exec(`DELETE FROM wf_docactions_master`))
+	error1(tx.Exec(`DELETE FROM wf_docstates_master WHERE id > 1`))
+	error1(tx.Exec(`DELETE FROM wf_doctypes_master`))
+
+	fatal0(tx.Commit())
+}
+
+// Retrieval of a document action using a cached prepared statement.
+func BenchmarkDocActionsGetCached(b *testing.B) {
+	da, _, err := DocActions.Ensure(nil, "BENCH Action", false)
+	if err != nil {
+		b.Fatalf("Ensure : %v", err)
+	}
+	defer DocActions.Delete(nil, da.ID)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = DocActions.Get(da.ID); err != nil {
+			b.Fatalf("Get : %v", err)
+		}
+	}
+}
+
+// Retrieval of a document action by re-parsing the query each time.
+func BenchmarkDocActionsGetUncached(b *testing.B) {
+	da, _, err := DocActions.Ensure(nil, "BENCH Action", false)
+	if err != nil {
+		b.Fatalf("Ensure : %v", err)
+	}
+	defer DocActions.Delete(nil, da.ID)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var elem DocAction
+		row := db().QueryRow("SELECT id, name, reconfirm FROM wf_docactions_master WHERE id = ?", da.ID)
+		if err = row.Scan(&elem.ID, &elem.Name, &elem.Reconfirm); err != nil {
+			b.Fatalf("Scan : %v", err)
+		}
+	}
 }
@@ -15,22 +15,66 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // GroupID is the type of unique group identifiers.
 type GroupID int64
 
+// GroupType distinguishes general groups from singleton groups.
+type GroupType string
+
+// The kinds of groups in `flow`.  These are also the values stored in
+// the database.
+const (
+	// GroupTypeGeneral : a group that can have any number of users
+	GroupTypeGeneral GroupType = "G"
+	// GroupTypeSingleton : a group of exactly one user, created for that user
+	GroupTypeSingleton GroupType = "S"
+)
+
+// String answers a readable name of the group type.
+func (gt GroupType) String() string {
+	switch gt {
+	case GroupTypeGeneral:
+		return "general"
+
+	case GroupTypeSingleton:
+		return "singleton"
+
+	default:
+		return string(gt)
+	}
+}
+
+// ParseGroupType answers the group type corresponding to the given
+// string.  Both the stored values -- `G` and `S` -- and the readable
+// names -- `general` and `singleton` -- are recognised.
+func ParseGroupType(s string) (GroupType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "g", "general":
+		return GroupTypeGeneral, nil
+
+	case "s", "singleton":
+		return GroupTypeSingleton, nil
+
+	default:
+		return "", fmt.Errorf("unknown group type : %s", s)
+	}
+}
+
 // Group represents a specified collection of users.  A user belongs
 // to zero or more groups.
 type Group struct {
-	ID        GroupID `json:"ID"`        // Globally-unique ID
-	Name      string  `json:"Name"`      // Globally-unique name
-	GroupType string  `json:"GroupType"` // Is this a user-specific group? Etc.
+	ID        GroupID   `json:"ID"`        // Globally-unique ID
+	Name      string    `json:"Name"`      // Globally-unique name
+	GroupType GroupType `json:"GroupType"` // Is this a user-specific group? Etc.
 }
 
 // Unexported type, only for convenience methods.
@@ -42,11 +86,15 @@ var Groups _Groups
 // NewSingleton creates a singleton group associated with the given
 // user.  The e-mail address of the user is used as the name of the
 // group.  This serves as the linking identifier.
-func (_Groups) NewSingleton(otx *sql.Tx, uid UserID) (GroupID, error) {
+func (_Groups) NewSingleton(otx *sql.Tx, uid UserID) (_ GroupID, err error) {
+	defer observeQuery("Groups.NewSingleton", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("group", "Groups.NewSingleton")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -57,25 +105,16 @@ func (_Groups) NewSingleton(otx *sql.Tx, uid UserID) (GroupID, error) {
 
 	q := `
 	INSERT INTO wf_groups_master(name, group_type)
-	SELECT u.email, 'S'
+	SELECT u.email, ?
 	FROM wf_users_master u
 	WHERE u.id = ?
 	`
-	res, err := tx.Exec(q, uid)
-	if err != nil {
-		return 0, err
-	}
-	var gid int64
-	gid, err = res.LastInsertId()
+	gid, err := dbDialect().InsertID(context.Background(), tx, q, GroupTypeSingleton, uid)
 	if err != nil {
 		return 0, err
 	}
 
-	res, err = tx.Exec("INSERT INTO wf_group_users(group_id, user_id) VALUES(?, ?)", gid, uid)
-	if err != nil {
-		return 0, err
-	}
-	_, err = res.LastInsertId()
+	_, err = tx.Exec(dbDialect().Rebind("INSERT INTO wf_group_users(group_id, user_id) VALUES(?, ?)"), gid, uid)
 	if err != nil {
 		return 0, err
 	}
@@ -91,24 +130,33 @@ func (_Groups) NewSingleton(otx *sql.Tx, uid UserID) (GroupID, error) {
 }
 
 // New creates a new group that can be populated with users later.
-func (_Groups) New(otx *sql.Tx, name string, gtype string) (GroupID, error) {
+//
+// Only general groups can be created using this method; use
+// `NewSingleton` for singleton groups.
+func (_Groups) New(otx *sql.Tx, name string, gtype GroupType) (_ GroupID, err error) {
+	defer observeQuery("Groups.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
-	gtype = strings.TrimSpace(gtype)
 	if name == "" || gtype == "" {
-		return 0, errors.New("group name and type must not be empty")
+		return 0, invalidArg("group", "Groups.New", "group name and type must not be empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("group", "Groups.New", err)
 	}
 	switch gtype {
-	case "G": // General
+	case GroupTypeGeneral:
 	// Nothing to do
 
 	default:
-		return 0, errors.New("unknown group type, must be 'G'")
+		return 0, invalidArg("group", "Groups.New", "unknown group type, must be 'G'")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("group", "Groups.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -117,12 +165,11 @@ func (_Groups) New(otx *sql.Tx, name string, gtype string) (GroupID, error) {
 		tx = otx
 	}
 
-	res, err := tx.Exec("INSERT INTO wf_groups_master(name, group_type) VALUES(?, ?)", name, gtype)
-	if err != nil {
-		return 0, err
+	if err = checkNameFree(context.Background(), tx, "wf_groups_master", name); err != nil {
+		return 0, classify("group", "Groups.New", err)
 	}
-	var id int64
-	id, err = res.LastInsertId()
+
+	id, err := dbDialect().InsertID(context.Background(), tx, "INSERT INTO wf_groups_master(name, group_type) VALUES(?, ?)", name, gtype)
 	if err != nil {
 		return 0, err
 	}
@@ -144,20 +191,45 @@ func (_Groups) New(otx *sql.Tx, name string, gtype string) (GroupID, error) {
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
 func (_Groups) List(offset, limit int64) ([]*Group, error) {
+	return Groups.listOrdered(nil, OrderByID, offset, limit)
+}
+
+// ListOrdered is a variant of `List` that answers the results in the
+// given order.
+func (_Groups) ListOrdered(order OrderBy, offset, limit int64) ([]*Group, error) {
+	return Groups.listOrdered(nil, order, offset, limit)
+}
+
+// ListTx is a variant of `List` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Groups) ListTx(otx *sql.Tx, offset, limit int64) ([]*Group, error) {
+	return Groups.listOrdered(otx, OrderByID, offset, limit)
+}
+
+// listOrdered implements the listings of groups, using the given
+// transaction, if any.
+func (_Groups) listOrdered(otx *sql.Tx, order OrderBy, offset, limit int64) (_ []*Group, err error) {
+	defer observeQuery("Groups.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("group", "Groups.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
 	}
+	ob, err := orderClause(order)
+	if err != nil {
+		return nil, flowError("group", "Groups.List", CodeInvalidArg, err)
+	}
 
 	q := `
 	SELECT id, name, group_type
 	FROM wf_groups_master
-	ORDER BY id
+	ORDER BY ` + ob + `
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := dbOrTx(otx).Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +238,7 @@ func (_Groups) List(offset, limit int64) ([]*Group, error) {
 	ary := make([]*Group, 0, 10)
 	for rows.Next() {
 		var g Group
-		err = rows.Scan(&g.ID, &g.Name, &g.GroupType)
+		err = rows.Scan(&g.ID, nullName{&g.Name}, &g.GroupType)
 		if err != nil {
 			return nil, err
 		}
@@ -179,42 +251,79 @@ func (_Groups) List(offset, limit int64) ([]*Group, error) {
 	return ary, nil
 }
 
+// Count answers the total number of groups in the system.
+func (_Groups) Count() (_ int64, err error) {
+	defer observeQuery("Groups.Count", time.Now(), &err)
+
+	var n int64
+	row := db().QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_groups_master"))
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 // Get initialises the group by reading from database.
 func (_Groups) Get(id GroupID) (*Group, error) {
+	return Groups.GetTx(nil, id)
+}
+
+// GetTx is a variant of `Get` that reads using the given transaction,
+// if any, so that changes made but not yet committed in it are
+// visible.
+func (_Groups) GetTx(otx *sql.Tx, id GroupID) (_ *Group, err error) {
+	defer observeQuery("Groups.Get", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("group ID should be a positive integer")
+		return nil, invalidArg("group", "Groups.Get", "group ID should be a positive integer")
 	}
 
 	var elem Group
-	row := db.QueryRow("SELECT id, name, group_type FROM wf_groups_master WHERE id = ?", id)
-	err := row.Scan(&elem.ID, &elem.Name, &elem.GroupType)
+	q := "SELECT id, name, group_type FROM wf_groups_master WHERE id = ?"
+	var row *sql.Row
+	if otx == nil {
+		row = db().QueryRow(dbDialect().Rebind(q), id)
+	} else {
+		row = otx.QueryRow(dbDialect().Rebind(q), id)
+	}
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.GroupType)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "group", "Groups.Get")
 	}
 
 	return &elem, nil
 }
 
 // Rename renames the given group.
-func (_Groups) Rename(otx *sql.Tx, id GroupID, name string) error {
+func (_Groups) Rename(otx *sql.Tx, id GroupID, name string) (err error) {
+	defer observeQuery("Groups.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name cannot be empty")
+		return invalidArg("group", "Groups.Rename", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("group", "Groups.Rename", err)
 	}
 
 	var elem Group
-	row := db.QueryRow("SELECT id, name, group_type FROM wf_groups_master WHERE id = ?", id)
-	err := row.Scan(&elem.ID, &elem.Name, &elem.GroupType)
+	row := db().QueryRow(dbDialect().Rebind("SELECT id, name, group_type FROM wf_groups_master WHERE id = ?"), id)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.GroupType)
 	if err != nil {
-		return err
+		return notFound(err, "group", "Groups.Rename")
 	}
-	if elem.GroupType == "S" {
-		return errors.New("cannot rename a singleton group")
+	if elem.GroupType == GroupTypeSingleton {
+		return conflict("group", "Groups.Rename", errors.New("cannot rename a singleton group"))
 	}
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("group", "Groups.Rename")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -223,7 +332,15 @@ func (_Groups) Rename(otx *sql.Tx, id GroupID, name string) error {
 		tx = otx
 	}
 
-	_, err = tx.Exec("UPDATE wf_groups_master SET name = ? WHERE id = ?", name, id)
+	if err = checkNameFreeExcept(context.Background(), tx, "wf_groups_master", name, "id", id); err != nil {
+		return classify("group", "Groups.Rename", err)
+	}
+
+	res, err := tx.Exec(dbDialect().Rebind("UPDATE wf_groups_master SET name = ? WHERE id = ?"), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_groups_master", "id", id, "group", "Groups.Rename")
 	if err != nil {
 		return err
 	}
@@ -238,50 +355,135 @@ func (_Groups) Rename(otx *sql.Tx, id GroupID, name string) error {
 	return nil
 }
 
-// Delete deletes the given group from the system, if no access
-// context is actively using it.
-func (_Groups) Delete(otx *sql.Tx, id GroupID) error {
+// Delete deletes the given group from the system, together with its
+// memberships, its roles in access contexts, its place in their
+// reporting hierarchies, and its mailbox.  Groups that reported to it
+// are made to report to its own reporting authority instead.
+//
+// A group that owns documents, or in whose name events were recorded,
+// is part of their history, and cannot be deleted.  Neither can a
+// singleton group, while its user is active.  Deleting the singleton
+// group of an inactive user leaves that user without one; the user
+// cannot act on documents until a new one is created using
+// `NewSingleton`.
+func (_Groups) Delete(otx *sql.Tx, id GroupID) (err error) {
+	defer observeQuery("Groups.Delete", time.Now(), &err)
+
 	if id <= 0 {
-		return errors.New("group ID must be a positive integer")
+		return invalidArg("group", "Groups.Delete", "group ID must be a positive integer")
 	}
 
-	row := db.QueryRow("SELECT group_type FROM wf_groups_master WHERE id = ?", id)
-	var gtype string
-	err := row.Scan(&gtype)
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("group", "Groups.Delete")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	row := tx.QueryRow(dbDialect().Rebind("SELECT group_type FROM wf_groups_master WHERE id = ?"), id)
+	var gtype GroupType
+	err = row.Scan(&gtype)
 	if err != nil {
-		return err
+		return notFound(err, "group", "Groups.Delete")
 	}
-	if gtype == "S" {
-		return errors.New("singleton groups cannot be deleted")
+	if gtype == GroupTypeSingleton {
+		q := `
+		SELECT EXISTS(
+			SELECT 1
+			FROM wf_group_users gu
+			JOIN wf_users_master um ON um.id = gu.user_id
+			WHERE gu.group_id = ?
+			AND um.active = 1
+		)
+		`
+		var active bool
+		row = tx.QueryRow(dbDialect().Rebind(q), id)
+		if err = row.Scan(&active); err != nil {
+			return err
+		}
+		if active {
+			return conflict("group", "Groups.Delete", errors.New("singleton group of an active user cannot be deleted"))
+		}
 	}
 
-	row = db.QueryRow("SELECT COUNT(*) FROM wf_ac_group_roles WHERE group_id = ?", id)
 	var n int64
-	err = row.Scan(&n)
+	err = tx.QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_docevents WHERE group_id = ?"), id).Scan(&n)
+	if err != nil {
+		return err
+	}
 	if n > 0 {
-		return errors.New("group is being used in at least one access context; cannot delete")
+		return conflict("group", "Groups.Delete", fmt.Errorf("group has %d document events", n))
 	}
-
-	var tx *sql.Tx
-	if otx == nil {
-		tx, err = db.Begin()
+	dts, err := DocTypes.ListTx(tx, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, dt := range dts {
+		err = tx.QueryRow(dbDialect().Rebind(`SELECT COUNT(*) FROM `+DocTypes.docStorName(dt.ID)+` WHERE group_id = ?`), id).Scan(&n)
 		if err != nil {
 			return err
 		}
-		defer tx.Rollback()
-	} else {
-		tx = otx
+		if n > 0 {
+			return conflict("group", "Groups.Delete", fmt.Errorf("group owns %d documents of type %s", n, dt.Name))
+		}
 	}
 
-	_, err = tx.Exec("DELETE FROM wf_group_users WHERE group_id = ?", id)
+	// Subordinates move up to this group's own reporting authority.
+	rows, err := tx.Query(dbDialect().Rebind("SELECT ac_id, reports_to FROM wf_ac_group_hierarchy WHERE group_id = ?"), id)
 	if err != nil {
 		return err
 	}
-	res, err := tx.Exec("DELETE FROM wf_groups_master WHERE id = ?", id)
+	defer rows.Close()
+
+	type link struct {
+		ac        AccessContextID
+		reportsTo GroupID
+	}
+	links := make([]link, 0, 1)
+	for rows.Next() {
+		var l link
+		if err = rows.Scan(&l.ac, &l.reportsTo); err != nil {
+			return err
+		}
+		links = append(links, l)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, l := range links {
+		_, err = tx.Exec(dbDialect().Rebind("UPDATE wf_ac_group_hierarchy SET reports_to = ? WHERE ac_id = ? AND reports_to = ?"), l.reportsTo, l.ac, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, q := range []string{
+		"DELETE FROM wf_ac_group_hierarchy WHERE group_id = ?",
+		"DELETE FROM wf_ac_group_roles WHERE group_id = ?",
+		"DELETE FROM wf_group_users WHERE group_id = ?",
+		"DELETE FROM wf_mailboxes WHERE group_id = ?",
+	} {
+		if _, err = tx.Exec(dbDialect().Rebind(q), id); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(dbDialect().Rebind("DELETE FROM wf_groups_master WHERE id = ?"), id)
 	if err != nil {
 		return err
 	}
 	n, err = res.RowsAffected()
+	if err != nil {
+		return err
+	}
 	if n != 1 {
 		return fmt.Errorf("expected number of affected rows : 1; actual affected : %d", n)
 	}
@@ -297,14 +499,16 @@ func (_Groups) Delete(otx *sql.Tx, id GroupID) error {
 }
 
 // Users answers a list of the given group's users.
-func (_Groups) Users(gid GroupID) ([]*User, error) {
+func (_Groups) Users(gid GroupID) (_ []*User, err error) {
+	defer observeQuery("Groups.Users", time.Now(), &err)
+
 	q := `
 	SELECT um.id, um.first_name, um.last_name, um.email, um.active
 	FROM wf_users_master um
 	JOIN wf_group_users gu ON gu.user_id = um.id
 	WHERE gu.group_id = ?
 	`
-	rows, err := db.Query(q, gid)
+	rows, err := db().Query(dbDialect().Rebind(q), gid)
 	if err != nil {
 		return nil, err
 	}
@@ -326,9 +530,99 @@ func (_Groups) Users(gid GroupID) ([]*User, error) {
 	return ary, nil
 }
 
+// ListUsers answers a subset of the active users in the given group,
+// ordered by ID.
+//
+// Result set begins with ID >= `offset`, and has not more than
+// `limit` elements.  A value of `0` for `offset` fetches from the
+// beginning, while a value of `0` for `limit` fetches until the end.
+func (_Groups) ListUsers(gid GroupID, offset, limit int64) (_ []*User, err error) {
+	defer observeQuery("Groups.ListUsers", time.Now(), &err)
+
+	if gid <= 0 {
+		return nil, invalidArg("group", "Groups.ListUsers", "group ID should be a positive integer")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("group", "Groups.ListUsers", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT um.id, um.first_name, um.last_name, um.email, um.active
+	FROM wf_users_master um
+	JOIN wf_group_users gu ON gu.user_id = um.id
+	WHERE gu.group_id = ?
+	AND um.active = 1
+	ORDER BY um.id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), gid, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*User, 0, 10)
+	for rows.Next() {
+		var elem User
+		err = rows.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ListByUser answers the groups that the given user is a member of,
+// ordered by ID.  The user's singleton group is included.
+func (_Groups) ListByUser(uid UserID) (_ []*Group, err error) {
+	defer observeQuery("Groups.ListByUser", time.Now(), &err)
+
+	if uid <= 0 {
+		return nil, invalidArg("group", "Groups.ListByUser", "user ID should be a positive integer")
+	}
+
+	q := `
+	SELECT gm.id, gm.name, gm.group_type
+	FROM wf_groups_master gm
+	JOIN wf_group_users gu ON gu.group_id = gm.id
+	WHERE gu.user_id = ?
+	ORDER BY gm.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Group, 0, 2)
+	for rows.Next() {
+		var elem Group
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.GroupType)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
 // HasUser answers `true` if this group includes the given user;
 // `false` otherwise.
-func (_Groups) HasUser(gid GroupID, uid UserID) (bool, error) {
+func (_Groups) HasUser(gid GroupID, uid UserID) (_ bool, err error) {
+	defer observeQuery("Groups.HasUser", time.Now(), &err)
+
 	q := `
 	SELECT id FROM wf_group_users
 	WHERE group_id = ?
@@ -337,11 +631,11 @@ func (_Groups) HasUser(gid GroupID, uid UserID) (bool, error) {
 	LIMIT 1
 	`
 	var id int64
-	row := db.QueryRow(q, gid, uid)
-	err := row.Scan(&id)
+	row := db().QueryRow(dbDialect().Rebind(q), gid, uid)
+	err = row.Scan(&id)
 	switch {
 	case err == sql.ErrNoRows:
-		return false, errors.New("given user is not part of the specified group")
+		return false, invalidArg("group", "Groups.HasUser", "given user is not part of the specified group")
 
 	case err != nil:
 		return false, err
@@ -351,9 +645,38 @@ func (_Groups) HasUser(gid GroupID, uid UserID) (bool, error) {
 	}
 }
 
+// IsMember answers `true` if the given user is a member of the given
+// group.  Unlike `HasUser`, it answers `false` without an error when
+// the user is not a member, or the group does not exist.
+func (_Groups) IsMember(gid GroupID, uid UserID) (_ bool, err error) {
+	defer observeQuery("Groups.IsMember", time.Now(), &err)
+
+	if gid <= 0 || uid <= 0 {
+		return false, invalidArg("group", "Groups.IsMember", "group ID and user ID must be positive integers")
+	}
+
+	q := `
+	SELECT EXISTS(
+		SELECT 1 FROM wf_group_users
+		WHERE group_id = ?
+		AND user_id = ?
+	)
+	`
+	var ok bool
+	row := db().QueryRow(dbDialect().Rebind(q), gid, uid)
+	err = row.Scan(&ok)
+	if err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
 // SingletonUser answer the user ID of the corresponding user, if this
 // group is a singleton group.
-func (_Groups) SingletonUser(gid GroupID) (*User, error) {
+func (_Groups) SingletonUser(gid GroupID) (_ *User, err error) {
+	defer observeQuery("Groups.SingletonUser", time.Now(), &err)
+
 	q := `
 	SELECT um.id, um.first_name, um.last_name, um.email, um.active
 	FROM wf_users_master um
@@ -366,27 +689,32 @@ func (_Groups) SingletonUser(gid GroupID) (*User, error) {
 	`
 
 	var elem User
-	row := db.QueryRow(q, gid)
-	err := row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
+	row := db().QueryRow(dbDialect().Rebind(q), gid)
+	err = row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
 	switch {
 	case err != nil:
-		return nil, err
+		return nil, notFound(err, "user", "Groups.SingletonUser")
 
 	default:
 		return &elem, nil
 	}
 }
 
-// AddUser adds the given user as a member of this group.
-func (_Groups) AddUser(otx *sql.Tx, gid GroupID, uid UserID) error {
+// AddUser adds the given user as a member of this group.  Adding a
+// user who is already a member does nothing, and answers `nil`.
+func (_Groups) AddUser(otx *sql.Tx, gid GroupID, uid UserID) (err error) {
+	defer observeQuery("Groups.AddUser", time.Now(), &err)
+
 	if gid <= 0 || uid <= 0 {
-		return errors.New("group ID and user ID must be positive integers")
+		return invalidArg("group", "Groups.AddUser", "group ID and user ID must be positive integers")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("group", "Groups.AddUser")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -395,17 +723,33 @@ func (_Groups) AddUser(otx *sql.Tx, gid GroupID, uid UserID) error {
 		tx = otx
 	}
 
-	var gtype string
-	row := tx.QueryRow("SELECT group_type FROM wf_groups_master WHERE id = ?", gid)
+	var gtype GroupType
+	row := tx.QueryRow(dbDialect().Rebind("SELECT group_type FROM wf_groups_master WHERE id = ?"), gid)
 	err = row.Scan(&gtype)
 	if err != nil {
+		return notFound(err, "group", "Groups.AddUser")
+	}
+	if gtype == GroupTypeSingleton {
+		return conflict("group", "Groups.AddUser", errors.New("cannot add users to singleton groups"))
+	}
+
+	var ok bool
+	row = tx.QueryRow(dbDialect().Rebind("SELECT EXISTS(SELECT 1 FROM wf_users_master WHERE id = ?)"), uid)
+	if err = row.Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errNotFound("user", "Groups.AddUser")
+	}
+	row = tx.QueryRow(dbDialect().Rebind("SELECT EXISTS(SELECT 1 FROM wf_group_users WHERE group_id = ? AND user_id = ?)"), gid, uid)
+	if err = row.Scan(&ok); err != nil {
 		return err
 	}
-	if gtype == "S" {
-		return errors.New("cannot add users to singleton groups")
+	if ok {
+		return nil
 	}
 
-	_, err = tx.Exec("INSERT INTO wf_group_users(group_id, user_id) VALUES(?, ?)", gid, uid)
+	_, err = tx.Exec(dbDialect().Rebind("INSERT INTO wf_group_users(group_id, user_id) VALUES(?, ?)"), gid, uid)
 	if err != nil {
 		return err
 	}
@@ -419,17 +763,124 @@ func (_Groups) AddUser(otx *sql.Tx, gid GroupID, uid UserID) error {
 	return nil
 }
 
+// AddUsers adds the given users as members of this group, in a single
+// multi-row insert.  Duplicate user IDs in the input are added once,
+// and users that are already members of the group are skipped.
+func (_Groups) AddUsers(otx *sql.Tx, gid GroupID, uids []UserID) (err error) {
+	defer observeQuery("Groups.AddUsers", time.Now(), &err)
+
+	if gid <= 0 {
+		return invalidArg("group", "Groups.AddUsers", "group ID should be a positive integer")
+	}
+	if len(uids) == 0 {
+		return invalidArg("group", "Groups.AddUsers", "list of user IDs should be non-empty")
+	}
+	seen := make(map[UserID]bool, len(uids))
+	us := make([]UserID, 0, len(uids))
+	for _, uid := range uids {
+		if uid <= 0 {
+			return invalidArg("group", "Groups.AddUsers", "user ID should be a positive integer")
+		}
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		us = append(us, uid)
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("group", "Groups.AddUsers")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var gtype GroupType
+	row := tx.QueryRow(dbDialect().Rebind("SELECT group_type FROM wf_groups_master WHERE id = ?"), gid)
+	err = row.Scan(&gtype)
+	if err != nil {
+		return notFound(err, "group", "Groups.AddUsers")
+	}
+	if gtype == GroupTypeSingleton {
+		return conflict("group", "Groups.AddUsers", errors.New("cannot add users to singleton groups"))
+	}
+
+	args := make([]interface{}, 0, len(us)+1)
+	args = append(args, gid)
+	for _, uid := range us {
+		args = append(args, uid)
+	}
+	q := `
+	SELECT user_id
+	FROM wf_group_users
+	WHERE group_id = ?
+	AND user_id IN (?` + strings.Repeat(", ?", len(us)-1) + `)
+	`
+	rows, err := tx.Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid UserID
+		if err = rows.Scan(&uid); err != nil {
+			return err
+		}
+		delete(seen, uid)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	args = args[:0]
+	for _, uid := range us {
+		if seen[uid] {
+			args = append(args, gid, uid)
+		}
+	}
+	if len(args) > 0 {
+		q = "INSERT INTO wf_group_users(group_id, user_id) VALUES" +
+			strings.TrimSuffix(strings.Repeat("(?, ?), ", len(args)/2), ", ")
+		_, err = tx.Exec(dbDialect().Rebind(q), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // RemoveUser removes the given user from this group, if the user is a
 // member of the group.  This operation is idempotent.
-func (_Groups) RemoveUser(otx *sql.Tx, gid GroupID, uid UserID) error {
+func (_Groups) RemoveUser(otx *sql.Tx, gid GroupID, uid UserID) (err error) {
+	defer observeQuery("Groups.RemoveUser", time.Now(), &err)
+
 	if gid <= 0 || uid <= 0 {
-		return errors.New("group ID and user ID must be positive integers")
+		return invalidArg("group", "Groups.RemoveUser", "group ID and user ID must be positive integers")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("group", "Groups.RemoveUser")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -438,17 +889,17 @@ func (_Groups) RemoveUser(otx *sql.Tx, gid GroupID, uid UserID) error {
 		tx = otx
 	}
 
-	var gtype string
-	row := tx.QueryRow("SELECT group_type FROM wf_groups_master WHERE id = ?", gid)
+	var gtype GroupType
+	row := tx.QueryRow(dbDialect().Rebind("SELECT group_type FROM wf_groups_master WHERE id = ?"), gid)
 	err = row.Scan(&gtype)
 	if err != nil {
 		return err
 	}
-	if gtype == "S" {
-		return errors.New("cannot remove users from singleton groups")
+	if gtype == GroupTypeSingleton {
+		return conflict("group", "Groups.RemoveUser", errors.New("cannot remove users from singleton groups"))
 	}
 
-	res, err := tx.Exec("DELETE FROM wf_group_users WHERE group_id = ? AND user_id = ?", gid, uid)
+	res, err := tx.Exec(dbDialect().Rebind("DELETE FROM wf_group_users WHERE group_id = ? AND user_id = ?"), gid, uid)
 	if err != nil {
 		return err
 	}
@@ -469,3 +920,270 @@ func (_Groups) RemoveUser(otx *sql.Tx, gid GroupID, uid UserID) error {
 
 	return nil
 }
+
+// MoveUser moves the given user from the source group to the target
+// group, in a single transaction.  It fails, changing nothing, if the
+// user is not a member of the source group, or if either group is a
+// singleton group.  If the user is already a member of the target
+// group, the membership in the source group is simply removed.
+func (_Groups) MoveUser(otx *sql.Tx, from, to GroupID, uid UserID) (err error) {
+	defer observeQuery("Groups.MoveUser", time.Now(), &err)
+
+	if from <= 0 || to <= 0 || uid <= 0 {
+		return invalidArg("group", "Groups.MoveUser", "group IDs and user ID must be positive integers")
+	}
+	if from == to {
+		return invalidArg("group", "Groups.MoveUser", "source and target groups must be different")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("group", "Groups.MoveUser")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var gtype GroupType
+	row := tx.QueryRow(dbDialect().Rebind("SELECT group_type FROM wf_groups_master WHERE id = ?"), from)
+	err = row.Scan(&gtype)
+	if err != nil {
+		return notFound(err, "group", "Groups.MoveUser")
+	}
+	if gtype == GroupTypeSingleton {
+		return conflict("group", "Groups.MoveUser", errors.New("cannot remove users from singleton groups"))
+	}
+
+	res, err := tx.Exec(dbDialect().Rebind("DELETE FROM wf_group_users WHERE group_id = ? AND user_id = ?"), from, uid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return flowError("user", "Groups.MoveUser", CodeNotFound, fmt.Errorf("user is not a member of the source group : %w", ErrNotFound))
+	}
+
+	err = Groups.AddUser(tx, to, uid)
+	if err != nil {
+		return err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Ancestors answers the groups to which the given group reports,
+// directly or transitively, in the given access context.  Nearer
+// ancestors precede farther ones.  Cycles in the hierarchy are
+// tolerated: each group is answered at most once, and the given group
+// itself is never included.
+func (_Groups) Ancestors(ac AccessContextID, gid GroupID) (_ []*Group, err error) {
+	defer observeQuery("Groups.Ancestors", time.Now(), &err)
+
+	if ac <= 0 || gid <= 0 {
+		return nil, invalidArg("group", "Groups.Ancestors", "access context and group IDs should be positive integers")
+	}
+
+	ids, err := groupHierarchyWalk(nil, ac, true, gid)
+	if err != nil {
+		return nil, err
+	}
+	return groupsByIDs(ids)
+}
+
+// Descendants answers the groups that report to the given group,
+// directly or transitively, in the given access context.  Nearer
+// descendants precede farther ones.  Cycles in the hierarchy are
+// tolerated: each group is answered at most once, and the given group
+// itself is never included.
+func (_Groups) Descendants(ac AccessContextID, gid GroupID) (_ []*Group, err error) {
+	defer observeQuery("Groups.Descendants", time.Now(), &err)
+
+	if ac <= 0 || gid <= 0 {
+		return nil, invalidArg("group", "Groups.Descendants", "access context and group IDs should be positive integers")
+	}
+
+	ids, err := groupHierarchyWalk(nil, ac, false, gid)
+	if err != nil {
+		return nil, err
+	}
+	return groupsByIDs(ids)
+}
+
+// groupHierarchyWalk walks the group hierarchy of the given access
+// context breadth-first from the given groups -- upwards towards the
+// reporting authorities if `up` is `true`, downwards towards the
+// reportees otherwise.  It answers the IDs of the groups reached,
+// excluding the starting groups, nearest first.  The visited set
+// guards against cycles.
+func groupHierarchyWalk(otx *sql.Tx, ac AccessContextID, up bool, gids ...GroupID) ([]GroupID, error) {
+	from, to := "reports_to", "group_id"
+	if up {
+		from, to = to, from
+	}
+	q := `
+	SELECT DISTINCT ` + to + `
+	FROM wf_ac_group_hierarchy
+	WHERE ac_id = ?
+	AND ` + to + ` > 0
+	AND ` + from + ` IN (?%s)
+	`
+
+	seen := make(map[GroupID]bool, len(gids))
+	front := make([]GroupID, 0, len(gids))
+	for _, gid := range gids {
+		if !seen[gid] {
+			seen[gid] = true
+			front = append(front, gid)
+		}
+	}
+	ary := make([]GroupID, 0, 10)
+	for len(front) > 0 {
+		args := make([]interface{}, 0, len(front)+1)
+		args = append(args, ac)
+		for _, id := range front {
+			args = append(args, id)
+		}
+		qq := fmt.Sprintf(q, strings.Repeat(", ?", len(front)-1))
+
+		var rows *sql.Rows
+		var err error
+		if otx == nil {
+			rows, err = db().Query(dbDialect().Rebind(qq), args...)
+		} else {
+			rows, err = otx.Query(dbDialect().Rebind(qq), args...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		next := make([]GroupID, 0, len(front))
+		for rows.Next() {
+			var id GroupID
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !seen[id] {
+				seen[id] = true
+				next = append(next, id)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		ary = append(ary, next...)
+		front = next
+	}
+
+	return ary, nil
+}
+
+// groupsByIDs answers the groups with the given IDs, in the same
+// order.
+func groupsByIDs(ids []GroupID) ([]*Group, error) {
+	ary := make([]*Group, 0, len(ids))
+	if len(ids) == 0 {
+		return ary, nil
+	}
+
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	q := `
+	SELECT id, name, group_type
+	FROM wf_groups_master
+	WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	m := make(map[GroupID]*Group, len(ids))
+	for rows.Next() {
+		var elem Group
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.GroupType)
+		if err != nil {
+			return nil, err
+		}
+		m[elem.ID] = &elem
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if g, ok := m[id]; ok {
+			ary = append(ary, g)
+		}
+	}
+	return ary, nil
+}
+
+// DeduplicateMemberships removes duplicate memberships of users in
+// groups, retaining only the earliest entry for each pair of a group
+// and a user.  It answers the number of entries removed.
+//
+// N.B. Such duplicates can arise only from direct edits to the
+// database made while its uniqueness constraint was missing.
+func (_Groups) DeduplicateMemberships(otx *sql.Tx) (_ int64, err error) {
+	defer observeQuery("Groups.DeduplicateMemberships", time.Now(), &err)
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return 0, txRequiredErr("group", "Groups.DeduplicateMemberships")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	q := `
+	DELETE gu1
+	FROM wf_group_users gu1
+	JOIN wf_group_users gu2 ON gu2.group_id = gu1.group_id AND gu2.user_id = gu1.user_id AND gu2.id < gu1.id
+	`
+	res, err := tx.Exec(dbDialect().Rebind(q))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,180 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// TransitionGuard is consulted before a document of the given type is
+// moved from one state to another, on behalf of the given user.
+// Answering a non-nil error vetoes the transition; that error is
+// answered by the method that attempted it.
+//
+// Guards run inside the transaction of the transition, and should
+// therefore return quickly.
+type TransitionGuard func(dtype DocTypeID, docID DocumentID, from, to DocStateID, action DocActionID, by UserID) error
+
+// AfterTransition is notified of each transition once it is
+// committed, with the event that effected it.  The event's `ToState`
+// holds the state into which the document moved.
+//
+// Listeners run outside the transaction of the transition, in the
+// goroutine that made it; slow work, such as calling a webhook, should
+// be handed off to another goroutine.
+type AfterTransition func(ev *DocEvent)
+
+// hooks holds the registered extension points.
+var hooks struct {
+	sync.RWMutex
+	guards    []TransitionGuard
+	listeners []AfterTransition
+}
+
+// RegisterTransitionGuard adds the given guard to those consulted
+// whenever an event is applied to a document: by `Documents.ApplyAction`
+// and its variants, as well as by `Workflow.ApplyEvent`.  Guards are
+// run in the order of their registration, and the first to answer an
+// error stops the others.
+func RegisterTransitionGuard(g TransitionGuard) {
+	if g == nil {
+		return
+	}
+
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.guards = append(hooks.guards, g)
+}
+
+// ResetTransitionGuards removes all registered transition guards.
+func ResetTransitionGuards() {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.guards = nil
+}
+
+// hasTransitionGuards answers `true` if any transition guard is
+// registered.
+func hasTransitionGuards() bool {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	return len(hooks.guards) > 0
+}
+
+// checkGuards runs the registered transition guards, in order,
+// answering the first error.
+func checkGuards(dtype DocTypeID, docID DocumentID, from, to DocStateID, action DocActionID, by UserID) error {
+	hooks.RLock()
+	gs := hooks.guards
+	hooks.RUnlock()
+
+	for _, g := range gs {
+		if err := g(dtype, docID, from, to, action, by); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterAfterTransition adds the given listener to those notified of
+// the transitions made by `Documents.ApplyAction` and its variants.
+// Listeners are invoked in the order of their registration.
+//
+// N.B. Listeners are invoked only for transitions known to be
+// committed.  Hence, while any listener is registered, a transaction
+// supplied by the caller for a transition should be begun using
+// `WithTx`, so that the listeners are invoked once it commits.  In
+// any other transaction of the caller, `flow` cannot know whether --
+// or when -- it commits; the transition is then refused with an error
+// wrapping `ErrTxUntracked`.
+func RegisterAfterTransition(l AfterTransition) {
+	if l == nil {
+		return
+	}
+
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.listeners = append(hooks.listeners, l)
+}
+
+// ResetAfterTransitions removes all registered transition listeners.
+func ResetAfterTransitions() {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.listeners = nil
+}
+
+// hasAfterTransitions answers `true` if any transition listener is
+// registered.
+func hasAfterTransitions() bool {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	return len(hooks.listeners) > 0
+}
+
+// checkAfterTransitionTx answers an error if any transition listener
+// is registered, and the given transaction of the caller was not begun
+// through `WithTx`, since the listeners could not then be notified.
+func checkAfterTransitionTx(otx *sql.Tx, op string) error {
+	if otx == nil || txTracked(otx) || !hasAfterTransitions() {
+		return nil
+	}
+	return txUntrackedErr("document", op)
+}
+
+// notifyAfterCommit invokes the registered transition listeners for
+// the given events, once their transaction is committed.  Without a
+// transaction of the caller, it already is.  Otherwise, the listeners
+// are invoked when that transaction commits.  An error is answered if
+// that transaction was not begun through `WithTx`; this happens only
+// when a listener is registered after `checkAfterTransitionTx`.
+func notifyAfterCommit(otx *sql.Tx, op string, evs ...*DocEvent) error {
+	if !hasAfterTransitions() {
+		return nil
+	}
+	if otx == nil {
+		for _, ev := range evs {
+			notifyAfterTransition(ev)
+		}
+		return nil
+	}
+
+	ok := onTxDone(otx, func(committed bool) {
+		if !committed {
+			return
+		}
+		for _, ev := range evs {
+			notifyAfterTransition(ev)
+		}
+	})
+	if !ok {
+		return txUntrackedErr("document", op)
+	}
+	return nil
+}
+
+// notifyAfterTransition invokes the registered transition listeners,
+// in order, each with its own copy of the given event.
+func notifyAfterTransition(ev *DocEvent) {
+	hooks.RLock()
+	ls := hooks.listeners
+	hooks.RUnlock()
+
+	for _, l := range ls {
+		e := *ev
+		l(&e)
+	}
+}
@@ -16,8 +16,8 @@ package flow
 
 import (
 	"database/sql"
-	"errors"
 	"math"
+	"time"
 )
 
 // Mailbox is the message delivery destination for both action and
@@ -43,9 +43,11 @@ var Mailboxes _Mailboxes
 // CountByUser answers the number of messages in the given user's
 // virtual mailbox. Specifying `true` for `unread` fetches a count of
 // unread messages.
-func (_Mailboxes) CountByUser(uid UserID, unread bool) (int64, error) {
+func (_Mailboxes) CountByUser(uid UserID, unread bool) (_ int64, err error) {
+	defer observeQuery("Mailboxes.CountByUser", time.Now(), &err)
+
 	if uid <= 0 {
-		return 0, errors.New("user ID should be a positive integer")
+		return 0, invalidArg("mailbox", "Mailboxes.CountByUser", "user ID should be a positive integer")
 	}
 
 	q := `
@@ -63,9 +65,9 @@ func (_Mailboxes) CountByUser(uid UserID, unread bool) (int64, error) {
 		q += `AND unread = 1`
 	}
 
-	row := db.QueryRow(q, uid)
+	row := db().QueryRow(dbDialect().Rebind(q), uid)
 	var n int64
-	err := row.Scan(&n)
+	err = row.Scan(&n)
 	if err != nil {
 		return 0, err
 	}
@@ -76,9 +78,11 @@ func (_Mailboxes) CountByUser(uid UserID, unread bool) (int64, error) {
 // CountByGroup answers the number of messages in the given group's
 // virtual mailbox. Specifying `true` for `unread` fetches a count of
 // unread messages.
-func (_Mailboxes) CountByGroup(gid GroupID, unread bool) (int64, error) {
+func (_Mailboxes) CountByGroup(gid GroupID, unread bool) (_ int64, err error) {
+	defer observeQuery("Mailboxes.CountByGroup", time.Now(), &err)
+
 	if gid <= 0 {
-		return 0, errors.New("group ID should be a positive integer")
+		return 0, invalidArg("mailbox", "Mailboxes.CountByGroup", "group ID should be a positive integer")
 	}
 
 	q := `
@@ -90,9 +94,9 @@ func (_Mailboxes) CountByGroup(gid GroupID, unread bool) (int64, error) {
 		q += `AND unread = 1`
 	}
 
-	row := db.QueryRow(q, gid)
+	row := db().QueryRow(dbDialect().Rebind(q), gid)
 	var n int64
-	err := row.Scan(&n)
+	err = row.Scan(&n)
 	if err != nil {
 		return 0, err
 	}
@@ -106,12 +110,14 @@ func (_Mailboxes) CountByGroup(gid GroupID, unread bool) (int64, error) {
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_Mailboxes) ListByUser(uid UserID, offset, limit int64, unread bool) ([]*Notification, error) {
+func (_Mailboxes) ListByUser(uid UserID, offset, limit int64, unread bool) (_ []*Notification, err error) {
+	defer observeQuery("Mailboxes.ListByUser", time.Now(), &err)
+
 	if uid <= 0 {
-		return nil, errors.New("user ID should be a positive integer")
+		return nil, invalidArg("mailbox", "Mailboxes.ListByUser", "user ID should be a positive integer")
 	}
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("mailbox", "Mailboxes.ListByUser", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -142,7 +148,7 @@ func (_Mailboxes) ListByUser(uid UserID, offset, limit int64, unread bool) ([]*N
 	LIMIT ? OFFSET ?
 	`
 
-	rows, err := db.Query(q, uid, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), uid, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -172,12 +178,14 @@ func (_Mailboxes) ListByUser(uid UserID, offset, limit int64, unread bool) ([]*N
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_Mailboxes) ListByGroup(gid GroupID, offset, limit int64, unread bool) ([]*Notification, error) {
+func (_Mailboxes) ListByGroup(gid GroupID, offset, limit int64, unread bool) (_ []*Notification, err error) {
+	defer observeQuery("Mailboxes.ListByGroup", time.Now(), &err)
+
 	if gid <= 0 {
-		return nil, errors.New("group ID should be a positive integer")
+		return nil, invalidArg("mailbox", "Mailboxes.ListByGroup", "group ID should be a positive integer")
 	}
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("mailbox", "Mailboxes.ListByGroup", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -198,7 +206,7 @@ func (_Mailboxes) ListByGroup(gid GroupID, offset, limit int64, unread bool) ([]
 	LIMIT ? OFFSET ?
 	`
 
-	rows, err := db.Query(q, gid, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), gid, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -224,9 +232,11 @@ func (_Mailboxes) ListByGroup(gid GroupID, offset, limit int64, unread bool) ([]
 
 // GetMessage answers the requested message from the given user's
 // virtual mailbox.
-func (_Mailboxes) GetMessage(msgID MessageID) (*Notification, error) {
+func (_Mailboxes) GetMessage(msgID MessageID) (_ *Notification, err error) {
+	defer observeQuery("Mailboxes.GetMessage", time.Now(), &err)
+
 	if msgID <= 0 {
-		return nil, errors.New("message ID should be positive integers")
+		return nil, invalidArg("mailbox", "Mailboxes.GetMessage", "message ID should be positive integers")
 	}
 
 	q := `
@@ -236,26 +246,28 @@ func (_Mailboxes) GetMessage(msgID MessageID) (*Notification, error) {
 	JOIN wf_doctypes_master dtm ON dtm.id = msgs.doctype_id
 	WHERE mbs.id = ?
 	`
-	row := db.QueryRow(q, msgID)
+	row := db().QueryRow(dbDialect().Rebind(q), msgID)
 	var elem Notification
-	err := row.Scan(&elem.GroupID, &elem.Message.ID, &elem.Message.DocType.ID,
+	err = row.Scan(&elem.GroupID, &elem.Message.ID, &elem.Message.DocType.ID,
 		&elem.Message.DocType.Name, &elem.Message.DocID, &elem.Message.Event,
 		&elem.Message.Title, &elem.Message.Data, &elem.Unread, &elem.Ctime)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "message", "Mailboxes.GetMessage")
 	}
 
 	return &elem, nil
 }
 
 //根据msgID查出所有mailbox
-func (_Mailboxes) GetMessageList(msgID MessageID, offset, limit int64, unread bool) ([]*Notification, error) {
+func (_Mailboxes) GetMessageList(msgID MessageID, offset, limit int64, unread bool) (_ []*Notification, err error) {
+	defer observeQuery("Mailboxes.GetMessageList", time.Now(), &err)
+
 	if msgID <= 0 {
-		return nil, errors.New("message ID should be positive integers")
+		return nil, invalidArg("mailbox", "Mailboxes.GetMessageList", "message ID should be positive integers")
 	}
 
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("mailbox", "Mailboxes.GetMessageList", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -273,7 +285,7 @@ func (_Mailboxes) GetMessageList(msgID MessageID, offset, limit int64, unread bo
 	ORDER BY msgs.id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, msgID, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), msgID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -317,18 +329,22 @@ func (_Mailboxes) GetMessageList(msgID MessageID, offset, limit int64, unread bo
 // ReassignMessage removes the message with the given ID from its
 // current mailbox, and delivers it to the given other group's
 // mailbox.
-func (_Mailboxes) ReassignMessage(otx *sql.Tx, fgid, tgid GroupID, msgID MessageID) error {
+func (_Mailboxes) ReassignMessage(otx *sql.Tx, fgid, tgid GroupID, msgID MessageID) (err error) {
+	defer observeQuery("Mailboxes.ReassignMessage", time.Now(), &err)
+
 	if fgid <= 0 || tgid <= 0 || msgID <= 0 {
-		return errors.New("all identifiers should be positive integers")
+		return invalidArg("mailbox", "Mailboxes.ReassignMessage", "all identifiers should be positive integers")
 	}
 	if fgid == tgid {
 		return nil
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("mailbox", "Mailboxes.ReassignMessage")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -342,7 +358,7 @@ func (_Mailboxes) ReassignMessage(otx *sql.Tx, fgid, tgid GroupID, msgID Message
 	WHERE group_id = ?
 	AND message_id = ?
 	`
-	_, err = tx.Exec(q, tgid, fgid, msgID)
+	_, err = tx.Exec(dbDialect().Rebind(q), tgid, fgid, msgID)
 	if err != nil {
 		return err
 	}
@@ -359,15 +375,19 @@ func (_Mailboxes) ReassignMessage(otx *sql.Tx, fgid, tgid GroupID, msgID Message
 
 // SetStatusByUser sets the `unread` status of the given message as
 // per input specification.
-func (_Mailboxes) SetStatusByUser(otx *sql.Tx, uid UserID, msgID MessageID, status bool) error {
+func (_Mailboxes) SetStatusByUser(otx *sql.Tx, uid UserID, msgID MessageID, status bool) (err error) {
+	defer observeQuery("Mailboxes.SetStatusByUser", time.Now(), &err)
+
 	if uid <= 0 || msgID <= 0 {
-		return errors.New("all identifiers should be positive integers")
+		return invalidArg("mailbox", "Mailboxes.SetStatusByUser", "all identifiers should be positive integers")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("mailbox", "Mailboxes.SetStatusByUser")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -387,7 +407,7 @@ func (_Mailboxes) SetStatusByUser(otx *sql.Tx, uid UserID, msgID MessageID, stat
 	)
 	AND message_id = ?
 	`
-	_, err = tx.Exec(q, status, uid, msgID)
+	_, err = tx.Exec(dbDialect().Rebind(q), status, uid, msgID)
 	if err != nil {
 		return err
 	}
@@ -404,15 +424,19 @@ func (_Mailboxes) SetStatusByUser(otx *sql.Tx, uid UserID, msgID MessageID, stat
 
 // SetStatusByGroup sets the `unread` status of the given message as
 // per input specification.
-func (_Mailboxes) SetStatusByGroup(otx *sql.Tx, gid GroupID, msgID MessageID, status bool) error {
+func (_Mailboxes) SetStatusByGroup(otx *sql.Tx, gid GroupID, msgID MessageID, status bool) (err error) {
+	defer observeQuery("Mailboxes.SetStatusByGroup", time.Now(), &err)
+
 	if gid <= 0 || msgID <= 0 {
-		return errors.New("all identifiers should be positive integers")
+		return invalidArg("mailbox", "Mailboxes.SetStatusByGroup", "all identifiers should be positive integers")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("mailbox", "Mailboxes.SetStatusByGroup")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -426,7 +450,7 @@ func (_Mailboxes) SetStatusByGroup(otx *sql.Tx, gid GroupID, msgID MessageID, st
 	WHERE group_id = ?
 	AND message_id = ?
 	`
-	_, err = tx.Exec(q, status, gid, msgID)
+	_, err = tx.Exec(dbDialect().Rebind(q), status, gid, msgID)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,114 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxNameLen is the maximum length, in characters, of names of
+	// access contexts, document actions, document states, document
+	// types, groups and workflows.  It matches the width of their
+	// `name` columns.
+	MaxNameLen = 100
+
+	// MaxRoleNameLen is the maximum length, in characters, of names
+	// of roles.
+	MaxRoleNameLen = 50
+)
+
+// nameRejectControl and nameDisallowed hold the current name
+// validation settings.  See `SetNameValidation`.
+var nameRejectControl bool
+var nameDisallowed string
+
+// SetNameValidation specifies additional validation that is applied
+// to names of access contexts, document actions, document states,
+// document types, groups, roles and workflows, when they are created
+// or renamed.
+//
+// When `rejectControl` is `true`, names containing control characters
+// are rejected.  Names containing any of the characters in
+// `disallowed` are rejected as well.  In both the cases, the error is
+// `ErrInvalidName`.
+//
+// By default, any name that is non-empty after trimming, and that is
+// within the applicable length limit, is accepted.  Over-length names
+// are always rejected with `ErrNameTooLong`.
+func SetNameValidation(rejectControl bool, disallowed string) {
+	nameRejectControl = rejectControl
+	nameDisallowed = disallowed
+}
+
+// checkName validates the given -- already trimmed -- name against
+// `MaxNameLen` and the current name validation settings.
+func checkName(name string) error {
+	if err := checkNameLen(name, MaxNameLen); err != nil {
+		return err
+	}
+	if nameRejectControl {
+		for _, r := range name {
+			if unicode.IsControl(r) {
+				return ErrInvalidName
+			}
+		}
+	}
+	if nameDisallowed != "" && strings.ContainsAny(name, nameDisallowed) {
+		return ErrInvalidName
+	}
+
+	return nil
+}
+
+// checkNameLen answers `ErrNameTooLong` if the given name has more
+// than `max` characters.
+func checkNameLen(name string, max int) error {
+	if utf8.RuneCountInString(name) > max {
+		return ErrNameTooLong
+	}
+
+	return nil
+}
+
+// checkNameFree answers `ErrNameExists` if the given master table
+// already has a row whose name matches the given one, ignoring case.
+// This guards against near-duplicate names under case-sensitive
+// collations.
+func checkNameFree(ctx context.Context, tx *sql.Tx, table, name string) error {
+	return checkNameFreeExcept(ctx, tx, table, name, "id", 0)
+}
+
+// checkNameFreeExcept is a variant of `checkNameFree` that ignores the
+// row whose given column holds the given value.  Renames use it to
+// exclude the row being renamed, so that a change of case alone is
+// allowed.
+func checkNameFreeExcept(ctx context.Context, tx *sql.Tx, table, name, col string, val interface{}) error {
+	q := "SELECT EXISTS(SELECT 1 FROM " + table + " WHERE LOWER(name) = LOWER(?) AND " + col + " <> ?)"
+	var exists bool
+	row := tx.QueryRowContext(ctx, dbDialect().Rebind(q), name, val)
+	if err := row.Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrNameExists
+	}
+
+	return nil
+}
@@ -15,10 +15,11 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"log"
 	"math"
+	"time"
 )
 
 // NodeID is the type of unique identifiers of nodes.
@@ -100,13 +101,13 @@ func (n *Node) Func() NodeFunc {
 // successfully.  Accordingly, it prepares a message by utilising the
 // registered node function, and posts it to applicable mailboxes.
 func (n *Node) applyEvent(otx *sql.Tx, event *DocEvent, recipients []GroupID) (DocStateID, error) {
-	ts, err := n.Transitions()
+	ts, err := DocTypes.transitionsTx(otx, n.DocType, n.State)
 	if err != nil {
 		return 0, err
 	}
 	tstate, ok := ts[event.Action]
 	if !ok {
-		return 0, ErrWorkflowInvalidAction
+		return 0, flowError("document", "Workflow.ApplyEvent", CodeConflict, ErrWorkflowInvalidAction)
 	}
 
 	// Check document's current state.
@@ -115,7 +116,14 @@ func (n *Node) applyEvent(otx *sql.Tx, event *DocEvent, recipients []GroupID) (D
 		return 0, err
 	}
 	if doc.State.ID != event.State {
-		return 0, ErrDocEventStateMismatch
+		return 0, flowError("document", "Workflow.ApplyEvent", CodeConflict, ErrDocEventStateMismatch)
+	}
+	closed, err := Documents.isClosed(otx, event.DocType, event.DocID)
+	if err != nil {
+		return 0, err
+	}
+	if closed {
+		return 0, flowError("document", "Workflow.ApplyEvent", CodeConflict, ErrDocumentClosed)
 	}
 
 	// Document has already transitioned.  So, we note that the event
@@ -129,12 +137,27 @@ func (n *Node) applyEvent(otx *sql.Tx, event *DocEvent, recipients []GroupID) (D
 		if err != nil {
 			return 0, err
 		}
-		return tstate, ErrDocEventRedundant
+		return tstate, flowError("document", "Workflow.ApplyEvent", CodeConflict, ErrDocEventRedundant)
+	}
+
+	// Consult the registered guards, on behalf of the user of the
+	// event's (singleton) group.
+	if hasTransitionGuards() {
+		var by UserID
+		q := `SELECT user_id FROM wf_group_users WHERE group_id = ? ORDER BY user_id LIMIT 1`
+		err = otx.QueryRow(dbDialect().Rebind(q), event.Group).Scan(&by)
+		if err != nil {
+			return 0, err
+		}
+		err = checkGuards(event.DocType, event.DocID, doc.State.ID, tstate, event.Action, by)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	// Transition document state according to the target node type.
 
-	tnode, err := Nodes.GetByState(n.DocType, tstate)
+	tnode, err := Nodes.GetByStateTx(otx, n.DocType, tstate)
 	if err != nil {
 		return 0, err
 	}
@@ -207,14 +230,14 @@ func (n *Node) recordEvent(otx *sql.Tx, event *DocEvent, tstate DocStateID, stat
 		INSERT INTO wf_docevent_application(doctype_id, doc_id, from_state_id, docevent_id, to_state_id)
 		VALUES(?, ?, ?, ?, ?)
 		`
-		_, err := otx.Exec(q, event.DocType, event.DocID, event.State, event.ID, tstate)
+		_, err := otx.Exec(dbDialect().Rebind(q), event.DocType, event.DocID, event.State, event.ID, tstate)
 		if err != nil {
 			return err
 		}
 	}
 
 	q := `UPDATE wf_docevents SET status = 'A' WHERE id = ?`
-	_, err := otx.Exec(q, event.ID)
+	_, err := otx.Exec(dbDialect().Rebind(q), event.ID)
 	if err != nil {
 		return err
 	}
@@ -238,7 +261,7 @@ func (n *Node) determineRecipients(otx *sql.Tx, recv map[GroupID]struct{}, doc *
 	LIMIT 1
 	`
 	//这里将event里对应的group发一份邮件，所以就相当于给自己也发了一封。
-	rows, err := otx.Query(q, acid, event.Group)
+	rows, err := otx.Query(dbDialect().Rebind(q), acid, event.Group)
 	if err != nil {
 		return nil, err
 	}
@@ -263,7 +286,7 @@ func (n *Node) determineRecipients(otx *sql.Tx, recv map[GroupID]struct{}, doc *
 	WHERE doctype_id = ?
 	AND doc_id = ?
 	`
-	rows2, err := otx.Query(q2, doc.DocType.ID, doc.ID)
+	rows2, err := otx.Query(dbDialect().Rebind(q2), doc.DocType.ID, doc.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -293,23 +316,19 @@ func (n *Node) postMessage(otx *sql.Tx, msg *Message, recv map[GroupID]struct{})
 	INSERT INTO wf_messages(doctype_id, doc_id, docevent_id, title, data)
 	VALUES(?, ?, ?, ?, ?)
 	`
-	res, err := otx.Exec(q, msg.DocType.ID, msg.DocID, msg.Event, msg.Title, msg.Data)
+	msgid, err := dbDialect().InsertID(context.Background(), otx, q, msg.DocType.ID, msg.DocID, msg.Event, msg.Title, msg.Data)
 	if err != nil {
 		return err
 	}
-	var msgid int64
-	if msgid, err = res.LastInsertId(); err != nil {
-		return err
-	}
 
 	// Post it into applicable mailboxes.
 
 	q = `
 	INSERT INTO wf_mailboxes(group_id, message_id, unread, ctime)
-	VALUES(?, ?, 1, NOW())
+	VALUES(?, ?, 1, ` + dbDialect().Now() + `)
 	`
 	for gid := range recv {
-		res, err = otx.Exec(q, gid, msgid)
+		_, err = otx.Exec(dbDialect().Rebind(q), gid, msgid)
 		if err != nil {
 			return err
 		}
@@ -326,13 +345,15 @@ type _Nodes struct{}
 var Nodes _Nodes
 
 // List answers a list of the nodes comprising the given workflow.
-func (_Nodes) List(id WorkflowID) ([]*Node, error) {
+func (_Nodes) List(id WorkflowID) (_ []*Node, err error) {
+	defer observeQuery("Nodes.List", time.Now(), &err)
+
 	q := `
 	SELECT id, doctype_id, docstate_id, workflow_id, name, type
 	FROM wf_workflow_nodes
 	WHERE workflow_id = ?
 	`
-	rows, err := db.Query(q, id)
+	rows, err := db().Query(dbDialect().Rebind(q), id)
 	if err != nil {
 		return nil, err
 	}
@@ -356,9 +377,11 @@ func (_Nodes) List(id WorkflowID) ([]*Node, error) {
 }
 
 // NodeList answers a list of the nodes 增加了accid.
-func (_Nodes) NodeList(offset, limit int64) ([]*Node, error) {
+func (_Nodes) NodeList(offset, limit int64) (_ []*Node, err error) {
+	defer observeQuery("Nodes.NodeList", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("node", "Nodes.NodeList", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -370,7 +393,7 @@ func (_Nodes) NodeList(offset, limit int64) ([]*Node, error) {
 	ORDER BY id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -379,10 +402,14 @@ func (_Nodes) NodeList(offset, limit int64) ([]*Node, error) {
 	ary := make([]*Node, 0, 10)
 	for rows.Next() {
 		var elem Node
-		err = rows.Scan(&elem.ID, &elem.DocType, &elem.State, &elem.AccCtx, &elem.Wflow, &elem.Name, &elem.NodeType)
+		var acID sql.NullInt64
+		err = rows.Scan(&elem.ID, &elem.DocType, &elem.State, &acID, &elem.Wflow, &elem.Name, &elem.NodeType)
 		if err != nil {
 			return nil, err
 		}
+		if acID.Valid {
+			elem.AccCtx = AccessContextID(acID.Int64)
+		}
 		elem.nfunc = defNodeFunc //这个是干嘛的
 		ary = append(ary, &elem)
 	}
@@ -394,9 +421,11 @@ func (_Nodes) NodeList(offset, limit int64) ([]*Node, error) {
 }
 
 // Get retrieves the requested node from the database.
-func (_Nodes) Get(id NodeID) (*Node, error) {
+func (_Nodes) Get(id NodeID) (_ *Node, err error) {
+	defer observeQuery("Nodes.Get", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("node ID must be a positive integer")
+		return nil, invalidArg("node", "Nodes.Get", "node ID must be a positive integer")
 	}
 
 	var elem Node
@@ -406,10 +435,10 @@ func (_Nodes) Get(id NodeID) (*Node, error) {
 	FROM wf_workflow_nodes
 	WHERE id = ?
 	`
-	row := db.QueryRow(q, id)
-	err := row.Scan(&elem.ID, &elem.DocType, &elem.State, &acID, &elem.Wflow, &elem.Name, &elem.NodeType)
+	row := db().QueryRow(dbDialect().Rebind(q), id)
+	err = row.Scan(&elem.ID, &elem.DocType, &elem.State, &acID, &elem.Wflow, &elem.Name, &elem.NodeType)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "node", "Nodes.Get")
 	}
 	if acID.Valid {
 		elem.AccCtx = AccessContextID(acID.Int64)
@@ -422,6 +451,15 @@ func (_Nodes) Get(id NodeID) (*Node, error) {
 // GetByState retrieves the requested node from the database, as per
 // the document state specification.
 func (_Nodes) GetByState(dtype DocTypeID, state DocStateID) (*Node, error) {
+	return Nodes.GetByStateTx(nil, dtype, state)
+}
+
+// GetByStateTx is a variant of `GetByState` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Nodes) GetByStateTx(otx *sql.Tx, dtype DocTypeID, state DocStateID) (_ *Node, err error) {
+	defer observeQuery("Nodes.GetByState", time.Now(), &err)
+
 	var elem Node
 	var acID sql.NullInt64
 	q := `
@@ -430,10 +468,10 @@ func (_Nodes) GetByState(dtype DocTypeID, state DocStateID) (*Node, error) {
 	WHERE doctype_id = ?
 	AND docstate_id = ?
 	`
-	row := db.QueryRow(q, dtype, state)
-	err := row.Scan(&elem.ID, &elem.DocType, &elem.State, &acID, &elem.Wflow, &elem.Name, &elem.NodeType)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind(q), dtype, state)
+	err = row.Scan(&elem.ID, &elem.DocType, &elem.State, &acID, &elem.Wflow, &elem.Name, &elem.NodeType)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "node", "Nodes.GetByState")
 	}
 	if acID.Valid {
 		elem.AccCtx = AccessContextID(acID.Int64)
@@ -0,0 +1,80 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified of the database operations that `flow`
+// performs, so that consuming applications can record metrics such as
+// counts and latencies.
+type Observer interface {
+	// ObserveQuery is called once an operation completes, with its
+	// name, its duration, and its error, if any.  Names are stable,
+	// and are of the form `Resource.Method` -- for instance,
+	// `DocActions.Get`.  Context-aware and transaction-aware variants
+	// of a method are reported under the name of the method itself.
+	//
+	// Every exported method of the resources -- `AccessContexts`,
+	// `DocActions`, `DocEvents`, `DocStates`, `DocStateTransitions`,
+	// `DocTypes`, `Documents`, `Groups`, `Mailboxes`, `Nodes`, `Roles`,
+	// `Users` and `Workflows` -- that queries the database is reported,
+	// as are `Workflow.ApplyEvent`, `AccessContext.GroupHasPermission`,
+	// `DocEvent.StatusInDB`, `DefineWorkflow`, `ExportWorkflow` and
+	// `Stats`.  An operation that is implemented using others is
+	// reported after them.  Schema management and registration of the
+	// database are not reported.
+	//
+	// It may be called concurrently, and should return quickly.
+	ObserveQuery(name string, d time.Duration, err error)
+}
+
+// nopObserver is the default observer, which ignores everything.
+type nopObserver struct{}
+
+// ObserveQuery implements the `Observer` interface.
+func (nopObserver) ObserveQuery(string, time.Duration, error) {}
+
+// observerBox lets `curObserver` hold observers of differing
+// concrete types.
+type observerBox struct {
+	o Observer
+}
+
+// curObserver holds the registered `observerBox`.
+var curObserver atomic.Value
+
+func init() {
+	curObserver.Store(observerBox{nopObserver{}})
+}
+
+// SetObserver registers the given observer of database operations,
+// replacing any registered earlier.  A `nil` observer restores the
+// default, which ignores everything.
+func SetObserver(o Observer) {
+	if o == nil {
+		o = nopObserver{}
+	}
+	curObserver.Store(observerBox{o})
+}
+
+// observeQuery reports the operation with the given name, begun at
+// the given time, to the registered observer.  It is meant to be
+// deferred, with a pointer to the named error result of the method.
+func observeQuery(name string, start time.Time, errp *error) {
+	curObserver.Load().(observerBox).o.ObserveQuery(name, time.Since(start), *errp)
+}
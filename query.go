@@ -0,0 +1,137 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// likeEscapeChar is the escape character used in all `LIKE` patterns
+// built by `flow`.
+//
+// The default escape character differs across databases and server
+// configurations: MySQL uses a backslash, which is itself special
+// inside MySQL string literals unless `NO_BACKSLASH_ESCAPES` is set,
+// while PostgreSQL has its own rules.  Hence, `flow` always states
+// the escape character explicitly through `likeEscapeClause`, and
+// picks one that is not special in any string literal syntax.
+const likeEscapeChar = "!"
+
+// likeEscapeClause should follow every `LIKE ?` whose pattern was
+// built using `likePrefix` or `likeContains`.
+const likeEscapeClause = ` ESCAPE '` + likeEscapeChar + `'`
+
+// likeEscaper escapes the escape character first, and then the `LIKE`
+// wildcards.
+var likeEscaper = strings.NewReplacer(
+	likeEscapeChar, likeEscapeChar+likeEscapeChar,
+	"%", likeEscapeChar+"%",
+	"_", likeEscapeChar+"_",
+)
+
+// likeEscape answers the given string with all `LIKE` wildcards and
+// the escape character escaped, so that it matches only itself.
+func likeEscape(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// likePrefix answers a `LIKE` pattern matching strings that begin
+// with the given literal prefix.
+func likePrefix(s string) string {
+	return likeEscape(s) + "%"
+}
+
+// likeContains answers a `LIKE` pattern matching strings that contain
+// the given literal substring.
+func likeContains(s string) string {
+	return "%" + likeEscape(s) + "%"
+}
+
+// queryer is satisfied by both `*sql.DB` and `*sql.Tx`, so that read
+// methods can run either on their own or in a caller's transaction.
+type queryer interface {
+	Query(q string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(q string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, q string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, q string, args ...interface{}) *sql.Row
+}
+
+// dbOrTx answers the given transaction, if any; the registered
+// database handle, otherwise.
+func dbOrTx(otx *sql.Tx) queryer {
+	if otx != nil {
+		return otx
+	}
+	return db()
+}
+
+// OrderBy specifies the order of the results of listings.
+type OrderBy uint8
+
+// Orderings supported by the `ListOrdered` methods.  Ties in names
+// are broken by ID, in the same direction.
+const (
+	OrderByID       OrderBy = iota // Ascending order of IDs
+	OrderByIDDesc                  // Descending order of IDs
+	OrderByName                    // Ascending order of names
+	OrderByNameDesc                // Descending order of names
+)
+
+// orderClause answers the `ORDER BY` expressions for the given
+// ordering.  Only the fixed expressions here are ever interpolated
+// into queries.
+func orderClause(o OrderBy) (string, error) {
+	switch o {
+	case OrderByID:
+		return "id", nil
+	case OrderByIDDesc:
+		return "id DESC", nil
+	case OrderByName:
+		return "name, id", nil
+	case OrderByNameDesc:
+		return "name DESC, id DESC", nil
+	default:
+		return "", fmt.Errorf("unknown ordering : %d", o)
+	}
+}
+
+// checkAffected answers a `FlowError` wrapping `ErrNotFound` if the given
+// result reports no affected rows, and the given table has no row
+// whose given column holds the given value.  MySQL does not count the
+// rows that an `UPDATE` leaves unchanged; hence the latter check.
+func checkAffected(ctx context.Context, tx *sql.Tx, res sql.Result, table, col string, val interface{}, what, op string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	q := "SELECT EXISTS(SELECT 1 FROM " + table + " WHERE " + col + " = ?)"
+	var exists bool
+	row := tx.QueryRowContext(ctx, dbDialect().Rebind(q), val)
+	if err = row.Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errNotFound(what, op)
+	}
+
+	return nil
+}
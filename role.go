@@ -15,11 +15,12 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // RoleID is the type of unique role identifiers.
@@ -40,16 +41,26 @@ type _Roles struct{}
 var Roles _Roles
 
 // New creates a role with the given name.
-func (_Roles) New(otx *sql.Tx, name string) (RoleID, error) {
+func (_Roles) New(otx *sql.Tx, name string) (_ RoleID, err error) {
+	defer observeQuery("Roles.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("name cannot not be empty")
+		return 0, invalidArg("role", "Roles.New", "name cannot not be empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("role", "Roles.New", err)
+	}
+	if err := checkNameLen(name, MaxRoleNameLen); err != nil {
+		return 0, classify("role", "Roles.New", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("role", "Roles.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -58,11 +69,11 @@ func (_Roles) New(otx *sql.Tx, name string) (RoleID, error) {
 		tx = otx
 	}
 
-	res, err := tx.Exec("INSERT INTO wf_roles_master(name) VALUES(?)", name)
-	if err != nil {
-		return 0, err
+	if err = checkNameFree(context.Background(), tx, "wf_roles_master", name); err != nil {
+		return 0, classify("role", "Roles.New", err)
 	}
-	id, err := res.LastInsertId()
+
+	id, err := dbDialect().InsertID(context.Background(), tx, "INSERT INTO wf_roles_master(name) VALUES(?)", name)
 	if err != nil {
 		return 0, err
 	}
@@ -84,20 +95,45 @@ func (_Roles) New(otx *sql.Tx, name string) (RoleID, error) {
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
 func (_Roles) List(offset, limit int64) ([]*Role, error) {
+	return Roles.listOrdered(nil, OrderByID, offset, limit)
+}
+
+// ListOrdered is a variant of `List` that answers the results in the
+// given order.
+func (_Roles) ListOrdered(order OrderBy, offset, limit int64) ([]*Role, error) {
+	return Roles.listOrdered(nil, order, offset, limit)
+}
+
+// ListTx is a variant of `List` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Roles) ListTx(otx *sql.Tx, offset, limit int64) ([]*Role, error) {
+	return Roles.listOrdered(otx, OrderByID, offset, limit)
+}
+
+// listOrdered implements the listings of roles, using the given
+// transaction, if any.
+func (_Roles) listOrdered(otx *sql.Tx, order OrderBy, offset, limit int64) (_ []*Role, err error) {
+	defer observeQuery("Roles.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("role", "Roles.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
 	}
+	ob, err := orderClause(order)
+	if err != nil {
+		return nil, flowError("role", "Roles.List", CodeInvalidArg, err)
+	}
 
 	q := `
 	SELECT id, name
 	FROM wf_roles_master
-	ORDER BY id
+	ORDER BY ` + ob + `
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := dbOrTx(otx).Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +142,7 @@ func (_Roles) List(offset, limit int64) ([]*Role, error) {
 	ary := make([]*Role, 0, 10)
 	for rows.Next() {
 		var elem Role
-		err = rows.Scan(&elem.ID, &elem.Name)
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
 		if err != nil {
 			return nil, err
 		}
@@ -119,18 +155,87 @@ func (_Roles) List(offset, limit int64) ([]*Role, error) {
 	return ary, nil
 }
 
+// ListByGroupInContext answers the roles assigned to the given group
+// in the given access context, ordered by ID.  Roles inherited through
+// the group hierarchy are not included.
+func (_Roles) ListByGroupInContext(acID AccessContextID, gid GroupID) (_ []*Role, err error) {
+	defer observeQuery("Roles.ListByGroupInContext", time.Now(), &err)
+
+	if acID <= 0 || gid <= 0 {
+		return nil, invalidArg("role", "Roles.ListByGroupInContext", "access context ID and group ID should be positive integers")
+	}
+
+	q := `
+	SELECT rm.id, rm.name
+	FROM wf_roles_master rm
+	JOIN wf_ac_group_roles agrs ON agrs.role_id = rm.id
+	WHERE agrs.ac_id = ?
+	AND agrs.group_id = ?
+	ORDER BY rm.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), acID, gid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Role, 0, 4)
+	for rows.Next() {
+		var elem Role
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// Count answers the total number of roles in the system.
+func (_Roles) Count() (_ int64, err error) {
+	defer observeQuery("Roles.Count", time.Now(), &err)
+
+	var n int64
+	row := db().QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_roles_master"))
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 // Get loads the role object corresponding to the given role ID from
 // the database, and answers that.
 func (_Roles) Get(id RoleID) (*Role, error) {
+	return Roles.GetTx(nil, id)
+}
+
+// GetTx is a variant of `Get` that reads using the given transaction,
+// if any, so that changes made but not yet committed in it are
+// visible.
+func (_Roles) GetTx(otx *sql.Tx, id RoleID) (_ *Role, err error) {
+	defer observeQuery("Roles.Get", time.Now(), &err)
+
 	if id <= 0 {
-		return nil, errors.New("ID must be a positive integer")
+		return nil, invalidArg("role", "Roles.Get", "ID must be a positive integer")
 	}
 
 	var elem Role
-	row := db.QueryRow("SELECT id, name FROM wf_roles_master WHERE id = ?", id)
-	err := row.Scan(&elem.ID, &elem.Name)
+	q := "SELECT id, name FROM wf_roles_master WHERE id = ?"
+	var row *sql.Row
+	if otx == nil {
+		row = db().QueryRow(dbDialect().Rebind(q), id)
+	} else {
+		row = otx.QueryRow(dbDialect().Rebind(q), id)
+	}
+	err = row.Scan(&elem.ID, nullName{&elem.Name})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "role", "Roles.Get")
 	}
 
 	return &elem, nil
@@ -139,32 +244,102 @@ func (_Roles) Get(id RoleID) (*Role, error) {
 // GetByName answers the role, if one with the given name is
 // registered; `nil` and the error, otherwise.
 func (_Roles) GetByName(name string) (*Role, error) {
+	return Roles.GetByNameTx(nil, name)
+}
+
+// GetByNameTx is a variant of `GetByName` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Roles) GetByNameTx(otx *sql.Tx, name string) (_ *Role, err error) {
+	defer observeQuery("Roles.GetByName", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return nil, errors.New("role cannot be empty")
+		return nil, invalidArg("role", "Roles.GetByName", "role cannot be empty")
 	}
 
 	var elem Role
-	row := db.QueryRow("SELECT id, name FROM wf_roles_master WHERE name = ?", name)
-	err := row.Scan(&elem.ID, &elem.Name)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind("SELECT id, name FROM wf_roles_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name})
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "role", "Roles.GetByName")
 	}
 
 	return &elem, nil
 }
 
+// Ensure answers the role with the given name, creating it if it is
+// not registered yet.  The boolean result is `true` only when the
+// role was created by this call.
+func (_Roles) Ensure(otx *sql.Tx, name string) (_ *Role, _ bool, err error) {
+	defer observeQuery("Roles.Ensure", time.Now(), &err)
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, false, invalidArg("role", "Roles.Ensure", "role cannot be empty")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, false, txRequiredErr("role", "Roles.Ensure")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return nil, false, err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	var elem Role
+	row := tx.QueryRow(dbDialect().Rebind("SELECT id, name FROM wf_roles_master WHERE name = ?"), name)
+	err = row.Scan(&elem.ID, nullName{&elem.Name})
+	switch {
+	case err == nil:
+		return &elem, false, nil
+
+	case err != sql.ErrNoRows:
+		return nil, false, err
+	}
+
+	id, err := Roles.New(tx, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &Role{ID: id, Name: name}, true, nil
+}
+
 // Rename renames the given role.
-func (_Roles) Rename(otx *sql.Tx, id RoleID, name string) error {
+func (_Roles) Rename(otx *sql.Tx, id RoleID, name string) (err error) {
+	defer observeQuery("Roles.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name cannot be empty")
+		return invalidArg("role", "Roles.Rename", "name cannot be empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("role", "Roles.Rename", err)
+	}
+	if err := checkNameLen(name, MaxRoleNameLen); err != nil {
+		return classify("role", "Roles.Rename", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("role", "Roles.Rename")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -173,7 +348,15 @@ func (_Roles) Rename(otx *sql.Tx, id RoleID, name string) error {
 		tx = otx
 	}
 
-	_, err = tx.Exec("UPDATE wf_roles_master SET name = ? WHERE id = ?", name, id)
+	if err = checkNameFreeExcept(context.Background(), tx, "wf_roles_master", name, "id", id); err != nil {
+		return classify("role", "Roles.Rename", err)
+	}
+
+	res, err := tx.Exec(dbDialect().Rebind("UPDATE wf_roles_master SET name = ? WHERE id = ?"), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_roles_master", "id", id, "role", "Roles.Rename")
 	if err != nil {
 		return err
 	}
@@ -188,23 +371,22 @@ func (_Roles) Rename(otx *sql.Tx, id RoleID, name string) error {
 	return nil
 }
 
-// Delete deletes the given role from the system, if no access context
-// is actively using it.
-func (_Roles) Delete(otx *sql.Tx, id RoleID) error {
-	if id <= 0 {
-		return errors.New("role ID must be a positive integer")
-	}
+// Delete deletes the given role from the system, together with its
+// permissions.  A role that is assigned to a group in any access
+// context is not deleted; the error answered says in how many.
+func (_Roles) Delete(otx *sql.Tx, id RoleID) (err error) {
+	defer observeQuery("Roles.Delete", time.Now(), &err)
 
-	row := db.QueryRow("SELECT COUNT(*) FROM wf_ac_group_roles WHERE role_id = ?", id)
-	var n int64
-	err := row.Scan(&n)
-	if n > 0 {
-		return errors.New("role is being used in at least one access context; cannot delete")
+	if id <= 0 {
+		return invalidArg("role", "Roles.Delete", "role ID must be a positive integer")
 	}
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("role", "Roles.Delete")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -213,15 +395,28 @@ func (_Roles) Delete(otx *sql.Tx, id RoleID) error {
 		tx = otx
 	}
 
-	_, err = tx.Exec("DELETE FROM wf_role_docactions WHERE role_id = ?", id)
+	row := tx.QueryRow(dbDialect().Rebind("SELECT COUNT(DISTINCT ac_id) FROM wf_ac_group_roles WHERE role_id = ?"), id)
+	var n int64
+	err = row.Scan(&n)
 	if err != nil {
 		return err
 	}
-	res, err := tx.Exec("DELETE FROM wf_roles_master WHERE id = ?", id)
+	if n > 0 {
+		return conflict("role", "Roles.Delete", fmt.Errorf("role is assigned in %d access contexts", n))
+	}
+
+	_, err = tx.Exec(dbDialect().Rebind("DELETE FROM wf_role_docactions WHERE role_id = ?"), id)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(dbDialect().Rebind("DELETE FROM wf_roles_master WHERE id = ?"), id)
 	if err != nil {
 		return err
 	}
 	n, err = res.RowsAffected()
+	if n == 0 {
+		return errNotFound("role", "Roles.Delete")
+	}
 	if n != 1 {
 		return fmt.Errorf("expected number of affected rows : 1; actual affected : %d", n)
 	}
@@ -238,11 +433,15 @@ func (_Roles) Delete(otx *sql.Tx, id RoleID) error {
 
 // AddPermissions adds the given actions to this role, for the given
 // document type.
-func (_Roles) AddPermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, actions []DocActionID) error {
+func (_Roles) AddPermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, actions []DocActionID) (err error) {
+	defer observeQuery("Roles.AddPermissions", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("role", "Roles.AddPermissions")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -256,7 +455,7 @@ func (_Roles) AddPermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, actions [
 	VALUES(?, ?, ?)
 	`
 	for _, action := range actions {
-		_, err = tx.Exec(q, rid, dtype, action)
+		_, err = tx.Exec(dbDialect().Rebind(q), rid, dtype, action)
 		if err != nil {
 			return err
 		}
@@ -273,11 +472,15 @@ func (_Roles) AddPermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, actions [
 
 // RemovePermissions removes the given actions from this role, for the
 // given document type.
-func (_Roles) RemovePermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, actions []DocActionID) error {
+func (_Roles) RemovePermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, actions []DocActionID) (err error) {
+	defer observeQuery("Roles.RemovePermissions", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("role", "Roles.RemovePermissions")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -293,7 +496,7 @@ func (_Roles) RemovePermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, action
 	AND docaction_id = ?
 	`
 	for _, action := range actions {
-		_, err = tx.Exec(q, rid, dtype, action)
+		_, err = tx.Exec(dbDialect().Rebind(q), rid, dtype, action)
 		if err != nil {
 			return err
 		}
@@ -308,13 +511,62 @@ func (_Roles) RemovePermissions(otx *sql.Tx, rid RoleID, dtype DocTypeID, action
 	return nil
 }
 
+// RevokeAllActions removes all the actions of the given document type
+// from this role, in a single statement.  It answers the number of
+// permissions removed.
+func (_Roles) RevokeAllActions(otx *sql.Tx, rid RoleID, dtype DocTypeID) (_ int64, err error) {
+	defer observeQuery("Roles.RevokeAllActions", time.Now(), &err)
+
+	if rid <= 0 || dtype <= 0 {
+		return 0, invalidArg("role", "Roles.RevokeAllActions", "all identifiers should be positive integers")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return 0, txRequiredErr("role", "Roles.RevokeAllActions")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	q := `
+	DELETE FROM wf_role_docactions
+	WHERE role_id = ?
+	AND doctype_id = ?
+	`
+	res, err := tx.Exec(dbDialect().Rebind(q), rid, dtype)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
 // Permissions answers the current set of permissions this role has.
 // It answers `nil` in case the given document type does not have any
 // permissions set in this role.
-func (_Roles) Permissions(rid RoleID) (map[string]struct {
+func (_Roles) Permissions(rid RoleID) (_ map[string]struct {
 	DocTypeID DocTypeID
 	Actions   []*DocAction
-}, error) {
+}, err error) {
+	defer observeQuery("Roles.Permissions", time.Now(), &err)
+
 	q := `
 	SELECT dtm.id, dtm.name, dam.id, dam.name, dam.reconfirm
 	FROM wf_doctypes_master dtm
@@ -322,7 +574,7 @@ func (_Roles) Permissions(rid RoleID) (map[string]struct {
 	JOIN wf_docactions_master dam ON dam.id = rdas.docaction_id
 	WHERE rdas.role_id = ?
 	`
-	rows, err := db.Query(q, rid)
+	rows, err := db().Query(dbDialect().Rebind(q), rid)
 	if err != nil {
 		return nil, err
 	}
@@ -373,6 +625,8 @@ type Permissionstruct struct {
 
 //自定义查询permission
 func (_Roles) PermissionsList(rid RoleID) (rp RolePermission, err error) {
+	defer observeQuery("Roles.PermissionsList", time.Now(), &err)
+
 	q := `
 	SELECT dtm.id, dtm.name, dam.id, dam.name, dam.reconfirm
 	FROM wf_doctypes_master dtm
@@ -380,7 +634,7 @@ func (_Roles) PermissionsList(rid RoleID) (rp RolePermission, err error) {
 	JOIN wf_docactions_master dam ON dam.id = rdas.docaction_id
 	WHERE rdas.role_id = ?
 	`
-	rows, err := db.Query(q, rid)
+	rows, err := db().Query(dbDialect().Rebind(q), rid)
 	if err != nil {
 		return rp, err
 	}
@@ -419,9 +673,11 @@ func (_Roles) PermissionsList(rid RoleID) (rp RolePermission, err error) {
 }
 
 //直接查出数据库
-func (_Roles) PermissionsList1(offset, limit int64) ([]*Permissionstruct, error) {
+func (_Roles) PermissionsList1(offset, limit int64) (_ []*Permissionstruct, err error) {
+	defer observeQuery("Roles.PermissionsList1", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("role", "Roles.PermissionsList1", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -433,7 +689,7 @@ func (_Roles) PermissionsList1(offset, limit int64) ([]*Permissionstruct, error)
 	ORDER BY id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -455,9 +711,50 @@ func (_Roles) PermissionsList1(offset, limit int64) ([]*Permissionstruct, error)
 	return ary, nil
 }
 
+// WithoutActions answers the roles that do not hold any permission on
+// the given document type.  Such roles are usually dead, and are good
+// candidates for review.
+func (_Roles) WithoutActions(dtype DocTypeID) (_ []*Role, err error) {
+	defer observeQuery("Roles.WithoutActions", time.Now(), &err)
+
+	if dtype <= 0 {
+		return nil, invalidArg("role", "Roles.WithoutActions", "document type should be a positive integer")
+	}
+
+	q := `
+	SELECT rm.id, rm.name
+	FROM wf_roles_master rm
+	LEFT JOIN wf_role_docactions rdas ON rdas.role_id = rm.id AND rdas.doctype_id = ?
+	WHERE rdas.role_id IS NULL
+	ORDER BY rm.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*Role, 0, 10)
+	for rows.Next() {
+		var elem Role
+		err = rows.Scan(&elem.ID, nullName{&elem.Name})
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
 // HasPermission answers `true` if this role has the queried
 // permission for the given document type.
-func (_Roles) HasPermission(rid RoleID, dtype DocTypeID, action DocActionID) (bool, error) {
+func (_Roles) HasPermission(rid RoleID, dtype DocTypeID, action DocActionID) (_ bool, err error) {
+	defer observeQuery("Roles.HasPermission", time.Now(), &err)
+
 	q := `
 	SELECT rdas.id FROM wf_role_docactions rdas
 	JOIN wf_doctypes_master dtm ON rdas.doctype_id = dtm.id
@@ -468,9 +765,9 @@ func (_Roles) HasPermission(rid RoleID, dtype DocTypeID, action DocActionID) (bo
 	ORDER BY rdas.id
 	LIMIT 1
 	`
-	row := db.QueryRow(q, rid, dtype, action)
+	row := db().QueryRow(dbDialect().Rebind(q), rid, dtype, action)
 	var n int64
-	err := row.Scan(&n)
+	err = row.Scan(&n)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -0,0 +1,392 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// wfTables lists the tables and views that `flow` expects to find in
+// its database.  Per-document type tables are created on demand, and
+// are hence not included.
+//
+// N.B. The list is in dependency order: a table appears after those
+// that it refers to.  `DropSchema` relies on this, dropping them in
+// reverse order.
+var wfTables = []string{
+	"wf_doctypes_master",
+	"wf_docstates_master",
+	"wf_docactions_master",
+	"wf_users_master",
+	"wf_groups_master",
+	"wf_roles_master",
+	"wf_group_users",
+	"wf_role_docactions",
+	"wf_access_contexts",
+	"wf_ac_group_roles",
+	"wf_ac_group_hierarchy",
+	"wf_ac_perms_v",
+	"wf_document_children",
+	"wf_document_blobs",
+	"wf_document_tags",
+	"wf_docstate_transitions",
+	"wf_doctype_terminal_states",
+	"wf_docevents",
+	"wf_docevent_application",
+	"wf_workflows",
+	"wf_workflow_nodes",
+	"wf_messages",
+	"wf_mailboxes",
+}
+
+//go:embed sql/*.sql
+var schemaFS embed.FS
+
+// schemaFiles lists the embedded DDL files that `CreateSchema` runs, in
+// dependency order.  The users master is owned by the consuming
+// application, and is hence not included.
+var schemaFiles = []string{
+	"sql/wf_doctypes_master.sql",
+	"sql/wf_docstates_master.sql",
+	"sql/wf_docactions_master.sql",
+	"sql/wf_users_master.sql",
+	"sql/wf_groups_master.sql",
+	"sql/wf_roles_master.sql",
+	"sql/wf_group_users.sql",
+	"sql/wf_role_docactions.sql",
+	"sql/wf_access_contexts.sql",
+	"sql/wf_ac_group_roles.sql",
+	"sql/wf_ac_group_hierarchy.sql",
+	"sql/wf_ac_perms_v.sql",
+	"sql/wf_documents.sql",
+	"sql/wf_docstate_transitions.sql",
+	"sql/wf_doctype_terminal_states.sql",
+	"sql/wf_docevents.sql",
+	"sql/wf_docevent_application.sql",
+	"sql/wf_workflows.sql",
+	"sql/wf_workflow_nodes.sql",
+	"sql/wf_messages.sql",
+	"sql/wf_mailboxes.sql",
+}
+
+// schemaViews lists the views among `wfTables`.
+var schemaViews = map[string]bool{
+	"wf_users_master": true,
+	"wf_ac_perms_v":   true,
+}
+
+// schemaColumn is a column added to a table after the table was first
+// released.
+type schemaColumn struct {
+	table string // Name of the table; empty for per-document type tables
+	name  string // Name of the column
+	def   string // Definition of the column, as in `ALTER TABLE ... ADD COLUMN`
+	index bool   // Should the column be indexed?
+}
+
+// schemaColumns lists the columns that `MigrateSchema` adds to tables
+// created by earlier versions of `flow`, in the order of their
+// introduction.
+var schemaColumns = []schemaColumn{
+	{"wf_docactions_master", "active", "TINYINT(1) NOT NULL DEFAULT 1", false},
+	{"wf_docactions_master", "ctime", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP", false},
+	{"wf_docactions_master", "mtime", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP", false},
+	{"wf_docstates_master", "ctime", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP", false},
+	{"wf_docstates_master", "mtime", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP", false},
+	{"wf_docstate_transitions", "sla_seconds", "INT NULL", false},
+	{"", "correlation_id", "VARCHAR(100) NULL", true},
+	{"", "version", "INT NOT NULL DEFAULT 1", false},
+}
+
+// CreateSchema creates all the tables and views that `flow` needs, in
+// the database of the given handle.  It is idempotent: existing
+// tables are left untouched, and reserved rows are inserted only
+// when missing.  Tables created by earlier versions of `flow` are then
+// upgraded using `MigrateSchema`.
+//
+// N.B. The view `wf_users_master` is defined over a table
+// `users_master`, which the consuming application should create
+// before calling this function.
+func CreateSchema(sdb *sql.DB) error {
+	if sdb == nil {
+		return errors.New("given database handle is `nil`")
+	}
+
+	for _, f := range schemaFiles {
+		err := execSchemaFile(sdb, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return MigrateSchema(sdb)
+}
+
+// MigrateSchema upgrades the tables created by earlier versions of
+// `flow`, in the database of the given handle, to the current schema.
+// It adds the columns that they lack -- including those of the tables
+// that hold the documents of each document type.  Running it on a
+// current schema does nothing.
+//
+// N.B. The new tables themselves should already exist; `CreateSchema`
+// creates them before calling this function.
+func MigrateSchema(sdb *sql.DB) error {
+	if sdb == nil {
+		return errors.New("given database handle is `nil`")
+	}
+
+	dtbls, err := schemaTables(sdb, MySQL, "wf!_documents!_%")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range schemaColumns {
+		tbls := []string{c.table}
+		if c.table == "" {
+			tbls = dtbls
+		}
+		for _, t := range tbls {
+			ok, err := schemaHasColumn(sdb, MySQL, t, c.name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+
+			q := "ALTER TABLE " + t + " ADD COLUMN " + c.name + " " + c.def
+			if c.index {
+				q += ", ADD INDEX (" + c.name + ")"
+			}
+			if _, err = sdb.Exec(q); err != nil {
+				return fmt.Errorf("%s : %v", t, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// schemaTables answers the names of the tables in the current schema
+// that match the given `LIKE` pattern, which uses `!` as its escape
+// character.
+func schemaTables(sdb *sql.DB, d Dialect, pattern string) ([]string, error) {
+	q := `
+	SELECT table_name
+	FROM information_schema.tables
+	WHERE table_schema = ` + d.CurrentSchema() + `
+	AND table_name LIKE ?` + likeEscapeClause + `
+	`
+	rows, err := sdb.Query(d.Rebind(q), pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tbls := make([]string, 0, 10)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		tbls = append(tbls, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tbls, nil
+}
+
+// schemaHasColumn answers `true` if the given table in the current
+// schema has the given column.
+func schemaHasColumn(sdb *sql.DB, d Dialect, table, column string) (bool, error) {
+	q := `
+	SELECT COUNT(*)
+	FROM information_schema.columns
+	WHERE table_schema = ` + d.CurrentSchema() + `
+	AND table_name = ?
+	AND column_name = ?
+	`
+	var n int64
+	err := sdb.QueryRow(d.Rebind(q), table, column).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DropSchema drops all the tables and views that `flow` created in the
+// database of the given handle, including those that hold the
+// documents of each document type.  The users master is left
+// untouched.
+//
+// N.B. This irrecoverably deletes all workflow data!
+func DropSchema(sdb *sql.DB) error {
+	if sdb == nil {
+		return errors.New("given database handle is `nil`")
+	}
+
+	// Document storage tables refer to several masters, and hence
+	// should go first.
+	tbls, err := schemaTables(sdb, MySQL, "wf!_documents!_%")
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tbls {
+		_, err = sdb.Exec("DROP TABLE IF EXISTS " + t)
+		if err != nil {
+			return err
+		}
+	}
+
+	// `wfTables` is in dependency order; hence, we drop in reverse.
+	for i := len(wfTables) - 1; i >= 0; i-- {
+		t := wfTables[i]
+		if schemaViews[t] {
+			_, err = sdb.Exec("DROP VIEW IF EXISTS " + t)
+		} else {
+			_, err = sdb.Exec("DROP TABLE IF EXISTS " + t)
+		}
+		if err != nil {
+			return fmt.Errorf("%s : %v", t, err)
+		}
+	}
+
+	return nil
+}
+
+// execSchemaFile runs the statements in the given embedded DDL file,
+// one at a time.
+func execSchemaFile(sdb *sql.DB, name string) error {
+	buf, err := schemaFS.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(buf), "\n")
+	ls := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "--") {
+			continue
+		}
+		ls = append(ls, l)
+	}
+
+	for _, stmt := range strings.Split(strings.Join(ls, "\n"), ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		_, err = sdb.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("%s : %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// RegisterDBWithCheck is a variant of `RegisterDB` that validates the
+// given database handle before registering it.  It pings the
+// database, and verifies that all the tables and views that `flow`
+// needs exist in the current schema.
+//
+// The handle is registered only if all checks pass.  Otherwise, a
+// single error listing all missing tables is answered.
+func RegisterDBWithCheck(sdb *sql.DB) error {
+	return RegisterDBDialectWithCheck(sdb, MySQL)
+}
+
+// RegisterDBDialectWithCheck is a variant of `RegisterDBWithCheck`
+// that also specifies the SQL dialect of the given database.
+func RegisterDBDialectWithCheck(sdb *sql.DB, d Dialect) error {
+	if d == nil {
+		return errors.New("given dialect is `nil`")
+	}
+	if sdb == nil {
+		return errors.New("given database handle is `nil`")
+	}
+	err := sdb.Ping()
+	if err != nil {
+		return err
+	}
+
+	tbls, err := schemaTables(sdb, d, "wf!_%")
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(tbls))
+	for _, name := range tbls {
+		found[strings.ToLower(name)] = true
+	}
+
+	missing := make([]string, 0, len(wfTables))
+	for _, t := range wfTables {
+		if !found[t] {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("database is missing required tables : %s", strings.Join(missing, ", "))
+	}
+
+	return RegisterDBDialect(sdb, d)
+}
+
+// Stats answers the number of rows in each table that `flow` uses,
+// keyed by table name, for use in status and diagnostics endpoints.
+// The users master is included; views and per-document type tables
+// are not.  The database is pinged first, so that a connectivity
+// problem is reported as such.
+func Stats() (_ map[string]int64, err error) {
+	defer observeQuery("Stats", time.Now(), &err)
+
+	sdb := db()
+	if sdb == nil {
+		return nil, errors.New("no database handle registered")
+	}
+	err = sdb.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	tbls := make([]string, 0, len(wfTables)+1)
+	tbls = append(tbls, "users_master")
+	for _, t := range wfTables {
+		if !schemaViews[t] {
+			tbls = append(tbls, t)
+		}
+	}
+
+	res := make(map[string]int64, len(tbls))
+	for _, t := range tbls {
+		var n int64
+		err = sdb.QueryRow("SELECT COUNT(*) FROM " + t).Scan(&n)
+		if err != nil {
+			return nil, fmt.Errorf("%s : %v", t, err)
+		}
+		res[t] = n
+	}
+
+	return res, nil
+}
@@ -0,0 +1,352 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WorkflowSpec declares a document type together with its state
+// machine: the states that it uses, the actions that move documents
+// between them, and the transitions.  States and actions are referred
+// to by name throughout.
+type WorkflowSpec struct {
+	DocType     string                   `json:"DocType"`     // Name of the document type
+	States      []WorkflowSpecState      `json:"States"`      // States used by the document type
+	Actions     []WorkflowSpecAction     `json:"Actions"`     // Actions used in the transitions
+	Transitions []WorkflowSpecTransition `json:"Transitions"` // Transitions between the states
+}
+
+// WorkflowSpecState declares a state of a `WorkflowSpec`.  Exactly one
+// state of a specification should be marked initial.
+type WorkflowSpecState struct {
+	Name     string `json:"Name"`     // Name of the state
+	Initial  bool   `json:"Initial"`  // Is this the initial state of the document type?
+	Terminal bool   `json:"Terminal"` // Does this state close documents?
+}
+
+// WorkflowSpecAction declares an action of a `WorkflowSpec`.
+type WorkflowSpecAction struct {
+	Name      string `json:"Name"`      // Name of the action
+	Reconfirm bool   `json:"Reconfirm"` // Should the user be prompted for a reconfirmation?
+}
+
+// WorkflowSpecTransition declares a transition of a `WorkflowSpec`,
+// naming its source state, action and target state.
+type WorkflowSpecTransition struct {
+	From   string `json:"From"`
+	Action string `json:"Action"`
+	To     string `json:"To"`
+}
+
+// DefinedWorkflow holds the identifiers of the items that
+// `DefineWorkflow` created or reused, keyed by their names in the
+// specification.
+type DefinedWorkflow struct {
+	DocType     DocTypeID
+	Workflow    WorkflowID
+	States      map[string]DocStateID
+	Actions     map[string]DocActionID
+	Transitions []DocTransitionID // In the order of the specification
+}
+
+// Validate checks the specification for consistency, without
+// consulting the database.  Names should be non-empty and distinct,
+// ignoring case; transitions should refer to the states and actions
+// of the specification; and exactly one state should be initial.
+func (s *WorkflowSpec) Validate() error {
+	const op = "WorkflowSpec.Validate"
+
+	if strings.TrimSpace(s.DocType) == "" {
+		return invalidArg("workflow", op, "document type cannot be empty")
+	}
+	if len(s.States) == 0 {
+		return invalidArg("workflow", op, "list of states should be non-empty")
+	}
+
+	states := make(map[string]bool, len(s.States))
+	initial := 0
+	for _, st := range s.States {
+		key := strings.ToLower(strings.TrimSpace(st.Name))
+		if key == "" {
+			return invalidArg("workflow", op, "state name should be non-empty")
+		}
+		if states[key] {
+			return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("duplicate state : %s", st.Name))
+		}
+		states[key] = true
+		if st.Initial {
+			initial++
+		}
+	}
+	if initial != 1 {
+		return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("exactly one initial state is required; found : %d", initial))
+	}
+
+	actions := make(map[string]bool, len(s.Actions))
+	for _, ac := range s.Actions {
+		key := strings.ToLower(strings.TrimSpace(ac.Name))
+		if key == "" {
+			return invalidArg("workflow", op, "action name should be non-empty")
+		}
+		if actions[key] {
+			return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("duplicate action : %s", ac.Name))
+		}
+		actions[key] = true
+	}
+
+	seen := make(map[string]bool, len(s.Transitions))
+	for _, tr := range s.Transitions {
+		from := strings.ToLower(strings.TrimSpace(tr.From))
+		action := strings.ToLower(strings.TrimSpace(tr.Action))
+		if !states[from] {
+			return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("unknown state in transition : %s", tr.From))
+		}
+		if !states[strings.ToLower(strings.TrimSpace(tr.To))] {
+			return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("unknown state in transition : %s", tr.To))
+		}
+		if !actions[action] {
+			return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("unknown action in transition : %s", tr.Action))
+		}
+		key := from + "\x00" + action
+		if seen[key] {
+			return flowError("workflow", op, CodeInvalidArg, fmt.Errorf("duplicate transition : %s -- %s", tr.From, tr.Action))
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// DefineWorkflow creates the document type of the given specification,
+// and defines its state machine and workflow.  The specification is
+// validated before the database is touched.  States and actions are
+// global in `flow`; those that already exist are reused.  States
+// marked terminal are made so; since that marker is global too, no
+// state is made non-terminal.
+//
+// The workflow is named after the document type, and has a node for
+// each state, not bound to any access context.  The initial state has
+// the `begin` node; terminal states have `end` nodes; states with
+// more than one outgoing transition have `branch` nodes; the others
+// have `linear` ones.
+//
+// Document types create their storage tables, and MySQL commits any
+// transaction implicitly when a table is created.  When no
+// transaction is given, the document type is created first, on its
+// own; everything else is defined in a transaction of its own, and
+// the document type is dropped again should a later step fail.
+//
+// When a transaction is given, the document type is created in it,
+// and the rest follows in it too.  N.B. The implicit commit persists
+// the work done in that transaction until then, including the new
+// document type, and MySQL does not roll back the subsequent steps
+// either.  Hence, should a later step fail, the partially defined
+// workflow is answered together with the error, so that the caller
+// can inspect or clean it up.
+func DefineWorkflow(otx *sql.Tx, spec *WorkflowSpec) (_ *DefinedWorkflow, err error) {
+	defer observeQuery("DefineWorkflow", time.Now(), &err)
+
+	if spec == nil {
+		return nil, invalidArg("workflow", "DefineWorkflow", "specification should be non-nil")
+	}
+	if err = spec.Validate(); err != nil {
+		return nil, err
+	}
+	if otx == nil && txRequired {
+		return nil, txRequiredErr("workflow", "DefineWorkflow")
+	}
+
+	var dtid DocTypeID
+	var tx *sql.Tx
+	if otx == nil {
+		dtid, err = DocTypes.New(nil, spec.DocType)
+		if err != nil {
+			return nil, err
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			DocTypes.drop(dtid)
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+				DocTypes.drop(dtid)
+			}
+		}()
+	} else {
+		if err = checkDocActionTx(otx, "DefineWorkflow"); err != nil {
+			return nil, err
+		}
+		tx = otx
+		dtid, err = DocTypes.New(tx, spec.DocType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dw := &DefinedWorkflow{
+		DocType:     dtid,
+		States:      make(map[string]DocStateID, len(spec.States)),
+		Actions:     make(map[string]DocActionID, len(spec.Actions)),
+		Transitions: make([]DocTransitionID, 0, len(spec.Transitions)),
+	}
+	// The partial definition is answered only with a caller's
+	// transaction; otherwise, it is undone.
+	partial := func(err error) (*DefinedWorkflow, error) {
+		if otx == nil {
+			return nil, err
+		}
+		return dw, err
+	}
+
+	byName := make(map[string]DocStateID, len(spec.States))
+	for _, st := range spec.States {
+		ds, _, err := DocStates.Ensure(tx, st.Name)
+		if err != nil {
+			return partial(err)
+		}
+		dw.States[st.Name] = ds.ID
+		byName[strings.ToLower(strings.TrimSpace(st.Name))] = ds.ID
+	}
+	// New actions are made known to the cache once they are committed.
+	madeActions := false
+	defer func() {
+		if madeActions {
+			docActionsChanged(otx)
+		}
+	}()
+	acts := make(map[string]DocActionID, len(spec.Actions))
+	for _, ac := range spec.Actions {
+		da, made, err := DocActions.ensure(context.Background(), tx, strings.TrimSpace(ac.Name), ac.Reconfirm)
+		if err != nil {
+			return partial(err)
+		}
+		madeActions = madeActions || made
+		dw.Actions[ac.Name] = da.ID
+		acts[strings.ToLower(strings.TrimSpace(ac.Name))] = da.ID
+	}
+
+	outgoing := make(map[DocStateID]int, len(spec.States))
+	for _, tr := range spec.Transitions {
+		from := byName[strings.ToLower(strings.TrimSpace(tr.From))]
+		to := byName[strings.ToLower(strings.TrimSpace(tr.To))]
+		action := acts[strings.ToLower(strings.TrimSpace(tr.Action))]
+		id, err := DocStateTransitions.New(tx, dtid, from, action, to)
+		if err != nil {
+			return partial(err)
+		}
+		dw.Transitions = append(dw.Transitions, id)
+		outgoing[from]++
+	}
+
+	var initial DocStateID
+	for _, st := range spec.States {
+		if st.Initial {
+			initial = byName[strings.ToLower(strings.TrimSpace(st.Name))]
+		}
+	}
+	dw.Workflow, err = Workflows.New(tx, spec.DocType, dtid, initial)
+	if err != nil {
+		return partial(err)
+	}
+
+	for _, st := range spec.States {
+		id := byName[strings.ToLower(strings.TrimSpace(st.Name))]
+		var ntype NodeType = NodeTypeLinear
+		switch {
+		case st.Initial:
+			ntype = NodeTypeBegin
+		case st.Terminal:
+			ntype = NodeTypeEnd
+		case outgoing[id] > 1:
+			ntype = NodeTypeBranch
+		}
+		if _, err = Workflows.AddNode(tx, dtid, id, 0, dw.Workflow, st.Name, ntype); err != nil {
+			return partial(err)
+		}
+		if st.Terminal {
+			if err = DocStates.SetTerminal(tx, dtid, id, true); err != nil {
+				return partial(err)
+			}
+		}
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dw, nil
+}
+
+// ExportWorkflow answers the specification of the given document type:
+// the states that it uses, ordered by ID, with their markers; the
+// actions used in its transitions, in the order of their first use;
+// and its transitions, ordered by ID.  The specification can be given
+// to `DefineWorkflow`, after renaming its document type, to define a
+// copy.  Its fields marshal to JSON in a stable order.
+func ExportWorkflow(dtid DocTypeID) (_ *WorkflowSpec, err error) {
+	defer observeQuery("ExportWorkflow", time.Now(), &err)
+
+	dt, err := DocTypes.Get(dtid)
+	if err != nil {
+		return nil, err
+	}
+	sm, err := loadStateMachine(dtid, "ExportWorkflow")
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &WorkflowSpec{
+		DocType:     dt.Name,
+		States:      make([]WorkflowSpecState, 0, len(sm.states)),
+		Actions:     make([]WorkflowSpecAction, 0, len(sm.actions)),
+		Transitions: make([]WorkflowSpecTransition, 0, len(sm.edges)),
+	}
+	names := make(map[DocStateID]string, len(sm.states))
+	for _, ds := range sm.states {
+		names[ds.ID] = ds.Name
+		spec.States = append(spec.States, WorkflowSpecState{
+			Name:     ds.Name,
+			Initial:  ds.ID == sm.initial,
+			Terminal: sm.terminal[ds.ID],
+		})
+	}
+	seen := make(map[DocActionID]bool, len(sm.actions))
+	for _, e := range sm.edges {
+		if !seen[e.action] {
+			seen[e.action] = true
+			spec.Actions = append(spec.Actions, WorkflowSpecAction{
+				Name:      sm.actions[e.action],
+				Reconfirm: sm.reconf[e.action],
+			})
+		}
+		spec.Transitions = append(spec.Transitions, WorkflowSpecTransition{
+			From:   names[e.from],
+			Action: sm.actions[e.action],
+			To:     names[e.to],
+		})
+	}
+
+	return spec, nil
+}
@@ -15,6 +15,26 @@ else
     db=$1
 fi
 
+# Reset an existing database, dropping the tables and views of `flow`
+# in the reverse order of their creation.  Document tables refer to
+# several masters, and hence go first.  The users master is left
+# untouched.
+if [ "$1" != "-t" ]; then
+    for t in $(mysql -u $user -N -e "SELECT table_name FROM information_schema.tables WHERE table_schema = '$db' AND table_name LIKE 'wf\\_documents\\_%'" 2>> err.log); do
+        mysql -u $user $db -e "DROP TABLE IF EXISTS $t" >> err.log 2>&1
+    done
+    for t in wf_mailboxes wf_messages wf_workflow_nodes wf_workflows \
+        wf_docevent_application wf_docevents wf_doctype_terminal_states \
+        wf_docstate_transitions wf_document_tags \
+        wf_document_blobs wf_document_children wf_ac_group_hierarchy \
+        wf_ac_group_roles wf_access_contexts wf_role_docactions \
+        wf_group_users wf_roles_master wf_groups_master \
+        wf_docactions_master wf_docstates_master wf_doctypes_master; do
+        mysql -u $user $db -e "DROP TABLE IF EXISTS $t" >> err.log 2>&1
+    done
+    mysql -u $user $db -e "DROP VIEW IF EXISTS wf_ac_perms_v, wf_users_master" >> err.log 2>&1
+fi
+
 # Create document-related masters.
 mysql -u $user $db < ./sql/wf_doctypes_master.sql >> err.log 2>&1
 mysql -u $user $db < ./sql/wf_docstates_master.sql >> err.log 2>&1
@@ -39,6 +59,7 @@ mysql -u $user $db < ./sql/wf_ac_perms_v.sql >> err.log 2>&1
 # Workflow related.
 mysql -u $user $db < ./sql/wf_documents.sql >> err.log 2>&1
 mysql -u $user $db < ./sql/wf_docstate_transitions.sql >> err.log 2>&1
+mysql -u $user $db < ./sql/wf_doctype_terminal_states.sql >> err.log 2>&1
 mysql -u $user $db < ./sql/wf_docevents.sql >> err.log 2>&1
 mysql -u $user $db < ./sql/wf_docevent_application.sql >> err.log 2>&1
 mysql -u $user $db < ./sql/wf_workflows.sql >> err.log 2>&1
@@ -1,12 +1,9 @@
-DROP TABLE IF EXISTS users_master;
-
---
-
-CREATE TABLE users_master (
+CREATE TABLE IF NOT EXISTS users_master (
     id INT NOT NULL AUTO_INCREMENT,
     first_name VARCHAR(30) NOT NULL,
     last_name VARCHAR(30) NOT NULL,
     email VARCHAR(100) NOT NULL,
+    user_name VARCHAR(100) NULL,
     active TINYINT(1) NOT NULL,
     PRIMARY KEY (id),
     UNIQUE (email)
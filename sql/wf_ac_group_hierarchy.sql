@@ -1,8 +1,4 @@
-DROP TABLE IF EXISTS wf_ac_group_hierarchy;
-
---
-
-CREATE TABLE wf_ac_group_hierarchy (
+CREATE TABLE IF NOT EXISTS wf_ac_group_hierarchy (
     id INT NOT NULL AUTO_INCREMENT,
     ac_id INT NOT NULL,
     group_id INT NOT NULL,
@@ -1,8 +1,4 @@
-DROP TABLE IF EXISTS wf_ac_group_roles;
-
---
-
-CREATE TABLE wf_ac_group_roles (
+CREATE TABLE IF NOT EXISTS wf_ac_group_roles (
     id INT NOT NULL AUTO_INCREMENT,
     ac_id INT NOT NULL,
     group_id INT NOT NULL,
@@ -1,11 +1,25 @@
-DROP TABLE IF EXISTS wf_docactions_master;
-
---
-
-CREATE TABLE wf_docactions_master (
+CREATE TABLE IF NOT EXISTS wf_docactions_master (
     id INT NOT NULL AUTO_INCREMENT,
     name VARCHAR(100) NOT NULL,
     reconfirm TINYINT(1) NOT NULL,
+    active TINYINT(1) NOT NULL DEFAULT 1,
+    ctime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    mtime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     PRIMARY KEY (id),
     UNIQUE (name)
 );
+
+--
+-- Tables created before document actions could be archived can be
+-- upgraded using:
+--
+-- ALTER TABLE wf_docactions_master
+--     ADD COLUMN active TINYINT(1) NOT NULL DEFAULT 1;
+
+--
+-- Tables created before creation and modification times were
+-- recorded can be upgraded using:
+--
+-- ALTER TABLE wf_docactions_master
+--     ADD COLUMN ctime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+--     ADD COLUMN mtime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
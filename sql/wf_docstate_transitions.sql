@@ -1,13 +1,10 @@
-DROP TABLE IF EXISTS wf_docstate_transitions;
-
---
-
-CREATE TABLE wf_docstate_transitions (
+CREATE TABLE IF NOT EXISTS wf_docstate_transitions (
     id INT NOT NULL AUTO_INCREMENT,
     doctype_id INT NOT NULL,
     from_state_id INT NOT NULL,
     docaction_id INT NOT NULL,
     to_state_id INT NOT NULL,
+    sla_seconds INT NULL,
     PRIMARY KEY (id),
     FOREIGN KEY (doctype_id) REFERENCES wf_doctypes_master(id),
     FOREIGN KEY (from_state_id) REFERENCES wf_docstates_master(id),
@@ -15,3 +12,10 @@ CREATE TABLE wf_docstate_transitions (
     FOREIGN KEY (to_state_id) REFERENCES wf_docstates_master(id),
     UNIQUE (doctype_id, from_state_id, docaction_id, to_state_id)
 );
+
+--
+-- Tables created before transition SLAs were introduced can be
+-- upgraded using:
+--
+-- ALTER TABLE wf_docstate_transitions
+--     ADD COLUMN sla_seconds INT NULL;
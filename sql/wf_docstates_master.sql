@@ -1,10 +1,8 @@
-DROP TABLE IF EXISTS wf_docstates_master;
-
---
-
-CREATE TABLE wf_docstates_master (
+CREATE TABLE IF NOT EXISTS wf_docstates_master (
     id INT NOT NULL AUTO_INCREMENT,
     name VARCHAR(100) NOT NULL,
+    ctime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    mtime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     PRIMARY KEY (id),
     UNIQUE (name)
 );
@@ -13,5 +11,13 @@ CREATE TABLE wf_docstates_master (
 
 -- This reserved state has ID `1`.  This is used as the only legal
 -- state for children documents.
-INSERT INTO wf_docstates_master(name)
+INSERT IGNORE INTO wf_docstates_master(name)
 VALUES('__RESERVED_CHILD_STATE__');
+
+--
+-- Tables created before creation and modification times were
+-- recorded can be upgraded using:
+--
+-- ALTER TABLE wf_docstates_master
+--     ADD COLUMN ctime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+--     ADD COLUMN mtime TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
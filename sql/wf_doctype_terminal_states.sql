@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS wf_doctype_terminal_states (
+    doctype_id INT NOT NULL,
+    docstate_id INT NOT NULL,
+    PRIMARY KEY (doctype_id, docstate_id),
+    FOREIGN KEY (doctype_id) REFERENCES wf_doctypes_master(id),
+    FOREIGN KEY (docstate_id) REFERENCES wf_docstates_master(id)
+);
@@ -7,17 +7,31 @@
 --     ctime TIMESTAMP NOT NULL,
 --     title VARCHAR(250) NULL,
 --     data TEXT NOT NULL,
+--     correlation_id VARCHAR(100) NULL,
+--     version INT NOT NULL DEFAULT 1,
 --     PRIMARY KEY (id),
+--     INDEX (correlation_id),
 --     FOREIGN KEY (ac_id) REFERENCES wf_access_contexts(id),
 --     FOREIGN KEY (docstate_id) REFERENCES wf_docstates_master(id),
 --     FOREIGN KEY (group_id) REFERENCES wf_groups_master(id)
 -- );
-
 --
+-- Document tables created before correlation identifiers were
+-- introduced can be upgraded using:
+--
+-- ALTER TABLE wf_documents_<DOCTYPE_ID>
+--     ADD COLUMN correlation_id VARCHAR(100) NULL,
+--     ADD INDEX (correlation_id);
+--
+-- Document tables created before documents were versioned can be
+-- upgraded using:
+--
+-- ALTER TABLE wf_documents_<DOCTYPE_ID>
+--     ADD COLUMN version INT NOT NULL DEFAULT 1;
 
-DROP TABLE IF EXISTS wf_document_children;
+--
 
-CREATE TABLE wf_document_children (
+CREATE TABLE IF NOT EXISTS wf_document_children (
     id INT NOT NULL AUTO_INCREMENT,
     parent_doctype_id INT NOT NULL,
     parent_id INT NOT NULL,
@@ -31,9 +45,7 @@ CREATE TABLE wf_document_children (
 
 --
 
-DROP TABLE IF EXISTS wf_document_blobs;
-
-CREATE TABLE wf_document_blobs (
+CREATE TABLE IF NOT EXISTS wf_document_blobs (
     id INT NOT NULL AUTO_INCREMENT,
     doctype_id INT NOT NULL,
     doc_id INT NOT NULL,
@@ -47,9 +59,7 @@ CREATE TABLE wf_document_blobs (
 
 --
 
-DROP TABLE IF EXISTS wf_document_tags;
-
-CREATE TABLE wf_document_tags (
+CREATE TABLE IF NOT EXISTS wf_document_tags (
     id INT NOT NULL AUTO_INCREMENT,
     doctype_id INT NOT NULL,
     doc_id INT NOT NULL,
@@ -0,0 +1,121 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// stmtGen is one generation of prepared statements, all prepared
+// against the same database handle.  It counts the statements of its
+// that are in use, so that a retired generation is closed only once
+// the last of them is released.
+type stmtGen struct {
+	m       map[string]*sql.Stmt
+	users   int
+	retired bool
+}
+
+// close closes all the statements of this generation.
+func (g *stmtGen) close() {
+	for _, stmt := range g.m {
+		stmt.Close()
+	}
+}
+
+// stmtCache holds prepared statements for frequently-run queries,
+// keyed by their text.  Statements are prepared lazily, on first use,
+// against the registered database handle.
+var stmtCache = struct {
+	sync.Mutex
+	cur *stmtGen
+}{cur: &stmtGen{m: make(map[string]*sql.Stmt)}}
+
+// cachedStmt answers a prepared statement for the given query,
+// preparing it if necessary.  The query is rendered in the registered
+// dialect before preparation.
+//
+// The answered function MUST be called once the statement is no
+// longer in use; until then, the statement remains open even if the
+// cache is reset meanwhile.
+func cachedStmt(ctx context.Context, q string) (*sql.Stmt, func(), error) {
+	q = dbDialect().Rebind(q)
+	for {
+		stmtCache.Lock()
+		g := stmtCache.cur
+		if stmt, ok := g.m[q]; ok {
+			g.users++
+			stmtCache.Unlock()
+			return stmt, func() { releaseStmt(g) }, nil
+		}
+		stmtCache.Unlock()
+
+		// Preparing can be slow; other queries should not wait for it.
+		stmt, err := db().PrepareContext(ctx, q)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stmtCache.Lock()
+		switch {
+		case stmtCache.cur != g:
+			// The cache was reset meanwhile, possibly for another
+			// database handle; prepare afresh.
+			stmtCache.Unlock()
+			stmt.Close()
+			continue
+
+		case g.m[q] != nil:
+			// Another caller won the race; use its statement.
+			stmtCache.Unlock()
+			stmt.Close()
+			continue
+		}
+		g.m[q] = stmt
+		g.users++
+		stmtCache.Unlock()
+
+		return stmt, func() { releaseStmt(g) }, nil
+	}
+}
+
+// releaseStmt records that a statement of the given generation is no
+// longer in use.  The last user of a retired generation closes it.
+func releaseStmt(g *stmtGen) {
+	stmtCache.Lock()
+	defer stmtCache.Unlock()
+
+	g.users--
+	if g.retired && g.users == 0 {
+		g.close()
+	}
+}
+
+// resetStmtCache discards all cached statements.  It should be called
+// whenever the registered database handle changes.  Statements that
+// are in use are closed once they are released.
+func resetStmtCache() {
+	stmtCache.Lock()
+	defer stmtCache.Unlock()
+
+	old := stmtCache.cur
+	stmtCache.cur = &stmtGen{m: make(map[string]*sql.Stmt)}
+	old.retired = true
+	if old.users == 0 {
+		old.close()
+	}
+}
@@ -0,0 +1,562 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// DocStateTransition is a rule of a document type's state machine.  A
+// document of the type, in the source state, moves to the target
+// state when the action is performed on it.
+type DocStateTransition struct {
+	ID        DocTransitionID `json:"ID"`        // Unique identifier of this transition
+	DocType   DocTypeID       `json:"DocType"`   // Document type to which this transition applies
+	FromState DocStateID      `json:"FromState"` // Source state of documents
+	Action    DocActionID     `json:"Action"`    // Action that causes the transition
+	ToState   DocStateID      `json:"ToState"`   // Target state of documents
+}
+
+// Unexported type, only for convenience methods.
+type _DocStateTransitions struct{}
+
+// DocStateTransitions provides a resource-like interface to the
+// transitions defined for document types.
+var DocStateTransitions _DocStateTransitions
+
+// New defines a transition of documents of the given type, from the
+// given state to the target state, upon the given action.
+//
+// At most one transition can be defined for a combination of document
+// type, source state and action; `ErrTransitionExists` is answered
+// otherwise.  Unlike `DocTypes.AddTransition`, which allows several
+// target states, this serialises concurrent definitions for the same
+// document type, by locking the document type.
+func (_DocStateTransitions) New(otx *sql.Tx, dtype DocTypeID, from DocStateID,
+	action DocActionID, to DocStateID) (_ DocTransitionID, err error) {
+	defer observeQuery("DocStateTransitions.New", time.Now(), &err)
+
+	if dtype <= 0 || from <= 0 || action <= 0 || to <= 0 {
+		return 0, invalidArg("transition", "DocStateTransitions.New", "all identifiers should be positive integers")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return 0, txRequiredErr("transition", "DocStateTransitions.New")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	// Lock the document type, so that a concurrent definition waits
+	// until this one is committed.
+	q := `SELECT id FROM wf_doctypes_master WHERE id = ? FOR UPDATE`
+	var dtid int64
+	err = tx.QueryRow(dbDialect().Rebind(q), dtype).Scan(&dtid)
+	if err != nil {
+		return 0, notFound(err, "document type", "DocStateTransitions.New")
+	}
+
+	q = `
+	SELECT COUNT(*)
+	FROM wf_docstate_transitions
+	WHERE doctype_id = ?
+	AND from_state_id = ?
+	AND docaction_id = ?
+	`
+	var n int64
+	err = tx.QueryRow(dbDialect().Rebind(q), dtype, from, action).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, conflict("transition", "DocStateTransitions.New", ErrTransitionExists)
+	}
+
+	q = `
+	INSERT INTO wf_docstate_transitions(doctype_id, from_state_id, docaction_id, to_state_id)
+	VALUES(?, ?, ?, ?)
+	`
+	id, err := dbDialect().InsertID(context.Background(), tx, q, dtype, from, action, to)
+	if err != nil {
+		return 0, err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return DocTransitionID(id), nil
+}
+
+// Get retrieves the transition for the given ID.
+func (_DocStateTransitions) Get(id DocTransitionID) (_ *DocStateTransition, err error) {
+	defer observeQuery("DocStateTransitions.Get", time.Now(), &err)
+
+	if id <= 0 {
+		return nil, invalidArg("transition", "DocStateTransitions.Get", "ID should be a positive integer")
+	}
+
+	q := `
+	SELECT id, doctype_id, from_state_id, docaction_id, to_state_id
+	FROM wf_docstate_transitions
+	WHERE id = ?
+	`
+	var elem DocStateTransition
+	row := db().QueryRow(dbDialect().Rebind(q), id)
+	err = row.Scan(&elem.ID, &elem.DocType, &elem.FromState, &elem.Action, &elem.ToState)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errNotFound("transition", "DocStateTransitions.Get")
+
+	case err != nil:
+		return nil, err
+	}
+
+	return &elem, nil
+}
+
+// List answers a subset of the transitions defined for the given
+// document type, ordered by ID.
+//
+// Result set skips the first `offset` transitions, and has not more
+// than `limit` elements.  A value of `0` for `offset` fetches from the
+// beginning, while a value of `0` for `limit` fetches until the end.
+func (_DocStateTransitions) List(dtype DocTypeID, offset, limit int64) (_ []*DocStateTransition, err error) {
+	defer observeQuery("DocStateTransitions.List", time.Now(), &err)
+
+	if dtype <= 0 {
+		return nil, invalidArg("transition", "DocStateTransitions.List", "document type ID should be a positive integer")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, invalidArg("transition", "DocStateTransitions.List", "offset and limit must be non-negative integers")
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+
+	q := `
+	SELECT id, doctype_id, from_state_id, docaction_id, to_state_id
+	FROM wf_docstate_transitions
+	WHERE doctype_id = ?
+	ORDER BY id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocStateTransition, 0, 10)
+	for rows.Next() {
+		var elem DocStateTransition
+		err = rows.Scan(&elem.ID, &elem.DocType, &elem.FromState, &elem.Action, &elem.ToState)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// NextState answers the state into which a document of the given type
+// moves, when the given action is performed on it in the given state.
+// The boolean result is `false` if no such transition is defined;
+// that is not an error.
+func (_DocStateTransitions) NextState(dtype DocTypeID, from DocStateID, action DocActionID) (DocStateID, bool, error) {
+	return DocStateTransitions.NextStateTx(nil, dtype, from, action)
+}
+
+// NextStateTx is a variant of `NextState` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_DocStateTransitions) NextStateTx(otx *sql.Tx, dtype DocTypeID, from DocStateID, action DocActionID) (_ DocStateID, _ bool, err error) {
+	defer observeQuery("DocStateTransitions.NextState", time.Now(), &err)
+
+	if dtype <= 0 || from <= 0 || action <= 0 {
+		return 0, false, invalidArg("transition", "DocStateTransitions.NextState", "all identifiers should be positive integers")
+	}
+
+	q := `
+	SELECT to_state_id
+	FROM wf_docstate_transitions
+	WHERE doctype_id = ?
+	AND from_state_id = ?
+	AND docaction_id = ?
+	`
+	var to DocStateID
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind(q), dtype, from, action)
+	err = row.Scan(&to)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+
+	case err != nil:
+		return 0, false, err
+	}
+
+	return to, true, nil
+}
+
+// ActionsFrom answers the actions that can be performed on documents
+// of the given type in the given state, ordered by ID.  The list is
+// empty when no transition leaves the state.
+func (_DocStateTransitions) ActionsFrom(dtype DocTypeID, from DocStateID) (_ []*DocAction, err error) {
+	defer observeQuery("DocStateTransitions.ActionsFrom", time.Now(), &err)
+
+	if dtype <= 0 || from <= 0 {
+		return nil, invalidArg("transition", "DocStateTransitions.ActionsFrom", "document type ID and state ID should be positive integers")
+	}
+
+	q := `
+	SELECT DISTINCT dam.id, dam.name, dam.reconfirm
+	FROM wf_docstate_transitions dst
+	JOIN wf_docactions_master dam ON dam.id = dst.docaction_id
+	WHERE dst.doctype_id = ?
+	AND dst.from_state_id = ?
+	ORDER BY dam.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]*DocAction, 0, 10)
+	for rows.Next() {
+		var elem DocAction
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.Reconfirm)
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, &elem)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// ExportDOT answers the state machine of the given document type as a
+// Graphviz digraph.  States are nodes, labelled with their names; the
+// initial state is double-circled, and terminal states are shaded.
+// Each transition is an edge labelled with the name of its action.
+func (_DocStateTransitions) ExportDOT(dtype DocTypeID) (_ string, err error) {
+	defer observeQuery("DocStateTransitions.ExportDOT", time.Now(), &err)
+
+	dt, err := DocTypes.Get(dtype)
+	if err != nil {
+		return "", err
+	}
+	sm, err := loadStateMachine(dtype, "DocStateTransitions.ExportDOT")
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(dt.Name))
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=circle];\n")
+	for _, ds := range sm.states {
+		attrs := "label=" + dotQuote(ds.Name)
+		if ds.ID == sm.initial {
+			attrs += ", shape=doublecircle"
+		}
+		if sm.terminal[ds.ID] {
+			attrs += ", style=filled, fillcolor=lightgrey"
+		}
+		fmt.Fprintf(&b, "\ts%d [%s];\n", ds.ID, attrs)
+	}
+	for _, e := range sm.edges {
+		fmt.Fprintf(&b, "\ts%d -> s%d [label=%s];\n", e.from, e.to, dotQuote(sm.actions[e.action]))
+	}
+	b.WriteString("}\n")
+
+	return b.String(), nil
+}
+
+// Validate checks the state machine of the given document type, and
+// answers a list of the problems found.  The list is empty when the
+// state machine is well-formed.
+//
+// The following are reported: states that cannot be reached from the
+// initial state, non-terminal states with no transitions leaving
+// them, and actions permitted on the document type that are used by
+// no transition.
+func (_DocStateTransitions) Validate(dtype DocTypeID) (_ []string, err error) {
+	defer observeQuery("DocStateTransitions.Validate", time.Now(), &err)
+
+	if dtype <= 0 {
+		return nil, invalidArg("transition", "DocStateTransitions.Validate", "document type ID should be a positive integer")
+	}
+
+	sm, err := loadStateMachine(dtype, "DocStateTransitions.Validate")
+	if err != nil {
+		return nil, err
+	}
+
+	ary := make([]string, 0, 4)
+
+	out := make(map[DocStateID][]DocStateID, len(sm.states))
+	for _, e := range sm.edges {
+		out[e.from] = append(out[e.from], e.to)
+	}
+
+	if sm.initial == 0 {
+		ary = append(ary, "no initial state is determined")
+	} else {
+		seen := map[DocStateID]bool{sm.initial: true}
+		queue := []DocStateID{sm.initial}
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			for _, next := range out[cur] {
+				if !seen[next] {
+					seen[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		for _, ds := range sm.states {
+			if !seen[ds.ID] {
+				ary = append(ary, fmt.Sprintf("state %q is unreachable from the initial state", ds.Name))
+			}
+		}
+	}
+
+	for _, ds := range sm.states {
+		if !sm.terminal[ds.ID] && len(out[ds.ID]) == 0 {
+			ary = append(ary, fmt.Sprintf("non-terminal state %q has no outgoing transitions", ds.Name))
+		}
+	}
+
+	q := `
+	SELECT DISTINCT dam.id, dam.name
+	FROM wf_role_docactions rda
+	JOIN wf_docactions_master dam ON dam.id = rda.docaction_id
+	WHERE rda.doctype_id = ?
+	ORDER BY dam.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id DocActionID
+		var name string
+		err = rows.Scan(&id, nullName{&name})
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := sm.actions[id]; !ok {
+			ary = append(ary, fmt.Sprintf("action %q is used by no transition", name))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ary, nil
+}
+
+// dotReplacer escapes the characters that are special inside DOT
+// quoted strings.
+var dotReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// dotQuote answers the given string as a DOT quoted string.
+func dotQuote(s string) string {
+	return `"` + dotReplacer.Replace(s) + `"`
+}
+
+// smEdge is a transition in a `stateMachine`.
+type smEdge struct {
+	from   DocStateID
+	action DocActionID
+	to     DocStateID
+}
+
+// stateMachine is an in-memory view of the states and transitions of
+// a document type, used for exporting and checking them.
+type stateMachine struct {
+	states   []*DocState            // States used by the document type, ordered by ID
+	terminal map[DocStateID]bool    // Terminal states among the above
+	initial  DocStateID             // Initial state, if one is determined; `0` otherwise
+	edges    []smEdge               // Transitions, ordered by ID
+	actions  map[DocActionID]string // Names of the actions used in transitions
+	reconf   map[DocActionID]bool   // Actions among the above that need reconfirmation
+}
+
+// loadStateMachine reads the states and transitions of the given
+// document type, on behalf of the given operation.
+func loadStateMachine(dtype DocTypeID, op string) (*stateMachine, error) {
+	if dtype <= 0 {
+		return nil, invalidArg("document type", op, "document type ID should be a positive integer")
+	}
+
+	sm := &stateMachine{
+		states:   make([]*DocState, 0, 10),
+		terminal: make(map[DocStateID]bool),
+		edges:    make([]smEdge, 0, 10),
+		actions:  make(map[DocActionID]string),
+		reconf:   make(map[DocActionID]bool),
+	}
+
+	q := `
+	SELECT dsm.id, dsm.name, ts.docstate_id IS NOT NULL
+	FROM wf_docstates_master dsm
+	LEFT JOIN wf_doctype_terminal_states ts ON ts.doctype_id = ? AND ts.docstate_id = dsm.id
+	WHERE dsm.id IN (
+		SELECT from_state_id FROM wf_docstate_transitions WHERE doctype_id = ?
+		UNION
+		SELECT to_state_id FROM wf_docstate_transitions WHERE doctype_id = ?
+		UNION
+		SELECT docstate_id FROM wf_workflow_nodes WHERE doctype_id = ?
+	)
+	ORDER BY dsm.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtype, dtype, dtype, dtype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var elem DocState
+		var terminal bool
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &terminal)
+		if err != nil {
+			return nil, err
+		}
+		sm.states = append(sm.states, &elem)
+		if terminal {
+			sm.terminal[elem.ID] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	q = `
+	SELECT dst.from_state_id, dst.docaction_id, dam.name, dam.reconfirm, dst.to_state_id
+	FROM wf_docstate_transitions dst
+	JOIN wf_docactions_master dam ON dam.id = dst.docaction_id
+	WHERE dst.doctype_id = ?
+	ORDER BY dst.id
+	`
+	trows, err := db().Query(dbDialect().Rebind(q), dtype)
+	if err != nil {
+		return nil, err
+	}
+	defer trows.Close()
+
+	for trows.Next() {
+		var e smEdge
+		var name string
+		var reconfirm bool
+		err = trows.Scan(&e.from, &e.action, nullName{&name}, &reconfirm, &e.to)
+		if err != nil {
+			return nil, err
+		}
+		sm.edges = append(sm.edges, e)
+		sm.actions[e.action] = name
+		if reconfirm {
+			sm.reconf[e.action] = true
+		}
+	}
+	if err = trows.Err(); err != nil {
+		return nil, err
+	}
+
+	ds, err := DocStates.Initial(dtype)
+	switch {
+	case err == nil:
+		sm.initial = ds.ID
+
+	case !errors.Is(err, ErrNoInitialState):
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+// Delete removes the given transition.
+func (_DocStateTransitions) Delete(otx *sql.Tx, id DocTransitionID) (err error) {
+	defer observeQuery("DocStateTransitions.Delete", time.Now(), &err)
+
+	if id <= 0 {
+		return invalidArg("transition", "DocStateTransitions.Delete", "ID should be a positive integer")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("transition", "DocStateTransitions.Delete")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	res, err := tx.Exec(dbDialect().Rebind("DELETE FROM wf_docstate_transitions WHERE id = ?"), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound("transition", "DocStateTransitions.Delete")
+	}
+	if n != 1 {
+		return fmt.Errorf("expected number of affected rows : 1; actual affected : %d", n)
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
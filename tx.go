@@ -0,0 +1,130 @@
+// (c) Copyright 2015-2017 JONNALAGADDA Srinivas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flow
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// txHooks holds the functions to run once the transactions begun by
+// `WithTxOpts` end.  Transactions begun elsewhere have no entry.
+var txHooks = struct {
+	sync.Mutex
+	m map[*sql.Tx][]func(committed bool)
+}{m: make(map[*sql.Tx][]func(committed bool))}
+
+// onTxDone arranges for the given function to be run once the given
+// transaction is committed or rolled back, and answers `true`.  It
+// answers `false` if the transaction was not begun by `WithTxOpts`,
+// since its end cannot then be observed.
+func onTxDone(tx *sql.Tx, fn func(committed bool)) bool {
+	txHooks.Lock()
+	defer txHooks.Unlock()
+
+	fns, ok := txHooks.m[tx]
+	if !ok {
+		return false
+	}
+	txHooks.m[tx] = append(fns, fn)
+	return true
+}
+
+// txTracked answers `true` if the given transaction was begun by
+// `WithTxOpts`, and has not ended yet.
+func txTracked(tx *sql.Tx) bool {
+	txHooks.Lock()
+	defer txHooks.Unlock()
+
+	_, ok := txHooks.m[tx]
+	return ok
+}
+
+// endTx forgets the given transaction, and runs the functions
+// registered for it.
+func endTx(tx *sql.Tx, committed bool) {
+	txHooks.Lock()
+	fns := txHooks.m[tx]
+	delete(txHooks.m, tx)
+	txHooks.Unlock()
+
+	for _, fn := range fns {
+		fn(committed)
+	}
+}
+
+// WithTx runs the given function in a new transaction, begun with the
+// driver's default options.  The transaction is committed if the
+// function answers `nil`; it is rolled back otherwise, and the
+// function's error is answered.  Should the function panic, the
+// transaction is rolled back, and the panic is propagated.
+//
+//	err := flow.WithTx(func(tx *sql.Tx) error {
+//		...
+//	})
+//
+// See `WithTxOpts` for selecting isolation levels.
+func WithTx(fn func(tx *sql.Tx) error) error {
+	return WithTxOpts(nil, fn)
+}
+
+// WithTxOpts runs the given function in a new transaction, begun with
+// the given options.  The transaction is committed if the function
+// answers `nil`; it is rolled back otherwise, and the function's
+// error is answered.  Should the function panic, the transaction is
+// rolled back, and the panic is propagated.
+//
+// Use `opts` to select the isolation level -- for instance,
+// `sql.LevelRepeatableRead` for reading consistent pages, or
+// `sql.LevelReadCommitted` for throughput -- and to request a
+// read-only transaction for pure reads.  A `nil` value for `opts`
+// uses the driver's defaults.
+//
+// Pass the transaction given to `fn` to the `flow` methods that
+// accept one, so that they participate in it.  Since `flow` can observe
+// the end of such a transaction, it refreshes its document action
+// cache, and notifies `AfterTransition` listeners, only after the
+// commit; see `EnableDocActionCache` and `RegisterAfterTransition`.
+func WithTxOpts(opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := db().BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	txHooks.Lock()
+	txHooks.m[tx] = nil
+	txHooks.Unlock()
+
+	// Deferred calls run while a panic unwinds, too.
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+		endTx(tx, committed)
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
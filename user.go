@@ -15,10 +15,12 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // UserID is the type of unique user identifiers.
@@ -45,21 +47,32 @@ type _Users struct{}
 // Users provides a resource-like interface to users in the system.
 var Users _Users
 
-// New creates a new group that can be populated with users later.
-func (_Users) New(otx *sql.Tx, first_name, last_name, email string, active int) (UserID, error) {
+// normalizeEmail answers the canonical form of the given e-mail
+// address, under which it is stored and looked up.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// New creates a new user.  The e-mail address is trimmed and
+// lower-cased before storing; a conflict error is answered if a user
+// with the same normalized address already exists.
+func (_Users) New(otx *sql.Tx, first_name, last_name, email string, active int) (_ UserID, err error) {
+	defer observeQuery("Users.New", time.Now(), &err)
+
 	first_name = strings.TrimSpace(first_name)
 	last_name = strings.TrimSpace(last_name)
-	email = strings.TrimSpace(email)
+	email = normalizeEmail(email)
 
 	if first_name == "" || last_name == "" || email == "" {
-		return 0, errors.New("name and type must not be empty")
+		return 0, invalidArg("user", "Users.New", "name and type must not be empty")
 	}
 
 	var tx *sql.Tx
-	var err error
-	var res sql.Result
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("user", "Users.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -67,25 +80,21 @@ func (_Users) New(otx *sql.Tx, first_name, last_name, email string, active int)
 	} else {
 		tx = otx
 	}
-	switch active {
-	case 0:
-		res, err = tx.Exec("INSERT INTO users_master(first_name, last_name, email, active) VALUES(?, ?, ?, ?)", first_name, last_name, email, 0)
-		// res, err := tx.Exec("INSERT INTO wf_groups_master(name, group_type) VALUES(?, ?)", name, gtype)
-		if err != nil {
-			return 0, err
-		}
-	case 1:
-		res, err = tx.Exec("INSERT INTO users_master(first_name, last_name, email, active) VALUES(?, ?, ?, ?)", first_name, last_name, email, 1)
-		// res, err := tx.Exec("INSERT INTO wf_groups_master(name, group_type) VALUES(?, ?)", name, gtype)
-		if err != nil {
-			return 0, err
-		}
-	default:
-		return 0, errors.New("unknown group type")
+
+	var n int64
+	row := tx.QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM users_master WHERE LOWER(email) = ?"), email)
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, conflict("user", "Users.New", fmt.Errorf("a user with the e-mail address already exists : %s", email))
 	}
 
-	var id int64
-	id, err = res.LastInsertId()
+	if active != 0 && active != 1 {
+		return 0, invalidArg("user", "Users.New", "active should be either 0 or 1")
+	}
+	id, err := dbDialect().InsertID(context.Background(), tx, "INSERT INTO users_master(first_name, last_name, email, active) VALUES(?, ?, ?, ?)", first_name, last_name, email, active)
 	if err != nil {
 		return 0, err
 	}
@@ -107,8 +116,17 @@ func (_Users) New(otx *sql.Tx, first_name, last_name, email string, active int)
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
 func (_Users) List(prefix string, offset, limit int64) ([]*User, error) {
+	return Users.ListTx(nil, prefix, offset, limit)
+}
+
+// ListTx is a variant of `List` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Users) ListTx(otx *sql.Tx, prefix string, offset, limit int64) (_ []*User, err error) {
+	defer observeQuery("Users.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("user", "Users.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -116,7 +134,6 @@ func (_Users) List(prefix string, offset, limit int64) ([]*User, error) {
 
 	var q string
 	var rows *sql.Rows
-	var err error
 
 	prefix = strings.TrimSpace(prefix)
 	if prefix == "" {
@@ -126,20 +143,20 @@ func (_Users) List(prefix string, offset, limit int64) ([]*User, error) {
 		ORDER BY id
 		LIMIT ? OFFSET ?
 		`
-		rows, err = db.Query(q, limit, offset)
+		rows, err = dbOrTx(otx).Query(dbDialect().Rebind(q), limit, offset)
 	} else {
 		q = `
 		SELECT id, first_name, last_name, email, active
 		FROM wf_users_master
-		WHERE first_name LIKE ?
+		WHERE first_name LIKE ?` + likeEscapeClause + `
 		UNION
 		SELECT id, first_name, last_name, email, active
 		FROM wf_users_master
-		WHERE last_name LIKE ?
+		WHERE last_name LIKE ?` + likeEscapeClause + `
 		ORDER BY id
 		LIMIT ? OFFSET ?
 		`
-		rows, err = db.Query(q, prefix+"%", prefix+"%", limit, offset)
+		rows, err = dbOrTx(otx).Query(dbDialect().Rebind(q), likePrefix(prefix), likePrefix(prefix), limit, offset)
 	}
 	if err != nil {
 		return nil, err
@@ -162,35 +179,88 @@ func (_Users) List(prefix string, offset, limit int64) ([]*User, error) {
 	return ary, nil
 }
 
+// Count answers the number of users whose first or last names begin
+// with the given prefix.  An empty prefix counts all the users.  This
+// matches the filtering of `List`.
+func (_Users) Count(prefix string) (_ int64, err error) {
+	defer observeQuery("Users.Count", time.Now(), &err)
+
+	var n int64
+	var row *sql.Row
+
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		row = db().QueryRow(dbDialect().Rebind("SELECT COUNT(*) FROM wf_users_master"))
+	} else {
+		q := `
+		SELECT COUNT(*)
+		FROM wf_users_master
+		WHERE first_name LIKE ?` + likeEscapeClause + `
+		OR last_name LIKE ?` + likeEscapeClause + `
+		`
+		row = db().QueryRow(dbDialect().Rebind(q), likePrefix(prefix), likePrefix(prefix))
+	}
+	err = row.Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
 // Get instantiates a user instance by reading the database.
 func (_Users) Get(uid UserID) (*User, error) {
+	return Users.GetTx(nil, uid)
+}
+
+// GetTx is a variant of `Get` that reads using the given transaction,
+// if any, so that changes made but not yet committed in it are
+// visible.
+func (_Users) GetTx(otx *sql.Tx, uid UserID) (_ *User, err error) {
+	defer observeQuery("Users.Get", time.Now(), &err)
+
 	if uid <= 0 {
-		return nil, errors.New("user ID should be a positive integer")
+		return nil, invalidArg("user", "Users.Get", "user ID should be a positive integer")
 	}
 
 	var elem User
-	row := db.QueryRow("SELECT id, first_name, last_name, email, active FROM wf_users_master WHERE id = ?", uid)
-	err := row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
+	q := "SELECT id, first_name, last_name, email, active FROM wf_users_master WHERE id = ?"
+	var row *sql.Row
+	if otx == nil {
+		row = db().QueryRow(dbDialect().Rebind(q), uid)
+	} else {
+		row = otx.QueryRow(dbDialect().Rebind(q), uid)
+	}
+	err = row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "user", "Users.Get")
 	}
 
 	return &elem, nil
 }
 
 // GetByEmail retrieves user information from the database, by looking
-// up the given e-mail address.
+// up the given e-mail address, ignoring surrounding space and case.
 func (_Users) GetByEmail(email string) (*User, error) {
-	email = strings.TrimSpace(email)
+	return Users.GetByEmailTx(nil, email)
+}
+
+// GetByEmailTx is a variant of `GetByEmail` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Users) GetByEmailTx(otx *sql.Tx, email string) (_ *User, err error) {
+	defer observeQuery("Users.GetByEmail", time.Now(), &err)
+
+	email = normalizeEmail(email)
 	if email == "" {
-		return nil, errors.New("e-mail address should be non-empty")
+		return nil, invalidArg("user", "Users.GetByEmail", "e-mail address should be non-empty")
 	}
 
 	var elem User
-	row := db.QueryRow("SELECT id, first_name, last_name, email, active FROM wf_users_master WHERE email = ?", email)
-	err := row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind("SELECT id, first_name, last_name, email, active FROM wf_users_master WHERE LOWER(email) = ?"), email)
+	err = row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "user", "Users.GetByEmail")
 	}
 
 	return &elem, nil
@@ -199,36 +269,109 @@ func (_Users) GetByEmail(email string) (*User, error) {
 // GetByEmail retrieves user information from the database, by looking
 // up the given e-mail address.
 func (_Users) GetByName(username string) (*User, error) {
+	return Users.GetByNameTx(nil, username)
+}
+
+// GetByNameTx is a variant of `GetByName` that reads using the given
+// transaction, if any, so that changes made but not yet committed in
+// it are visible.
+func (_Users) GetByNameTx(otx *sql.Tx, username string) (_ *User, err error) {
+	defer observeQuery("Users.GetByName", time.Now(), &err)
+
 	username = strings.TrimSpace(username)
 	if username == "" {
-		return nil, errors.New("username should be non-empty")
+		return nil, invalidArg("user", "Users.GetByName", "username should be non-empty")
 	}
 
 	var elem User
-	row := db.QueryRow("SELECT id, first_name, last_name, email, active FROM wf_users_master WHERE first_name = ?", username)
-	err := row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind("SELECT id, first_name, last_name, email, active FROM wf_users_master WHERE first_name = ?"), username)
+	err = row.Scan(&elem.ID, &elem.FirstName, &elem.LastName, &elem.Email, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "user", "Users.GetByName")
 	}
 
 	return &elem, nil
 }
 
 // IsActive answers `true` if the given user's account is enabled.
-func (_Users) IsActive(uid UserID) (bool, error) {
-	row := db.QueryRow("SELECT active FROM wf_users_master WHERE id = ?", uid)
+func (_Users) IsActive(uid UserID) (_ bool, err error) {
+	defer observeQuery("Users.IsActive", time.Now(), &err)
+
+	row := db().QueryRow(dbDialect().Rebind("SELECT active FROM wf_users_master WHERE id = ?"), uid)
 	var active bool
-	err := row.Scan(&active)
+	err = row.Scan(&active)
 	if err != nil {
-		return false, err
+		return false, notFound(err, "user", "Users.IsActive")
 	}
 
 	return active, nil
 }
 
+// Activate enables the given user's account.
+func (_Users) Activate(otx *sql.Tx, uid UserID) error {
+	return Users.setActive(otx, uid, true)
+}
+
+// Deactivate disables the given user's account.  The user's group
+// memberships are retained.
+func (_Users) Deactivate(otx *sql.Tx, uid UserID) error {
+	return Users.setActive(otx, uid, false)
+}
+
+// setActive updates the active flag of the given user.
+func (_Users) setActive(otx *sql.Tx, uid UserID, active bool) (err error) {
+	op := "Users.Deactivate"
+	if active {
+		op = "Users.Activate"
+	}
+	defer observeQuery(op, time.Now(), &err)
+
+	if uid <= 0 {
+		return invalidArg("user", op, "user ID should be a positive integer")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return txRequiredErr("user", op)
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	} else {
+		tx = otx
+	}
+
+	flag := 0
+	if active {
+		flag = 1
+	}
+	res, err := tx.Exec(dbDialect().Rebind("UPDATE users_master SET active = ? WHERE id = ?"), flag, uid)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "users_master", "id", uid, "user", op)
+	if err != nil {
+		return err
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // GroupsOf answers a list of groups that the given user is a member
 // of.
-func (_Users) GroupsOf(uid UserID) ([]*Group, error) {
+func (_Users) GroupsOf(uid UserID) (_ []*Group, err error) {
+	defer observeQuery("Users.GroupsOf", time.Now(), &err)
+
 	q := `
 	SELECT gm.id, gm.name, gm.group_type
 	FROM wf_groups_master gm
@@ -236,7 +379,7 @@ func (_Users) GroupsOf(uid UserID) ([]*Group, error) {
 	JOIN wf_users_master um ON um.id = gus.user_id
 	WHERE um.id = ?
 	`
-	rows, err := db.Query(q, uid)
+	rows, err := db().Query(dbDialect().Rebind(q), uid)
 	if err != nil {
 		return nil, err
 	}
@@ -245,7 +388,7 @@ func (_Users) GroupsOf(uid UserID) ([]*Group, error) {
 	ary := make([]*Group, 0, 2)
 	for rows.Next() {
 		var elem Group
-		err = rows.Scan(&elem.ID, &elem.Name, &elem.GroupType)
+		err = rows.Scan(&elem.ID, nullName{&elem.Name}, &elem.GroupType)
 		if err != nil {
 			return nil, err
 		}
@@ -262,6 +405,15 @@ func (_Users) GroupsOf(uid UserID) ([]*Group, error) {
 // SingletonGroupOf answers the ID of the given user's singleton
 // group.
 func (_Users) SingletonGroupOf(uid UserID) (*Group, error) {
+	return Users.SingletonGroupOfTx(nil, uid)
+}
+
+// SingletonGroupOfTx is a variant of `SingletonGroupOf` that reads
+// using the given transaction, if any, so that changes made but not
+// yet committed in it are visible.
+func (_Users) SingletonGroupOfTx(otx *sql.Tx, uid UserID) (_ *Group, err error) {
+	defer observeQuery("Users.SingletonGroupOf", time.Now(), &err)
+
 	q := `
 	SELECT gm.id, gm.name, gm.group_type
 	FROM wf_groups_master gm
@@ -270,10 +422,10 @@ func (_Users) SingletonGroupOf(uid UserID) (*Group, error) {
 	AND gm.group_type = 'S'
 	`
 	var elem Group
-	row := db.QueryRow(q, uid)
-	err := row.Scan(&elem.ID, &elem.Name, &elem.GroupType)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind(q), uid)
+	err = row.Scan(&elem.ID, nullName{&elem.Name}, &elem.GroupType)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "singleton group", "Users.SingletonGroupOf")
 	}
 
 	return &elem, nil
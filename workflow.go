@@ -15,10 +15,11 @@
 package flow
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"math"
 	"strings"
+	"time"
 )
 
 // WorkflowID is the type of unique workflow identifiers.
@@ -49,37 +50,27 @@ type Workflow struct {
 // ApplyEvent takes an input user action or a system event, and
 // applies its document action to the given document.  This results in
 // a possibly new document state.  This method also prepares a message
-// that is posted to applicable mailboxes.
-func (w *Workflow) ApplyEvent(otx *sql.Tx, event *DocEvent, recipients []GroupID) (DocStateID, error) {
+// that is posted to applicable mailboxes.  `ErrDocumentClosed` is
+// answered if the document is in a terminal state of its type.
+func (w *Workflow) ApplyEvent(otx *sql.Tx, event *DocEvent, recipients []GroupID) (_ DocStateID, err error) {
+	defer observeQuery("Workflow.ApplyEvent", time.Now(), &err)
+
 	if !w.Active {
-		return 0, ErrWorkflowInactive
+		return 0, flowError("workflow", "Workflow.ApplyEvent", CodeConflict, ErrWorkflowInactive)
 	}
 	if event.Status == EventStatusApplied {
-		return 0, ErrDocEventAlreadyApplied
+		return 0, flowError("workflow", "Workflow.ApplyEvent", CodeConflict, ErrDocEventAlreadyApplied)
 	}
 	if w.DocType.ID != event.DocType {
-		return 0, ErrDocEventDocTypeMismatch
-	}
-
-	n, err := Nodes.GetByState(w.DocType.ID, event.State)
-	if err != nil {
-		return 0, err
-	}
-
-	var gt string
-	tq := `SELECT group_type FROM wf_groups_master WHERE id = ?`
-	row := db.QueryRow(tq, event.Group)
-	err = row.Scan(&gt)
-	if err != nil {
-		return 0, err
-	}
-	if gt != "S" {
-		return 0, errors.New("group must be singleton")
+		return 0, flowError("workflow", "Workflow.ApplyEvent", CodeInvalidArg, ErrDocEventDocTypeMismatch)
 	}
 
 	var tx *sql.Tx
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("workflow", "Workflow.ApplyEvent")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -87,6 +78,22 @@ func (w *Workflow) ApplyEvent(otx *sql.Tx, event *DocEvent, recipients []GroupID
 	} else {
 		tx = otx
 	}
+
+	n, err := Nodes.GetByStateTx(tx, w.DocType.ID, event.State)
+	if err != nil {
+		return 0, err
+	}
+
+	var gt GroupType
+	tq := `SELECT group_type FROM wf_groups_master WHERE id = ?`
+	row := tx.QueryRow(dbDialect().Rebind(tq), event.Group)
+	err = row.Scan(&gt)
+	if err != nil {
+		return 0, notFound(err, "group", "Workflow.ApplyEvent")
+	}
+	if gt != GroupTypeSingleton {
+		return 0, invalidArg("workflow", "Workflow.ApplyEvent", "group must be singleton")
+	}
 	//这里会给自己发一封信
 	nstate, err := n.applyEvent(tx, event, recipients)
 	if err != nil {
@@ -116,22 +123,29 @@ var Workflows _Workflows
 // begins.
 //
 // N.B.  Workflow names must be globally-unique.
-func (_Workflows) New(otx *sql.Tx, name string, dtype DocTypeID, state DocStateID) (WorkflowID, error) {
+func (_Workflows) New(otx *sql.Tx, name string, dtype DocTypeID, state DocStateID) (_ WorkflowID, err error) {
+	defer observeQuery("Workflows.New", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("name should not be empty")
+		return 0, invalidArg("workflow", "Workflows.New", "name should not be empty")
+	}
+	if err := checkName(name); err != nil {
+		return 0, classify("workflow", "Workflows.New", err)
 	}
 	if dtype <= 0 {
-		return 0, errors.New("document type should be a positive integer")
+		return 0, invalidArg("workflow", "Workflows.New", "document type should be a positive integer")
 	}
 	if state <= 1 {
-		return 0, errors.New("initial document state should be an integer > 1")
+		return 0, invalidArg("workflow", "Workflows.New", "initial document state should be an integer > 1")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("workflow", "Workflows.New")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -140,15 +154,15 @@ func (_Workflows) New(otx *sql.Tx, name string, dtype DocTypeID, state DocStateI
 		tx = otx
 	}
 
+	if err = checkNameFree(context.Background(), tx, "wf_workflows", name); err != nil {
+		return 0, classify("workflow", "Workflows.New", err)
+	}
+
 	q := `
 	INSERT INTO wf_workflows(name, doctype_id, docstate_id, active)
 	VALUES(?, ?, ?, 1)
 	`
-	res, err := tx.Exec(q, name, dtype, state)
-	if err != nil {
-		return 0, err
-	}
-	id, err := res.LastInsertId()
+	id, err := dbDialect().InsertID(context.Background(), tx, q, name, dtype, state)
 	if err != nil {
 		return 0, err
 	}
@@ -169,9 +183,11 @@ func (_Workflows) New(otx *sql.Tx, name string, dtype DocTypeID, state DocStateI
 // Result set begins with ID >= `offset`, and has not more than
 // `limit` elements.  A value of `0` for `offset` fetches from the
 // beginning, while a value of `0` for `limit` fetches until the end.
-func (_Workflows) List(offset, limit int64) ([]*Workflow, error) {
+func (_Workflows) List(offset, limit int64) (_ []*Workflow, err error) {
+	defer observeQuery("Workflows.List", time.Now(), &err)
+
 	if offset < 0 || limit < 0 {
-		return nil, errors.New("offset and limit must be non-negative integers")
+		return nil, invalidArg("workflow", "Workflows.List", "offset and limit must be non-negative integers")
 	}
 	if limit == 0 {
 		limit = math.MaxInt64
@@ -185,7 +201,7 @@ func (_Workflows) List(offset, limit int64) ([]*Workflow, error) {
 	ORDER BY wf.id
 	LIMIT ? OFFSET ?
 	`
-	rows, err := db.Query(q, limit, offset)
+	rows, err := db().Query(dbDialect().Rebind(q), limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -214,7 +230,9 @@ func (_Workflows) List(offset, limit int64) ([]*Workflow, error) {
 // N.B.  This method retrieves the primary information of the
 // workflow.  Information of the nodes comprising this workflow have
 // to be fetched separately.
-func (_Workflows) Get(id WorkflowID) (*Workflow, error) {
+func (_Workflows) Get(id WorkflowID) (_ *Workflow, err error) {
+	defer observeQuery("Workflows.Get", time.Now(), &err)
+
 	q := `
 	SELECT wf.id, wf.name, dtm.id, dtm.name, dsm.id, dsm.name, wf.active
 	FROM wf_workflows wf
@@ -222,12 +240,12 @@ func (_Workflows) Get(id WorkflowID) (*Workflow, error) {
 	JOIN wf_docstates_master dsm ON dsm.id = wf.docstate_id
 	WHERE wf.id = ?
 	`
-	row := db.QueryRow(q, id)
+	row := db().QueryRow(dbDialect().Rebind(q), id)
 	var elem Workflow
-	err := row.Scan(&elem.ID, &elem.Name, &elem.DocType.ID, &elem.DocType.Name,
+	err = row.Scan(&elem.ID, &elem.Name, &elem.DocType.ID, &elem.DocType.Name,
 		&elem.BeginState.ID, &elem.BeginState.Name, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "workflow", "Workflows.Get")
 	}
 
 	return &elem, nil
@@ -240,6 +258,15 @@ func (_Workflows) Get(id WorkflowID) (*Workflow, error) {
 // workflow.  Information of the nodes comprising this workflow have
 // to be fetched separately.
 func (_Workflows) GetByDocType(dtid DocTypeID) (*Workflow, error) {
+	return Workflows.GetByDocTypeTx(nil, dtid)
+}
+
+// GetByDocTypeTx is a variant of `GetByDocType` that reads using the
+// given transaction, if any, so that changes made but not yet
+// committed in it are visible.
+func (_Workflows) GetByDocTypeTx(otx *sql.Tx, dtid DocTypeID) (_ *Workflow, err error) {
+	defer observeQuery("Workflows.GetByDocType", time.Now(), &err)
+
 	q := `
 	SELECT wf.id, wf.name, dtm.id, dtm.name, dsm.id, dsm.name, wf.active
 	FROM wf_workflows wf
@@ -247,12 +274,12 @@ func (_Workflows) GetByDocType(dtid DocTypeID) (*Workflow, error) {
 	JOIN wf_docstates_master dsm ON dsm.id = wf.docstate_id
 	WHERE wf.doctype_id = ?
 	`
-	row := db.QueryRow(q, dtid)
+	row := dbOrTx(otx).QueryRow(dbDialect().Rebind(q), dtid)
 	var elem Workflow
-	err := row.Scan(&elem.ID, &elem.Name, &elem.DocType.ID, &elem.DocType.Name,
+	err = row.Scan(&elem.ID, &elem.Name, &elem.DocType.ID, &elem.DocType.Name,
 		&elem.BeginState.ID, &elem.BeginState.Name, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "workflow", "Workflows.GetByDocType")
 	}
 
 	return &elem, nil
@@ -264,7 +291,9 @@ func (_Workflows) GetByDocType(dtid DocTypeID) (*Workflow, error) {
 // N.B.  This method retrieves the primary information of the
 // workflow.  Information of the nodes comprising this workflow have
 // to be fetched separately.
-func (_Workflows) GetByName(name string) (*Workflow, error) {
+func (_Workflows) GetByName(name string) (_ *Workflow, err error) {
+	defer observeQuery("Workflows.GetByName", time.Now(), &err)
+
 	q := `
 	SELECT wf.id, wf.name, dtm.id, dtm.name, dsm.id, dsm.name, wf.active
 	FROM wf_workflows wf
@@ -272,28 +301,35 @@ func (_Workflows) GetByName(name string) (*Workflow, error) {
 	JOIN wf_docstates_master dsm ON wf.docstate_id = dsm.id
 	WHERE wf.name = ?
 	`
-	row := db.QueryRow(q, name)
+	row := db().QueryRow(dbDialect().Rebind(q), name)
 	var elem Workflow
-	err := row.Scan(&elem.ID, &elem.Name, &elem.DocType.ID, &elem.DocType.Name,
+	err = row.Scan(&elem.ID, &elem.Name, &elem.DocType.ID, &elem.DocType.Name,
 		&elem.BeginState.ID, &elem.BeginState.Name, &elem.Active)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "workflow", "Workflows.GetByName")
 	}
 
 	return &elem, nil
 }
 
 // Rename assigns a new name to the given workflow.
-func (_Workflows) Rename(otx *sql.Tx, id WorkflowID, name string) error {
+func (_Workflows) Rename(otx *sql.Tx, id WorkflowID, name string) (err error) {
+	defer observeQuery("Workflows.Rename", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return errors.New("name should be non-empty")
+		return invalidArg("workflow", "Workflows.Rename", "name should be non-empty")
+	}
+	if err := checkName(name); err != nil {
+		return classify("workflow", "Workflows.Rename", err)
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("workflow", "Workflows.Rename")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -302,11 +338,19 @@ func (_Workflows) Rename(otx *sql.Tx, id WorkflowID, name string) error {
 		tx = otx
 	}
 
+	if err = checkNameFreeExcept(context.Background(), tx, "wf_workflows", name, "id", id); err != nil {
+		return classify("workflow", "Workflows.Rename", err)
+	}
+
 	q := `
 	UPDATE wf_workflows SET name = ?
 	WHERE id = ?
 	`
-	_, err = tx.Exec(q, name, id)
+	res, err := tx.Exec(dbDialect().Rebind(q), name, id)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(context.Background(), tx, res, "wf_workflows", "id", id, "workflow", "Workflows.Rename")
 	if err != nil {
 		return err
 	}
@@ -323,11 +367,15 @@ func (_Workflows) Rename(otx *sql.Tx, id WorkflowID, name string) error {
 
 // SetActive sets the status of the workflow as either active or
 // inactive, helping in workflow management and deprecation.
-func (_Workflows) SetActive(otx *sql.Tx, id WorkflowID, active bool) error {
+func (_Workflows) SetActive(otx *sql.Tx, id WorkflowID, active bool) (err error) {
+	defer observeQuery("Workflows.SetActive", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("workflow", "Workflows.SetActive")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -344,7 +392,7 @@ func (_Workflows) SetActive(otx *sql.Tx, id WorkflowID, active bool) error {
 	UPDATE wf_workflows SET active = ?
 	WHERE id = ?
 	`
-	_, err = tx.Exec(q, flag, id)
+	_, err = tx.Exec(dbDialect().Rebind(q), flag, id)
 	if err != nil {
 		return err
 	}
@@ -361,18 +409,22 @@ func (_Workflows) SetActive(otx *sql.Tx, id WorkflowID, active bool) error {
 
 // AddNode maps the given document state to the specified node.  This
 // map is consulted by the workflow when performing a state transition
-// of the system.
+// of the system.  A zero access context leaves the node unbound.
 func (_Workflows) AddNode(otx *sql.Tx, dtype DocTypeID, state DocStateID,
-	ac AccessContextID, wid WorkflowID, name string, ntype NodeType) (NodeID, error) {
+	ac AccessContextID, wid WorkflowID, name string, ntype NodeType) (_ NodeID, err error) {
+	defer observeQuery("Workflows.AddNode", time.Now(), &err)
+
 	name = strings.TrimSpace(name)
 	if name == "" {
-		return 0, errors.New("name should not be empty")
+		return 0, invalidArg("workflow", "Workflows.AddNode", "name should not be empty")
 	}
 
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return 0, txRequiredErr("workflow", "Workflows.AddNode")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return 0, err
 		}
@@ -385,11 +437,11 @@ func (_Workflows) AddNode(otx *sql.Tx, dtype DocTypeID, state DocStateID,
 	INSERT INTO wf_workflow_nodes(doctype_id, docstate_id, ac_id, workflow_id, name, type)
 	VALUES(?, ?, ?, ?, ?, ?)
 	`
-	res, err := tx.Exec(q, dtype, state, ac, wid, name, string(ntype))
-	if err != nil {
-		return 0, err
+	var acID sql.NullInt64
+	if ac > 0 {
+		acID = sql.NullInt64{Int64: int64(ac), Valid: true}
 	}
-	id, err := res.LastInsertId()
+	id, err := dbDialect().InsertID(context.Background(), tx, q, dtype, state, acID, wid, name, string(ntype))
 	if err != nil {
 		return 0, err
 	}
@@ -407,11 +459,15 @@ func (_Workflows) AddNode(otx *sql.Tx, dtype DocTypeID, state DocStateID,
 // RemoveNode unmaps the given document state to the specified node.
 // This map is consulted by the workflow when performing a state
 // transition of the system.
-func (_Workflows) RemoveNode(otx *sql.Tx, wid WorkflowID, nid NodeID) error {
+func (_Workflows) RemoveNode(otx *sql.Tx, wid WorkflowID, nid NodeID) (err error) {
+	defer observeQuery("Workflows.RemoveNode", time.Now(), &err)
+
 	var tx *sql.Tx
-	var err error
 	if otx == nil {
-		tx, err = db.Begin()
+		if txRequired {
+			return txRequiredErr("workflow", "Workflows.RemoveNode")
+		}
+		tx, err = db().Begin()
 		if err != nil {
 			return err
 		}
@@ -425,7 +481,7 @@ func (_Workflows) RemoveNode(otx *sql.Tx, wid WorkflowID, nid NodeID) error {
 	WHERE workflow_id = ?
 	AND id = ?
 	`
-	_, err = tx.Exec(q, wid, nid)
+	_, err = tx.Exec(dbDialect().Rebind(q), wid, nid)
 	if err != nil {
 		return err
 	}
@@ -439,3 +495,289 @@ func (_Workflows) RemoveNode(otx *sql.Tx, wid WorkflowID, nid NodeID) error {
 
 	return nil
 }
+
+// IsDeterministic answers `true` if no pair of a state and an action
+// of the given document type leads to more than one target state.
+// Otherwise, it answers `false` together with the conflicting
+// transitions.
+//
+// N.B. The uniqueness constraint on transitions includes the target
+// state.  Therefore, the database does not prevent such conflicts.
+func (_Workflows) IsDeterministic(dtid DocTypeID) (_ bool, _ []DocTransitionID, err error) {
+	defer observeQuery("Workflows.IsDeterministic", time.Now(), &err)
+
+	if dtid <= 0 {
+		return false, nil, invalidArg("workflow", "Workflows.IsDeterministic", "document type should be a positive integer")
+	}
+
+	q := `
+	SELECT dst.id
+	FROM wf_docstate_transitions dst
+	JOIN (
+		SELECT from_state_id, docaction_id
+		FROM wf_docstate_transitions
+		WHERE doctype_id = ?
+		GROUP BY from_state_id, docaction_id
+		HAVING COUNT(*) > 1
+	) cs ON cs.from_state_id = dst.from_state_id AND cs.docaction_id = dst.docaction_id
+	WHERE dst.doctype_id = ?
+	ORDER BY dst.id
+	`
+	rows, err := db().Query(dbDialect().Rebind(q), dtid, dtid)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	ary := make([]DocTransitionID, 0, 2)
+	for rows.Next() {
+		var id DocTransitionID
+		err = rows.Scan(&id)
+		if err != nil {
+			return false, nil, err
+		}
+		ary = append(ary, id)
+	}
+	if err = rows.Err(); err != nil {
+		return false, nil, err
+	}
+
+	return len(ary) == 0, ary, nil
+}
+
+// DwellTimes answers the average time that documents of the given
+// type spent in each state.  These are computed from consecutive
+// applied events of each document: a document is in the state of an
+// event from the time of the preceding event -- or, for its first
+// event, from its creation -- until the time of that event.
+//
+// Only the stays that ended within the given window are considered.
+// A zero value for `from` or `to` leaves that end of the window open.
+// States that no document left during the window are omitted.
+func (_Workflows) DwellTimes(dtid DocTypeID, from, to time.Time) (_ map[DocStateID]time.Duration, err error) {
+	defer observeQuery("Workflows.DwellTimes", time.Now(), &err)
+
+	if dtid <= 0 {
+		return nil, invalidArg("workflow", "Workflows.DwellTimes", "document type should be a positive integer")
+	}
+
+	// Each stay ends with an event, and begins with the preceding
+	// applied event of the same document, if any, or with the
+	// document's creation.  Only the ends are bounded by the window.
+	tbl := DocTypes.docStorName(dtid)
+	q := `
+	SELECT de.docstate_id, de.ctime, COALESCE((
+		SELECT MAX(pe.ctime)
+		FROM wf_docevents pe
+		WHERE pe.doctype_id = de.doctype_id
+		AND pe.doc_id = de.doc_id
+		AND pe.status = 'A'
+		AND (pe.ctime < de.ctime OR (pe.ctime = de.ctime AND pe.id < de.id))
+	), docs.ctime)
+	FROM wf_docevents de
+	JOIN ` + tbl + ` docs ON docs.id = de.doc_id
+	WHERE de.doctype_id = ?
+	AND de.status = 'A'
+	`
+	args := []interface{}{dtid}
+	if !from.IsZero() {
+		q += "AND de.ctime >= ?\n"
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		q += "AND de.ctime < ?\n"
+		args = append(args, to)
+	}
+	rows, err := db().Query(dbDialect().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[DocStateID]time.Duration{}
+	counts := map[DocStateID]int64{}
+	for rows.Next() {
+		var state DocStateID
+		var ctime, since time.Time
+		err = rows.Scan(&state, &ctime, &since)
+		if err != nil {
+			return nil, err
+		}
+		totals[state] += ctime.Sub(since)
+		counts[state]++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make(map[DocStateID]time.Duration, len(totals))
+	for state, total := range totals {
+		res[state] = total / time.Duration(counts[state])
+	}
+
+	return res, nil
+}
+
+// StandardWorkflow holds the workflow, states and actions of the
+// canonical workflow seeded by `SeedStandard`.
+type StandardWorkflow struct {
+	Workflow WorkflowID
+
+	Draft    DocStateID
+	Pending  DocStateID
+	Approved DocStateID
+	Rejected DocStateID
+
+	Submit  DocActionID
+	Approve DocActionID
+	Reject  DocActionID
+}
+
+// SeedStandard defines the canonical transitions
+//
+//     DRAFT   -- SUBMIT  --> PENDING
+//     PENDING -- APPROVE --> APPROVED
+//     PENDING -- REJECT  --> REJECTED
+//
+// for the given document type, together with its workflow and one
+// node per state: DRAFT begins, PENDING branches, and APPROVED and
+// REJECTED end.  The workflow is named after the document type, and
+// its nodes are not bound to any access context.
+//
+// The states and the actions are global; existing ones are reused.
+// An existing workflow of the document type is reused, as are its
+// nodes.  Seeding the same document type again does not create any
+// duplicates.
+func (_Workflows) SeedStandard(otx *sql.Tx, dtype DocTypeID) (_ *StandardWorkflow, err error) {
+	defer observeQuery("Workflows.SeedStandard", time.Now(), &err)
+
+	if dtype <= 0 {
+		return nil, invalidArg("workflow", "Workflows.SeedStandard", "document type should be a positive integer")
+	}
+
+	var tx *sql.Tx
+	if otx == nil {
+		if txRequired {
+			return nil, txRequiredErr("workflow", "Workflows.SeedStandard")
+		}
+		tx, err = db().Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+	} else {
+		if err = checkDocActionTx(otx, "Workflows.SeedStandard"); err != nil {
+			return nil, err
+		}
+		tx = otx
+	}
+
+	sw := &StandardWorkflow{}
+	for _, st := range []struct {
+		name string
+		id   *DocStateID
+	}{
+		{"DRAFT", &sw.Draft},
+		{"PENDING", &sw.Pending},
+		{"APPROVED", &sw.Approved},
+		{"REJECTED", &sw.Rejected},
+	} {
+		ds, _, err := DocStates.Ensure(tx, st.name)
+		if err != nil {
+			return nil, err
+		}
+		*st.id = ds.ID
+	}
+	// New actions are made known to the cache once they are committed.
+	madeActions := false
+	defer func() {
+		if madeActions {
+			docActionsChanged(otx)
+		}
+	}()
+	for _, ac := range []struct {
+		name      string
+		reconfirm bool
+		id        *DocActionID
+	}{
+		{"SUBMIT", false, &sw.Submit},
+		{"APPROVE", false, &sw.Approve},
+		{"REJECT", true, &sw.Reject},
+	} {
+		da, made, err := DocActions.ensure(context.Background(), tx, ac.name, ac.reconfirm)
+		if err != nil {
+			return nil, err
+		}
+		madeActions = madeActions || made
+		*ac.id = da.ID
+	}
+
+	q := `
+	INSERT INTO wf_docstate_transitions(doctype_id, from_state_id, docaction_id, to_state_id)
+	VALUES(?, ?, ?, ?)
+	` + dbDialect().IgnoreDuplicates("id")
+	for _, tr := range []struct {
+		from   DocStateID
+		action DocActionID
+		to     DocStateID
+	}{
+		{sw.Draft, sw.Submit, sw.Pending},
+		{sw.Pending, sw.Approve, sw.Approved},
+		{sw.Pending, sw.Reject, sw.Rejected},
+	} {
+		_, err = tx.Exec(dbDialect().Rebind(q), dtype, tr.from, tr.action, tr.to)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var wid int64
+	q = `SELECT id FROM wf_workflows WHERE doctype_id = ?`
+	err = tx.QueryRow(dbDialect().Rebind(q), dtype).Scan(&wid)
+	switch {
+	case err == sql.ErrNoRows:
+		var name string
+		q = `SELECT name FROM wf_doctypes_master WHERE id = ?`
+		if err = tx.QueryRow(dbDialect().Rebind(q), dtype).Scan(&name); err != nil {
+			return nil, notFound(err, "document type", "Workflows.SeedStandard")
+		}
+		id, err := Workflows.New(tx, name, dtype, sw.Draft)
+		if err != nil {
+			return nil, err
+		}
+		wid = int64(id)
+
+	case err != nil:
+		return nil, err
+	}
+	sw.Workflow = WorkflowID(wid)
+
+	q = `
+	INSERT INTO wf_workflow_nodes(doctype_id, docstate_id, ac_id, workflow_id, name, type)
+	VALUES(?, ?, NULL, ?, ?, ?)
+	` + dbDialect().IgnoreDuplicates("id")
+	for _, n := range []struct {
+		state DocStateID
+		name  string
+		ntype NodeType
+	}{
+		{sw.Draft, "DRAFT", NodeTypeBegin},
+		{sw.Pending, "PENDING", NodeTypeBranch},
+		{sw.Approved, "APPROVED", NodeTypeEnd},
+		{sw.Rejected, "REJECTED", NodeTypeEnd},
+	} {
+		_, err = tx.Exec(dbDialect().Rebind(q), dtype, n.state, wid, n.name, string(n.ntype))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if otx == nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sw, nil
+}